@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// autoContrast stretches the levels of m so that its darkest pixels become
+// black and its brightest pixels white, ignoring the given percentage of the
+// darkest and brightest pixels so that a few outliers, such as specks of dust
+// on a scan, do not prevent the stretch.  If perChannel is true, each color
+// channel is stretched separately, which also corrects color casts.
+// Otherwise, the range of the luminance of the pixels is stretched, and the
+// same stretch is applied to each channel.  Images which already span the
+// full range are returned unchanged.
+func autoContrast(m image.Image, clip float64, perChannel bool) image.Image {
+	src := imaging.Clone(m)
+
+	// histograms of the luminance, or of each channel, of the pixels which
+	// are not fully transparent
+	var hist [3][256]int
+	var n int
+	for i := 0; i+3 < len(src.Pix); i += 4 {
+		p := src.Pix[i : i+4 : i+4]
+		if p[3] == 0 {
+			continue
+		}
+		n++
+		if perChannel {
+			hist[0][p[0]]++
+			hist[1][p[1]]++
+			hist[2][p[2]]++
+		} else {
+			hist[0][luminance(p[0], p[1], p[2])]++
+		}
+	}
+	if n == 0 {
+		return m
+	}
+
+	channels := 1
+	if perChannel {
+		channels = 3
+	}
+	skip := int(float64(n) * clip / 100)
+	var lut [3][256]uint8
+	unchanged := true
+	for ch := 0; ch < 3; ch++ {
+		if ch >= channels {
+			lut[ch] = lut[0]
+			continue
+		}
+		lo, hi := histogramRange(hist[ch][:], skip)
+		if hi <= lo || lo == 0 && hi == 255 {
+			for v := range lut[ch] {
+				lut[ch][v] = uint8(v)
+			}
+			continue
+		}
+		unchanged = false
+		for v := range lut[ch] {
+			s := float64(v-lo) * 255 / float64(hi-lo)
+			lut[ch][v] = uint8(math.Max(0, math.Min(255, s+0.5)))
+		}
+	}
+	if unchanged {
+		return m
+	}
+
+	for i := 0; i+3 < len(src.Pix); i += 4 {
+		p := src.Pix[i : i+4 : i+4]
+		p[0], p[1], p[2] = lut[0][p[0]], lut[1][p[1]], lut[2][p[2]]
+	}
+	return src
+}
+
+// luminance returns the luminance of a color with the given channels, using
+// the ITU-R BT.601 weights.
+func luminance(r, g, b uint8) uint8 {
+	return uint8((299*int(r) + 587*int(g) + 114*int(b) + 500) / 1000)
+}
+
+// histogramRange returns the lowest and highest values in hist after the
+// skip lowest and skip highest counted values are ignored.
+func histogramRange(hist []int, skip int) (lo, hi int) {
+	var count int
+	for lo = 0; lo < len(hist)-1; lo++ {
+		if count += hist[lo]; count > skip {
+			break
+		}
+	}
+	count = 0
+	for hi = len(hist) - 1; hi > 0; hi-- {
+		if count += hist[hi]; count > skip {
+			break
+		}
+	}
+	return lo, hi
+}
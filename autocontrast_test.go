@@ -0,0 +1,91 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// grays returns a row of opaque gray pixels with the given values.
+func grays(values ...uint8) []color.NRGBA {
+	pixels := make([]color.NRGBA, len(values))
+	for i, v := range values {
+		pixels[i] = color.NRGBA{v, v, v, 255}
+	}
+	return pixels
+}
+
+// pixels returns the colors of the pixels in m, row by row.
+func pixels(m image.Image) []color.NRGBA {
+	var p []color.NRGBA
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p = append(p, color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA))
+		}
+	}
+	return p
+}
+
+func TestAutoContrast(t *testing.T) {
+	faded := grays(64, 96, 128, 192)
+	// an outlier at each end, which clipping 20% of the pixels ignores
+	outliers := grays(0, 64, 96, 128, 192, 255)
+	// colors with a red cast
+	cast := []color.NRGBA{{100, 0, 0, 255}, {255, 200, 200, 255}, {150, 100, 100, 255}, {0, 0, 0, 0}}
+
+	tests := []struct {
+		src        []color.NRGBA
+		clip       float64
+		perChannel bool
+		want       []color.NRGBA
+	}{
+		{faded, 0, false, grays(0, 64, 128, 255)},
+		{faded, 0, true, grays(0, 64, 128, 255)},
+		{outliers, 20, false, grays(0, 0, 64, 128, 255, 255)},
+		{cast, 0, true, []color.NRGBA{{0, 0, 0, 255}, {255, 255, 255, 255}, {82, 128, 128, 255}, {0, 0, 0, 0}}},
+		// the luminance range of 30 to 216 is stretched, keeping the cast
+		{cast, 0, false, []color.NRGBA{{96, 0, 0, 255}, {255, 233, 233, 255}, {165, 96, 96, 255}, {0, 0, 0, 0}}},
+	}
+	for _, tt := range tests {
+		m := autoContrast(newImage(len(tt.src), 1, tt.src...), tt.clip, tt.perChannel)
+		if got := pixels(m); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("autoContrast(%v, %v, %t) returned %v, want %v", tt.src, tt.clip, tt.perChannel, got, tt.want)
+		}
+	}
+}
+
+func TestAutoContrast_Unchanged(t *testing.T) {
+	tests := []struct {
+		src  image.Image
+		clip float64
+	}{
+		// already spans the full range
+		{newImage(3, 1, grays(0, 128, 255)...), 0},
+		// outliers prevent the stretch without clipping
+		{newImage(6, 1, grays(0, 64, 96, 128, 192, 255)...), 0},
+		// uniform and fully transparent images can not be stretched
+		{newImage(2, 2, color.NRGBA{128, 128, 128, 255}), 10},
+		{newImage(2, 2, color.NRGBA{}), 0},
+	}
+	for _, tt := range tests {
+		if m := autoContrast(tt.src, tt.clip, false); m != tt.src {
+			t.Errorf("autoContrast(%v, %v) changed image", pixels(tt.src), tt.clip)
+		}
+	}
+}
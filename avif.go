@@ -0,0 +1,51 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build avif
+// +build avif
+
+package imageproxy
+
+import (
+	"image"
+	"io"
+
+	"github.com/gen2brain/avif" // also registers avif decoder
+)
+
+func init() {
+	registerEncoder("avif", encodeAVIF)
+}
+
+// encodeAVIF encodes m as an AVIF image.  opt.Effort is mapped onto the
+// encoder's speed setting, which runs in the opposite direction.
+func encodeAVIF(w io.Writer, m image.Image, opt Options) error {
+	o := avif.Options{
+		Quality:      avif.DefaultQuality,
+		QualityAlpha: avif.DefaultQuality,
+		Speed:        avif.DefaultSpeed,
+	}
+	if opt.Quality != 0 {
+		o.Quality, o.QualityAlpha = opt.Quality, opt.Quality
+	}
+	if effort := opt.Effort; effort != 0 {
+		if effort < 1 {
+			effort = 1
+		} else if effort > 10 {
+			effort = 10
+		}
+		o.Speed = 10 - effort
+	}
+	return avif.Encode(w, m, o)
+}
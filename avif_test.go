@@ -0,0 +1,59 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build avif
+// +build avif
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestTransform_AVIF(t *testing.T) {
+	src := newImage(8, 8, red, green, blue, yellow)
+	buf := new(bytes.Buffer)
+	png.Encode(buf, src)
+
+	for _, opt := range []Options{
+		{Format: "avif"},
+		{Format: "avif", Quality: 40, Effort: 10},
+		{Format: "avif", Effort: 1},
+	} {
+		out, err := Transform(buf.Bytes(), opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", opt, err)
+			continue
+		}
+		if _, format, err := image.DecodeConfig(bytes.NewReader(out)); err != nil || format != "avif" {
+			t.Errorf("Transform(%v) returned format %q, err %v; want avif", opt, format, err)
+		}
+
+		// avif input should round-trip
+		resized, err := Transform(out, Options{Width: 4})
+		if err != nil {
+			t.Errorf("Transform with avif input returned unexpected error: %v", err)
+			continue
+		}
+		m, format, err := image.Decode(bytes.NewReader(resized))
+		if err != nil || format != "avif" {
+			t.Errorf("Transform with avif input returned format %q, err %v; want avif", format, err)
+		} else if got := m.Bounds().Dx(); got != 4 {
+			t.Errorf("Transform with avif input returned width %d, want 4", got)
+		}
+	}
+}
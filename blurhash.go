@@ -0,0 +1,151 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// blurHashSize is the maximum dimension of the downscaled copy of an image
+// that is encoded by BlurHash.  The components of a BlurHash describe only
+// the coarsest details, so larger images would not change the result much.
+const blurHashSize = 64
+
+// blurHashChars is the base 83 alphabet used to encode BlurHash strings.
+const blurHashChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// BlurHash returns the BlurHash of the encoded image img, a compact string
+// which clients can decode into a blurred placeholder shown while the image
+// loads.  xComp and yComp are the number of horizontal and vertical
+// components to encode, from 1 to 9, with more components preserving more
+// detail.  See https://blurha.sh for details of the format.  Images which can
+// not be decoded result in a *TransformError, as with Transform.
+func BlurHash(img []byte, xComp, yComp int) (string, error) {
+	if xComp < 1 || xComp > 9 || yComp < 1 || yComp > 9 {
+		return "", fmt.Errorf("invalid blurhash components: %dx%d", xComp, yComp)
+	}
+	m, err := decodeImage(img)
+	if err != nil {
+		return "", err
+	}
+	return blurHash(m, xComp, yComp), nil
+}
+
+// blurHash returns the BlurHash of m with the given number of components.
+func blurHash(m image.Image, xComp, yComp int) string {
+	src := imaging.Fit(m, blurHashSize, blurHashSize, imaging.Box)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	// convert pixels to linear RGB once, rather than for each component
+	linear := make([][3]float64, w*h)
+	for i := range linear {
+		p := src.Pix[i*4 : i*4+3]
+		linear[i] = [3]float64{sRGBToLinear(p[0]), sRGBToLinear(p[1]), sRGBToLinear(p[2])}
+	}
+
+	factors := make([][3]float64, 0, xComp*yComp)
+	for j := 0; j < yComp; j++ {
+		for i := 0; i < xComp; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				cy := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				for x := 0; x < w; x++ {
+					basis := norm * math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * cy
+					for c, v := range linear[y*w+x] {
+						f[c] += basis * v
+					}
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var b strings.Builder
+	encode83(&b, (xComp-1)+(yComp-1)*9, 1)
+
+	// AC components are quantized relative to the largest of them
+	maxValue := 1.0
+	if ac := factors[1:]; len(ac) > 0 {
+		var actualMax float64
+		for _, f := range ac {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantizedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantizedMax+1) / 166
+		encode83(&b, quantizedMax, 1)
+	} else {
+		encode83(&b, 0, 1)
+	}
+
+	dc := factors[0]
+	encode83(&b, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range factors[1:] {
+		var q [3]int
+		for c, v := range f {
+			q[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		encode83(&b, q[0]*19*19+q[1]*19+q[2], 2)
+	}
+	return b.String()
+}
+
+// encode83 writes the base 83 encoding of v to b, using exactly length
+// digits.
+func encode83(b *strings.Builder, v, length int) {
+	divisor := 1
+	for i := 1; i < length; i++ {
+		divisor *= 83
+	}
+	for ; divisor > 0; divisor /= 83 {
+		b.WriteByte(blurHashChars[v/divisor%83])
+	}
+}
+
+// sRGBToLinear converts an sRGB color channel value to linear RGB, from 0
+// to 1.
+func sRGBToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB converts a linear RGB color channel value, from 0 to 1, to
+// sRGB.  Values outside that range are clamped.
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow returns the absolute value of v raised to exp, with the sign of v.
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// pngBytes returns m encoded as a PNG image.
+func pngBytes(m image.Image) []byte {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, m)
+	return buf.Bytes()
+}
+
+func TestBlurHash(t *testing.T) {
+	white := color.NRGBA{255, 255, 255, 255}
+	black := color.NRGBA{0, 0, 0, 255}
+	tests := []struct {
+		img          []byte
+		xComp, yComp int
+		want         string
+	}{
+		{pngBytes(newImage(2, 2, white, white, white, white)), 1, 1, "00TSUA"},
+		{pngBytes(newImage(1, 1, black)), 1, 1, "000000"},
+		{pngBytes(newImage(4, 1, white, white, black, black)), 2, 1, "1~Lqe9~q"},
+	}
+	for _, tt := range tests {
+		got, err := BlurHash(tt.img, tt.xComp, tt.yComp)
+		if err != nil {
+			t.Errorf("BlurHash(%d, %d) returned unexpected error: %v", tt.xComp, tt.yComp, err)
+		}
+		if got != tt.want {
+			t.Errorf("BlurHash(%d, %d) returned %q, want %q", tt.xComp, tt.yComp, got, tt.want)
+		}
+	}
+}
+
+func TestBlurHash_Components(t *testing.T) {
+	// left half white, right half black
+	white := color.NRGBA{255, 255, 255, 255}
+	black := color.NRGBA{0, 0, 0, 255}
+	img := pngBytes(newImage(4, 1, white, white, black, black))
+
+	for xComp := 1; xComp <= 9; xComp++ {
+		for yComp := 1; yComp <= 9; yComp++ {
+			got, err := BlurHash(img, xComp, yComp)
+			if err != nil {
+				t.Fatalf("BlurHash(%d, %d) returned unexpected error: %v", xComp, yComp, err)
+			}
+			if want := 4 + 2*xComp*yComp; len(got) != want {
+				t.Errorf("BlurHash(%d, %d) returned %q of length %d, want %d", xComp, yComp, got, len(got), want)
+			}
+			if want := blurHashChars[(xComp-1)+(yComp-1)*9]; got[0] != want {
+				t.Errorf("BlurHash(%d, %d) returned %q with size flag %c, want %c", xComp, yComp, got, got[0], want)
+			}
+		}
+	}
+}
+
+func TestBlurHash_Invalid(t *testing.T) {
+	img := pngBytes(newImage(1, 1, red))
+	for _, comp := range [][2]int{{0, 1}, {1, 0}, {10, 1}, {1, 10}} {
+		if _, err := BlurHash(img, comp[0], comp[1]); err == nil {
+			t.Errorf("BlurHash(%d, %d) did not return expected error", comp[0], comp[1])
+		}
+	}
+	if _, err := BlurHash([]byte("<html></html>"), 4, 3); !errors.Is(err, ErrNotAnImage) {
+		t.Errorf("BlurHash of html returned error %v, want %v", err, ErrNotAnImage)
+	}
+}
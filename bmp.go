@@ -0,0 +1,32 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"io"
+
+	"golang.org/x/image/bmp" // also registers bmp decoder
+)
+
+func init() {
+	registerEncoder("bmp", encodeBMP)
+}
+
+// encodeBMP encodes m as an uncompressed BMP image.  BMP has no quality or
+// compression settings, so opt is not used.
+func encodeBMP(w io.Writer, m image.Image, opt Options) error {
+	return bmp.Encode(w, m)
+}
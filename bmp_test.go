@@ -0,0 +1,78 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"reflect"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/bmp"
+)
+
+func TestTransform_BMP(t *testing.T) {
+	// bmp does not support transparency, so the image is opaque
+	src := newImage(4, 2, red, green, blue, yellow, yellow, blue, green, red)
+	buf := new(bytes.Buffer)
+	png.Encode(buf, src)
+
+	// quality has no effect on bmp output
+	var first []byte
+	for _, opt := range []Options{{Format: "bmp"}, {Format: "bmp", Quality: 10}} {
+		out, err := Transform(buf.Bytes(), opt)
+		if err != nil {
+			t.Fatalf("Transform(%v) returned unexpected error: %v", opt, err)
+		}
+		if first == nil {
+			first = out
+		} else if !bytes.Equal(out, first) {
+			t.Errorf("Transform(%v) returned a different image than without quality", opt)
+		}
+		if got := imageContentType(out); got != "image/bmp" {
+			t.Errorf("Transform(%v) returned content type %q, want image/bmp", opt, got)
+		}
+		m, err := bmp.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("Transform(%v) returned invalid bmp: %v", opt, err)
+		}
+		if !reflect.DeepEqual(imaging.Clone(m), src) {
+			t.Errorf("Transform(%v) did not preserve the image", opt)
+		}
+	}
+
+	// bmp input is encoded as bmp again
+	resized, err := Transform(first, Options{Width: 2})
+	if err != nil {
+		t.Fatalf("Transform with bmp input returned unexpected error: %v", err)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(resized))
+	if err != nil || format != "bmp" {
+		t.Errorf("Transform with bmp input returned format %q, err %v; want bmp", format, err)
+	} else if cfg.Width != 2 {
+		t.Errorf("Transform with bmp input returned width %d, want 2", cfg.Width)
+	}
+
+	// transparent output is encoded as png
+	out, err := Transform(buf.Bytes(), Options{Format: "bmp", RoundedCorners: 2})
+	if err != nil {
+		t.Fatalf("Transform with rounded corners returned unexpected error: %v", err)
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(out)); err != nil || format != "png" {
+		t.Errorf("Transform with rounded corners returned format %q, err %v; want png", format, err)
+	}
+}
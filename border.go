@@ -0,0 +1,100 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// defaultBorderColor is the color of borders which do not specify one.
+var defaultBorderColor = color.NRGBA{0, 0, 0, 255}
+
+// maxBorderWidth is the largest valid border width, in pixels.  Borders
+// expand the canvas regardless of the size of the image, so wider borders
+// are rejected rather than drawn.
+const maxBorderWidth = 1000
+
+// addBorder draws the border specified by opt around m.  Unless the border
+// is inset, the canvas is first expanded by the border width on each side.
+// If opt includes rounded corners, both the outer edge of the border and the
+// corners of the image inside it are rounded, so that the border has the
+// same width all the way around.
+func addBorder(m image.Image, opt Options) *image.NRGBA {
+	src := imaging.Clone(m)
+	width := opt.BorderWidth
+
+	// the image is drawn at pos within the outer edge of the border, and
+	// is visible within its inner edge
+	outer := src.Bounds()
+	var pos image.Point
+	if !opt.BorderInset {
+		outer = image.Rect(0, 0, outer.Dx()+2*width, outer.Dy()+2*width)
+		pos = image.Pt(width, width)
+	}
+	inner := outer.Inset(width)
+	r := cornerRadius(outer.Dx(), outer.Dy(), opt)
+	innerR := math.Max(r-float64(width), 0)
+
+	c := opt.BorderColor
+	if c == (color.NRGBA{}) {
+		c = defaultBorderColor
+	}
+	ba := float64(c.A) / 255
+	border := [4]float64{float64(c.R) * ba, float64(c.G) * ba, float64(c.B) * ba, float64(c.A)}
+
+	dst := image.NewNRGBA(outer)
+	srcBounds := src.Bounds()
+	for y := outer.Min.Y; y < outer.Max.Y; y++ {
+		for x := outer.Min.X; x < outer.Max.X; x++ {
+			oc := coverage(x, y, outer, r)
+			if oc == 0 {
+				continue
+			}
+			ic := coverage(x, y, inner, innerR)
+			ring := oc - ic
+
+			// the image is covered by the inner edge of the border, or
+			// the outer edge of an inset border, which is drawn over it
+			imgCov := ic
+			if opt.BorderInset {
+				imgCov = oc
+			}
+			var img [4]float64
+			if p := image.Pt(x, y).Sub(pos); p.In(srcBounds) {
+				s := src.Pix[src.PixOffset(p.X, p.Y):]
+				a := float64(s[3]) / 255
+				img = [4]float64{float64(s[0]) * a, float64(s[1]) * a, float64(s[2]) * a, float64(s[3])}
+			}
+
+			var out [4]float64
+			for k := range out {
+				out[k] = border[k]*ring + img[k]*imgCov*(1-ba*ring)
+			}
+			if out[3] > 0 {
+				i := dst.PixOffset(x, y)
+				a := out[3] / 255
+				dst.Pix[i+0] = clampUint8(out[0] / a)
+				dst.Pix[i+1] = clampUint8(out[1] / a)
+				dst.Pix[i+2] = clampUint8(out[2] / a)
+				dst.Pix[i+3] = clampUint8(out[3])
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestAddBorder(t *testing.T) {
+	white := color.NRGBA{255, 255, 255, 255}
+	black := color.NRGBA{0, 0, 0, 255}
+	src := newImage(4, 4, red)
+
+	tests := []struct {
+		opt    Options
+		size   image.Point
+		border []image.Point // pixels which should be the border color
+		image  []image.Point // pixels which should be the image
+		color  color.NRGBA
+	}{
+		{
+			Options{BorderWidth: 2, BorderColor: white},
+			image.Pt(8, 8),
+			[]image.Point{{0, 0}, {1, 1}, {7, 7}, {2, 1}, {6, 4}},
+			[]image.Point{{2, 2}, {5, 5}},
+			white,
+		},
+		{
+			Options{BorderWidth: 1},
+			image.Pt(6, 6),
+			[]image.Point{{0, 0}, {5, 3}},
+			[]image.Point{{1, 1}, {4, 4}},
+			black,
+		},
+		{
+			Options{BorderWidth: 1, BorderColor: white, BorderInset: true},
+			image.Pt(4, 4),
+			[]image.Point{{0, 0}, {3, 3}, {0, 2}},
+			[]image.Point{{1, 1}, {2, 2}},
+			white,
+		},
+	}
+
+	for _, tt := range tests {
+		m := addBorder(src, tt.opt)
+		if got := m.Bounds().Size(); got != tt.size {
+			t.Errorf("addBorder(%v) returned size %v, want %v", tt.opt, got, tt.size)
+			continue
+		}
+		for _, p := range tt.border {
+			if got := m.NRGBAAt(p.X, p.Y); got != tt.color {
+				t.Errorf("addBorder(%v) returned %v at %v, want border color %v", tt.opt, got, p, tt.color)
+			}
+		}
+		for _, p := range tt.image {
+			if got := m.NRGBAAt(p.X, p.Y); got != red {
+				t.Errorf("addBorder(%v) returned %v at %v, want image color %v", tt.opt, got, p, red)
+			}
+		}
+	}
+}
+
+func TestAddBorder_RoundedCorners(t *testing.T) {
+	white := color.NRGBA{255, 255, 255, 255}
+	m := addBorder(newImage(16, 16, red), Options{BorderWidth: 2, BorderColor: white, RoundedCorners: 0.5})
+	if got, want := m.Bounds().Size(), image.Pt(20, 20); got != want {
+		t.Fatalf("addBorder returned size %v, want %v", got, want)
+	}
+
+	// outside the circle is transparent
+	if got := m.NRGBAAt(0, 0); got.A != 0 {
+		t.Errorf("addBorder returned corner %v, want transparent", got)
+	}
+	// the border follows the circle, including along the diagonal
+	for _, p := range []image.Point{{10, 1}, {1, 10}, {18, 10}, {10, 18}, {3, 4}, {16, 15}} {
+		if got := m.NRGBAAt(p.X, p.Y); got != white {
+			t.Errorf("addBorder returned %v at %v, want border color", got, p)
+		}
+	}
+	for _, p := range []image.Point{{10, 10}, {5, 5}, {14, 14}} {
+		if got := m.NRGBAAt(p.X, p.Y); got != red {
+			t.Errorf("addBorder returned %v at %v, want image color", got, p)
+		}
+	}
+}
+
+func TestAddBorder_Transparent(t *testing.T) {
+	// transparent areas of the image are not filled by the border
+	src := newImage(4, 4, color.NRGBA{})
+	m := addBorder(src, Options{BorderWidth: 1, BorderColor: color.NRGBA{0, 0, 255, 128}})
+	if got, want := m.NRGBAAt(0, 0), (color.NRGBA{0, 0, 255, 128}); got != want {
+		t.Errorf("addBorder returned border %v, want %v", got, want)
+	}
+	if got := m.NRGBAAt(2, 2); got.A != 0 {
+		t.Errorf("addBorder returned %v inside border, want transparent", got)
+	}
+}
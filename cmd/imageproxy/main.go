@@ -16,19 +16,26 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"fmt"
+	"image"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/gregjones/httpcache"
 	"github.com/gregjones/httpcache/diskcache"
 	"github.com/peterbourgon/diskv"
-	"sourcegraph.com/sourcegraph/s3cache"
 	"willnorris.com/go/imageproxy"
+	"willnorris.com/go/imageproxy/internal/lrucache"
+	"willnorris.com/go/imageproxy/internal/rediscache"
+	"willnorris.com/go/imageproxy/internal/s3cache"
 )
 
 // goxc values
@@ -42,16 +49,105 @@ var (
 
 var addr = flag.String("addr", "localhost:8080", "TCP address to listen on")
 var whitelist = flag.String("whitelist", "", "comma separated list of allowed remote hosts")
+var allowHosts = flag.String("allowHosts", "", "comma separated list of the only remote hosts images may be fetched from, even by signed requests")
+var denyNetworks = flag.String("denyNetworks", "private", `comma separated list of IP networks the proxy will not connect to ("private" includes all private, loopback, and link-local networks)`)
+var allowNetworks = flag.String("allowNetworks", "", "comma separated list of IP networks the proxy may connect to, even if denied")
 var referrers = flag.String("referrers", "", "comma separated list of allowed referring hosts")
+var allowEmptyReferrer = flag.Bool("allowEmptyReferrer", false, "allow requests without a referrer, even if referrers is set")
 var baseURL = flag.String("baseURL", "", "default base URL for relative remote URLs")
 var cache = flag.String("cache", "", "location to cache images (see https://github.com/willnorris/imageproxy#cache)")
 var cacheDir = flag.String("cacheDir", "", "(Deprecated; use 'cache' instead) directory to use for file cache")
 var cacheSize = flag.Uint64("cacheSize", 0, "Deprecated: this flag does nothing")
 var signatureKey = flag.String("signatureKey", "", "HMAC key used in calculating request signatures")
+var signatureHash = flag.String("signatureHash", "sha256", "hash function used in calculating request signatures: sha1, sha256, or sha512")
+var defaultOptions = flag.String("defaultOptions", "", "options applied to requests which do not specify them, such as \"q80,strip\"")
 var scaleUp = flag.Bool("scaleUp", false, "allow images to scale beyond their original dimensions")
+var maxWidth = flag.Int("maxWidth", 0, "maximum width of transformed images (0 for no limit)")
+var maxHeight = flag.Int("maxHeight", 0, "maximum height of transformed images (0 for no limit)")
+var clampSize = flag.Bool("clampSize", false, "reduce requested sizes larger than maxWidth or maxHeight, rather than rejecting them")
+var autoFormat = flag.Bool("autoFormat", false, "encode images in the best format accepted by the client, if not specified in the request")
+var autoFormats = flag.String("autoFormats", "", "comma separated list of formats chosen by autoFormat, in order of preference (empty for avif,webp)")
+var jpegQuality = flag.Int("jpegQuality", 0, "default quality of JPEG images, if not specified in the request (0 for 95)")
+var webpQuality = flag.Int("webpQuality", 0, "default quality of WebP images, if not specified in the request (0 for 95)")
+var avifQuality = flag.Int("avifQuality", 0, "default quality of AVIF images, if not specified in the request (0 for the encoder default)")
+var resampleFilter = flag.String("resampleFilter", "", "default resampling filter used to resize images, if not specified in the request: lanczos, catmullrom, linear, box, or nearest (empty for lanczos)")
+var allowPartial = flag.Bool("allowPartial", false, "transform truncated or corrupt jpeg images as far as they can be decoded, rather than responding with an error")
 var timeout = flag.Duration("timeout", 0, "time limit for requests served by this proxy")
+var fetchTimeout = flag.Duration("fetchTimeout", 0, "time limit for fetching and transforming each remote image")
+var userAgent = flag.String("userAgent", "", "User-Agent header of requests for remote images")
+var forwardHeaders = flag.String("forwardHeaders", "", "comma separated list of client request headers forwarded to remote servers")
+var maxRedirects = flag.Int("maxRedirects", 0, "maximum number of redirects followed when fetching each remote image (0 for 10, -1 for none)")
+var maxPixels = flag.Int("maxPixels", imageproxy.MaxPixels, "maximum number of pixels in images to transform (0 for no limit)")
+var maxFrames = flag.Int("maxFrames", imageproxy.MaxFrames, "maximum number of frames in animated GIFs and WebP images to transform (0 for no limit)")
+var truncateFrames = flag.Bool("truncateFrames", false, "truncate animated GIFs and WebP images exceeding maxFrames or maxPixels, rather than rejecting them")
+var maxDPR = flag.Float64("maxDPR", imageproxy.MaxDPR, "maximum device pixel ratio that requested sizes are multiplied by (0 for no limit)")
+var watermark = flag.String("watermark", "", "path to image overlaid on images which request a watermark")
+var rateLimit = flag.Float64("rateLimit", 0, "maximum average number of requests per second from each client IP address (0 for no limit)")
+var rateBurst = flag.Int("rateBurst", 10, "maximum number of requests in a burst from each client IP address, if rateLimit is set")
+var trustedProxies = flag.Int("trustedProxies", 0, "number of reverse proxies in front of imageproxy which append to X-Forwarded-For, used to determine client IP addresses")
+var metricsAddr = flag.String("metricsAddr", "", "TCP address to serve expvar metrics on, at /debug/vars (empty to disable)")
 var version = flag.Bool("version", false, "print version information")
 
+func init() {
+	flag.Var(headerFlag(upstreamHeader), "header", `header added to requests for remote images, as "Name: value" (may be repeated)`)
+	flag.Var(lutFlag(luts), "lut", `3D color lookup table which images may request with the lut option, as "name=path" to a .cube file (may be repeated)`)
+}
+
+// upstreamHeader holds the headers specified by the header flag.
+var upstreamHeader = make(http.Header)
+
+// headerFlag is a flag.Value which adds a header, formatted as "Name: value",
+// to an http.Header each time the flag is set.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var headers []string
+	for name, values := range h {
+		for _, v := range values {
+			headers = append(headers, name+": "+v)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+func (h headerFlag) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return fmt.Errorf("invalid header %q, want \"Name: value\"", s)
+	}
+	http.Header(h).Add(strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]))
+	return nil
+}
+
+// luts holds the LUTs loaded by the lut flag.
+var luts = make(map[string]*imageproxy.LUT)
+
+// lutFlag is a flag.Value which loads a LUT, specified as "name=path" to a
+// .cube file, each time the flag is set.
+type lutFlag map[string]*imageproxy.LUT
+
+func (l lutFlag) String() string {
+	var names []string
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (l lutFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 || strings.ContainsAny(s[:i], ",/") {
+		return fmt.Errorf("invalid LUT %q, want \"name=path\"", s)
+	}
+	lut, err := imageproxy.ReadCubeFile(s[i+1:])
+	if err != nil {
+		return fmt.Errorf("error reading LUT %q: %v", s[:i], err)
+	}
+	l[s[:i]] = lut
+	return nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -65,13 +161,26 @@ func main() {
 		log.Fatal(err)
 	}
 
-	p := imageproxy.NewProxy(nil, c)
+	filter, err := parseNetworkFilter()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var transport http.RoundTripper
+	if len(filter.Deny) > 0 {
+		transport = filter.Transport()
+	}
+
+	p := imageproxy.NewProxy(transport, c)
 	if *whitelist != "" {
 		p.Whitelist = strings.Split(*whitelist, ",")
 	}
+	if *allowHosts != "" {
+		p.AllowHosts = strings.Split(*allowHosts, ",")
+	}
 	if *referrers != "" {
 		p.Referrers = strings.Split(*referrers, ",")
 	}
+	p.AllowEmptyReferrer = *allowEmptyReferrer
 	if *signatureKey != "" {
 		key := []byte(*signatureKey)
 		if strings.HasPrefix(*signatureKey, "@") {
@@ -83,6 +192,7 @@ func main() {
 			}
 		}
 		p.SignatureKey = key
+		p.SignatureHash = *signatureHash
 	}
 	if *baseURL != "" {
 		var err error
@@ -92,18 +202,105 @@ func main() {
 		}
 	}
 
+	p.DefaultOptions = imageproxy.ParseOptions(*defaultOptions)
 	p.Timeout = *timeout
+	p.FetchTimeout = *fetchTimeout
+	p.MaxRedirects = *maxRedirects
+	p.UserAgent = *userAgent
+	if *rateLimit > 0 {
+		p.RateLimiter = imageproxy.NewRateLimiter(*rateLimit, *rateBurst)
+	}
+	p.TrustedProxies = *trustedProxies
+	if len(upstreamHeader) > 0 {
+		p.Header = upstreamHeader
+	}
+	if *forwardHeaders != "" {
+		p.ForwardHeaders = strings.Split(*forwardHeaders, ",")
+	}
 	p.ScaleUp = *scaleUp
+	p.MaxWidth = *maxWidth
+	p.MaxHeight = *maxHeight
+	p.ClampSize = *clampSize
+	p.AutoFormat = *autoFormat
+	if *autoFormats != "" {
+		p.AutoFormats = strings.Split(*autoFormats, ",")
+	}
+	if _, err := imageproxy.NewOptions(imageproxy.WithFilter(*resampleFilter)); err != nil {
+		log.Fatalf("error parsing resampleFilter: %v", err)
+	}
+	p.TransformConfig = imageproxy.TransformConfig{
+		Quality:      imageproxy.Qualities{JPEG: *jpegQuality, WebP: *webpQuality, AVIF: *avifQuality},
+		Filter:       *resampleFilter,
+		AllowPartial: *allowPartial,
+	}
+	imageproxy.MaxPixels = *maxPixels
+	imageproxy.MaxFrames = *maxFrames
+	imageproxy.TruncateFrames = *truncateFrames
+	imageproxy.MaxDPR = *maxDPR
+	imageproxy.LUTs = luts
+	if *watermark != "" {
+		imageproxy.Watermark, err = readImage(*watermark)
+		if err != nil {
+			log.Fatalf("error reading watermark: %v", err)
+		}
+	}
 
 	server := &http.Server{
 		Addr:    *addr,
 		Handler: p,
 	}
 
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsAddr, mux))
+		}()
+	}
+
 	fmt.Printf("imageproxy (version %v) listening on %s\n", VERSION, server.Addr)
 	log.Fatal(server.ListenAndServe())
 }
 
+// readImage reads and decodes the image file at path.
+func readImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, _, err := image.Decode(f)
+	return m, err
+}
+
+// parseNetworkFilter parses the network-related flags and returns the
+// specified NetworkFilter.
+func parseNetworkFilter() (imageproxy.NetworkFilter, error) {
+	var f imageproxy.NetworkFilter
+	var deny []string
+	for _, n := range strings.Split(*denyNetworks, ",") {
+		switch n = strings.TrimSpace(n); n {
+		case "":
+		case "private":
+			f.Deny = append(f.Deny, imageproxy.PrivateNetworks...)
+		default:
+			deny = append(deny, n)
+		}
+	}
+	nets, err := imageproxy.ParseNetworks(deny)
+	if err != nil {
+		return f, fmt.Errorf("error parsing denyNetworks flag: %v", err)
+	}
+	f.Deny = append(f.Deny, nets...)
+
+	if *allowNetworks != "" {
+		if f.Allow, err = imageproxy.ParseNetworks(strings.Split(*allowNetworks, ",")); err != nil {
+			return f, fmt.Errorf("error parsing allowNetworks flag: %v", err)
+		}
+	}
+	return f, nil
+}
+
 // parseCache parses the cache-related flags and returns the specified Cache implementation.
 func parseCache() (imageproxy.Cache, error) {
 	if *cache == "" {
@@ -113,8 +310,8 @@ func parseCache() (imageproxy.Cache, error) {
 		return nil, nil
 	}
 
-	if *cache == "memory" {
-		return httpcache.NewMemoryCache(), nil
+	if *cache == "memory" || strings.HasPrefix(*cache, "memory:") {
+		return memoryCache(strings.TrimPrefix(*cache, "memory"))
 	}
 
 	u, err := url.Parse(*cache)
@@ -124,8 +321,9 @@ func parseCache() (imageproxy.Cache, error) {
 
 	switch u.Scheme {
 	case "s3":
-		u.Scheme = "https"
-		return s3cache.New(u.String()), nil
+		return s3Cache(u), nil
+	case "redis":
+		return redisCache(u)
 	case "file":
 		fallthrough
 	default:
@@ -133,6 +331,67 @@ func parseCache() (imageproxy.Cache, error) {
 	}
 }
 
+// defaultMemoryCacheSize is the maximum size in megabytes of the memory
+// cache if not otherwise specified.
+const defaultMemoryCacheSize = 100
+
+// memoryCache returns an in-memory cache for the size option, in the form
+// ":{megabytes}", or the empty string for the default size.
+func memoryCache(size string) (*lrucache.Cache, error) {
+	mb := defaultMemoryCacheSize
+	if size != "" {
+		var err error
+		if mb, err = strconv.Atoi(strings.TrimPrefix(size, ":")); err != nil || mb < 0 {
+			return nil, fmt.Errorf("invalid memory cache size %q", size)
+		}
+	}
+	c := lrucache.New(int64(mb) << 20)
+	// publish the cache size and evictions for the metricsAddr flag
+	expvar.Publish("memoryCache", c)
+	return c, nil
+}
+
+// s3Cache returns an S3 cache for the URL u, in the form
+// s3://{endpoint}/{bucket}[/{prefix}].
+func s3Cache(u *url.URL) *s3cache.Cache {
+	bucket := strings.TrimPrefix(u.Path, "/")
+	var prefix string
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, prefix = bucket[:i], bucket[i+1:]
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	c := s3cache.New(bucket, "", prefix)
+	c.BucketURL = "https://" + u.Host + "/" + bucket
+	return c
+}
+
+// redisCache returns a Redis cache for the URL u, in the form
+// redis://[:password@]host:port[/db][?prefix=prefix&ttl=duration].
+func redisCache(u *url.URL) (*rediscache.Cache, error) {
+	opt := rediscache.Options{
+		Addr:   u.Host,
+		Prefix: u.Query().Get("prefix"),
+	}
+	if u.User != nil {
+		opt.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		var err error
+		if opt.DB, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	if ttl := u.Query().Get("ttl"); ttl != "" {
+		var err error
+		if opt.TTL, err = time.ParseDuration(ttl); err != nil {
+			return nil, fmt.Errorf("invalid redis ttl %q: %v", ttl, err)
+		}
+	}
+	return rediscache.New(opt), nil
+}
+
 func diskCache(path string) *diskcache.Cache {
 	d := diskv.New(diskv.Options{
 		BasePath: path,
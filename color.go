@@ -0,0 +1,75 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+)
+
+// dominantColorSize is the maximum dimension of the downscaled copy of an
+// image whose colors are counted by DominantColor.
+const dominantColorSize = 100
+
+// DominantColor returns the most common color of the encoded image img,
+// suitable for a placeholder background shown while the image loads.  Similar
+// colors are counted together, and the average of the most common group is
+// returned as an opaque color.  Transparent pixels are ignored, and images
+// which are entirely transparent return a transparent color.  Images which
+// can not be decoded result in a *TransformError, as with Transform.
+func DominantColor(img []byte) (color.RGBA, error) {
+	m, err := decodeImage(img)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	return dominantColor(m), nil
+}
+
+// dominantColor returns the average color of the pixels of m in the most
+// common group of similar colors.
+func dominantColor(m image.Image) color.RGBA {
+	src := imaging.Fit(m, dominantColorSize, dominantColorSize, imaging.Box)
+
+	// group colors by the 4 most significant bits of each channel
+	type group struct{ r, g, b, n int }
+	var groups [4096]group
+	best := -1
+	for i := 0; i+3 < len(src.Pix); i += 4 {
+		if src.Pix[i+3] == 0 {
+			continue
+		}
+		r, g, b := int(src.Pix[i]), int(src.Pix[i+1]), int(src.Pix[i+2])
+		k := r>>4<<8 | g>>4<<4 | b>>4
+		groups[k].r += r
+		groups[k].g += g
+		groups[k].b += b
+		groups[k].n++
+		if best < 0 || groups[k].n > groups[best].n {
+			best = k
+		}
+	}
+	if best < 0 {
+		return color.RGBA{}
+	}
+	g := groups[best]
+	return color.RGBA{
+		R: uint8((g.r + g.n/2) / g.n),
+		G: uint8((g.g + g.n/2) / g.n),
+		B: uint8((g.b + g.n/2) / g.n),
+		A: 255,
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestDominantColor(t *testing.T) {
+	transparent := color.NRGBA{}
+	tests := []struct {
+		m    image.Image
+		want color.RGBA
+	}{
+		{newImage(1, 1, red), color.RGBA{255, 0, 0, 255}},
+		{newImage(3, 1, red, blue, blue), color.RGBA{0, 0, 255, 255}},
+		{ // similar colors are counted together
+			newImage(5, 1, red, red, color.NRGBA{0, 0, 250, 255}, color.NRGBA{0, 0, 244, 255}, color.NRGBA{0, 2, 246, 255}),
+			color.RGBA{0, 1, 247, 255},
+		},
+		{ // transparent pixels are ignored
+			newImage(3, 1, transparent, transparent, green),
+			color.RGBA{0, 255, 0, 255},
+		},
+		{newImage(2, 1, transparent, transparent), color.RGBA{}},
+	}
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		png.Encode(buf, tt.m)
+		got, err := DominantColor(buf.Bytes())
+		if err != nil {
+			t.Errorf("DominantColor(%v) returned unexpected error: %v", tt.m, err)
+		}
+		if got != tt.want {
+			t.Errorf("DominantColor(%v) returned %v, want %v", tt.m, got, tt.want)
+		}
+	}
+
+	if _, err := DominantColor([]byte("<html></html>")); !errors.Is(err, ErrNotAnImage) {
+		t.Errorf("DominantColor of html returned error %v, want %v", err, ErrNotAnImage)
+	}
+}
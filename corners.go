@@ -0,0 +1,98 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// cornerRadius returns the radius in pixels of the rounded corners specified
+// by opt for an image of size w by h.  Like Width and Height, values between
+// 0 and 1 are interpreted as a percentage, in this case of the shorter side.
+// The radius is limited to half of the shorter side, which produces a circle
+// or pill shape.
+func cornerRadius(w, h int, opt Options) float64 {
+	side := float64(w)
+	if h < w {
+		side = float64(h)
+	}
+	r := opt.RoundedCorners
+	if 0 < r && r < 1 {
+		r *= side
+	}
+	return math.Min(r, side/2)
+}
+
+// roundCorners masks the corners of m with quarter circles of radius r,
+// making the pixels outside of them transparent.  Pixels along the edge of
+// the circles are partially transparent, to smooth the curve.
+func roundCorners(m image.Image, r float64) *image.NRGBA {
+	dst := imaging.Clone(m)
+	if r <= 0 {
+		return dst
+	}
+	b := dst.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if c := coverage(x, y, b, r); c < 1 {
+				i := dst.PixOffset(x, y) + 3
+				dst.Pix[i] = uint8(float64(dst.Pix[i]) * c)
+			}
+		}
+	}
+	return dst
+}
+
+// coverage returns how much of the pixel at x, y is covered by the rectangle
+// rect with corners rounded to radius r, from 0 to 1.  Coverage along the
+// curve is approximated by the distance of the pixel center from it.
+func coverage(x, y int, rect image.Rectangle, r float64) float64 {
+	px, py := float64(x)+0.5, float64(y)+0.5
+	minX, minY := float64(rect.Min.X), float64(rect.Min.Y)
+	maxX, maxY := float64(rect.Max.X), float64(rect.Max.Y)
+
+	c := math.Min(math.Min(px-minX, maxX-px), math.Min(py-minY, maxY-py)) + 0.5
+	if r > 0 {
+		// distance from the center of the nearest corner circle, which
+		// is only positive for both axes within the corners.
+		dx := math.Max(minX+r-px, px-(maxX-r))
+		dy := math.Max(minY+r-py, py-(maxY-r))
+		if dx > 0 && dy > 0 {
+			c = math.Min(c, r-math.Hypot(dx, dy)+0.5)
+		}
+	}
+	return math.Max(0, math.Min(1, c))
+}
+
+// transparentPalette returns p with a fully transparent color, so that the
+// transparent areas of GIF frames are not mapped to an opaque color.  If p
+// is full, its last color is replaced.
+func transparentPalette(p color.Palette) color.Palette {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+	out := append(color.Palette{}, p...)
+	if len(out) < 256 {
+		return append(out, color.NRGBA{})
+	}
+	out[len(out)-1] = color.NRGBA{}
+	return out
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestCornerRadius(t *testing.T) {
+	tests := []struct {
+		w, h   int
+		radius float64
+		want   float64
+	}{
+		{100, 100, 10, 10},
+		{100, 100, 0.1, 10},
+		{100, 50, 0.1, 5},
+		{50, 100, 0.5, 25},
+		{100, 100, 80, 50},
+		{100, 100, 1, 1},
+	}
+
+	for _, tt := range tests {
+		if got := cornerRadius(tt.w, tt.h, Options{RoundedCorners: tt.radius}); got != tt.want {
+			t.Errorf("cornerRadius(%d, %d, %v) returned %v, want %v", tt.w, tt.h, tt.radius, got, tt.want)
+		}
+	}
+}
+
+func TestRoundCorners(t *testing.T) {
+	m := roundCorners(newImage(20, 10, red), 4)
+
+	transparent := [][2]int{{0, 0}, {19, 0}, {0, 9}, {19, 9}}
+	for _, p := range transparent {
+		if got := m.NRGBAAt(p[0], p[1]); got.A != 0 {
+			t.Errorf("roundCorners returned pixel %v at %v, want transparent", got, p)
+		}
+	}
+	opaque := [][2]int{{4, 0}, {15, 0}, {0, 4}, {19, 5}, {10, 5}, {2, 2}}
+	for _, p := range opaque {
+		if got := m.NRGBAAt(p[0], p[1]); got != red {
+			t.Errorf("roundCorners returned pixel %v at %v, want %v", got, p, red)
+		}
+	}
+
+	// the curve should be smoothed with partially transparent pixels
+	var partial int
+	for i := 0; i < len(m.Pix); i += 4 {
+		if a := m.Pix[i+3]; a != 0 && a != 255 {
+			partial++
+		}
+	}
+	if partial == 0 {
+		t.Errorf("roundCorners returned no partially transparent pixels")
+	}
+
+	// a radius of half the side of a square image makes a circle
+	m = roundCorners(newImage(10, 10, red), 5)
+	for _, p := range [][2]int{{5, 0}, {0, 5}, {9, 4}, {4, 9}} {
+		if got := m.NRGBAAt(p[0], p[1]); got.A == 0 {
+			t.Errorf("roundCorners circle returned transparent pixel at %v", p)
+		}
+	}
+	for _, p := range [][2]int{{0, 0}, {9, 0}, {0, 9}, {9, 9}} {
+		if got := m.NRGBAAt(p[0], p[1]); got.A != 0 {
+			t.Errorf("roundCorners circle returned pixel %v at %v, want transparent", got, p)
+		}
+	}
+
+	// a zero radius is a noop
+	if m := roundCorners(newImage(4, 4, red), 0); m.NRGBAAt(0, 0) != red {
+		t.Errorf("roundCorners with zero radius modified image")
+	}
+}
+
+func TestTransparentPalette(t *testing.T) {
+	transparent := color.NRGBA{}
+	tests := []struct {
+		p    color.Palette
+		want color.Palette
+	}{
+		{color.Palette{red, green}, color.Palette{red, green, transparent}},
+		{color.Palette{red, transparent, green}, color.Palette{red, transparent, green}},
+	}
+	for _, tt := range tests {
+		got := transparentPalette(tt.p)
+		if len(got) != len(tt.want) {
+			t.Errorf("transparentPalette(%v) returned %v, want %v", tt.p, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("transparentPalette(%v) returned %v, want %v", tt.p, got, tt.want)
+				break
+			}
+		}
+	}
+
+	full := make(color.Palette, 256)
+	for i := range full {
+		full[i] = color.Gray{uint8(i)}
+	}
+	got := transparentPalette(full)
+	if len(got) != 256 || got[255] != transparent || got[0] != full[0] {
+		t.Errorf("transparentPalette of full palette did not replace last color")
+	}
+	if full[255] == transparent {
+		t.Errorf("transparentPalette modified its argument")
+	}
+}
@@ -15,26 +15,128 @@
 package imageproxy
 
 import (
-	"bytes"
+	"encoding/hex"
 	"fmt"
+	"image/color"
+	"image/png"
+	"math"
 	"net/http"
 	"net/url"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 const (
-	optFit             = "fit"
-	optFlipVertical    = "fv"
-	optFlipHorizontal  = "fh"
-	optRotatePrefix    = "r"
-	optQualityPrefix   = "q"
-	optSignaturePrefix = "s"
-	optSizeDelimiter   = "x"
-	optScaleUp         = "scaleUp"
+	optFit               = "fit"
+	optPad               = "pad"
+	optFlipVertical      = "fv"
+	optFlipHorizontal    = "fh"
+	optRotatePrefix      = "r"
+	optQualityPrefix     = "q"
+	optEffortPrefix      = "e"
+	optSignaturePrefix   = "s"
+	optCropX             = "cx"
+	optCropY             = "cy"
+	optCropWidth         = "cw"
+	optCropHeight        = "ch"
+	optSizeDelimiter     = "x"
+	optPercentSuffix     = "p"
+	optScaleUp           = "scaleUp"
+	optSmartCrop         = "sc"
+	optFocalXPrefix      = "fpx:"
+	optFocalYPrefix      = "fpy:"
+	optGravityPrefix     = "gravity:"
+	optGrayscale         = "gray"
+	optInvert            = "invert"
+	optStripMetadata     = "strip"
+	optPreserveProfile   = "icc"
+	optPreserveEXIF      = "exif"
+	optStripGPS          = "nogps"
+	optColor             = "color"
+	optBlurHash          = "blurhash"
+	optBlurHashPrefix    = "blurhash:"
+	optDownload          = "download"
+	optFilenamePrefix    = "filename:"
+	optProgressive       = "progressive"
+	optAutoContrast      = "autocontrast"
+	optAutoContrPrefix   = "autocontrast:"
+	optAutoContrastRGB   = "rgb"
+	optBrightnessPrefix  = "brightness:"
+	optContrastPrefix    = "contrast:"
+	optGammaPrefix       = "gamma:"
+	optSaturationPrefix  = "saturation:"
+	optHuePrefix         = "hue:"
+	optSepiaPrefix       = "sepia:"
+	optLUTPrefix         = "lut:"
+	optBlurPrefix        = "blur:"
+	optSharpenPrefix     = "sharpen:"
+	optAutoSharpen       = "autosharpen"
+	optPixelatePrefix    = "pixelate:"
+	optCompressionPrefix = "compression:"
+	optTIFFCompPrefix    = "tiffcompression:"
+	optICOSizePrefix     = "icosize:"
+	optRotateFillPrefix  = "rotatefill:"
+	optBackgroundPrefix  = "bg:"
+	optRoundPrefix       = "round:"
+	optWatermarkPrefix   = "wm:"
+	optWMOpacityPrefix   = "wmopacity:"
+	optWMMarginPrefix    = "wmmargin:"
+	optBorderPrefix      = "border:"
+	optBorderInset       = "borderinset"
+	optTrim              = "trim"
+	optTrimPrefix        = "trim:"
+	optMegapixelsPrefix  = "mp:"
+	optDither            = "dither"
+	optFramePrefix       = "frame:"
+	optFirstFrame        = "frame:first"
+	optSubsamplingPrefix = "subsampling:"
+	optDPRPrefix         = "dpr:"
+	optFilterPrefix      = "filter:"
+	optPipelinePrefix    = "pipeline:"
+	optDPIPrefix         = "dpi:"
+	optLossless          = "lossless"
+	optOptimize          = "optimize"
 )
 
+// pngCompressionLevels maps the names used in the "compression:" option to
+// PNG compression levels.
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// tiffCompressions maps the names used in the "tiffcompression:" option to
+// TIFF compression types.
+var tiffCompressions = map[string]TIFFCompression{
+	"none":    TIFFUncompressed,
+	"lzw":     TIFFLZW,
+	"deflate": TIFFDeflate,
+}
+
+// maxDPI is the largest resolution, in dots per inch, that JFIF headers can
+// hold.
+const maxDPI = 0xffff
+
+// maxBlurSigma is the largest valid blur sigma.  The cost of blurring grows
+// with the sigma, and larger values blur the image beyond recognition anyway.
+const maxBlurSigma = 100
+
+// maxSharpenSigma is the largest valid sharpen sigma, for the same reason.
+const maxSharpenSigma = 100
+
+// losslessFormats are the output formats which can encode images without
+// any loss, as the lossless option requires.
+var losslessFormats = map[string]bool{"webp": true, "png": true, "tiff": true, "bmp": true, "ico": true}
+
+// outputFormats are the image formats which may be specified as the output
+// format of a transformed image, in addition to any registered encoders.
+var outputFormats = []string{"jpeg", "png", "webp"}
+
 // URLError reports a malformed URL error.
 type URLError struct {
 	Message string
@@ -51,60 +153,852 @@ type Options struct {
 	Width  float64
 	Height float64
 
+	// If true, Width or Height is a percentage of the original image size,
+	// such as 50 for half or 100 for the full size, rather than a number of
+	// pixels or a fraction between 0 and 1.
+	WidthPercent  bool
+	HeightPercent bool
+
 	// If true, resize the image to fit in the specified dimensions.  Image
 	// will not be cropped, and aspect ratio will be maintained.
 	Fit bool
 
-	// Rotate image the specified degrees counter-clockwise.  Valid values
-	// are 90, 180, 270.
-	Rotate int
+	// If true, and both Width and Height are specified, resize the image to
+	// fit in the specified dimensions and pad the remaining space, so that
+	// the result is exactly the specified size.  The padding is transparent
+	// unless a Background color is specified.
+	Pad bool
+
+	// Maximum size of the resized image, in millions of pixels.  The image
+	// is scaled down, preserving its aspect ratio, if it would otherwise be
+	// larger.  Zero means no limit.
+	Megapixels float64
+
+	// Device pixel ratio of the display the image is intended for.  Width
+	// and Height are multiplied by it, up to MaxDPR, so that images are
+	// sharp on high density displays.  Zero means 1.
+	DPR float64
+
+	// Resampling filter used to resize the image, one of "lanczos",
+	// "catmullrom", "linear", "box", or "nearest".  Nearest neighbor
+	// scaling keeps the hard edges of pixel art.  The zero value uses
+	// Lanczos.
+	Filter string
+
+	// Rotate image the specified degrees counter-clockwise.  Rotations of
+	// 90, 180, and 270 degrees are lossless, other angles enlarge the image
+	// to fit the rotated corners.
+	Rotate float64
+
+	// Background color for the corners exposed by rotating an image by an
+	// angle other than a multiple of 90 degrees.  The zero value is
+	// transparent.
+	RotateFill color.NRGBA
 
 	FlipVertical   bool
 	FlipHorizontal bool
 
-	// Quality of output image
+	// If true, stretch the levels of the image after resizing, so that its
+	// darkest pixels become black and its brightest pixels white, before
+	// other color adjustments.  AutoContrastClip is the percentage, from 0
+	// to 50, of the darkest and of the brightest pixels which are ignored,
+	// so that outliers do not prevent the stretch.  If AutoContrastRGB is
+	// true, each color channel is stretched separately, rather than the
+	// luminance of the image.
+	AutoContrast     bool
+	AutoContrastClip float64
+	AutoContrastRGB  bool
+
+	// Brightness and Contrast adjustments, in the range -100 to 100.  Zero
+	// means no change.
+	Brightness float64
+	Contrast   float64
+
+	// Gamma correction to apply.  Values less than 1 darken the image and
+	// values greater than 1 lighten it.  Zero and 1 mean no change.
+	// Negative values are invalid.
+	Gamma float64
+
+	// Saturation adjustment, in the range -100 to 100.  -100 removes all
+	// color, and zero means no change.
+	Saturation float64
+
+	// Angle in degrees, from 0 to 360, to rotate the hue of each pixel
+	// by.  Zero and 360 mean no change.
+	Hue float64
+
+	// If true, convert the image to grayscale.
+	Grayscale bool
+
+	// Intensity of a sepia tone to apply, from 0 to 100.  Zero means no
+	// change, and 100 fully sepia tones the image.
+	Sepia float64
+
+	// If true, invert the colors of the image, producing a negative.
+	// Transparency is not affected.
+	Invert bool
+
+	// Name of the package LUT to color grade the image with, after the
+	// other color adjustments.  If empty, no LUT is applied.
+	LUT string
+
+	// Radius of rounded corners to mask the image with, after resizing and
+	// rotating.  Like Width and Height, values between 0 and 1 are
+	// interpreted as a percentage, in this case of the shorter side, so 0.5
+	// produces a circle for square images.  Images with rounded corners are
+	// encoded as PNG rather than JPEG, to support transparency, unless they
+	// are flattened onto an opaque Background.
+	RoundedCorners float64
+
+	// Width in pixels and color of a border to draw around the image,
+	// after resizing.  The canvas is expanded by the border width on each
+	// side, unless BorderInset is true, in which case the border is drawn
+	// over the edges of the image.  If BorderColor is the zero value, the
+	// border is black.  Widths greater than 1000 are invalid.
+	BorderWidth int
+	BorderColor color.NRGBA
+	BorderInset bool
+
+	// Position to overlay the package Watermark image at, after resizing.
+	// Valid values are "northwest", "northeast", "southwest", "southeast",
+	// and "center".  If empty, no watermark is applied.
+	WatermarkPosition string
+
+	// Opacity of the watermark, from 0 to 1.  Zero means fully opaque.
+	WatermarkOpacity float64
+
+	// Distance in pixels between the watermark and the edges of the image.
+	// Not used for centered watermarks.
+	WatermarkMargin int
+
+	// Background color to flatten transparent images onto, after all other
+	// transformations.  The zero value leaves transparency as is, which
+	// JPEG images encode as black.
+	Background color.NRGBA
+
+	// Sigma of the gaussian blur to apply to the image after resizing.
+	// Zero means no blur.  Negative values and values greater than 100 are
+	// invalid.
+	Blur float64
+
+	// Sigma of the sharpening to apply to the image after resizing.  Zero
+	// means no sharpening.  Negative values and values greater than 100 are
+	// invalid.
+	Sharpen float64
+
+	// Whether to apply a mild sharpening to images which are downscaled to
+	// less than half of their original size, if Sharpen is zero.  Images
+	// which are not resized, or are scaled up, are not sharpened.
+	AutoSharpen bool
+
+	// Size in pixels of the blocks to pixelate the image into after
+	// resizing, each filled with its average color.  Zero and 1 mean no
+	// pixelation.  Negative values are invalid.
+	Pixelate int
+
+	// Quality of output image.  PNG images with a quality below 100 are
+	// quantized to a palette of fewer colors.
 	Quality int
 
+	// Format of output image.  If empty, the image is encoded in the same
+	// format as the original.  Valid values are "jpeg", "png", "webp",
+	// "tiff", "bmp", and "ico", as well as "avif" when built with the "avif"
+	// build tag.
+	Format string
+
+	// Effort the encoder should spend compressing the output image, from
+	// 1 (fastest) to 10 (slowest, smallest output).  If zero, the
+	// encoder's default is used.  Currently only used for AVIF images.
+	Effort int
+
+	// If true, encode WebP output losslessly, ignoring Quality, which
+	// avoids ringing around the sharp edges of screenshots and line art.
+	// PNG output is also not quantized.  Other lossless formats are
+	// unaffected, and formats without a lossless mode are not allowed.
+	Lossless bool
+
+	// If true, static JPEG, PNG, WebP, and AVIF output is also encoded as
+	// PNG and, if the image is opaque and the format is lossy, as JPEG,
+	// and the smallest encoding is used, even if it is not in the
+	// requested format.  This helps tiny images such as icons, for which
+	// the overhead of AVIF and WebP can exceed their savings, at the cost
+	// of encoding each image several times.  If the options only change
+	// how the image is encoded, and the result is larger than the original
+	// image, the original is returned instead.
+	Optimize bool
+
+	// Compression level of PNG output.  The zero value is
+	// png.DefaultCompression.
+	PNGCompression png.CompressionLevel
+
+	// Compression of TIFF output.  The zero value is TIFFUncompressed.
+	TIFFCompression TIFFCompression
+
+	// Sizes of the images in ICO output.  If empty, ICO output contains
+	// just the transformed image, scaled down to 256 pixels if it is
+	// larger.
+	ICOSizes ICOSizes
+
+	// If true, reduce images with 16 bits per channel to 8 bits using
+	// Floyd-Steinberg dithering before they are transformed, so that smooth
+	// gradients do not become visible bands.  Otherwise, 16-bit images are
+	// truncated to 8 bits by any transformation which changes their pixels,
+	// and are only encoded at their original depth if their pixels are
+	// unchanged.  Dither also applies Floyd-Steinberg dithering when PNG
+	// output is reduced to a palette by a Quality below 100, rather than
+	// mapping each pixel to its nearest palette color.
+	Dither bool
+
+	// If true, encode JPEG output as a progressive JPEG, which browsers can
+	// display at low quality before it has fully loaded.
+	Progressive bool
+
+	// Chroma subsampling of JPEG output: 444 for none, which keeps colored
+	// edges sharp, or 422 or 420.  If zero, the standard library encoder's
+	// 4:2:0 subsampling is used.
+	Subsampling int
+
+	// If true, remove all metadata (such as EXIF, XMP, ICC profiles, and
+	// comments) from JPEG and PNG images, even if no other transformation
+	// is requested.
+	StripMetadata bool
+
+	// If true, embed the ICC color profile of the original image in the
+	// transformed JPEG or PNG image, even if StripMetadata is also set.
+	PreserveColorProfile bool
+
+	// If true, embed the EXIF metadata of the original JPEG, PNG, or WebP
+	// image in the transformed JPEG image, even if StripMetadata is also
+	// set.  The Orientation tag is reset to 1, since it is not applied to
+	// the transformed image.
+	PreserveEXIF bool
+
+	// If true, remove the GPS location from the EXIF metadata of JPEG
+	// images, keeping all other EXIF tags, even if no other
+	// transformation is requested.
+	StripGPS bool
+
+	// Resolution of JPEG and PNG output in dots per inch, for printing,
+	// written to the JFIF header or pHYs chunk.  If zero, the resolution is
+	// left as it is, even if no other transformation is requested.
+	DPI int
+
+	// If true, the proxy responds with the dominant color of the
+	// transformed image, as JSON, rather than the image itself.  This
+	// option is not used by Transform.
+	Color bool
+
+	// If non-zero, the proxy responds with the BlurHash of the
+	// transformed image, as plain text, rather than the image itself.
+	// BlurHashX and BlurHashY are the number of horizontal and vertical
+	// components to encode, from 1 to 9.  These options are not used by
+	// Transform.
+	BlurHashX int
+	BlurHashY int
+
+	// If true, the proxy responds with a Content-Disposition header which
+	// asks browsers to download the image, rather than display it.
+	// Filename is the name the image is saved as, whose extension is
+	// replaced by that of the format the image is actually encoded in.  If
+	// Filename is empty, the name of the remote image is used.  If Filename
+	// is set without Download, the image is still displayed, but saved
+	// with that name.  These options are not used by Transform.
+	Download bool
+	Filename string
+
 	// HMAC Signature for signed requests.
 	Signature string
 
+	// If true, extract a single frame of animated GIFs, which is then
+	// transformed and encoded as a static image.  Frame is the index of the
+	// frame, starting at 0, and is clamped to the last frame.  Extracted
+	// frames are encoded as PNG unless Format is also specified.  Other
+	// images are not affected.
+	ExtractFrame bool
+	Frame        int
+
+	// If true, trim uniform borders of the color of the top-left pixel
+	// from the image, after cropping and before resizing.  TrimTolerance is
+	// the largest difference, from 0 to 255, of each color channel from the
+	// border color which is still trimmed.
+	Trim          bool
+	TrimTolerance float64
+
+	// Crop rectangle params, applied before resizing.  Like Width and
+	// Height, values between 0 and 1 are interpreted as percentages of the
+	// original image size.  Negative CropX and CropY values are offsets from
+	// the right or bottom edge instead, so -100 starts 100 pixels from the
+	// right edge and -0.25 starts 25% of the width from it.  If CropWidth or
+	// CropHeight are zero, the crop extends to the right or bottom edge of
+	// the image.
+	CropX      float64
+	CropY      float64
+	CropWidth  float64
+	CropHeight float64
+
+	// If true, and both Width and Height are specified, crop to the most
+	// interesting region of the image rather than its center.
+	SmartCrop bool
+
+	// Focal point of the image, as fractions from 0 to 1 of its width and
+	// height measured from the top left corner.  If both Width and Height
+	// are specified, the image is cropped around this point rather than
+	// its center, overriding SmartCrop.  A zero value centers the crop
+	// along that axis.
+	FocalX float64
+	FocalY float64
+
+	// Gravity positions the crop against an edge or corner of the image,
+	// such as "north" to keep the top of portraits, if both Width and
+	// Height are specified.  It is one of "north", "northeast", "east",
+	// "southeast", "south", "southwest", "west", "northwest", or "center"
+	// (the default).  It overrides SmartCrop, and is overridden by a focal
+	// point.
+	Gravity string
+
 	// Allow image to scale beyond its original dimensions.  This value
 	// will always be overwritten by the value of Proxy.ScaleUp.
 	ScaleUp bool
+
+	// Pipeline is the order to perform the requested operations in, such as
+	// "crop+rotate+blur", rather than the default order described in
+	// ParseOptions.  It must include every operation requested by the
+	// other options.
+	Pipeline string
 }
 
+// String returns the canonical representation of o as a comma separated list
+// of options, which ParseOptions parses back to o.  The options are sorted,
+// so the representation does not depend on the order in which they are
+// added to it.
 func (o Options) String() string {
-	buf := new(bytes.Buffer)
-	fmt.Fprintf(buf, "%v%s%v", o.Width, optSizeDelimiter, o.Height)
+	w, h := fmt.Sprint(o.Width), fmt.Sprint(o.Height)
+	if o.WidthPercent {
+		w += optPercentSuffix
+	}
+	if o.HeightPercent {
+		h += optPercentSuffix
+	}
+	opts := []string{w + optSizeDelimiter + h}
 	if o.Fit {
-		fmt.Fprintf(buf, ",%s", optFit)
+		opts = append(opts, optFit)
+	}
+	if o.Pad {
+		opts = append(opts, optPad)
+	}
+	if o.Megapixels != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optMegapixelsPrefix, o.Megapixels))
+	}
+	if o.DPR != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optDPRPrefix, o.DPR))
+	}
+	if o.Pipeline != "" {
+		opts = append(opts, optPipelinePrefix+o.Pipeline)
+	}
+	if o.Filter != "" {
+		opts = append(opts, optFilterPrefix+o.Filter)
 	}
 	if o.Rotate != 0 {
-		fmt.Fprintf(buf, ",%s%d", string(optRotatePrefix), o.Rotate)
+		opts = append(opts, fmt.Sprintf("%s%v", string(optRotatePrefix), o.Rotate))
+	}
+	if o.RotateFill != (color.NRGBA{}) {
+		opts = append(opts, fmt.Sprintf("%s%s", optRotateFillPrefix, formatColor(o.RotateFill)))
 	}
 	if o.FlipVertical {
-		fmt.Fprintf(buf, ",%s", optFlipVertical)
+		opts = append(opts, optFlipVertical)
 	}
 	if o.FlipHorizontal {
-		fmt.Fprintf(buf, ",%s", optFlipHorizontal)
+		opts = append(opts, optFlipHorizontal)
+	}
+	if o.AutoContrast {
+		opt := optAutoContrast
+		if o.AutoContrastRGB {
+			opt += ":" + optAutoContrastRGB
+		}
+		if o.AutoContrastClip != 0 {
+			opt += fmt.Sprintf(":%v", o.AutoContrastClip)
+		}
+		opts = append(opts, opt)
+	}
+	if o.Brightness != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optBrightnessPrefix, o.Brightness))
+	}
+	if o.Contrast != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optContrastPrefix, o.Contrast))
+	}
+	if o.Gamma != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optGammaPrefix, o.Gamma))
+	}
+	if o.Saturation != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optSaturationPrefix, o.Saturation))
+	}
+	if o.Hue != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optHuePrefix, o.Hue))
+	}
+	if o.Sepia != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optSepiaPrefix, o.Sepia))
+	}
+	if o.Invert {
+		opts = append(opts, optInvert)
+	}
+	if o.LUT != "" {
+		opts = append(opts, optLUTPrefix+o.LUT)
+	}
+	if o.Grayscale {
+		opts = append(opts, optGrayscale)
+	}
+	if o.RoundedCorners != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optRoundPrefix, o.RoundedCorners))
+	}
+	if o.BorderWidth != 0 {
+		// the border color must immediately follow the border width,
+		// so they are sorted as a single option
+		border := fmt.Sprintf("%s%d", optBorderPrefix, o.BorderWidth)
+		if o.BorderColor != (color.NRGBA{}) {
+			border += "," + formatColor(o.BorderColor)
+		}
+		opts = append(opts, border)
+	}
+	if o.BorderInset {
+		opts = append(opts, optBorderInset)
+	}
+	if o.WatermarkPosition != "" {
+		opts = append(opts, fmt.Sprintf("%s%s", optWatermarkPrefix, o.WatermarkPosition))
+	}
+	if o.WatermarkOpacity != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optWMOpacityPrefix, o.WatermarkOpacity))
+	}
+	if o.WatermarkMargin != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optWMMarginPrefix, o.WatermarkMargin))
+	}
+	if o.Background != (color.NRGBA{}) {
+		opts = append(opts, fmt.Sprintf("%s%s", optBackgroundPrefix, formatColor(o.Background)))
+	}
+	if o.Blur != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optBlurPrefix, o.Blur))
+	}
+	if o.Sharpen != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optSharpenPrefix, o.Sharpen))
+	}
+	if o.AutoSharpen {
+		opts = append(opts, optAutoSharpen)
+	}
+	if o.Pixelate != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optPixelatePrefix, o.Pixelate))
 	}
 	if o.Quality != 0 {
-		fmt.Fprintf(buf, ",%s%d", string(optQualityPrefix), o.Quality)
+		opts = append(opts, fmt.Sprintf("%s%d", string(optQualityPrefix), o.Quality))
+	}
+	if o.Effort != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", string(optEffortPrefix), o.Effort))
+	}
+	if o.PNGCompression != png.DefaultCompression {
+		for name, level := range pngCompressionLevels {
+			if level == o.PNGCompression {
+				opts = append(opts, fmt.Sprintf("%s%s", optCompressionPrefix, name))
+			}
+		}
+	}
+	if o.TIFFCompression != TIFFUncompressed {
+		for name, c := range tiffCompressions {
+			if c == o.TIFFCompression {
+				opts = append(opts, fmt.Sprintf("%s%s", optTIFFCompPrefix, name))
+			}
+		}
+	}
+	for _, size := range o.ICOSizes.sizes() {
+		opts = append(opts, fmt.Sprintf("%s%d", optICOSizePrefix, size))
+	}
+	if o.Dither {
+		opts = append(opts, optDither)
+	}
+	if o.Lossless {
+		opts = append(opts, optLossless)
+	}
+	if o.Optimize {
+		opts = append(opts, optOptimize)
+	}
+	if o.Format != "" {
+		opts = append(opts, o.Format)
+	}
+	if o.Progressive {
+		opts = append(opts, optProgressive)
+	}
+	if o.Subsampling != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optSubsamplingPrefix, o.Subsampling))
+	}
+	if o.StripMetadata {
+		opts = append(opts, optStripMetadata)
+	}
+	if o.PreserveColorProfile {
+		opts = append(opts, optPreserveProfile)
+	}
+	if o.PreserveEXIF {
+		opts = append(opts, optPreserveEXIF)
+	}
+	if o.StripGPS {
+		opts = append(opts, optStripGPS)
+	}
+	if o.DPI != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optDPIPrefix, o.DPI))
+	}
+	if o.Color {
+		opts = append(opts, optColor)
+	}
+	if o.blurHash() {
+		opts = append(opts, fmt.Sprintf("%s%dx%d", optBlurHashPrefix, o.BlurHashX, o.BlurHashY))
+	}
+	if o.Download {
+		opts = append(opts, optDownload)
+	}
+	if o.Filename != "" {
+		opts = append(opts, optFilenamePrefix+o.Filename)
 	}
 	if o.Signature != "" {
-		fmt.Fprintf(buf, ",%s%s", string(optSignaturePrefix), o.Signature)
+		opts = append(opts, fmt.Sprintf("%s%s", string(optSignaturePrefix), o.Signature))
 	}
 	if o.ScaleUp {
-		fmt.Fprintf(buf, ",%s", optScaleUp)
+		opts = append(opts, optScaleUp)
+	}
+	if o.SmartCrop {
+		opts = append(opts, optSmartCrop)
+	}
+	if o.Trim {
+		if o.TrimTolerance != 0 {
+			opts = append(opts, fmt.Sprintf("%s%v", optTrimPrefix, o.TrimTolerance))
+		} else {
+			opts = append(opts, optTrim)
+		}
+	}
+	if o.ExtractFrame {
+		if o.Frame != 0 {
+			opts = append(opts, fmt.Sprintf("%s%d", optFramePrefix, o.Frame))
+		} else {
+			opts = append(opts, optFirstFrame)
+		}
+	}
+	if o.FocalX != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optFocalXPrefix, o.FocalX))
+	}
+	if o.FocalY != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optFocalYPrefix, o.FocalY))
+	}
+	if o.Gravity != "" {
+		opts = append(opts, optGravityPrefix+o.Gravity)
+	}
+	if o.CropX != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optCropX, o.CropX))
+	}
+	if o.CropY != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optCropY, o.CropY))
+	}
+	if o.CropWidth != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optCropWidth, o.CropWidth))
+	}
+	if o.CropHeight != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optCropHeight, o.CropHeight))
+	}
+	sort.Strings(opts)
+	return strings.Join(opts, ",")
+}
+
+// defaultGroups lists fields of Options which only have their intended effect
+// together, so that defaults are applied to each group as a whole.  For
+// example, a request for a height does not get a default width.
+var defaultGroups = [][]string{
+	{"Width", "Height", "WidthPercent", "HeightPercent"},
+	{"BorderWidth", "BorderColor", "BorderInset"},
+	{"BlurHashX", "BlurHashY"},
+	{"ExtractFrame", "Frame"},
+	{"Trim", "TrimTolerance"},
+	{"AutoContrast", "AutoContrastClip", "AutoContrastRGB"},
+	{"CropX", "CropY", "CropWidth", "CropHeight"},
+	{"FocalX", "FocalY"},
+}
+
+// withDefaults returns o with each field which it does not set taken from
+// defaults, except for Signature.  Fields listed together in defaultGroups
+// are only taken from defaults if none of them are set.
+//
+// Fields are unset if they have the zero value, so an explicit zero value
+// cannot override a default.  For example, a request for "q0" is encoded with
+// the default quality, and boolean defaults cannot be turned off.
+// Distinguishing them would require pointer fields, which would make Options
+// harder to use and no longer comparable.
+func (o Options) withDefaults(defaults Options) Options {
+	defaults.Signature = ""
+	v := reflect.ValueOf(&o).Elem()
+	d := reflect.ValueOf(defaults)
+
+	grouped := make(map[string]bool)
+	for _, group := range defaultGroups {
+		set := false
+		for _, name := range group {
+			grouped[name] = true
+			set = set || !v.FieldByName(name).IsZero()
+		}
+		if !set {
+			for _, name := range group {
+				v.FieldByName(name).Set(d.FieldByName(name))
+			}
+		}
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Field(i); f.IsZero() && !grouped[v.Type().Field(i).Name] {
+			f.Set(d.Field(i))
+		}
 	}
-	return buf.String()
+	return o
 }
 
 // transform returns whether o includes transformation options.  Some fields
 // are not transform related at all (like Signature), and others only apply in
 // the presence of other fields (like Fit and Quality).
 func (o Options) transform() bool {
-	return o.Width != 0 || o.Height != 0 || o.Rotate != 0 || o.FlipHorizontal || o.FlipVertical
+	return o.Width != 0 || o.Height != 0 || o.Megapixels != 0 || o.Rotate != 0 || o.FlipHorizontal || o.FlipVertical || o.Format != "" ||
+		o.crop() || o.Trim || o.AutoContrast || o.Brightness != 0 || o.Contrast != 0 || o.gamma() ||
+		o.Saturation != 0 || o.hue() || o.Sepia != 0 || o.Invert || o.LUT != "" ||
+		o.Grayscale || o.RoundedCorners != 0 || o.BorderWidth != 0 ||
+		o.WatermarkPosition != "" || o.background() || o.Blur != 0 || o.Sharpen != 0 || o.Pixelate > 1 || o.Progressive || o.Subsampling != 0 || o.Dither ||
+		o.ExtractFrame
+}
+
+// encodeOnly returns whether o only specifies how the image is encoded, such
+// as its format and quality, without changing its size or pixels.
+func (o Options) encodeOnly() bool {
+	o.Format, o.Quality, o.Effort, o.Lossless, o.Optimize = "", 0, 0, false, false
+	o.PNGCompression, o.TIFFCompression, o.ICOSizes = png.DefaultCompression, 0, ICOSizes{}
+	o.Progressive, o.Subsampling = false, 0
+	return !o.transform()
+}
+
+// resizeOnly returns whether o only resizes the image, so that images which
+// are already the requested size are not changed by it.  Padded images are
+// not only resized.
+func (o Options) resizeOnly() bool {
+	if o.Pad {
+		return false
+	}
+	o.Width, o.Height, o.Megapixels, o.DPR, o.Fit, o.ScaleUp, o.Filter = 0, 0, 0, 0, false, false, ""
+	o.SmartCrop, o.FocalX, o.FocalY, o.Gravity, o.AutoSharpen = false, 0, 0, "", false
+	return !o.transform()
+}
+
+// gamma returns whether o includes a gamma correction.
+func (o Options) gamma() bool {
+	return o.Gamma != 0 && o.Gamma != 1
+}
+
+// hue returns whether o rotates the hue of the image.
+func (o Options) hue() bool {
+	return o.Hue != 0 && o.Hue != 360
+}
+
+// transparent returns whether o makes parts of the image transparent, which
+// requires an output format that supports transparency.
+func (o Options) transparent() bool {
+	if o.Background.A == 255 {
+		return false // flattened onto an opaque background
+	}
+	return o.RoundedCorners != 0 || o.pad() || (o.BorderWidth != 0 && o.BorderColor != (color.NRGBA{}) && o.BorderColor.A != 255)
+}
+
+// pad returns whether o pads the image to the exact requested size.
+func (o Options) pad() bool {
+	return o.Pad && o.Width != 0 && o.Height != 0
+}
+
+// dpr returns the device pixel ratio of o, limited to MaxDPR.  The zero
+// value is a ratio of 1.
+func (o Options) dpr() float64 {
+	if o.DPR <= 0 {
+		return 1
+	}
+	if MaxDPR > 0 && o.DPR > MaxDPR {
+		return MaxDPR
+	}
+	return o.DPR
+}
+
+// background returns whether o includes a background color to flatten the
+// image onto.  Fully transparent colors have no effect.
+func (o Options) background() bool {
+	return o.Background.A != 0
+}
+
+// validate returns an error if o contains invalid option values.
+func (o Options) validate() error {
+	if o.Format != "" && !isOutputFormat(o.Format) {
+		return fmt.Errorf("unsupported output format: %s (supported formats: %s)", o.Format, strings.Join(SupportedOutputFormats(), ", "))
+	}
+	if o.Megapixels < 0 {
+		return fmt.Errorf("invalid megapixels: %v", o.Megapixels)
+	}
+	if (o.WidthPercent && !(o.Width > 0)) || (o.HeightPercent && !(o.Height > 0)) {
+		return fmt.Errorf("invalid percentage size: %vx%v", o.Width, o.Height)
+	}
+	if o.DPR < 0 || math.IsNaN(o.DPR) || math.IsInf(o.DPR, 0) {
+		return fmt.Errorf("invalid dpr: %v", o.DPR)
+	}
+	if _, ok := resampleFilters[o.Filter]; o.Filter != "" && !ok {
+		return fmt.Errorf("invalid filter: %s", o.Filter)
+	}
+	if math.IsNaN(o.Rotate) || math.IsInf(o.Rotate, 0) {
+		return fmt.Errorf("invalid rotation: %v", o.Rotate)
+	}
+	if o.Brightness < -100 || o.Brightness > 100 {
+		return fmt.Errorf("invalid brightness: %v", o.Brightness)
+	}
+	if o.Contrast < -100 || o.Contrast > 100 {
+		return fmt.Errorf("invalid contrast: %v", o.Contrast)
+	}
+	if o.Gamma < 0 || math.IsNaN(o.Gamma) || math.IsInf(o.Gamma, 0) {
+		return fmt.Errorf("invalid gamma: %v", o.Gamma)
+	}
+	if !(o.Saturation >= -100 && o.Saturation <= 100) {
+		return fmt.Errorf("invalid saturation: %v", o.Saturation)
+	}
+	if !(o.Hue >= 0 && o.Hue <= 360) {
+		return fmt.Errorf("invalid hue: %v", o.Hue)
+	}
+	if o.blurHash() && (o.BlurHashX < 1 || o.BlurHashX > 9 || o.BlurHashY < 1 || o.BlurHashY > 9) {
+		return fmt.Errorf("invalid blurhash components: %dx%d", o.BlurHashX, o.BlurHashY)
+	}
+	if o.blurHash() && o.Color {
+		return fmt.Errorf("color and blurhash options can not be combined")
+	}
+	if !(o.Sepia >= 0 && o.Sepia <= 100) {
+		return fmt.Errorf("invalid sepia intensity: %v", o.Sepia)
+	}
+	if o.LUT != "" && LUTs[o.LUT] == nil {
+		return fmt.Errorf("unknown LUT: %s", o.LUT)
+	}
+	if o.RoundedCorners < 0 {
+		return fmt.Errorf("invalid corner radius: %v", o.RoundedCorners)
+	}
+	if _, ok := jpegSubsampling[o.Subsampling]; o.Subsampling != 0 && !ok {
+		return fmt.Errorf("invalid subsampling: %d", o.Subsampling)
+	}
+	if o.Frame < 0 {
+		return fmt.Errorf("invalid frame: %d", o.Frame)
+	}
+	if !(o.FocalX >= 0 && o.FocalX <= 1) || !(o.FocalY >= 0 && o.FocalY <= 1) {
+		return fmt.Errorf("invalid focal point: %v,%v", o.FocalX, o.FocalY)
+	}
+	if o.Gravity != "" && !isGravity(o.Gravity) {
+		return fmt.Errorf("invalid gravity: %s", o.Gravity)
+	}
+	if o.Filename != "" && !isFilename(o.Filename) {
+		return fmt.Errorf("invalid filename: %q", o.Filename)
+	}
+	if err := o.validatePipeline(); err != nil {
+		return err
+	}
+	if !(o.AutoContrastClip >= 0 && o.AutoContrastClip < 50) {
+		return fmt.Errorf("invalid auto contrast clip: %v", o.AutoContrastClip)
+	}
+	if o.TrimTolerance < 0 || o.TrimTolerance > 255 {
+		return fmt.Errorf("invalid trim tolerance: %v", o.TrimTolerance)
+	}
+	if o.BorderWidth < 0 || o.BorderWidth > maxBorderWidth {
+		return fmt.Errorf("invalid border width: %d", o.BorderWidth)
+	}
+	if o.WatermarkPosition != "" && !isWatermarkPosition(o.WatermarkPosition) {
+		return fmt.Errorf("invalid watermark position: %s", o.WatermarkPosition)
+	}
+	if o.WatermarkOpacity < 0 || o.WatermarkOpacity > 1 {
+		return fmt.Errorf("invalid watermark opacity: %v", o.WatermarkOpacity)
+	}
+	if o.WatermarkMargin < 0 {
+		return fmt.Errorf("invalid watermark margin: %d", o.WatermarkMargin)
+	}
+	if !(o.Blur >= 0 && o.Blur <= maxBlurSigma) {
+		return fmt.Errorf("invalid blur sigma: %v", o.Blur)
+	}
+	if !(o.Sharpen >= 0 && o.Sharpen <= maxSharpenSigma) {
+		return fmt.Errorf("invalid sharpen sigma: %v", o.Sharpen)
+	}
+	if o.Pixelate < 0 {
+		return fmt.Errorf("invalid pixelate block size: %d", o.Pixelate)
+	}
+	if !validPNGCompression(o.PNGCompression) {
+		return fmt.Errorf("invalid png compression level: %d", o.PNGCompression)
+	}
+	if !validTIFFCompression(o.TIFFCompression) {
+		return fmt.Errorf("invalid tiff compression: %d", o.TIFFCompression)
+	}
+	if o.DPI < 0 || o.DPI > maxDPI {
+		return fmt.Errorf("invalid dpi: %d", o.DPI)
+	}
+	for _, size := range o.ICOSizes {
+		if size < 0 || size > maxICOSize {
+			return fmt.Errorf("invalid ico size: %d", size)
+		}
+	}
+	return nil
+}
+
+// validPNGCompression returns whether level is one of the named PNG
+// compression levels.
+func validPNGCompression(level png.CompressionLevel) bool {
+	for _, l := range pngCompressionLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// validTIFFCompression returns whether c is one of the named TIFF
+// compression types.
+func validTIFFCompression(c TIFFCompression) bool {
+	for _, v := range tiffCompressions {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// parseColor parses s as a hexadecimal color in the form "rrggbb" or
+// "rrggbbaa".
+func parseColor(s string) (color.NRGBA, bool) {
+	if len(s) != 6 && len(s) != 8 {
+		return color.NRGBA{}, false
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return color.NRGBA{}, false
+	}
+	c := color.NRGBA{b[0], b[1], b[2], 255}
+	if len(b) == 4 {
+		c.A = b[3]
+	}
+	return c, true
+}
+
+// formatColor formats c in the form parsed by parseColor, omitting the alpha
+// value of opaque colors.
+func formatColor(c color.NRGBA) string {
+	if c.A == 255 {
+		return fmt.Sprintf("%02x%02x%02x", c.R, c.G, c.B)
+	}
+	return fmt.Sprintf("%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+// crop returns whether o includes a crop rectangle.
+func (o Options) crop() bool {
+	return o.CropX != 0 || o.CropY != 0 || o.CropWidth != 0 || o.CropHeight != 0
+}
+
+// blurHash returns whether o requests the BlurHash of the image.
+func (o Options) blurHash() bool {
+	return o.BlurHashX != 0 || o.BlurHashY != 0
+}
+
+// focalPoint returns whether o specifies a focal point to crop around.
+func (o Options) focalPoint() bool {
+	return o.FocalX != 0 || o.FocalY != 0
 }
 
 // ParseOptions parses str as a list of comma separated transformation options.
@@ -115,10 +1009,13 @@ func (o Options) transform() bool {
 // The size option takes the general form "{width}x{height}", where width and
 // height are numbers. Integer values greater than 1 are interpreted as exact
 // pixel values. Floats between 0 and 1 are interpreted as percentages of the
-// original image size. If either value is omitted or set to 0, it will be
-// automatically set to preserve the aspect ratio based on the other dimension.
-// If a single number is provided (with no "x" separator), it will be used for
-// both height and width.
+// original image size, rounded to the nearest pixel. A value of exactly 1 is
+// one pixel, not 100% of the original size. Values with a "p" suffix are
+// percentages of the original image size, so "50p" is half the original
+// width and "100p" is the original size. If either value is omitted or set
+// to 0, it will be automatically set to preserve the aspect ratio based on the
+// other dimension, so "0x0" keeps the original size. If a single number is
+// provided (with no "x" separator), it will be used for both height and width.
 //
 // Depending on the size options specified, an image may be cropped to fit the
 // requested size. In all cases, the original aspect ratio of the image will be
@@ -139,18 +1036,322 @@ func (o Options) transform() bool {
 // option with only one of either width or height does the same thing as if
 // "fit" had not been specified.
 //
+// If the "pad" option is specified together with a width and height value,
+// the image will be resized to fit within a containing box of the specified
+// size, as with the "fit" option, and then centered on a canvas of exactly
+// that size, padding the remaining space. The padding is transparent unless a
+// background color is specified using the "bg" option. Since JPEG images do
+// not support transparency, they are encoded as PNG instead, unless padded with
+// an opaque background color.
+//
+// The "mp:{megapixels}" option limits the size of the image to the specified
+// number of millions of pixels, such as "mp:2" for at most two million pixels.
+// If the image, after being resized to any width and height also specified,
+// would be larger, it is scaled down further, preserving its aspect ratio.
+// Without a width or height, images larger than the limit are scaled down to
+// fit it, and smaller images are unchanged.
+//
+// The "dpr:{ratio}" option multiplies the width and height by the device pixel
+// ratio of the display the image is intended for, such as "300x,dpr:2" for an
+// image 600 pixels wide. Ratios are limited to MaxDPR. Unless scaling up is
+// allowed, the ratio is reduced as necessary to avoid enlarging the image,
+// preserving the requested aspect ratio. Requests without this option use the
+// DPR client hint header sent by the browser, if any.
+//
+// The "filter:{name}" option selects the resampling filter used to resize the
+// image, one of "lanczos" (the default), "catmullrom", "linear", "box", or
+// "nearest". Nearest neighbor scaling, such as "400x,scaleUp,filter:nearest",
+// enlarges pixel art without blurring it, and box filtering is faster than the
+// default. Requests for unknown filters are rejected.
+//
+// The "sc" option can be specified together with a width and height value to
+// crop to the most detailed region of the image, rather than its center.
+// Images which are too small to analyze are center cropped as usual.
+//
+// The "fpx:{x}" and "fpy:{y}" options specify a focal point, as fractions
+// from 0 to 1 of the image width and height measured from the top left
+// corner, such as "100x100,fpx:0.3,fpy:0.6". When cropping to a width and
+// height, the crop is centered as closely as possible on the focal point
+// rather than the center of the image, overriding the "sc" option. An
+// omitted or zero value centers the crop along that axis.
+//
+// The "gravity:{position}" option positions the crop against an edge or
+// corner of the image when cropping to a width and height, such as
+// "100x100,gravity:north" to keep the top of a portrait. Positions are "north",
+// "northeast", "east", "southeast", "south", "southwest", "west", "northwest",
+// and "center", which is the default. Gravity overrides the "sc" option, and a
+// focal point overrides gravity. Requests for unknown positions are rejected.
+//
+// The "cx{x}", "cy{y}", "cw{width}", and "ch{height}" options can be used to
+// crop the original image to the specified rectangle before any resizing is
+// done. The values are interpreted the same as the size option: integer values
+// are pixels and floats between 0 and 1 are percentages of the original image
+// size. Negative x and y values are offsets from the right or bottom edge
+// rather than the left or top, so "cx-100" starts 100 pixels from the right
+// edge and "cy-0.5" starts halfway up the image. If the crop width or height
+// is omitted, the crop extends to the right or bottom edge of the image. Crop
+// rectangles extending beyond the image are clamped to the image bounds.
+//
+// The "trim" option will trim uniform borders, such as the white margins of a
+// scanned logo, from the image after it is cropped and before it is resized.
+// The border color is that of the top-left pixel. The "trim:{tolerance}"
+// option also trims pixels whose color channels differ from the border color
+// by up to the specified tolerance, from 0 to 255, which is useful for JPEG
+// images. Images which are entirely the border color are not trimmed.
+//
+// The "round:{radius}" option will give the image transparent rounded corners
+// of the specified radius, after it is resized and rotated. Values between 0
+// and 1 are interpreted as percentages of the shorter side of the image, so
+// "round:0.5" crops a square image to a circle. Since JPEG images do not
+// support transparency, they are encoded as PNG instead, unless flattened
+// onto an opaque background color using the "bg" option.
+//
 // Rotation and Flips
 //
 // The "r{degrees}" option will rotate the image the specified number of
-// degrees, counter-clockwise. Valid degrees values are 90, 180, and 270.
+// degrees, counter-clockwise. Rotations of 90, 180, and 270 degrees are
+// lossless. Images rotated by any other angle, such as "r3.5", are enlarged to
+// fit the rotated corners, which are transparent unless the
+// "rotatefill:{color}" option is used to specify a hexadecimal background
+// color in the form "rrggbb" or "rrggbbaa".
 //
 // The "fv" option will flip the image vertically. The "fh" option will flip
 // the image horizontally. Images are flipped after being rotated.
 //
+// Color
+//
+// The "autocontrast" option will stretch the levels of the image, so that its
+// darkest pixels become black and its brightest pixels white, which restores
+// the contrast of faded scans. The "autocontrast:{clip}" option ignores the
+// specified percentage, from 0 to 50, of the darkest and of the brightest
+// pixels, such as "autocontrast:0.5", so that outliers do not prevent the
+// stretch. The luminance of the image is stretched by default, and with
+// "autocontrast:rgb" or "autocontrast:rgb:{clip}" each color channel is
+// stretched separately, which also removes color casts. Images which already
+// span the full range are not changed.
+//
+// The "brightness:{percentage}" and "contrast:{percentage}" options adjust the
+// brightness and contrast of the image. Values range from -100 to 100, with 0
+// meaning no change.
+//
+// The "gamma:{gamma}" option applies gamma correction to the image. Values less
+// than 1 darken the image and values greater than 1 lighten it. Values of 0 and
+// 1 mean no change, and negative values are invalid.
+//
+// The "saturation:{percentage}" option adjusts the color saturation of the
+// image. Values range from -100, which removes all color, to 100, with 0
+// meaning no change.
+//
+// The "hue:{degrees}" option rotates the hue of each pixel by the specified
+// angle, from 0 to 360 degrees, such as "hue:180" to swap colors with their
+// complements.
+//
+// The "gray" option will convert the image to grayscale.
+//
+// The "sepia:{intensity}" option applies a sepia tone to the image, blending
+// it with the original by the specified intensity, from 0 to 100.
+//
+// The "invert" option will invert the colors of the image, producing a
+// negative, without affecting its transparency.
+//
+// The "lut:{name}" option will color grade the image with the 3D lookup table
+// of the specified name configured for the proxy, such as one loaded from a
+// .cube file exported by color grading software.
+//
+// The "bg:{color}" option will flatten transparent images onto the specified
+// hexadecimal background color, in the form "rrggbb" or "rrggbbaa". This is
+// useful when converting transparent images to JPEG, which otherwise renders
+// transparent areas as black. The image is flattened after all other
+// transformations.
+//
+// Colors are adjusted after the image is resized, in the order listed above.
+//
+// Filters
+//
+// The "blur:{sigma}" option will blur the image using a gaussian function
+// with the specified sigma, which must be from 0 to 100. Images are blurred
+// after being resized.
+//
+// The "sharpen:{sigma}" option will sharpen the image with the specified
+// sigma, which is useful to counteract the softness introduced by
+// downscaling. A sigma of zero does no sharpening, and negative values and
+// values greater than 100 are invalid. Images are sharpened after being
+// resized.
+//
+// The "autosharpen" option applies a mild sharpening only to images which
+// are downscaled to less than half of their original size, so that
+// thumbnails stay crisp without tuning the sigma for each image. It has no
+// effect on images which are not resized or are scaled up, or if a sharpen
+// sigma is specified.
+//
+// The "pixelate:{size}" option divides the image into square blocks of the
+// specified size in pixels, each filled with its average color, to produce
+// a mosaic. Images are pixelated after being resized, so the block size is
+// relative to the output image. Sizes of 0 and 1 do no pixelation.
+//
+// Border
+//
+// The "border:{width},{color}" option will draw a border of the specified
+// width in pixels around the image after it is resized, expanding the canvas
+// by the border width on each side. The color is a hexadecimal value in the
+// form "rrggbb" or "rrggbbaa" and must immediately follow the width. If it is
+// omitted, the border is black. Widths may not exceed 1000 pixels, and borders
+// which would expand the canvas beyond the maximum number of pixels are
+// rejected. The "borderinset" option will instead draw the border over the
+// edges of the image, keeping its size. Borders follow the shape of rounded
+// corners.
+//
+// Watermark
+//
+// The "wm:{position}" option will overlay the watermark image configured for
+// the proxy, if any, after the image is resized. Valid positions are
+// "northwest", "northeast", "southwest", "southeast", and "center". Watermarks
+// covering more than a quarter of the width or height of the image are scaled
+// down to fit. The "wmopacity:{opacity}" option sets the opacity of the
+// watermark, from 0 to 1, and the "wmmargin:{pixels}" option sets its
+// distance from the edges of the image.
+//
 // Quality
 //
 // The "q{qualityPercentage}" option can be used to specify the quality of the
-// output file (JPEG only)
+// output file (JPEG, WebP, and AVIF only). PNG output files with a quality
+// below 100 are reduced to a palette of at most 256 colors, with fewer colors
+// at lower qualities.
+//
+// The "e{effort}" option can be used to specify how much effort the encoder
+// should spend compressing the output file, from 1 (fastest) to 10 (slowest).
+// This is currently only used for AVIF files.
+//
+// The "lossless" option encodes WebP output losslessly, ignoring the quality,
+// which avoids artifacts in screenshots and line art. It also prevents PNG
+// output from being quantized.
+//
+// The "optimize" option also encodes static images as PNG and, if they are
+// opaque and the output format is lossy, as JPEG, and returns the smallest
+// result, even if it is not in the requested format. This avoids the codec
+// overhead of AVIF and WebP making tiny images larger. If the image is only
+// re-encoded, without changing its size or pixels, and the result is larger
+// than the original image, the original is returned.
+//
+// The "compression:{level}" option can be used to specify the compression
+// level of PNG output files. Valid levels are "default", "none", "speed"
+// (fastest), and "best" (smallest). Unknown levels are ignored.
+//
+// The "tiffcompression:{type}" option can be used to specify the compression
+// of TIFF output files. Valid types are "none", which is the default, "lzw",
+// and "deflate", all of which are lossless. Unknown types are ignored.
+//
+// The "icosize:{size}" option adds an image of the given size, up to 256
+// pixels, to ICO output files. It can be repeated to create ICO files with
+// several sizes, such as "ico,icosize:16,icosize:32,icosize:48" for favicons.
+// Each image is scaled to fit within a square of its size.
+//
+// The "dither" option reduces images with 16 bits per channel, such as some
+// PNG images, to 8 bits using dithering, which avoids visible banding in
+// smooth gradients. It also dithers PNG images which are reduced to a palette
+// by a quality below 100. The frames of GIF images are always dithered onto
+// their palettes.
+//
+// Format
+//
+// The "jpeg", "png", "webp", "tiff", "bmp", and "ico" options can be used to
+// specify the format of the output file.  By default, images are encoded in
+// the same format as the original image, except for still WebP images which
+// are encoded as PNG.  Animated GIFs remain GIFs unless WebP output is
+// requested, either with the "webp" option or through format negotiation, in
+// which case they are encoded as animated WebP images with the same frame
+// delays and loop count.  Animated WebP images remain animated, unless they
+// are encoded in another format, which keeps only their first frame.  Only the
+// first page of multi-page TIFF images is transformed.  When built with the
+// "avif" build tag, the "avif" option is also available.  When built with the
+// "heic" build tag, HEIC images can be transformed, and are encoded as JPEG by
+// default.  When built with the "svg" build tag, SVG images are rasterized at
+// the requested size, or the size of their viewBox, and are encoded as PNG by
+// default.
+//
+// The "progressive" option will encode JPEG output as a progressive JPEG,
+// which can be displayed at a low quality while it is still loading.
+//
+// The "subsampling:{ratio}" option sets the chroma subsampling of JPEG output
+// to "444", "422", or "420". Screenshots and images with text should use
+// "subsampling:444", which avoids blurring colored edges. By default, images
+// are encoded with 4:2:0 subsampling.
+//
+// The "frame:{index}" option will extract a single frame of an animated GIF,
+// starting at 0, and transform it as a static image. "frame:first" is the
+// same as "frame:0", and indexes past the last frame select the last frame.
+// Since the result is not animated, it is encoded as PNG unless a different
+// output format is specified, so "frame:first,jpeg" produces a JPEG still
+// of the first frame. Other images are not affected.
+//
+// Metadata
+//
+// The "strip" option will remove all metadata, such as EXIF, XMP, ICC
+// profiles, and comments, from JPEG and PNG images. This is done without
+// re-encoding the image if no other transformation is requested. Images which
+// are otherwise transformed never include metadata from the original image.
+// Note that the EXIF orientation of the original image is not applied, so
+// stripping it may change how some images are displayed.
+//
+// The "icc" option will embed the ICC color profile of the original image in
+// transformed JPEG and PNG images, so that wide-gamut images are displayed
+// correctly. This can be combined with the "strip" option to remove all other
+// metadata. If the profile cannot be parsed, it is dropped.
+//
+// The "exif" option will embed the EXIF metadata of the original JPEG, PNG, or
+// WebP image, such as the camera model and capture time, in transformed JPEG
+// images. Since the EXIF orientation is not applied to the transformed image,
+// its Orientation tag is reset to 1, so the image is displayed as it is
+// without this option. It can also be combined with the "strip" option.
+//
+// The "nogps" option will remove the GPS location from the EXIF metadata of
+// JPEG images, while keeping other EXIF tags. It applies to images that are
+// not otherwise transformed, and to EXIF metadata embedded by the "exif"
+// option.
+//
+// The "dpi:{dpi}" option sets the resolution of JPEG and PNG images, in dots
+// per inch, which print workflows use to size images. For example, "dpi:300"
+// is suitable for printing. It applies to images that are not otherwise
+// transformed as well.
+//
+// Placeholders
+//
+// The "color" option will respond with the dominant color of the image as
+// JSON, such as {"color":"#8a6f4e"}, rather than the image itself. This can
+// be used as the background of a placeholder shown while the image loads.
+// Other options are applied before the color is determined.
+//
+// The "blurhash:{x}x{y}" option will respond with the BlurHash of the image
+// as plain text, a compact string which clients can decode into a blurred
+// placeholder. x and y are the number of horizontal and vertical components
+// to encode, from 1 to 9. The "blurhash" option is the same as
+// "blurhash:4x3". Other options are applied before the image is encoded, and
+// the "color" and "blurhash" options can not be combined.
+//
+// Downloads
+//
+// The "download" option will ask browsers to download the image, rather
+// than display it, by responding with a Content-Disposition header. The
+// "filename:{name}" option sets the name the image is saved as, which
+// otherwise is the name of the remote image. In both cases, the extension
+// of the name is replaced by that of the format the image is encoded in, so
+// "filename:photo.png,webp" is saved as "photo.webp". Names may not include
+// slashes, commas, or control characters.
+//
+// Order of Operations
+//
+// Operations are performed in the following order: crop, trim, resize,
+// autocontrast, brightness, contrast, gamma, saturation, hue, gray, sepia,
+// invert, lut, blur, sharpen, pixelate, pad, flip, rotate, watermark, border,
+// round, and background. Resizing includes the crop of the "sc", "fp", and
+// "gravity" options, and "round" is the rounding of corners without a border,
+// which borders round themselves.
+//
+// The "pipeline:{operations}" option performs the requested operations in
+// another order, given by their names separated by "+". It must include every
+// operation requested by the other options, and pad must follow resize. For
+// example, "200x,blur:4,r45,pipeline:blur+resize+rotate" blurs the image
+// before resizing it, and rotates it last.
 //
 // Examples
 //
@@ -164,24 +1365,211 @@ func (o Options) transform() bool {
 // 	100,r90   - 100 pixels square, rotated 90 degrees
 // 	100,fv,fh - 100 pixels square, flipped horizontal and vertical
 // 	200x,q80  - 200 pixels wide, proportional height, 80% quality
+// 	200x,webp - 200 pixels wide, proportional height, encoded as WebP
+// 	100x150,sc - 100 by 150 pixels, cropping to the most detailed region
+// 	cx10,cy20,cw100,ch50,200x - crop to 100x50 region at (10,20), then 200 pixels wide
 func ParseOptions(str string) Options {
 	var options Options
 
-	for _, opt := range strings.Split(str, ",") {
+	opts := strings.Split(str, ",")
+	for i := 0; i < len(opts); i++ {
+		opt := opts[i]
 		switch {
 		case len(opt) == 0:
 			break
 		case opt == optFit:
 			options.Fit = true
+		case opt == optPad:
+			options.Pad = true
 		case opt == optFlipVertical:
 			options.FlipVertical = true
 		case opt == optFlipHorizontal:
 			options.FlipHorizontal = true
 		case opt == optScaleUp: // this option is intentionally not documented above
 			options.ScaleUp = true
+		case opt == optSmartCrop:
+			options.SmartCrop = true
+		case opt == optGrayscale:
+			options.Grayscale = true
+		case opt == optInvert:
+			options.Invert = true
+		case opt == optAutoSharpen:
+			options.AutoSharpen = true
+		case opt == optStripMetadata:
+			options.StripMetadata = true
+		case opt == optPreserveProfile:
+			options.PreserveColorProfile = true
+		case opt == optPreserveEXIF:
+			options.PreserveEXIF = true
+		case opt == optStripGPS:
+			options.StripGPS = true
+		case opt == optLossless:
+			options.Lossless = true
+		case opt == optOptimize:
+			options.Optimize = true
+		case opt == optColor:
+			options.Color = true
+		case opt == optBlurHash:
+			options.BlurHashX, options.BlurHashY = 4, 3
+		case strings.HasPrefix(opt, optBlurHashPrefix):
+			value := strings.TrimPrefix(opt, optBlurHashPrefix)
+			if parts := strings.SplitN(value, "x", 2); len(parts) == 2 {
+				options.BlurHashX, _ = strconv.Atoi(parts[0])
+				options.BlurHashY, _ = strconv.Atoi(parts[1])
+			}
+		case opt == optDownload:
+			options.Download = true
+		case strings.HasPrefix(opt, optFilenamePrefix):
+			if value := strings.TrimPrefix(opt, optFilenamePrefix); isFilename(value) {
+				options.Filename = value
+			}
+		case opt == optDither:
+			options.Dither = true
+		case opt == optProgressive:
+			options.Progressive = true
+		case isOutputFormat(opt):
+			options.Format = opt
+		case opt == optAutoContrast:
+			options.AutoContrast = true
+		case strings.HasPrefix(opt, optAutoContrPrefix):
+			value := strings.TrimPrefix(opt, optAutoContrPrefix)
+			options.AutoContrast = true
+			if value == optAutoContrastRGB || strings.HasPrefix(value, optAutoContrastRGB+":") {
+				options.AutoContrastRGB = true
+				value = strings.TrimPrefix(strings.TrimPrefix(value, optAutoContrastRGB), ":")
+			}
+			options.AutoContrastClip, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optBrightnessPrefix):
+			value := strings.TrimPrefix(opt, optBrightnessPrefix)
+			options.Brightness, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optContrastPrefix):
+			value := strings.TrimPrefix(opt, optContrastPrefix)
+			options.Contrast, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optSaturationPrefix):
+			value := strings.TrimPrefix(opt, optSaturationPrefix)
+			options.Saturation, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optLUTPrefix):
+			options.LUT = strings.TrimPrefix(opt, optLUTPrefix)
+		case strings.HasPrefix(opt, optSepiaPrefix):
+			value := strings.TrimPrefix(opt, optSepiaPrefix)
+			options.Sepia, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optHuePrefix):
+			value := strings.TrimPrefix(opt, optHuePrefix)
+			options.Hue, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optGammaPrefix):
+			value := strings.TrimPrefix(opt, optGammaPrefix)
+			options.Gamma, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optBlurPrefix):
+			value := strings.TrimPrefix(opt, optBlurPrefix)
+			options.Blur, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optCompressionPrefix):
+			value := strings.TrimPrefix(opt, optCompressionPrefix)
+			if level, ok := pngCompressionLevels[value]; ok {
+				options.PNGCompression = level
+			}
+		case strings.HasPrefix(opt, optTIFFCompPrefix):
+			value := strings.TrimPrefix(opt, optTIFFCompPrefix)
+			if c, ok := tiffCompressions[value]; ok {
+				options.TIFFCompression = c
+			}
+		case strings.HasPrefix(opt, optICOSizePrefix):
+			value := strings.TrimPrefix(opt, optICOSizePrefix)
+			if size, err := strconv.Atoi(value); err == nil {
+				options.ICOSizes = options.ICOSizes.add(size)
+			}
+		case strings.HasPrefix(opt, optRotateFillPrefix):
+			value := strings.TrimPrefix(opt, optRotateFillPrefix)
+			options.RotateFill, _ = parseColor(value)
+		case strings.HasPrefix(opt, optRoundPrefix):
+			value := strings.TrimPrefix(opt, optRoundPrefix)
+			options.RoundedCorners, _ = strconv.ParseFloat(value, 64)
+		case opt == optTrim:
+			options.Trim = true
+		case strings.HasPrefix(opt, optMegapixelsPrefix):
+			value := strings.TrimPrefix(opt, optMegapixelsPrefix)
+			options.Megapixels, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optDPRPrefix):
+			value := strings.TrimPrefix(opt, optDPRPrefix)
+			options.DPR, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optPipelinePrefix):
+			options.Pipeline = strings.TrimPrefix(opt, optPipelinePrefix)
+		case strings.HasPrefix(opt, optFilterPrefix):
+			options.Filter = strings.TrimPrefix(opt, optFilterPrefix)
+		case strings.HasPrefix(opt, optDPIPrefix):
+			value := strings.TrimPrefix(opt, optDPIPrefix)
+			if dpi, err := strconv.Atoi(value); err == nil && dpi > 0 && dpi <= maxDPI {
+				options.DPI = dpi
+			}
+		case strings.HasPrefix(opt, optFocalXPrefix):
+			value := strings.TrimPrefix(opt, optFocalXPrefix)
+			options.FocalX, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optFocalYPrefix):
+			value := strings.TrimPrefix(opt, optFocalYPrefix)
+			options.FocalY, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optGravityPrefix):
+			options.Gravity = strings.TrimPrefix(opt, optGravityPrefix)
+		case opt == optFirstFrame:
+			options.ExtractFrame = true
+		case strings.HasPrefix(opt, optFramePrefix):
+			value := strings.TrimPrefix(opt, optFramePrefix)
+			if frame, err := strconv.Atoi(value); err == nil {
+				options.ExtractFrame = true
+				options.Frame = frame
+			}
+		case strings.HasPrefix(opt, optSubsamplingPrefix):
+			value := strings.TrimPrefix(opt, optSubsamplingPrefix)
+			options.Subsampling, _ = strconv.Atoi(value)
+		case strings.HasPrefix(opt, optTrimPrefix):
+			value := strings.TrimPrefix(opt, optTrimPrefix)
+			options.Trim = true
+			options.TrimTolerance, _ = strconv.ParseFloat(value, 64)
+		case opt == optBorderInset:
+			options.BorderInset = true
+		case strings.HasPrefix(opt, optBorderPrefix):
+			value := strings.TrimPrefix(opt, optBorderPrefix)
+			options.BorderWidth, _ = strconv.Atoi(value)
+			// the border color is the next option, if present
+			if i+1 < len(opts) {
+				if c, ok := parseColor(opts[i+1]); ok {
+					options.BorderColor = c
+					i++
+				}
+			}
+		case strings.HasPrefix(opt, optWatermarkPrefix):
+			options.WatermarkPosition = strings.TrimPrefix(opt, optWatermarkPrefix)
+		case strings.HasPrefix(opt, optWMOpacityPrefix):
+			value := strings.TrimPrefix(opt, optWMOpacityPrefix)
+			options.WatermarkOpacity, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optWMMarginPrefix):
+			value := strings.TrimPrefix(opt, optWMMarginPrefix)
+			options.WatermarkMargin, _ = strconv.Atoi(value)
+		case strings.HasPrefix(opt, optBackgroundPrefix):
+			value := strings.TrimPrefix(opt, optBackgroundPrefix)
+			options.Background, _ = parseColor(value)
+		case strings.HasPrefix(opt, optSharpenPrefix):
+			value := strings.TrimPrefix(opt, optSharpenPrefix)
+			options.Sharpen, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optPixelatePrefix):
+			value := strings.TrimPrefix(opt, optPixelatePrefix)
+			options.Pixelate, _ = strconv.Atoi(value)
+		case strings.HasPrefix(opt, optCropX):
+			value := strings.TrimPrefix(opt, optCropX)
+			options.CropX, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optCropY):
+			value := strings.TrimPrefix(opt, optCropY)
+			options.CropY, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optCropWidth):
+			value := strings.TrimPrefix(opt, optCropWidth)
+			options.CropWidth, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optCropHeight):
+			value := strings.TrimPrefix(opt, optCropHeight)
+			options.CropHeight, _ = strconv.ParseFloat(value, 64)
 		case strings.HasPrefix(opt, optRotatePrefix):
 			value := strings.TrimPrefix(opt, optRotatePrefix)
-			options.Rotate, _ = strconv.Atoi(value)
+			options.Rotate, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optEffortPrefix):
+			value := strings.TrimPrefix(opt, optEffortPrefix)
+			options.Effort, _ = strconv.Atoi(value)
 		case strings.HasPrefix(opt, optQualityPrefix):
 			value := strings.TrimPrefix(opt, optQualityPrefix)
 			options.Quality, _ = strconv.Atoi(value)
@@ -190,15 +1578,15 @@ func ParseOptions(str string) Options {
 		case strings.Contains(opt, optSizeDelimiter):
 			size := strings.SplitN(opt, optSizeDelimiter, 2)
 			if w := size[0]; w != "" {
-				options.Width, _ = strconv.ParseFloat(w, 64)
+				options.Width, options.WidthPercent, _ = parseSize(w)
 			}
 			if h := size[1]; h != "" {
-				options.Height, _ = strconv.ParseFloat(h, 64)
+				options.Height, options.HeightPercent, _ = parseSize(h)
 			}
 		default:
-			if size, err := strconv.ParseFloat(opt, 64); err == nil {
-				options.Width = size
-				options.Height = size
+			if size, percent, err := parseSize(opt); err == nil {
+				options.Width, options.WidthPercent = size, percent
+				options.Height, options.HeightPercent = size, percent
 			}
 		}
 	}
@@ -206,6 +1594,18 @@ func ParseOptions(str string) Options {
 	return options
 }
 
+// parseSize parses a width or height value of the size option, which is a
+// percentage of the original image size if it has the "p" suffix.  Values
+// which are not positive are never percentages.
+func parseSize(s string) (v float64, percent bool, err error) {
+	if strings.HasSuffix(s, optPercentSuffix) {
+		v, err = strconv.ParseFloat(strings.TrimSuffix(s, optPercentSuffix), 64)
+		return v, v > 0, err
+	}
+	v, err = strconv.ParseFloat(s, 64)
+	return v, false, err
+}
+
 // Request is an imageproxy request which includes a remote URL of an image to
 // proxy, and an optional set of transformations to perform.
 type Request struct {
@@ -215,7 +1615,14 @@ type Request struct {
 }
 
 // String returns the request URL as a string, with r.Options encoded in the
-// URL fragment.
+// URL fragment.  This is the URL that the proxy fetches the transformed image
+// from, and so also its cache key.  Options which depend on headers of the
+// original request, such as a negotiated output format, must be resolved in
+// r.Options, so that responses for clients sending different headers are
+// cached separately.  The negotiated format is encoded as its short format
+// option, such as "webp", so the cache holds at most one variant of each
+// transformed image per negotiated format, which requests specifying that
+// format explicitly share, plus one in the original format.
 func (r Request) String() string {
 	u := *r.URL
 	u.Fragment = r.Options.String()
@@ -241,8 +1648,10 @@ func NewRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
 
 	path := r.URL.Path[1:] // strip leading slash
 	req.URL, err = parseURL(path)
-	if err != nil || !req.URL.IsAbs() {
-		// first segment should be options
+	if err != nil || !req.URL.IsAbs() || req.URL.Opaque != "" {
+		// first segment should be options.  Options with values, such as
+		// "gravity:north", parse as URLs with an opaque part, which
+		// remote URLs never have.
 		parts := strings.SplitN(path, "/", 2)
 		if len(parts) != 2 {
 			return nil, URLError{"too few path segments", r.URL}
@@ -255,6 +1664,9 @@ func NewRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
 		}
 
 		req.Options = ParseOptions(parts[0])
+		if err := req.Options.validate(); err != nil {
+			return nil, URLError{err.Error(), r.URL}
+		}
 	}
 
 	if baseURL != nil {
@@ -282,3 +1694,14 @@ func parseURL(s string) (*url.URL, error) {
 	s = reCleanedURL.ReplaceAllString(s, "$1://$2")
 	return url.Parse(s)
 }
+
+// isOutputFormat returns whether format is a valid output format.
+func isOutputFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	_, ok := encoders[format]
+	return ok
+}
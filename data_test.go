@@ -15,7 +15,11 @@
 package imageproxy
 
 import (
+	"image/color"
+	"image/png"
+	"math/rand"
 	"net/http"
+	"reflect"
 	"testing"
 )
 
@@ -31,12 +35,156 @@ func TestOptions_String(t *testing.T) {
 			"0x0",
 		},
 		{
-			Options{1, 2, true, 90, true, true, 80, "", false},
-			"1x2,fit,r90,fv,fh,q80",
+			Options{Width: 1, Height: 2, Fit: true, Rotate: 90, FlipVertical: true, FlipHorizontal: true, Grayscale: true, Blur: 0.5, Sharpen: 1, Quality: 80},
+			"1x2,blur:0.5,fh,fit,fv,gray,q80,r90,sharpen:1",
 		},
 		{
-			Options{0.15, 1.3, false, 45, false, false, 95, "c0ffee", false},
-			"0.15x1.3,r45,q95,sc0ffee",
+			Options{Width: 0.15, Height: 1.3, Rotate: 45, Quality: 95, StripMetadata: true, PreserveColorProfile: true, Signature: "c0ffee"},
+			"0.15x1.3,icc,q95,r45,sc0ffee,strip",
+		},
+		{
+			Options{Width: 100, Quality: 80, Effort: 4, Format: "webp"},
+			"100x0,e4,q80,webp",
+		},
+		{
+			Options{Width: 800, Fit: true, Megapixels: 2},
+			"800x0,fit,mp:2",
+		},
+		{
+			Options{Width: 300, PreserveEXIF: true, StripMetadata: true},
+			"300x0,exif,strip",
+		},
+		{
+			Options{Width: 300, DPR: 2},
+			"300x0,dpr:2",
+		},
+		{
+			Options{Width: 400, Filter: "nearest", ScaleUp: true},
+			"400x0,filter:nearest,scaleUp",
+		},
+		{
+			Options{Width: 100, Height: 50, Pad: true, Background: color.NRGBA{255, 255, 255, 255}},
+			"100x50,bg:ffffff,pad",
+		},
+		{
+			Options{Quality: 60, Format: "jpeg", Progressive: true},
+			"0x0,jpeg,progressive,q60",
+		},
+		{
+			Options{Format: "png", PNGCompression: png.BestSpeed},
+			"0x0,compression:speed,png",
+		},
+		{
+			Options{Format: "tiff", TIFFCompression: TIFFDeflate},
+			"0x0,tiff,tiffcompression:deflate",
+		},
+		{
+			Options{Format: "jpeg", DPI: 300},
+			"0x0,dpi:300,jpeg",
+		},
+		{
+			Options{Format: "webp", Lossless: true},
+			"0x0,lossless,webp",
+		},
+		{
+			Options{Format: "avif", Optimize: true},
+			"0x0,avif,optimize",
+		},
+		{
+			Options{Format: "ico", ICOSizes: ICOSizes{48, 16, 32}},
+			"0x0,ico,icosize:16,icosize:32,icosize:48",
+		},
+		{
+			Options{Format: "jpeg", Progressive: true, Subsampling: 444},
+			"0x0,jpeg,progressive,subsampling:444",
+		},
+		{
+			Options{Width: 100, ExtractFrame: true, Format: "jpeg"},
+			"100x0,frame:first,jpeg",
+		},
+		{
+			Options{ExtractFrame: true, Frame: 3},
+			"0x0,frame:3",
+		},
+		{
+			Options{Width: 100, Dither: true, Format: "png"},
+			"100x0,dither,png",
+		},
+		{
+			Options{Rotate: 3.5, RotateFill: color.NRGBA{255, 255, 255, 255}},
+			"0x0,r3.5,rotatefill:ffffff",
+		},
+		{
+			Options{Rotate: -10, RotateFill: color.NRGBA{0, 0, 0, 128}},
+			"0x0,r-10,rotatefill:00000080",
+		},
+		{
+			Options{Grayscale: true, Background: color.NRGBA{255, 255, 255, 255}, Format: "jpeg"},
+			"0x0,bg:ffffff,gray,jpeg",
+		},
+		{
+			Options{Width: 100, RoundedCorners: 0.5, Background: color.NRGBA{255, 255, 255, 255}},
+			"100x0,bg:ffffff,round:0.5",
+		},
+		{
+			Options{WatermarkPosition: "southeast", WatermarkOpacity: 0.5, WatermarkMargin: 10},
+			"0x0,wm:southeast,wmmargin:10,wmopacity:0.5",
+		},
+		{
+			Options{Width: 100, BorderWidth: 5, BorderColor: color.NRGBA{0, 0, 0, 255}},
+			"100x0,border:5,000000",
+		},
+		{
+			Options{BorderWidth: 2, BorderInset: true},
+			"0x0,border:2,borderinset",
+		},
+		{
+			Options{Width: 100, Trim: true},
+			"100x0,trim",
+		},
+		{
+			Options{Trim: true, TrimTolerance: 10},
+			"0x0,trim:10",
+		},
+		{
+			Options{AutoContrast: true, AutoContrastClip: 1.5, AutoContrastRGB: true},
+			"0x0,autocontrast:rgb:1.5",
+		},
+		{
+			Options{Brightness: 10, Contrast: -5.5, Gamma: 1.2},
+			"0x0,brightness:10,contrast:-5.5,gamma:1.2",
+		},
+		{
+			Options{Width: 100, Pixelate: 10},
+			"100x0,pixelate:10",
+		},
+		{
+			Options{Width: 100, AutoSharpen: true},
+			"100x0,autosharpen",
+		},
+		{
+			Options{Saturation: -50, Hue: 180, Sepia: 80, Invert: true, LUT: "brand"},
+			"0x0,hue:180,invert,lut:brand,saturation:-50,sepia:80",
+		},
+		{
+			Options{SmartCrop: true, CropX: 10, CropY: 0.5, CropWidth: 100, CropHeight: 0.25},
+			"0x0,ch0.25,cw100,cx10,cy0.5,sc",
+		},
+		{
+			Options{Width: 100, Height: 100, FocalX: 0.3, FocalY: 0.6},
+			"100x100,fpx:0.3,fpy:0.6",
+		},
+		{
+			Options{Width: 100, Height: 100, Gravity: "north"},
+			"100x100,gravity:north",
+		},
+		{
+			Options{Width: 50, WidthPercent: true, Height: 100},
+			"50px100",
+		},
+		{
+			Options{Format: "webp", Download: true, Filename: "cat photo.webp"},
+			"0x0,download,filename:cat photo.webp,webp",
 		},
 	}
 
@@ -47,6 +195,245 @@ func TestOptions_String(t *testing.T) {
 	}
 }
 
+// allOptions sets every field of Options, so that round trip tests cover
+// all of them.  New fields must be added here.
+var allOptions = Options{
+	Width:                0.5,
+	Height:               200,
+	WidthPercent:         true,
+	HeightPercent:        true,
+	Fit:                  true,
+	Pad:                  true,
+	Megapixels:           1.5,
+	DPR:                  2,
+	Filter:               "catmullrom",
+	Rotate:               -12.5,
+	RotateFill:           color.NRGBA{1, 2, 3, 4},
+	FlipVertical:         true,
+	FlipHorizontal:       true,
+	Brightness:           10,
+	Contrast:             -20,
+	Gamma:                2.2,
+	Saturation:           20,
+	Hue:                  90,
+	Sepia:                50,
+	Invert:               true,
+	LUT:                  "brand",
+	Grayscale:            true,
+	RoundedCorners:       0.25,
+	BorderWidth:          4,
+	BorderColor:          color.NRGBA{255, 0, 0, 255},
+	BorderInset:          true,
+	WatermarkPosition:    "southeast",
+	WatermarkOpacity:     0.5,
+	WatermarkMargin:      8,
+	Background:           color.NRGBA{255, 255, 255, 128},
+	Blur:                 1.5,
+	Sharpen:              0.5,
+	AutoSharpen:          true,
+	Pixelate:             8,
+	Quality:              80,
+	Format:               "webp",
+	Effort:               4,
+	Lossless:             true,
+	Optimize:             true,
+	PNGCompression:       png.BestCompression,
+	TIFFCompression:      TIFFLZW,
+	ICOSizes:             ICOSizes{16, 32},
+	Dither:               true,
+	Progressive:          true,
+	Subsampling:          444,
+	StripMetadata:        true,
+	PreserveColorProfile: true,
+	PreserveEXIF:         true,
+	StripGPS:             true,
+	DPI:                  300,
+	Color:                true,
+	BlurHashX:            4,
+	BlurHashY:            3,
+	Download:             true,
+	Filename:             "photo.jpg",
+	Signature:            "c0ffee",
+	ExtractFrame:         true,
+	Frame:                3,
+	Trim:                 true,
+	TrimTolerance:        12,
+	AutoContrast:         true,
+	AutoContrastClip:     0.5,
+	AutoContrastRGB:      true,
+	CropX:                10,
+	CropY:                0.1,
+	CropWidth:            100,
+	CropHeight:           0.5,
+	SmartCrop:            true,
+	FocalX:               0.3,
+	FocalY:               0.6,
+	Gravity:              "southeast",
+	ScaleUp:              true,
+	Pipeline:             "resize+crop",
+}
+
+// randomOptions returns Options with fields randomly set to zero or another
+// value which can be represented as a string.
+func randomOptions(r *rand.Rand) Options {
+	float := func() float64 {
+		switch r.Intn(4) {
+		case 0:
+			return 0
+		case 1:
+			return float64(r.Intn(2000))
+		case 2:
+			return r.Float64()
+		}
+		return r.NormFloat64() * 100
+	}
+	nrgba := func() color.NRGBA {
+		if r.Intn(2) == 0 {
+			return color.NRGBA{}
+		}
+		return color.NRGBA{uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256))}
+	}
+	pick := func(values ...string) string { return values[r.Intn(len(values))] }
+	flag := func() bool { return r.Intn(2) == 0 }
+
+	o := Options{
+		Width:                float(),
+		Height:               float(),
+		Fit:                  flag(),
+		Pad:                  flag(),
+		Megapixels:           float(),
+		DPR:                  float(),
+		Filter:               pick("", "lanczos", "box", "nearest"),
+		Rotate:               float(),
+		RotateFill:           nrgba(),
+		FlipVertical:         flag(),
+		FlipHorizontal:       flag(),
+		Brightness:           float(),
+		Contrast:             float(),
+		Gamma:                float(),
+		Saturation:           float(),
+		Hue:                  float(),
+		Sepia:                float(),
+		Invert:               flag(),
+		LUT:                  pick("", "brand", "film"),
+		Grayscale:            flag(),
+		RoundedCorners:       float(),
+		BorderInset:          flag(),
+		WatermarkPosition:    pick("", "center", "northwest"),
+		WatermarkOpacity:     float(),
+		WatermarkMargin:      r.Intn(100),
+		Background:           nrgba(),
+		Blur:                 float(),
+		Sharpen:              float(),
+		AutoSharpen:          flag(),
+		Pixelate:             r.Intn(20),
+		Quality:              r.Intn(101),
+		Format:               pick("", "jpeg", "png", "webp"),
+		Effort:               r.Intn(10),
+		Lossless:             flag(),
+		Optimize:             flag(),
+		PNGCompression:       []png.CompressionLevel{png.DefaultCompression, png.NoCompression, png.BestSpeed, png.BestCompression}[r.Intn(4)],
+		TIFFCompression:      []TIFFCompression{TIFFUncompressed, TIFFLZW, TIFFDeflate}[r.Intn(3)],
+		ICOSizes:             ICOSizes{}.add(r.Intn(3) * 16).add(r.Intn(3) * 96),
+		Dither:               flag(),
+		Progressive:          flag(),
+		Subsampling:          []int{0, 420, 422, 444}[r.Intn(4)],
+		StripMetadata:        flag(),
+		PreserveColorProfile: flag(),
+		PreserveEXIF:         flag(),
+		StripGPS:             flag(),
+		DPI:                  []int{0, 72, 300}[r.Intn(3)],
+		Color:                flag(),
+		Download:             flag(),
+		Filename:             pick("", "photo.jpg", "cat photo", "x:y"),
+		Signature:            pick("", "c0ffee", "abc-_="),
+		CropX:                float(),
+		CropY:                float(),
+		CropWidth:            float(),
+		CropHeight:           float(),
+		SmartCrop:            flag(),
+		FocalX:               float(),
+		FocalY:               float(),
+		Gravity:              pick("", "north", "southeast", "center"),
+		ScaleUp:              flag(),
+		Pipeline:             pick("", "blur+resize", "crop+trim+resize+pad"),
+	}
+	// fields which are only represented together with another field
+	o.WidthPercent = o.Width > 0 && flag()
+	o.HeightPercent = o.Height > 0 && flag()
+	if o.BorderWidth = r.Intn(3); o.BorderWidth != 0 {
+		o.BorderColor = nrgba()
+	}
+	if o.ExtractFrame = flag(); o.ExtractFrame {
+		o.Frame = r.Intn(10)
+	}
+	if o.Trim = flag(); o.Trim {
+		o.TrimTolerance = float64(r.Intn(256))
+	}
+	if o.AutoContrast = flag(); o.AutoContrast {
+		o.AutoContrastClip = float64(r.Intn(50))
+		o.AutoContrastRGB = flag()
+	}
+	if flag() {
+		o.BlurHashX, o.BlurHashY = 1+r.Intn(9), 1+r.Intn(9)
+	}
+	return o
+}
+
+func TestOptions_RoundTrip(t *testing.T) {
+	v := reflect.ValueOf(allOptions)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Errorf("allOptions does not set field %s", v.Type().Field(i).Name)
+		}
+	}
+
+	tests := []Options{emptyOptions, allOptions}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		tests = append(tests, randomOptions(r))
+	}
+	for _, o := range tests {
+		s := o.String()
+		if got := ParseOptions(s); got != o {
+			t.Errorf("ParseOptions(%q) returned %#v, want %#v", s, got, o)
+		}
+		if got := ParseOptions(s).String(); got != s {
+			t.Errorf("ParseOptions(%q).String() returned %q", s, got)
+		}
+	}
+}
+
+func TestOptions_withDefaults(t *testing.T) {
+	defaults := Options{Width: 800, Quality: 80, StripMetadata: true, Signature: "c0ffee", CropX: 10, CropY: 10}
+
+	tests := []struct {
+		opt  Options
+		want Options
+	}{
+		{emptyOptions, Options{Width: 800, Quality: 80, StripMetadata: true, CropX: 10, CropY: 10}},
+		// explicit values win
+		{Options{Quality: 50, Format: "png"}, Options{Width: 800, Quality: 50, Format: "png", StripMetadata: true, CropX: 10, CropY: 10}},
+		// grouped fields are not mixed with defaults
+		{Options{Height: 200}, Options{Height: 200, Quality: 80, StripMetadata: true, CropX: 10, CropY: 10}},
+		{Options{CropWidth: 50}, Options{Width: 800, Quality: 80, StripMetadata: true, CropWidth: 50}},
+		// the signature of the request is kept
+		{Options{Signature: "abc"}, Options{Width: 800, Quality: 80, StripMetadata: true, Signature: "abc", CropX: 10, CropY: 10}},
+	}
+	for _, tt := range tests {
+		if got := tt.opt.withDefaults(defaults); got != tt.want {
+			t.Errorf("%v.withDefaults(%v) returned %v, want %v", tt.opt, defaults, got, tt.want)
+		}
+	}
+
+	if got := allOptions.withDefaults(defaults); got != allOptions {
+		t.Errorf("withDefaults changed options which set every field: %v", got)
+	}
+	if got := defaults.withDefaults(emptyOptions); got != defaults {
+		t.Errorf("withDefaults with no defaults returned %v, want %v", got, defaults)
+	}
+}
+
 func TestParseOptions(t *testing.T) {
 	tests := []struct {
 		Input   string
@@ -66,12 +453,122 @@ func TestParseOptions(t *testing.T) {
 		{"0.1x0.2", Options{Width: 0.1, Height: 0.2}},
 		{"1", Options{Width: 1, Height: 1}},
 		{"0.1", Options{Width: 0.1, Height: 0.1}},
+		{"50px", Options{Width: 50, WidthPercent: true}},
+		{"x100p", Options{Height: 100, HeightPercent: true}},
+		{"0.5px200", Options{Width: 0.5, WidthPercent: true, Height: 200}},
+		{"100p", Options{Width: 100, WidthPercent: true, Height: 100, HeightPercent: true}},
+		{"0px-5p", Options{Height: -5}},
+		{"p", emptyOptions},
 
 		// additional flags
 		{"fit", Options{Fit: true}},
+		{"mp:2", Options{Megapixels: 2}},
+		{"pad", Options{Pad: true}},
+		{"mp:0.5,800x", Options{Width: 800, Megapixels: 0.5}},
+		{"300x,dpr:2", Options{Width: 300, DPR: 2}},
+		{"dpr:1.5", Options{DPR: 1.5}},
+		{"filter:nearest", Options{Filter: "nearest"}},
+		{"filter:linear,100x", Options{Width: 100, Filter: "linear"}},
+		{"filter:bicubic", Options{Filter: "bicubic"}},
 		{"r90", Options{Rotate: 90}},
 		{"fv", Options{FlipVertical: true}},
 		{"fh", Options{FlipHorizontal: true}},
+		{"jpeg", Options{Format: "jpeg"}},
+		{"png", Options{Format: "png"}},
+		{"webp", Options{Format: "webp"}},
+		{"bmp", Options{Format: "bmp"}},
+		{"pdf", emptyOptions},
+		{"e4", Options{Effort: 4}},
+		{"sc", Options{SmartCrop: true}},
+		{"fpx:0.3,fpy:0.6", Options{FocalX: 0.3, FocalY: 0.6}},
+		{"fpy:1", Options{FocalY: 1}},
+		{"gravity:northwest", Options{Gravity: "northwest"}},
+		{"gravity:top", Options{Gravity: "top"}},
+		{"progressive", Options{Progressive: true}},
+		{"jpeg,progressive", Options{Format: "jpeg", Progressive: true}},
+		{"compression:best", Options{PNGCompression: png.BestCompression}},
+		{"compression:none", Options{PNGCompression: png.NoCompression}},
+		{"compression:default", emptyOptions},
+		{"compression:9", emptyOptions},
+		{"tiff,tiffcompression:lzw", Options{Format: "tiff", TIFFCompression: TIFFLZW}},
+		{"tiffcompression:none", emptyOptions},
+		{"tiffcompression:ccitt", emptyOptions},
+		{"compression:lzw", emptyOptions},
+		{"ico,icosize:48,icosize:16", Options{Format: "ico", ICOSizes: ICOSizes{16, 48}}},
+		{"icosize:16,icosize:16", Options{ICOSizes: ICOSizes{16}}},
+		{"icosize:0,icosize:257,icosize:big", emptyOptions},
+		{"icosize:1,icosize:2,icosize:3,icosize:4,icosize:5,icosize:6,icosize:7,icosize:8,icosize:9",
+			Options{ICOSizes: ICOSizes{1, 2, 3, 4, 5, 6, 7, 8}}},
+		{"dither,png", Options{Dither: true, Format: "png"}},
+		{"subsampling:444", Options{Subsampling: 444}},
+		{"jpeg,subsampling:422", Options{Format: "jpeg", Subsampling: 422}},
+		{"subsampling:full", emptyOptions},
+		{"frame:first", Options{ExtractFrame: true}},
+		{"frame:2,100x", Options{Width: 100, ExtractFrame: true, Frame: 2}},
+		{"frame:last", emptyOptions},
+		{"r3.5", Options{Rotate: 3.5}},
+		{"r-90", Options{Rotate: -90}},
+		{"r3.5,rotatefill:ff8000", Options{Rotate: 3.5, RotateFill: color.NRGBA{255, 128, 0, 255}}},
+		{"rotatefill:ff800080", Options{RotateFill: color.NRGBA{255, 128, 0, 128}}},
+		{"rotatefill:fff", emptyOptions},
+		{"rotatefill:gggggg", emptyOptions},
+		{"bg:ffffff", Options{Background: color.NRGBA{255, 255, 255, 255}}},
+		{"bg:ffffff,blur:1", Options{Background: color.NRGBA{255, 255, 255, 255}, Blur: 1}},
+		{"bg:white", emptyOptions},
+		{"round:10", Options{RoundedCorners: 10}},
+		{"wm:center", Options{WatermarkPosition: "center"}},
+		{"trim", Options{Trim: true}},
+		{"autocontrast", Options{AutoContrast: true}},
+		{"autocontrast:0.5", Options{AutoContrast: true, AutoContrastClip: 0.5}},
+		{"autocontrast:rgb", Options{AutoContrast: true, AutoContrastRGB: true}},
+		{"autocontrast:rgb:2", Options{AutoContrast: true, AutoContrastClip: 2, AutoContrastRGB: true}},
+		{"trim:12.5,100x", Options{Width: 100, Trim: true, TrimTolerance: 12.5}},
+		{"border:5,000000", Options{BorderWidth: 5, BorderColor: color.NRGBA{0, 0, 0, 255}}},
+		{"border:5,ffffff80,100", Options{Width: 100, Height: 100, BorderWidth: 5, BorderColor: color.NRGBA{255, 255, 255, 128}}},
+		{"100,border:3", Options{Width: 100, Height: 100, BorderWidth: 3}},
+		{"border:3,fit,borderinset", Options{Fit: true, BorderWidth: 3, BorderInset: true}},
+		{"wm:northwest,wmopacity:0.3,wmmargin:5", Options{WatermarkPosition: "northwest", WatermarkOpacity: 0.3, WatermarkMargin: 5}},
+		{"100,round:0.5", Options{Width: 100, Height: 100, RoundedCorners: 0.5}},
+		{"gray", Options{Grayscale: true}},
+		{"strip", Options{StripMetadata: true}},
+		{"icc,strip", Options{StripMetadata: true, PreserveColorProfile: true}},
+		{"exif", Options{PreserveEXIF: true}},
+		{"exif,nogps", Options{PreserveEXIF: true, StripGPS: true}},
+		{"dpi:300", Options{DPI: 300}},
+		{"lossless,webp", Options{Lossless: true, Format: "webp"}},
+		{"optimize", Options{Optimize: true}},
+		{"dpi:0", emptyOptions},
+		{"dpi:-72", emptyOptions},
+		{"dpi:100000", emptyOptions},
+		{"dpi:high", emptyOptions},
+		{"200x,color", Options{Width: 200, Color: true}},
+		{"blurhash", Options{BlurHashX: 4, BlurHashY: 3}},
+		{"blurhash:9x1", Options{BlurHashX: 9, BlurHashY: 1}},
+		{"blurhash:3", emptyOptions},
+		{"download", Options{Download: true}},
+		{"filename:photo.jpg,download", Options{Download: true, Filename: "photo.jpg"}},
+		{"filename:..", emptyOptions},
+		{"filename:", emptyOptions},
+		{"filename:a\\b.jpg", emptyOptions},
+		{"brightness:10,contrast:-20.5", Options{Brightness: 10, Contrast: -20.5}},
+		{"gamma:1.2", Options{Gamma: 1.2}},
+		{"saturation:-50,hue:120", Options{Saturation: -50, Hue: 120}},
+		{"sepia:100", Options{Sepia: 100}},
+		{"invert,gray", Options{Invert: true, Grayscale: true}},
+		{"lut:brand", Options{LUT: "brand"}},
+		{"blur:1.5", Options{Blur: 1.5}},
+		{"blur:-1", Options{Blur: -1}},
+		{"sharpen:0.8", Options{Sharpen: 0.8}},
+		{"pixelate:8", Options{Pixelate: 8}},
+		{"100x,autosharpen", Options{Width: 100, AutoSharpen: true}},
+		{"sharpen:0.8,sc0ffee", Options{Sharpen: 0.8, Signature: "c0ffee"}},
+		{"100x200,sc,sc0ffee", Options{Width: 100, Height: 200, SmartCrop: true, Signature: "c0ffee"}},
+		{"cx10,cy20,cw30,ch40", Options{CropX: 10, CropY: 20, CropWidth: 30, CropHeight: 40}},
+		{"cx0.1,cy0.2,cw0.3,ch0.4", Options{CropX: 0.1, CropY: 0.2, CropWidth: 0.3, CropHeight: 0.4}},
+		{"cx-100,cy-0.5,cw50", Options{CropX: -100, CropY: -0.5, CropWidth: 50}},
+		{"pipeline:blur+resize", Options{Pipeline: "blur+resize"}},
+		{"pipeline:blur+zoom", Options{Pipeline: "blur+zoom"}},
+		{"pipeline:", emptyOptions},
 
 		// duplicate flags (last one wins)
 		{"1x2,3x4", Options{Width: 3, Height: 4}},
@@ -79,13 +576,14 @@ func TestParseOptions(t *testing.T) {
 		{"1x2,0x3", Options{Width: 0, Height: 3}},
 		{"1x,x2", Options{Width: 1, Height: 2}},
 		{"r90,r270", Options{Rotate: 270}},
+		{"png,webp", Options{Format: "webp"}},
 
 		// mix of valid and invalid flags
 		{"FOO,1,BAR,r90,BAZ", Options{Width: 1, Height: 1, Rotate: 90}},
 
 		// all flags, in different orders
-		{"q70,1x2,fit,r90,fv,fh,sc0ffee", Options{1, 2, true, 90, true, true, 70, "c0ffee", false}},
-		{"r90,fh,sc0ffee,q90,1x2,fv,fit", Options{1, 2, true, 90, true, true, 90, "c0ffee", false}},
+		{"q70,1x2,fit,r90,fv,fh,sc0ffee,webp", Options{Width: 1, Height: 2, Fit: true, Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 70, Format: "webp", Signature: "c0ffee"}},
+		{"webp,r90,fh,sc0ffee,q90,1x2,fv,fit", Options{Width: 1, Height: 2, Fit: true, Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 90, Format: "webp", Signature: "c0ffee"}},
 	}
 
 	for _, tt := range tests {
@@ -122,6 +620,48 @@ func TestNewRequest(t *testing.T) {
 			"http://example.com/", Options{Width: 1}, false,
 		},
 
+		// invalid option values
+		{"http://localhost/blur:-1/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/blur:101/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/blur:NaN/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/blur:Inf/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/sharpen:-0.5/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/sharpen:101/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/sharpen:NaN/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/sharpen:Inf/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/brightness:101/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/contrast:-101/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/gamma:-1/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/gamma:NaN/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/gamma:Inf/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/saturation:101/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/hue:-90/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/hue:NaN/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/sepia:150/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/pixelate:-2/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/blurhash:0x3/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/blurhash:4x10/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/blurhash,color/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/rNaN/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/round:-1/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/mp:-2/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/dpr:-1/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/dpr:NaN/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/wm:left/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/border:-1/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/trim:300/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/frame:-1/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/fpx:1.5/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/fpy:-0.1/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/subsampling:411/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/wm:center,wmopacity:2/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/wm:center,wmmargin:-1/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/rInf/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/100,blur:2,pipeline:blur/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/filter:bicubic/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/100x100,gravity:top/http://example.com/", "", emptyOptions, true},
+		{"http://localhost/blur:2,pipeline:blur+zoom/http://example.com/", "", emptyOptions, true},
+
 		// valid URLs
 		{
 			"http://localhost/http://example.com/foo",
@@ -151,6 +691,18 @@ func TestNewRequest(t *testing.T) {
 			"http://localhost/http:///example.com/foo",
 			"http://example.com/foo", emptyOptions, false,
 		},
+		{
+			"http://localhost/gravity:north,100/http://example.com/foo",
+			"http://example.com/foo", Options{Width: 100, Height: 100, Gravity: "north"}, false,
+		},
+		{
+			"http://localhost/filename:cat.jpg/http://example.com/foo",
+			"http://example.com/foo", Options{Filename: "cat.jpg"}, false,
+		},
+		{
+			"http://localhost/100,blur:2,pipeline:blur+resize/http://example.com/foo",
+			"http://example.com/foo", Options{Width: 100, Height: 100, Blur: 2, Pipeline: "blur+resize"}, false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,88 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// is16Bit returns whether m has 16 bits per color channel.
+func is16Bit(m image.Image) bool {
+	switch m.ColorModel() {
+	case color.NRGBA64Model, color.RGBA64Model, color.Gray16Model:
+		return true
+	}
+	return false
+}
+
+// dither16 reduces m from 16 to 8 bits per channel, diffusing the rounding
+// error of each pixel to its neighbors using the Floyd-Steinberg algorithm.
+// Grayscale images are returned as *image.Gray, and all others as
+// *image.NRGBA.  Images which do not have 16 bits per channel are returned
+// unchanged.
+func dither16(m image.Image) image.Image {
+	if !is16Bit(m) {
+		return m
+	}
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	gray := m.ColorModel() == color.Gray16Model
+	n := 4
+	if gray {
+		n = 1
+	}
+	pix := make([]uint8, w*h*n)
+
+	// rounding errors of the current and next rows, with an extra pixel
+	// on each side so that errors can be diffused past the edges
+	cur := make([]float64, (w+2)*n)
+	next := make([]float64, (w+2)*n)
+	var v [4]float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := m.At(b.Min.X+x, b.Min.Y+y)
+			if gray {
+				v[0] = float64(color.Gray16Model.Convert(c).(color.Gray16).Y)
+			} else {
+				c := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+				v = [4]float64{float64(c.R), float64(c.G), float64(c.B), float64(c.A)}
+			}
+			for k := 0; k < n; k++ {
+				i := (x+1)*n + k
+				want := v[k]/257 + cur[i]
+				got := math.Max(0, math.Min(255, math.Floor(want+0.5)))
+				pix[(y*w+x)*n+k] = uint8(got)
+
+				e := want - got
+				cur[i+n] += e * 7 / 16
+				next[i-n] += e * 3 / 16
+				next[i] += e * 5 / 16
+				next[i+n] += e * 1 / 16
+			}
+		}
+		cur, next = next, cur
+		for i := range next {
+			next[i] = 0
+		}
+	}
+
+	if gray {
+		return &image.Gray{Pix: pix, Stride: w, Rect: image.Rect(0, 0, w, h)}
+	}
+	return &image.NRGBA{Pix: pix, Stride: w * 4, Rect: image.Rect(0, 0, w, h)}
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// newGradient returns a 16-bit grayscale image of size w by h, with a
+// horizontal gradient from 8-bit gray level from to level to.
+func newGradient(w, h int, from, to float64) *image.Gray16 {
+	m := image.NewGray16(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		v := (from + (to-from)*float64(x)/float64(w-1)) * 257
+		for y := 0; y < h; y++ {
+			m.SetGray16(x, y, color.Gray16{uint16(v)})
+		}
+	}
+	return m
+}
+
+// longestRun returns the length of the longest run of identical pixels in
+// row y of m.
+func longestRun(m image.Image, y int) int {
+	b := m.Bounds()
+	longest, run := 0, 0
+	var prev color.Color
+	for x := b.Min.X; x < b.Max.X; x++ {
+		c := m.At(x, y)
+		if c == prev {
+			run++
+		} else {
+			run = 1
+		}
+		prev = c
+		if run > longest {
+			longest = run
+		}
+	}
+	return longest
+}
+
+func TestDither16(t *testing.T) {
+	// a gradient across only four 8-bit levels
+	src := newGradient(256, 8, 100, 104)
+
+	m := dither16(src)
+	gray, ok := m.(*image.Gray)
+	if !ok {
+		t.Fatalf("dither16 of Gray16 image returned %T, want *image.Gray", m)
+	}
+	if got := longestRun(gray, 4); got >= 32 {
+		t.Errorf("dither16 returned band of %d identical pixels, want less than 32", got)
+	}
+
+	// the average of each column should follow the original gradient
+	for x := 0; x < 256; x += 32 {
+		var sum float64
+		for y := 0; y < 8; y++ {
+			sum += float64(gray.GrayAt(x, y).Y)
+		}
+		want := float64(src.Gray16At(x, 0).Y) / 257
+		if got := sum / 8; math.Abs(got-want) > 0.75 {
+			t.Errorf("dither16 returned average %v at column %d, want %v", got, x, want)
+		}
+	}
+
+	// truncating the same gradient produces wide bands
+	if got := longestRun(imaging.Clone(src), 4); got < 48 {
+		t.Errorf("truncated gradient has longest band of %d pixels, want at least 48", got)
+	}
+
+	rgba := image.NewNRGBA64(image.Rect(0, 0, 2, 2))
+	rgba.SetNRGBA64(1, 1, color.NRGBA64{0xffff, 0x8080, 0, 0xffff})
+	if m, ok := dither16(rgba).(*image.NRGBA); !ok {
+		t.Errorf("dither16 of NRGBA64 image returned %T, want *image.NRGBA", m)
+	} else if got, want := m.NRGBAAt(1, 1), (color.NRGBA{255, 128, 0, 255}); got != want {
+		t.Errorf("dither16 returned pixel %v, want %v", got, want)
+	}
+
+	// 8-bit images are unchanged
+	if src := newImage(2, 2, red); dither16(src) != src {
+		t.Errorf("dither16 of 8-bit image returned a different image")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"errors"
+	"image"
+	"net/http"
+	"strings"
+)
+
+// Kinds of errors returned by Transform, which callers can test for using
+// errors.Is.  The errors returned are of type *TransformError, which also
+// wraps the underlying cause.
+var (
+	// ErrUnsupportedFormat is returned for images in a format which can
+	// not be decoded or encoded.
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+
+	// ErrNotAnImage is returned for content which is not an image at
+	// all, such as HTML or PDF documents, according to its sniffed
+	// content type.  The content is not decoded.
+	ErrNotAnImage = errors.New("not an image")
+
+	// ErrDecode is returned for images which can not be decoded, such as
+	// corrupt or truncated images.
+	ErrDecode = errors.New("error decoding image")
+
+	// ErrTooLarge is returned for images which exceed MaxPixels or
+	// MaxFrames, or which would be drawn onto a canvas exceeding
+	// MaxPixels.
+	ErrTooLarge = errors.New("image too large")
+)
+
+// TransformError is an error transforming an image.
+type TransformError struct {
+	Kind error // ErrUnsupportedFormat, ErrNotAnImage, ErrDecode, or ErrTooLarge
+	Err  error // underlying cause
+}
+
+func (e *TransformError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying cause of e.
+func (e *TransformError) Unwrap() error { return e.Err }
+
+// Is returns whether target is the kind of e.
+func (e *TransformError) Is(target error) bool { return target == e.Kind }
+
+// decodeError returns err, returned by decoding an image, as a
+// *TransformError.  Images in unknown formats are reported as
+// ErrUnsupportedFormat, and all others as ErrDecode.
+func decodeError(err error) error {
+	if err == image.ErrFormat {
+		return &TransformError{ErrUnsupportedFormat, err}
+	}
+	return &TransformError{ErrDecode, err}
+}
+
+// decodeConfigError is decodeError for err, returned by decoding the config
+// of the image starting with header.  HEIC images which can not be decoded
+// because imageproxy was built without HEIC support are reported as
+// ErrUnsupportedFormat with errNoHEIC.
+func decodeConfigError(header []byte, err error) error {
+	if err == image.ErrFormat && isHEIC(header) {
+		return &TransformError{ErrUnsupportedFormat, errNoHEIC}
+	}
+	return decodeError(err)
+}
+
+// isImageContentType returns whether the content type sniffed by
+// http.DetectContentType may be that of an image.  Content which is not
+// recognized is sniffed as "application/octet-stream", and may be an image
+// in a format that is not sniffed.
+func isImageContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/") || contentType == "application/octet-stream"
+}
+
+// errorStatus returns the HTTP status code for responding to requests whose
+// image could not be transformed because of err, or zero if the request
+// should be served the original image instead.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrDecode):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrUnsupportedFormat), errors.Is(err, ErrNotAnImage):
+		return http.StatusUnsupportedMediaType
+	}
+	return 0
+}
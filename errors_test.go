@@ -0,0 +1,113 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTransform_Errors(t *testing.T) {
+	defer func(max, frames int) { MaxPixels, MaxFrames = max, frames }(MaxPixels, MaxFrames)
+	MaxPixels, MaxFrames = 1000, 2
+
+	encodePNG := func(m image.Image) []byte {
+		buf := new(bytes.Buffer)
+		png.Encode(buf, m)
+		return buf.Bytes()
+	}
+	valid := encodePNG(newImage(10, 10, red))
+	large := encodePNG(newImage(40, 40, red))
+
+	frame := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{red, green})
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, &gif.GIF{
+		Image: []*image.Paletted{frame, frame, frame},
+		Delay: []int{10, 10, 10},
+	})
+	animated := buf.Bytes()
+
+	tests := []struct {
+		name string
+		img  []byte
+		kind error
+	}{
+		{"html", []byte("<html><body>Not Found</body></html>"), ErrNotAnImage},
+		{"pdf", []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"), ErrNotAnImage},
+		{"binary", []byte{0x00, 0x01, 0x02, 0x03}, ErrUnsupportedFormat},
+		{"empty", nil, ErrUnsupportedFormat},
+		{"corrupt header", append(append([]byte{}, valid[:16]...), bytes.Repeat([]byte{0xff}, 32)...), ErrDecode},
+		{"truncated", valid[:len(valid)-20], ErrDecode},
+		{"too many pixels", large, ErrTooLarge},
+		{"too many frames", animated, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		_, err := Transform(tt.img, Options{Width: 2})
+		if !errors.Is(err, tt.kind) {
+			t.Errorf("Transform of %s image returned error %v, want %v", tt.name, err, tt.kind)
+			continue
+		}
+		var terr *TransformError
+		if !errors.As(err, &terr) || terr.Err == nil {
+			t.Errorf("Transform of %s image returned error %#v, want *TransformError with cause", tt.name, err)
+		}
+		for _, kind := range []error{ErrUnsupportedFormat, ErrNotAnImage, ErrDecode, ErrTooLarge} {
+			if kind != tt.kind && errors.Is(err, kind) {
+				t.Errorf("Transform of %s image returned error %v, which is also %v", tt.name, err, kind)
+			}
+		}
+	}
+
+	// the underlying cause is wrapped
+	if _, err := Transform([]byte{0x00}, Options{Width: 2}); !errors.Is(err, image.ErrFormat) {
+		t.Errorf("Transform of binary data returned error %v, want wrapped %v", err, image.ErrFormat)
+	}
+
+	// the error includes the detected content type
+	_, err := Transform([]byte("<!DOCTYPE html><title>Error</title>"), Options{Width: 2})
+	if err == nil || !strings.Contains(err.Error(), "text/html") {
+		t.Errorf("Transform of html returned error %v, want error with content type", err)
+	}
+
+	// invalid options are not transform errors
+	if _, err := Transform(valid, Options{Blur: -1}); err == nil || errorStatus(err) != 0 {
+		t.Errorf("Transform with invalid options returned error %v, want error without status", err)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{errors.New("other"), 0},
+		{&TransformError{ErrUnsupportedFormat, image.ErrFormat}, http.StatusUnsupportedMediaType},
+		{&TransformError{ErrNotAnImage, errors.New("html")}, http.StatusUnsupportedMediaType},
+		{&TransformError{ErrDecode, errors.New("bad")}, http.StatusUnprocessableEntity},
+		{&TransformError{ErrTooLarge, errors.New("big")}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		if got := errorStatus(tt.err); got != tt.want {
+			t.Errorf("errorStatus(%v) returned %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"sort"
+)
+
+// formatSignatures are the leading bytes of images in each format that a
+// decoder may be registered for with image.RegisterFormat.  They are used to
+// find the registered decoders, since the image package does not list them.
+var formatSignatures = append([]string{
+	"GIF89a",
+	"\xff\xd8",
+	"\x89PNG\r\n\x1a\n",
+	"RIFF\x00\x00\x00\x00WEBPVP8",
+	"II*\x00",
+	"MM\x00*",
+	"BM\x00\x00\x00\x00\x00\x00\x00\x00",
+	"\x00\x00\x00\x00ftypavif",
+}, isoSignatures(heicBrands)...)
+
+// isoSignatures returns the signatures of ISO base media files with each of
+// brands.
+func isoSignatures(brands []string) []string {
+	var sigs []string
+	for _, brand := range brands {
+		sigs = append(sigs, "\x00\x00\x00\x00ftyp"+brand)
+	}
+	return sigs
+}
+
+// SupportedInputFormats returns the names of the image formats that this
+// build of imageproxy can decode and transform, in alphabetical order.  Some
+// formats, such as HEIC and SVG, are only supported when built with the
+// appropriate build tags.  The names are those of the registered decoders,
+// which are used as Options.Format when the output format is not specified.
+func SupportedInputFormats() []string {
+	seen := make(map[string]bool)
+	for _, sig := range formatSignatures {
+		// image.DecodeConfig reports the name of the decoder matching
+		// the signature even though the rest of the image is missing
+		if _, name, err := image.DecodeConfig(bytes.NewReader([]byte(sig))); err != image.ErrFormat {
+			seen[name] = true
+		}
+	}
+	if rasterizeSVG != nil {
+		seen["svg"] = true
+	}
+	return sortedKeys(seen)
+}
+
+// SupportedOutputFormats returns the image formats that this build of
+// imageproxy can encode, which are the valid values of Options.Format, in
+// alphabetical order.  Some formats, such as AVIF, are only supported when
+// built with the appropriate build tags.
+func SupportedOutputFormats() []string {
+	seen := make(map[string]bool)
+	for _, f := range outputFormats {
+		seen[f] = true
+	}
+	for f := range encoders {
+		seen[f] = true
+	}
+	return sortedKeys(seen)
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,59 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSupportedInputFormats(t *testing.T) {
+	got := SupportedInputFormats()
+	if !sort.StringsAreSorted(got) {
+		t.Errorf("SupportedInputFormats returned unsorted formats %v", got)
+	}
+	supported := make(map[string]bool)
+	for _, f := range got {
+		supported[f] = true
+	}
+	for _, f := range []string{"bmp", "gif", "jpeg", "png", "tiff", "webp"} {
+		if !supported[f] {
+			t.Errorf("SupportedInputFormats returned %v, which does not include %s", got, f)
+		}
+	}
+	if want := rasterizeSVG != nil; supported["svg"] != want {
+		t.Errorf("SupportedInputFormats returned %v, want svg %v", got, want)
+	}
+}
+
+func TestSupportedOutputFormats(t *testing.T) {
+	got := SupportedOutputFormats()
+	if !sort.StringsAreSorted(got) {
+		t.Errorf("SupportedOutputFormats returned unsorted formats %v", got)
+	}
+	for _, f := range got {
+		if !isOutputFormat(f) {
+			t.Errorf("SupportedOutputFormats returned invalid output format %s", f)
+		}
+	}
+	want := []string{"bmp", "ico", "jpeg", "png", "tiff", "webp"}
+	if _, ok := encoders["avif"]; ok {
+		want = []string{"avif", "bmp", "ico", "jpeg", "png", "tiff", "webp"}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SupportedOutputFormats returned %v, want %v", got, want)
+	}
+}
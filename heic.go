@@ -0,0 +1,41 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"errors"
+)
+
+// heicBrands are the brands of the ISO base media file format used by
+// HEIC and HEIF images, as specified in ISO/IEC 23008-12.
+var heicBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "hevm", "hevs", "mif1", "msf1"}
+
+// errNoHEIC is the cause of errors for HEIC images when imageproxy is built
+// without HEIC support.
+var errNoHEIC = errors.New("HEIC images require the heic build tag")
+
+// isHEIC returns whether b starts with the ftyp box of a HEIC or HEIF image.
+func isHEIC(b []byte) bool {
+	if len(b) < 12 || !bytes.Equal(b[4:8], []byte("ftyp")) {
+		return false
+	}
+	for _, brand := range heicBrands {
+		if string(b[8:12]) == brand {
+			return true
+		}
+	}
+	return false
+}
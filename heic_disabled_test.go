@@ -0,0 +1,31 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !heic
+// +build !heic
+
+package imageproxy
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTransform_HEICUnsupported(t *testing.T) {
+	img := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+	_, err := Transform(img, Options{Width: 10})
+	if !errors.Is(err, ErrUnsupportedFormat) || !errors.Is(err, errNoHEIC) {
+		t.Errorf("Transform returned error %v, want %v", err, errNoHEIC)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import "testing"
+
+func TestIsHEIC(t *testing.T) {
+	tests := []struct {
+		b    string
+		want bool
+	}{
+		{"", false},
+		{"\x00\x00\x00\x18ftyp", false},
+		{"\x00\x00\x00\x18ftypheic", true},
+		{"\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00", true},
+		{"\x00\x00\x00\x18ftypavif", false},
+		{"\x00\x00\x00\x18ftypisom", false},
+		{"\x00\x00\x00\x18moovheic", false},
+	}
+	for _, tt := range tests {
+		if got := isHEIC([]byte(tt.b)); got != tt.want {
+			t.Errorf("isHEIC(%q) returned %v, want %v", tt.b, got, tt.want)
+		}
+	}
+}
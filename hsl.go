@@ -0,0 +1,118 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// adjustSaturation changes the saturation of m by percentage, from -100 to
+// 100.  -100 removes all color, and 100 doubles the saturation of each
+// pixel, limited to full saturation.
+func adjustSaturation(m image.Image, percentage float64) *image.NRGBA {
+	scale := 1 + math.Max(-100, math.Min(100, percentage))/100
+	return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+		h, s, l := rgbToHSL(c)
+		return hslToRGB(h, math.Min(1, s*scale), l, c.A)
+	})
+}
+
+// adjustHue rotates the hue of each pixel of m by the given angle in
+// degrees.
+func adjustHue(m image.Image, degrees float64) *image.NRGBA {
+	shift := math.Mod(degrees, 360) / 360
+	return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+		h, s, l := rgbToHSL(c)
+		h += shift
+		if h < 0 {
+			h++
+		} else if h >= 1 {
+			h--
+		}
+		return hslToRGB(h, s, l, c.A)
+	})
+}
+
+// rgbToHSL returns the hue, saturation, and lightness of c, each from 0 to
+// 1.  The alpha channel is ignored.
+func rgbToHSL(c color.NRGBA) (h, s, l float64) {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	l = (max + min) / 2
+	if max == min {
+		return 0, 0, l
+	}
+
+	d := max - min
+	if l > 0.5 {
+		s = d / (2 - max - min)
+	} else {
+		s = d / (max + min)
+	}
+	switch max {
+	case r:
+		h = (g - b) / d
+		if g < b {
+			h += 6
+		}
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	return h / 6, s, l
+}
+
+// hslToRGB returns the color with hue h, saturation s, and lightness l, each
+// from 0 to 1, and alpha a.
+func hslToRGB(h, s, l float64, a uint8) color.NRGBA {
+	if s == 0 {
+		v := uint8(l*255 + 0.5)
+		return color.NRGBA{v, v, v, a}
+	}
+
+	var q float64
+	if l < 0.5 {
+		q = l * (1 + s)
+	} else {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+	channel := func(t float64) uint8 {
+		if t < 0 {
+			t++
+		} else if t > 1 {
+			t--
+		}
+		var v float64
+		switch {
+		case t < 1.0/6:
+			v = p + (q-p)*6*t
+		case t < 1.0/2:
+			v = q
+		case t < 2.0/3:
+			v = p + (q-p)*(2.0/3-t)*6
+		default:
+			v = p
+		}
+		return uint8(math.Max(0, math.Min(255, v*255+0.5)))
+	}
+	return color.NRGBA{channel(h + 1.0/3), channel(h), channel(h - 1.0/3), a}
+}
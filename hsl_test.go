@@ -0,0 +1,95 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestRGBToHSL(t *testing.T) {
+	tests := []struct {
+		c       color.NRGBA
+		h, s, l float64
+	}{
+		{color.NRGBA{0, 0, 0, 255}, 0, 0, 0},
+		{color.NRGBA{255, 255, 255, 255}, 0, 0, 1},
+		{color.NRGBA{255, 0, 0, 255}, 0, 1, 0.5},
+		{color.NRGBA{0, 255, 0, 255}, 1.0 / 3, 1, 0.5},
+		{color.NRGBA{0, 0, 255, 255}, 2.0 / 3, 1, 0.5},
+		{color.NRGBA{255, 0, 255, 255}, 5.0 / 6, 1, 0.5},
+		{color.NRGBA{191, 64, 64, 255}, 0, 0.498, 0.5},
+	}
+	for _, tt := range tests {
+		h, s, l := rgbToHSL(tt.c)
+		if math.Abs(h-tt.h) > 0.005 || math.Abs(s-tt.s) > 0.005 || math.Abs(l-tt.l) > 0.005 {
+			t.Errorf("rgbToHSL(%v) returned %v, %v, %v, want %v, %v, %v", tt.c, h, s, l, tt.h, tt.s, tt.l)
+		}
+	}
+}
+
+func TestHSLToRGB_RoundTrip(t *testing.T) {
+	for r := 0; r < 256; r += 15 {
+		for g := 0; g < 256; g += 15 {
+			for b := 0; b < 256; b += 15 {
+				c := color.NRGBA{uint8(r), uint8(g), uint8(b), 128}
+				h, s, l := rgbToHSL(c)
+				if got := hslToRGB(h, s, l, c.A); got != c {
+					t.Errorf("hslToRGB(rgbToHSL(%v)) returned %v", c, got)
+				}
+			}
+		}
+	}
+}
+
+func TestAdjustSaturation(t *testing.T) {
+	m := newImage(1, 1, color.NRGBA{191, 64, 64, 255})
+	tests := []struct {
+		percentage float64
+		want       color.NRGBA
+	}{
+		{0, color.NRGBA{191, 64, 64, 255}},
+		{-100, color.NRGBA{128, 128, 128, 255}},
+		{-50, color.NRGBA{159, 96, 96, 255}},
+		{100, color.NRGBA{255, 0, 0, 255}},
+		{500, color.NRGBA{255, 0, 0, 255}}, // clamped to 100
+	}
+	for _, tt := range tests {
+		if got := adjustSaturation(m, tt.percentage).NRGBAAt(0, 0); got != tt.want {
+			t.Errorf("adjustSaturation(%v) returned %v, want %v", tt.percentage, got, tt.want)
+		}
+	}
+}
+
+func TestAdjustHue(t *testing.T) {
+	m := newImage(1, 1, color.NRGBA{255, 0, 0, 200})
+	tests := []struct {
+		degrees float64
+		want    color.NRGBA
+	}{
+		{0, color.NRGBA{255, 0, 0, 200}},
+		{60, color.NRGBA{255, 255, 0, 200}},
+		{180, color.NRGBA{0, 255, 255, 200}},
+		{300, color.NRGBA{255, 0, 255, 200}},
+		{360, color.NRGBA{255, 0, 0, 200}},
+		{-60, color.NRGBA{255, 0, 255, 200}},
+	}
+	for _, tt := range tests {
+		if got := adjustHue(m, tt.degrees).NRGBAAt(0, 0); got != tt.want {
+			t.Errorf("adjustHue(%v) returned %v, want %v", tt.degrees, got, tt.want)
+		}
+	}
+}
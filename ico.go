@@ -0,0 +1,129 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+func init() {
+	registerEncoder("ico", encodeICO)
+}
+
+// maxICOSizes is the maximum number of images in ICO output.
+const maxICOSizes = 8
+
+// maxICOSize is the largest width and height of images in ICO files.
+const maxICOSize = 256
+
+// ICOSizes are the sizes of the images in ICO output, such as favicons.
+// Each size is the width and height in pixels of a square image, up to 256.
+// Unused entries are zero.
+type ICOSizes [maxICOSizes]int
+
+// sizes returns the used sizes of s, in ascending order.
+func (s ICOSizes) sizes() []int {
+	var sizes []int
+	for _, size := range s {
+		if size != 0 {
+			sizes = append(sizes, size)
+		}
+	}
+	sort.Ints(sizes)
+	return sizes
+}
+
+// add returns s with size added in ascending order, unless it is already
+// included, it is out of range, or s is full.
+func (s ICOSizes) add(size int) ICOSizes {
+	sizes := s.sizes()
+	if size <= 0 || size > maxICOSize || len(sizes) == maxICOSizes {
+		return s
+	}
+	for _, v := range sizes {
+		if v == size {
+			return s
+		}
+	}
+	var out ICOSizes
+	copy(out[:], append(sizes, size))
+	sort.Ints(out[:len(sizes)+1])
+	return out
+}
+
+// encodeICO encodes m as an ICO image containing a PNG image for each of
+// opt.ICOSizes, scaled to fit within that size.  If opt.ICOSizes is empty,
+// m is included at its own size, scaled down to fit within 256 pixels if it
+// is larger.
+func encodeICO(w io.Writer, m image.Image, opt Options) error {
+	sizes := opt.ICOSizes.sizes()
+	if len(sizes) == 0 {
+		b := m.Bounds()
+		size := b.Dx()
+		if b.Dy() > size {
+			size = b.Dy()
+		}
+		if size > maxICOSize {
+			size = maxICOSize
+		}
+		sizes = []int{size}
+	}
+
+	// the ICONDIR header is followed by an ICONDIRENTRY for each image,
+	// and then the images themselves
+	header := new(bytes.Buffer)
+	header.Write([]byte{0, 0, 1, 0})
+	binary.Write(header, binary.LittleEndian, uint16(len(sizes)))
+	images := new(bytes.Buffer)
+	offset := 6 + 16*len(sizes)
+	for _, size := range sizes {
+		frame := icoFrame(m, size, resampleFilter(opt.Filter))
+		start := images.Len()
+		if err := encodePNG(images, frame, opt); err != nil {
+			return err
+		}
+		n := images.Len() - start
+
+		// widths and heights of 256 are stored as 0
+		b := frame.Bounds()
+		header.Write([]byte{byte(b.Dx()), byte(b.Dy()), 0, 0})
+		binary.Write(header, binary.LittleEndian, []uint16{1, 32})
+		binary.Write(header, binary.LittleEndian, []uint32{uint32(n), uint32(offset + start)})
+	}
+	if _, err := header.WriteTo(w); err != nil {
+		return err
+	}
+	_, err := images.WriteTo(w)
+	return err
+}
+
+// icoFrame returns m scaled with filter to fit within size by size pixels,
+// scaling it up if it is smaller.
+func icoFrame(m image.Image, size int, filter imaging.ResampleFilter) image.Image {
+	b := m.Bounds()
+	if b.Dx() == size && b.Dy() <= size || b.Dy() == size && b.Dx() <= size {
+		return m
+	}
+	if b.Dx() >= b.Dy() {
+		return imaging.Resize(m, size, 0, filter)
+	}
+	return imaging.Resize(m, 0, size, filter)
+}
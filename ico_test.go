@@ -0,0 +1,114 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestICOSizes_add(t *testing.T) {
+	tests := []struct {
+		s    ICOSizes
+		size int
+		want ICOSizes
+	}{
+		{ICOSizes{}, 16, ICOSizes{16}},
+		{ICOSizes{16, 48}, 32, ICOSizes{16, 32, 48}},
+		{ICOSizes{16, 48}, 16, ICOSizes{16, 48}},
+		{ICOSizes{48, 16}, 256, ICOSizes{16, 48, 256}},
+		{ICOSizes{16}, 0, ICOSizes{16}},
+		{ICOSizes{16}, 257, ICOSizes{16}},
+		{ICOSizes{1, 2, 3, 4, 5, 6, 7, 8}, 9, ICOSizes{1, 2, 3, 4, 5, 6, 7, 8}},
+	}
+	for _, tt := range tests {
+		if got := tt.s.add(tt.size); got != tt.want {
+			t.Errorf("%v.add(%d) returned %v, want %v", tt.s, tt.size, got, tt.want)
+		}
+	}
+}
+
+// icoImages returns the sizes of the images in the ICO file b, as stored in
+// its directory and as decoded from the PNG images.
+func icoImages(t *testing.T, b []byte) (dir, decoded []image.Point) {
+	if len(b) < 6 || !bytes.Equal(b[:4], []byte{0, 0, 1, 0}) {
+		t.Fatalf("invalid ICO header: % x", b[:6])
+	}
+	n := int(binary.LittleEndian.Uint16(b[4:]))
+	for i := 0; i < n; i++ {
+		e := b[6+16*i:]
+		w, h := int(e[0]), int(e[1])
+		if w == 0 {
+			w = 256
+		}
+		if h == 0 {
+			h = 256
+		}
+		dir = append(dir, image.Pt(w, h))
+
+		size := binary.LittleEndian.Uint32(e[8:])
+		offset := binary.LittleEndian.Uint32(e[12:])
+		cfg, err := png.DecodeConfig(bytes.NewReader(b[offset : offset+size]))
+		if err != nil {
+			t.Fatalf("error decoding ICO image %d: %v", i, err)
+		}
+		decoded = append(decoded, image.Pt(cfg.Width, cfg.Height))
+	}
+	return dir, decoded
+}
+
+func TestTransform_ICO(t *testing.T) {
+	src := newImage(400, 200, red)
+	buf := new(bytes.Buffer)
+	png.Encode(buf, src)
+
+	tests := []struct {
+		opt  Options
+		want []image.Point
+	}{
+		{Options{Format: "ico"}, []image.Point{{256, 128}}},
+		{Options{Format: "ico", Width: 40}, []image.Point{{40, 20}}},
+		{Options{Format: "ico", Width: 200, Height: 200}, []image.Point{{200, 200}}},
+		{
+			Options{Format: "ico", ICOSizes: ICOSizes{16, 32, 48}},
+			[]image.Point{{16, 8}, {32, 16}, {48, 24}},
+		},
+		{
+			// images are scaled up to the requested sizes
+			Options{Format: "ico", Width: 20, Height: 20, ICOSizes: ICOSizes{64, 16}},
+			[]image.Point{{16, 16}, {64, 64}},
+		},
+	}
+	for _, tt := range tests {
+		out, err := Transform(buf.Bytes(), tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		dir, decoded := icoImages(t, out)
+		if len(dir) != len(tt.want) {
+			t.Errorf("Transform(%v) returned ICO with images %v, want %v", tt.opt, dir, tt.want)
+			continue
+		}
+		for i := range dir {
+			if dir[i] != tt.want[i] || decoded[i] != tt.want[i] {
+				t.Errorf("Transform(%v) returned ICO image %d with size %v, decoded %v, want %v", tt.opt, i, dir[i], decoded[i], tt.want[i])
+			}
+		}
+	}
+}
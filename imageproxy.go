@@ -19,14 +19,25 @@ package imageproxy // import "willnorris.com/go/imageproxy"
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/hmac"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash"
+	"image/color"
 	"io"
 	"io/ioutil"
+	"math"
+	"mime"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -44,11 +55,24 @@ type Proxy struct {
 	// proxied from.  An empty list means all hosts are allowed.
 	Whitelist []string
 
+	// AllowHosts specifies a list of remote hosts that images may be
+	// proxied from, even if the request is signed.  Hosts of the form
+	// "*.example.com" match example.com and all of its subdomains.
+	// Requests for other hosts are rejected without being fetched, as are
+	// redirects to them.  An empty list means all hosts are allowed.
+	AllowHosts []string
+
 	// Referrers, when given, requires that requests to the image
-	// proxy come from a referring host. An empty list means all
-	// hosts are allowed.
+	// proxy come from a referring host, independent of any signature.
+	// Hosts of the form "*.example.com" match example.com and all of its
+	// subdomains.  An empty list means all hosts are allowed.
 	Referrers []string
 
+	// AllowEmptyReferrer allows requests without a Referer header even if
+	// Referrers is set, such as those from browsers whose referrer policy
+	// omits it.  Requests with a referrer must still match Referrers.
+	AllowEmptyReferrer bool
+
 	// DefaultBaseURL is the URL that relative remote URLs are resolved in
 	// reference to.  If nil, all remote URLs specified in requests must be
 	// absolute.
@@ -57,13 +81,114 @@ type Proxy struct {
 	// SignatureKey is the HMAC key used to verify signed requests.
 	SignatureKey []byte
 
-	// Allow images to scale beyond their original dimensions.
+	// SignatureHash is the name of the hash function used with
+	// SignatureKey to compute request signatures: "sha1", "sha256", or
+	// "sha512".  If empty, "sha256" is used.  The hash is not specified in
+	// requests, so that clients cannot choose a weaker one.
+	SignatureHash string
+
+	// DefaultOptions are applied to every request, except for the fields
+	// which the request sets itself, such as a default quality or
+	// StripMetadata.  Fields which only have their intended effect together,
+	// such as Width and Height, are applied together if the request sets
+	// none of them.  A field is only unset if it has the zero value, so
+	// requests cannot override defaults with zero values, such as "q0".
+	// ScaleUp is always set from the Proxy.
+	DefaultOptions Options
+
+	// Allow images to scale beyond their original dimensions.  This is a
+	// policy of the proxy, not an option of requests: it replaces the
+	// ScaleUp option of every request, including DefaultOptions, so
+	// clients cannot upscale images unless it is true.
 	ScaleUp bool
 
+	// MaxWidth and MaxHeight limit the size of transformed images, which
+	// is important when ScaleUp is enabled.  Requests for larger widths or
+	// heights are rejected, unless ClampSize is true, in which case the
+	// requested size is reduced to fit within the limits, preserving its
+	// aspect ratio.  Percentage sizes, which never exceed the size of the
+	// original image, are not limited.  Zero means no limit.
+	MaxWidth  int
+	MaxHeight int
+	ClampSize bool
+
+	// AutoFormat specifies whether requests which do not specify an output
+	// format are encoded in the best format accepted by the client,
+	// according to its Accept header: AVIF if imageproxy supports it, then
+	// WebP.  If the client accepts neither, the original format is kept.
+	AutoFormat bool
+
+	// AutoFormats, if not empty, lists the formats chosen by AutoFormat in
+	// order of preference, from "avif" and "webp", instead of both.  Each
+	// negotiated format is cached as a separate variant of every
+	// transformed image, so listing fewer formats reduces the size of the
+	// cache.  Other formats are ignored.
+	AutoFormats []string
+
+	// TransformConfig holds the defaults used to transform images for
+	// requests which do not specify them, such as the quality images are
+	// encoded with in each output format, and the filter used to resize
+	// them.  For example, thumbnails are often encoded at a lower JPEG
+	// quality than the default of 95.
+	TransformConfig TransformConfig
+
+	// DefaultQuality specifies the quality that images are encoded with in
+	// each output format, for requests which do not specify a quality.
+	// Qualities in TransformConfig.Quality take precedence.
+	//
+	// Deprecated: set TransformConfig.Quality instead.
+	DefaultQuality Qualities
+
 	// Timeout specifies a time limit for requests served by this Proxy.
 	// If a call runs for longer than its time limit, a 504 Gateway Timeout
 	// response is returned.  A Timeout of zero means no timeout.
 	Timeout time.Duration
+
+	// FetchTimeout specifies a time limit for fetching each remote image,
+	// including transforming it.  If the image is not fetched in time, a
+	// 504 Gateway Timeout response is returned.  Unlike Timeout, the
+	// response is not buffered.  A FetchTimeout of zero means no timeout.
+	FetchTimeout time.Duration
+
+	// UserAgent, if not empty, is sent as the User-Agent header of
+	// requests for remote images, instead of the default of the
+	// transport, which some servers refuse.
+	UserAgent string
+
+	// Header specifies headers added to each request for a remote image,
+	// such as API keys required by the remote server.
+	Header http.Header
+
+	// ForwardHeaders lists headers of client requests, such as
+	// Accept-Language, which are forwarded to the remote server when
+	// fetching the requested image.  Cached images are shared by all
+	// clients regardless of these headers, unless the remote server
+	// varies its responses by them.
+	ForwardHeaders []string
+
+	// MaxRedirects limits the number of redirects followed when fetching
+	// each remote image, by the client created by NewProxy.  Redirects
+	// back to a URL which was already fetched are never followed.  If
+	// zero, up to 10 redirects are followed.  If negative, redirects are
+	// not followed at all.
+	MaxRedirects int
+
+	// RateLimiter, if not nil, limits the rate of requests from each
+	// client IP address.  Requests exceeding the limit receive a 429 Too
+	// Many Requests response, with a Retry-After header.
+	RateLimiter RateLimiter
+
+	// TrustedProxies is the number of reverse proxies in front of this
+	// Proxy which append the address of their client to the
+	// X-Forwarded-For header.  It is used to determine the IP addresses
+	// of clients for RateLimiter.  If zero, X-Forwarded-For is ignored,
+	// since it could be set by clients.
+	TrustedProxies int
+
+	// Metrics, if not nil, receives measurements of the requests served by
+	// this Proxy.  The transport and cache created by NewProxy also record
+	// them to it.
+	Metrics Metrics
 }
 
 // NewProxy constructs a new proxy.  The provided http RoundTripper will be
@@ -77,20 +202,34 @@ func NewProxy(transport http.RoundTripper, cache Cache) *Proxy {
 		cache = NopCache
 	}
 
-	proxy := Proxy{
+	proxy := &Proxy{
 		Cache: cache,
 	}
+	metrics := proxyMetrics{proxy}
 
 	client := new(http.Client)
+	client.CheckRedirect = proxy.checkRedirect
 	client.Transport = &httpcache.Transport{
-		Transport:           &TransformingTransport{transport, client},
-		Cache:               cache,
+		Transport: &TransformingTransport{
+			Transport:      transport,
+			CachingClient:  client,
+			Metrics:        metrics,
+			Config:         &proxy.TransformConfig,
+			DefaultQuality: &proxy.DefaultQuality,
+		},
+		Cache:               metricsCache{cache, metrics},
 		MarkCachedResponses: true,
 	}
 
 	proxy.Client = client
 
-	return &proxy
+	return proxy
+}
+
+// metrics returns the Metrics of p, or a Metrics which discards measurements
+// if it has none.
+func (p *Proxy) metrics() Metrics {
+	return proxyMetrics{p}.metrics()
 }
 
 // ServeHTTP handles incoming requests.
@@ -104,6 +243,15 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if p.RateLimiter != nil {
+		if ok, wait := p.RateLimiter.Allow(clientIP(r, p.TrustedProxies)); !ok {
+			p.metrics().Error(ErrorKindRateLimit)
+			w.Header().Set("Retry-After", retryAfter(wait))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+
 	var h http.Handler = http.HandlerFunc(p.serveImage)
 	if p.Timeout > 0 {
 		h = tphttp.TimeoutHandler(h, p.Timeout, "Gateway timeout waiting for remote resource.")
@@ -117,23 +265,83 @@ func (p *Proxy) serveImage(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		msg := fmt.Sprintf("invalid request URL: %v", err)
 		glog.Error(msg)
+		p.metrics().Error(ErrorKindRequest)
 		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
 
 	// assign static settings from proxy to req.Options
+	req.Options = req.Options.withDefaults(p.DefaultOptions)
 	req.Options.ScaleUp = p.ScaleUp
 
+	// use the device pixel ratio client hint for requests which do not
+	// specify one, which makes the response depend on the hint header
+	if req.Options.DPR == 0 && (req.Options.Width != 0 || req.Options.Height != 0) {
+		w.Header().Add("Vary", "Sec-CH-DPR, DPR")
+		req.Options.DPR = clientDPR(r)
+	}
+
+	// negotiate the output format, which makes the response depend on the
+	// Accept header
+	if p.AutoFormat && req.Options.Format == "" && !req.Options.Color && !req.Options.blurHash() {
+		w.Header().Add("Vary", "Accept")
+		req.Options.Format = acceptFormat(r, p.AutoFormats)
+	}
+
+	// the request options were validated before the proxy settings were
+	// applied, which can form an invalid combination with them
+	if err := req.Options.validate(); err != nil {
+		msg := fmt.Sprintf("invalid options: %v", err)
+		glog.Error(msg)
+		p.metrics().Error(ErrorKindRequest)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if err := p.limitSize(&req.Options); err != nil {
+		glog.Error(err)
+		p.metrics().Error(ErrorKindRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if err := p.allowed(req); err != nil {
 		glog.Error(err)
+		p.metrics().Error(ErrorKindForbidden)
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
-	resp, err := p.Client.Get(req.String())
+	ctx := r.Context()
+	if p.FetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.FetchTimeout)
+		defer cancel()
+	}
+	fetch, err := http.NewRequest("GET", req.String(), nil)
+	if err != nil {
+		msg := fmt.Sprintf("invalid remote URL: %v", err)
+		glog.Error(msg)
+		p.metrics().Error(ErrorKindRequest)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if h := p.upstreamHeader(r); len(h) > 0 {
+		fetch.Header = h
+		ctx = context.WithValue(ctx, upstreamHeaderKey{}, h)
+	}
+	resp, err := p.Client.Do(fetch.WithContext(ctx))
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			msg := fmt.Sprintf("timeout fetching remote image: %v", req.URL)
+			glog.Error(msg)
+			p.metrics().Error(ErrorKindTimeout)
+			http.Error(w, msg, http.StatusGatewayTimeout)
+			return
+		}
 		msg := fmt.Sprintf("error fetching remote image: %v", err)
 		glog.Error(msg)
+		p.metrics().Error(ErrorKindFetch)
 		http.Error(w, msg, http.StatusInternalServerError)
 		return
 	}
@@ -143,6 +351,9 @@ func (p *Proxy) serveImage(w http.ResponseWriter, r *http.Request) {
 	glog.Infof("request: %v (served from cache: %v)", *req, cached == "1")
 
 	copyHeader(w, resp, "Cache-Control")
+	if cc := updateMaxAge(resp.Header, time.Now()); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
 	copyHeader(w, resp, "Last-Modified")
 	copyHeader(w, resp, "Expires")
 	copyHeader(w, resp, "Etag")
@@ -155,8 +366,152 @@ func (p *Proxy) serveImage(w http.ResponseWriter, r *http.Request) {
 
 	copyHeader(w, resp, "Content-Length")
 	copyHeader(w, resp, "Content-Type")
+	if resp.StatusCode == http.StatusOK && (req.Options.Download || req.Options.Filename != "") {
+		if cd := contentDisposition(req, resp.Header.Get("Content-Type")); cd != "" {
+			w.Header().Set("Content-Disposition", cd)
+		}
+	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	n, _ := io.Copy(w, resp.Body)
+	p.metrics().BytesServed(n)
+}
+
+// upstreamHeaderKey is the context key of the headers added to requests for
+// remote images.  They are passed in the context, rather than in the request
+// headers, because a TransformingTransport makes a new request for the
+// original image.
+type upstreamHeaderKey struct{}
+
+// upstreamHeader returns the headers added to requests for remote images
+// made on behalf of the client request r: the UserAgent and Header of p, and
+// the headers of r listed in ForwardHeaders.
+func (p *Proxy) upstreamHeader(r *http.Request) http.Header {
+	h := make(http.Header)
+	for name, values := range p.Header {
+		h[name] = append([]string(nil), values...)
+	}
+	if p.UserAgent != "" {
+		h.Set("User-Agent", p.UserAgent)
+	}
+	for _, name := range p.ForwardHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			h[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+	return h
+}
+
+// clientDPR returns the device pixel ratio sent by the client in the
+// Sec-CH-DPR or DPR client hint header of r, or zero if there is none.
+func clientDPR(r *http.Request) float64 {
+	for _, header := range []string{"Sec-CH-DPR", "DPR"} {
+		if v := r.Header.Get(header); v != "" {
+			if dpr, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && dpr > 0 && !math.IsInf(dpr, 0) {
+				return dpr
+			}
+		}
+	}
+	return 0
+}
+
+// autoFormats are the output formats chosen by Proxy.AutoFormat, in order of
+// preference, and their media types.
+var autoFormats = []struct{ format, mediaType string }{
+	{"avif", "image/avif"},
+	{"webp", "image/webp"},
+}
+
+// acceptFormat returns the preferred supported output format from
+// autoFormats that is accepted by the Accept header of r, or an empty string
+// if there is none.  If formats is not empty, only the autoFormats it lists
+// are considered, in its order of preference.  Wildcard media ranges are not
+// considered to accept any of the formats, since they are sent by clients
+// which do not support them.
+func acceptFormat(r *http.Request, formats []string) string {
+	accepted := make(map[string]bool)
+	for _, v := range r.Header["Accept"] {
+		for _, part := range strings.Split(v, ",") {
+			params := strings.Split(part, ";")
+			mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, _ = strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				}
+			}
+			accepted[mediaType] = q > 0
+		}
+	}
+	if len(formats) == 0 {
+		for _, f := range autoFormats {
+			formats = append(formats, f.format)
+		}
+	}
+	for _, format := range formats {
+		for _, f := range autoFormats {
+			if f.format == format && accepted[f.mediaType] && isOutputFormat(f.format) {
+				return f.format
+			}
+		}
+	}
+	return ""
+}
+
+// filenameExtensions are the extensions of downloaded images, by their
+// media type.
+var filenameExtensions = map[string]string{
+	"image/avif":    ".avif",
+	"image/bmp":     ".bmp",
+	"image/gif":     ".gif",
+	"image/heic":    ".heic",
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/svg+xml": ".svg",
+	"image/tiff":    ".tiff",
+	"image/webp":    ".webp",
+	"image/x-icon":  ".ico",
+}
+
+// isFilename returns whether name can be used as the Filename option, which
+// must not be a path or include commas, which separate options.
+func isFilename(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	for _, r := range name {
+		if r == '/' || r == '\\' || r == ',' || r < ' ' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// contentDisposition returns the Content-Disposition header of the response
+// to req, an image of the given media type, named by the Filename option or
+// the remote URL with the extension of the media type.  An empty string is
+// returned for responses which are not images, such as those of the Color
+// option.
+func contentDisposition(req *Request, contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return ""
+	}
+	name := req.Options.Filename
+	if name == "" {
+		name = path.Base(req.URL.Path)
+		if !isFilename(name) {
+			name = "image"
+		}
+	}
+	if ext, ok := filenameExtensions[mediaType]; ok {
+		name = strings.TrimSuffix(name, path.Ext(name)) + ext
+	}
+	disposition := "inline"
+	if req.Options.Download {
+		disposition = "attachment"
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": name})
 }
 
 func copyHeader(w http.ResponseWriter, r *http.Response, header string) {
@@ -166,14 +521,59 @@ func copyHeader(w http.ResponseWriter, r *http.Response, header string) {
 	}
 }
 
+// updateMaxAge returns the Cache-Control header in h with its max-age
+// directive reduced by the age of the response, so that responses served from
+// cache are not considered fresh by clients for longer than the remote server
+// specified.  If the header has no max-age directive, it is returned
+// unchanged.
+func updateMaxAge(h http.Header, now time.Time) string {
+	cc := h.Get("Cache-Control")
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		return cc
+	}
+	age := now.Sub(date)
+	if a, err := strconv.Atoi(h.Get("Age")); err == nil {
+		age += time.Duration(a) * time.Second
+	}
+
+	directives := strings.Split(cc, ",")
+	for i, d := range directives {
+		directives[i] = strings.TrimSpace(d)
+	}
+	for i, d := range directives {
+		if !strings.HasPrefix(d, "max-age=") {
+			continue
+		}
+		maxAge, err := strconv.Atoi(strings.TrimPrefix(d, "max-age="))
+		if err != nil {
+			return cc
+		}
+		if age > 0 {
+			maxAge -= int(age / time.Second)
+		}
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		directives[i] = fmt.Sprintf("max-age=%d", maxAge)
+		return strings.Join(directives, ", ")
+	}
+	return cc
+}
+
 // allowed determines whether the specified request contains an allowed
 // referrer, host, and signature.  It returns an error if the request is not
 // allowed.
 func (p *Proxy) allowed(r *Request) error {
-	if len(p.Referrers) > 0 && !validReferrer(p.Referrers, r.Original) {
+	if len(p.Referrers) > 0 && !validReferrer(p.Referrers, r.Original) &&
+		!(p.AllowEmptyReferrer && r.Original.Header.Get("Referer") == "") {
 		return fmt.Errorf("request does not contain an allowed referrer: %v", r)
 	}
 
+	if len(p.AllowHosts) > 0 && !validHost(p.AllowHosts, r.URL) {
+		return fmt.Errorf("request is not for an allowed host: %v", r)
+	}
+
 	if len(p.Whitelist) == 0 && len(p.SignatureKey) == 0 {
 		return nil // no whitelist or signature key, all requests accepted
 	}
@@ -182,20 +582,126 @@ func (p *Proxy) allowed(r *Request) error {
 		return nil
 	}
 
-	if len(p.SignatureKey) > 0 && validSignature(p.SignatureKey, r) {
-		return nil
+	if len(p.SignatureKey) > 0 {
+		newHash, ok := signatureHashes[p.SignatureHash]
+		if !ok {
+			return fmt.Errorf("unsupported signature hash: %q", p.SignatureHash)
+		}
+		if validSignature(p.SignatureKey, newHash, r) {
+			return nil
+		}
 	}
 
 	return fmt.Errorf("request does not contain an allowed host or valid signature: %v", r)
 }
 
-// validHost returns whether the host in u matches one of hosts.
+// limitSize applies the proxy's MaxWidth and MaxHeight to opt, either
+// reducing the requested size or returning an error if it is too large.
+// Percentage sizes depend on the size of the original image, so they can not
+// be checked against the limits, and are only allowed to scale images up to
+// their original size.
+func (p *Proxy) limitSize(opt *Options) error {
+	if err := p.limitPercent(opt); err != nil {
+		return err
+	}
+
+	// the limits apply to the size after multiplying by the device pixel ratio
+	dpr := opt.dpr()
+	wPixels := opt.Width >= 1 && !opt.WidthPercent
+	hPixels := opt.Height >= 1 && !opt.HeightPercent
+	scale := 1.0
+	if w := opt.Width * dpr; p.MaxWidth > 0 && wPixels && w > float64(p.MaxWidth) {
+		scale = float64(p.MaxWidth) / w
+	}
+	if h := opt.Height * dpr; p.MaxHeight > 0 && hPixels && h > float64(p.MaxHeight) {
+		scale = math.Min(scale, float64(p.MaxHeight)/h)
+	}
+	if scale == 1 {
+		return nil
+	}
+	if !p.ClampSize {
+		return fmt.Errorf("requested size %vx%v exceeds maximum size %dx%d", opt.Width, opt.Height, p.MaxWidth, p.MaxHeight)
+	}
+	if wPixels {
+		opt.Width = math.Max(1, math.Floor(opt.Width*scale))
+	}
+	if hPixels {
+		opt.Height = math.Max(1, math.Floor(opt.Height*scale))
+	}
+	return nil
+}
+
+// limitPercent applies the proxy's MaxWidth and MaxHeight to percentage sizes
+// in opt, which are limited to 100% if images may be scaled up.
+func (p *Proxy) limitPercent(opt *Options) error {
+	if !opt.ScaleUp {
+		return nil
+	}
+	scale := 1.0
+	if p.MaxWidth > 0 && opt.WidthPercent && opt.Width > 100 {
+		scale = 100 / opt.Width
+	}
+	if p.MaxHeight > 0 && opt.HeightPercent && opt.Height > 100 {
+		scale = math.Min(scale, 100/opt.Height)
+	}
+	if scale == 1 {
+		return nil
+	}
+	if !p.ClampSize {
+		return fmt.Errorf("requested percentage size exceeds 100%% with maximum size %dx%d", p.MaxWidth, p.MaxHeight)
+	}
+	if opt.WidthPercent {
+		opt.Width *= scale
+	}
+	if opt.HeightPercent {
+		opt.Height *= scale
+	}
+	return nil
+}
+
+// defaultMaxRedirects is the number of redirects followed if
+// Proxy.MaxRedirects is zero, which is the same as the default of
+// http.Client.
+const defaultMaxRedirects = 10
+
+// checkRedirect is used as the CheckRedirect function of the proxy's client.
+// In addition to limiting the number of redirects to MaxRedirects, it
+// prevents redirect loops and redirects to hosts which are not allowed.
+// Redirects to addresses refused by a NetworkFilter are prevented when they
+// are connected to.
+func (p *Proxy) checkRedirect(req *http.Request, via []*http.Request) error {
+	max := p.MaxRedirects
+	if max == 0 {
+		max = defaultMaxRedirects
+	}
+	if max < 0 {
+		return fmt.Errorf("redirect not followed: %v", req.URL)
+	}
+	if len(via) >= max {
+		return fmt.Errorf("stopped after %d redirects", max)
+	}
+	for _, r := range via {
+		if r.URL.String() == req.URL.String() {
+			return fmt.Errorf("redirect loop at %v", req.URL)
+		}
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to unsupported scheme: %v", req.URL)
+	}
+	if len(p.AllowHosts) > 0 && !validHost(p.AllowHosts, req.URL) {
+		return fmt.Errorf("redirect to host that is not allowed: %v", req.URL)
+	}
+	return nil
+}
+
+// validHost returns whether the host in u matches one of hosts.  Hosts of
+// the form "*.example.com" match example.com and all of its subdomains.
 func validHost(hosts []string, u *url.URL) bool {
 	for _, host := range hosts {
 		if u.Host == host {
 			return true
 		}
-		if strings.HasPrefix(host, "*.") && strings.HasSuffix(u.Host, host[2:]) {
+		if strings.HasPrefix(host, "*.") && (u.Host == host[2:] || strings.HasSuffix(u.Host, host[1:])) {
 			return true
 		}
 	}
@@ -213,8 +719,18 @@ func validReferrer(hosts []string, r *http.Request) bool {
 	return validHost(hosts, u)
 }
 
-// validSignature returns whether the request signature is valid.
-func validSignature(key []byte, r *Request) bool {
+// signatureHashes maps the names of supported values of Proxy.SignatureHash
+// to their hash functions.
+var signatureHashes = map[string]func() hash.Hash{
+	"":       sha256.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// validSignature returns whether the request signature is a valid HMAC of
+// the request URL, using key and the hash function newHash.
+func validSignature(key []byte, newHash func() hash.Hash, r *Request) bool {
 	sig := r.Options.Signature
 	if m := len(sig) % 4; m != 0 { // add padding if missing
 		sig += strings.Repeat("=", 4-m)
@@ -226,7 +742,7 @@ func validSignature(key []byte, r *Request) bool {
 		return false
 	}
 
-	mac := hmac.New(sha256.New, key)
+	mac := hmac.New(newHash, key)
 	mac.Write([]byte(r.URL.String()))
 	want := mac.Sum(nil)
 
@@ -234,15 +750,12 @@ func validSignature(key []byte, r *Request) bool {
 }
 
 // check304 checks whether we should send a 304 Not Modified in response to
-// req, based on the response resp.  This is determined using the last modified
-// time and the entity tag of resp.
+// req, based on the response resp.  This is determined using the entity tag
+// of resp if req has an If-None-Match header, and using its last modified time
+// otherwise, as specified by RFC 7232.
 func check304(req *http.Request, resp *http.Response) bool {
-	// TODO(willnorris): if-none-match header can be a comma separated list
-	// of multiple tags to be matched, or the special value "*" which
-	// matches all etags
-	etag := resp.Header.Get("Etag")
-	if etag != "" && etag == req.Header.Get("If-None-Match") {
-		return true
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return etagMatch(inm, resp.Header.Get("Etag"))
 	}
 
 	lastModified, err := time.Parse(time.RFC1123, resp.Header.Get("Last-Modified"))
@@ -253,13 +766,40 @@ func check304(req *http.Request, resp *http.Response) bool {
 	if err != nil {
 		return false
 	}
-	if lastModified.Before(ifModSince) {
+	if !lastModified.After(ifModSince) {
 		return true
 	}
 
 	return false
 }
 
+// etagMatch reports whether etag matches any of the comma separated entity
+// tags in the If-None-Match header value inm, using weak comparison.  The
+// special value "*" matches any entity tag.
+func etagMatch(inm, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(inm) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(inm, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// contentETag returns a strong entity tag for the response body b.  It is
+// derived from a hash of b, so identical responses have the same entity tag,
+// even across restarts.
+func contentETag(b []byte) string {
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
 // TransformingTransport is an implementation of http.RoundTripper that
 // optionally transforms images using the options specified in the request URL
 // fragment.
@@ -272,35 +812,141 @@ type TransformingTransport struct {
 	// used rather than Transport directly in order to ensure that
 	// responses are properly cached.
 	CachingClient *http.Client
+
+	// Metrics, if not nil, receives measurements of fetching and
+	// transforming images.
+	Metrics Metrics
+
+	// Config, if not nil, holds the defaults used to transform images for
+	// requests which do not specify them.  The transport created by
+	// NewProxy points to the TransformConfig of the proxy, so that it can
+	// be set after the proxy is created.
+	Config *TransformConfig
+
+	// DefaultQuality, if not nil, specifies the quality that images are
+	// encoded with for requests which do not specify a quality.  Qualities
+	// in Config take precedence.
+	//
+	// Deprecated: set the Quality of Config instead.
+	DefaultQuality *Qualities
+}
+
+// metrics returns the Metrics of t, or a Metrics which discards measurements
+// if it has none.
+func (t *TransformingTransport) metrics() Metrics {
+	if t.Metrics == nil {
+		return nopMetrics{}
+	}
+	return t.Metrics
 }
 
 // RoundTrip implements the http.RoundTripper interface.
 func (t *TransformingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if req.URL.Fragment == "" {
-		// normal requests pass through
+		// normal requests pass through, with any headers added by the
+		// proxy
+		if h, ok := req.Context().Value(upstreamHeaderKey{}).(http.Header); ok {
+			req = req.Clone(req.Context())
+			for name, values := range h {
+				req.Header[name] = values
+			}
+		}
 		glog.Infof("fetching remote URL: %v", req.URL)
-		return t.Transport.RoundTrip(req)
+		start := time.Now()
+		resp, err := t.Transport.RoundTrip(req)
+		t.metrics().FetchDuration(time.Since(start))
+		return resp, err
 	}
 
 	u := *req.URL
 	u.Fragment = ""
-	resp, err := t.CachingClient.Get(u.String())
+	fetch, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.CachingClient.Do(fetch.WithContext(req.Context()))
 	if err != nil {
 		return nil, err
 	}
 
+	var config TransformConfig
+	if t.Config != nil {
+		config = *t.Config
+	}
+	if t.DefaultQuality != nil {
+		config.Quality = config.Quality.or(*t.DefaultQuality)
+	}
+
 	defer resp.Body.Close()
 	b, err := ioutil.ReadAll(resp.Body)
+	partial := false
 	if err != nil {
-		return nil, err
+		// images whose download was cut short can still be partially
+		// decoded, but must not be cached
+		if !config.AllowPartial || err != io.ErrUnexpectedEOF || len(b) == 0 {
+			return nil, err
+		}
+		glog.Warningf("transforming partially fetched image %v: %v", u.String(), err)
+		partial = true
 	}
 
+	t.metrics().BytesFetched(int64(len(b)))
+
 	opt := ParseOptions(req.URL.Fragment)
 
-	img, err := Transform(b, opt)
+	start := time.Now()
+	img, err := transformContext(req.Context(), b, opt, config, nil)
+	if err == nil {
+		// respond with a placeholder instead of the image if requested
+		switch {
+		case opt.Color:
+			img, err = colorJSON(img)
+		case opt.blurHash():
+			var hash string
+			hash, err = BlurHash(img, opt.BlurHashX, opt.BlurHashY)
+			img = []byte(hash)
+		}
+	}
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
 	if err != nil {
 		glog.Errorf("error transforming image: %v", err)
+		t.metrics().Error(ErrorKindTransform)
 		img = b
+		if code := errorStatus(err); code != 0 {
+			// respond with the error rather than the image, which
+			// can not be transformed as requested
+			resp.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+			resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+			resp.Header.Del("Etag")
+			resp.Header.Del("Last-Modified")
+			img = []byte(err.Error())
+		}
+	} else if opt.Color {
+		resp.Header.Set("Content-Type", "application/json")
+	} else if opt.blurHash() {
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	} else if opt.transform() {
+		// the transformed image may be encoded in a different format
+		// than the original (webp images are re-encoded as png, for
+		// example), so update the content type to match.
+		contentType := imageContentType(img)
+		resp.Header.Set("Content-Type", contentType)
+		t.metrics().TransformDuration(strings.TrimPrefix(contentType, "image/"), time.Since(start))
+	}
+
+	if partial {
+		resp.Header.Set("Cache-Control", "no-store")
+		resp.Header.Del("Expires")
+	}
+
+	// the entity tag of the original image does not identify the
+	// transformed image, so derive one from its content instead, which
+	// allows clients to revalidate it cheaply.
+	if err == nil && resp.StatusCode == http.StatusOK &&
+		(opt.transform() || opt.Color || opt.blurHash() || resp.Header.Get("Etag") == "") {
+		resp.Header.Set("Etag", contentETag(img))
 	}
 
 	// replay response with transformed image and updated content length
@@ -312,3 +958,25 @@ func (t *TransformingTransport) RoundTrip(req *http.Request) (*http.Response, er
 
 	return http.ReadResponse(bufio.NewReader(buf), req)
 }
+
+// imageContentType returns the media type of the encoded image img.  TIFF
+// images, which http.DetectContentType does not recognize, are detected by
+// their byte order header.
+func imageContentType(img []byte) string {
+	if bytes.HasPrefix(img, []byte("II*\x00")) || bytes.HasPrefix(img, []byte("MM\x00*")) {
+		return "image/tiff"
+	}
+	return http.DetectContentType(img)
+}
+
+// colorJSON returns the JSON response to requests for the dominant color of
+// the encoded image img.
+func colorJSON(img []byte) ([]byte, error) {
+	c, err := DominantColor(img)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Color string `json:"color"`
+	}{"#" + formatColor(color.NRGBA(c))})
+}
@@ -17,15 +17,22 @@ package imageproxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"image"
+	"image/jpeg"
 	"image/png"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/gregjones/httpcache"
 )
 
 func TestAllowed(t *testing.T) {
@@ -88,6 +95,171 @@ func TestAllowed(t *testing.T) {
 			t.Errorf("allowed(%q) returned %v, want %v.\nTest struct: %#v", req, got, want, tt)
 		}
 	}
+
+	// empty referrers are allowed only if AllowEmptyReferrer is set, while
+	// other referrers must still match
+	for _, tt := range []struct {
+		referer string
+		allowed bool
+	}{
+		{"", true},
+		{"http://good/foo", true},
+		{"http://bad/foo", false},
+	} {
+		p := NewProxy(nil, nil)
+		p.Referrers = whitelist
+		p.AllowEmptyReferrer = true
+		u, _ := url.Parse("http://test/image")
+		req := &Request{u, emptyOptions, genRequest(map[string]string{"Referer": tt.referer})}
+		if got := p.allowed(req); (got == nil) != tt.allowed {
+			t.Errorf("allowed with empty referrers allowed and referer %q returned %v, want allowed %v", tt.referer, got, tt.allowed)
+		}
+	}
+
+	// unsupported hash functions reject all signatures
+	p := NewProxy(nil, nil)
+	p.SignatureKey = key
+	p.SignatureHash = "md5"
+	u, _ := url.Parse("http://test/image")
+	if err := p.allowed(&Request{u, Options{Signature: "NDx5zZHx7QfE8E-ijowRreq6CJJBZjwiRfOVk_mkfQQ="}, nil}); err == nil {
+		t.Errorf("allowed with unsupported signature hash returned nil error")
+	}
+}
+
+func TestProxy_limitSize(t *testing.T) {
+	tests := []struct {
+		maxW, maxH int
+		clamp      bool
+		opt        Options
+		want       Options
+		wantErr    bool
+	}{
+		{0, 0, false, Options{Width: 10000, Height: 10000}, Options{Width: 10000, Height: 10000}, false},
+		{1000, 1000, false, Options{Width: 1000, Height: 500}, Options{Width: 1000, Height: 500}, false},
+		{1000, 1000, false, Options{Width: 0.5, Height: 0.5}, Options{Width: 0.5, Height: 0.5}, false},
+		{1000, 1000, false, Options{Width: 2000}, Options{Width: 2000}, true},
+		{1000, 1000, false, Options{Height: 2000}, Options{Height: 2000}, true},
+		{1000, 0, false, Options{Height: 2000}, Options{Height: 2000}, false},
+
+		// clamped sizes preserve the requested aspect ratio
+		{1000, 1000, true, Options{Width: 2000}, Options{Width: 1000}, false},
+		{1000, 1000, true, Options{Width: 2000, Height: 1000}, Options{Width: 1000, Height: 500}, false},
+		{1000, 800, true, Options{Width: 2000, Height: 2000}, Options{Width: 800, Height: 800}, false},
+		{1000, 1000, true, Options{Width: 3000, Height: 0.5}, Options{Width: 1000, Height: 0.5}, false},
+		{100, 100, true, Options{Width: 100000, Height: 2}, Options{Width: 100, Height: 1}, false},
+
+		// limits apply to the size multiplied by the device pixel ratio
+		{1000, 1000, false, Options{Width: 600, DPR: 2}, Options{Width: 600, DPR: 2}, true},
+		{1000, 1000, true, Options{Width: 600, DPR: 2}, Options{Width: 500, DPR: 2}, false},
+		{1000, 1000, false, Options{Width: 400, DPR: 2}, Options{Width: 400, DPR: 2}, false},
+
+		// percentages are limited to the original size when scaling up
+		{1000, 1000, false, Options{Width: 50, WidthPercent: true}, Options{Width: 50, WidthPercent: true}, false},
+		{1000, 1000, false, Options{Width: 200, WidthPercent: true}, Options{Width: 200, WidthPercent: true}, false},
+		{1000, 1000, false, Options{Width: 100, WidthPercent: true, ScaleUp: true}, Options{Width: 100, WidthPercent: true, ScaleUp: true}, false},
+		{1000, 1000, false, Options{Width: 200, WidthPercent: true, ScaleUp: true}, Options{Width: 200, WidthPercent: true, ScaleUp: true}, true},
+		{0, 0, false, Options{Width: 200, WidthPercent: true, ScaleUp: true}, Options{Width: 200, WidthPercent: true, ScaleUp: true}, false},
+		{
+			1000, 1000, true,
+			Options{Width: 400, WidthPercent: true, Height: 200, HeightPercent: true, ScaleUp: true},
+			Options{Width: 100, WidthPercent: true, Height: 50, HeightPercent: true, ScaleUp: true}, false,
+		},
+		{1000, 1000, true, Options{Width: 200, WidthPercent: true, Height: 3000, ScaleUp: true}, Options{Width: 100, WidthPercent: true, Height: 1000, ScaleUp: true}, false},
+	}
+
+	for _, tt := range tests {
+		p := &Proxy{MaxWidth: tt.maxW, MaxHeight: tt.maxH, ClampSize: tt.clamp}
+		opt := tt.opt
+		err := p.limitSize(&opt)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("limitSize(%v) with max %dx%d returned error %v, want error %t", tt.opt, tt.maxW, tt.maxH, err, tt.wantErr)
+		}
+		if opt != tt.want {
+			t.Errorf("limitSize(%v) with max %dx%d returned options %v, want %v", tt.opt, tt.maxW, tt.maxH, opt, tt.want)
+		}
+	}
+}
+
+func TestClientDPR(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		want    float64
+	}{
+		{nil, 0},
+		{map[string]string{"Sec-CH-DPR": "2"}, 2},
+		{map[string]string{"DPR": "1.5"}, 1.5},
+		{map[string]string{"Sec-CH-DPR": "3", "DPR": "1.5"}, 3},
+		{map[string]string{"Sec-CH-DPR": "x", "DPR": "2"}, 2},
+		{map[string]string{"DPR": "-1"}, 0},
+		{map[string]string{"DPR": "NaN"}, 0},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		if got := clientDPR(req); got != tt.want {
+			t.Errorf("clientDPR(%v) returned %v, want %v", tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptFormat(t *testing.T) {
+	avif := ""
+	if isOutputFormat("avif") {
+		avif = "avif"
+	}
+	// best is the most preferred format of clients accepting both
+	best := "webp"
+	if avif != "" {
+		best = avif
+	}
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"*/*", ""},
+		{"image/*,*/*;q=0.8", ""},
+		{"image/webp,*/*", "webp"},
+		{"text/html, IMAGE/WEBP;q=0.9", "webp"},
+		{"image/webp;q=0", ""},
+		{"image/avif", avif},
+		{"image/avif,image/webp,*/*", best},
+		{"image/avif;q=0,image/webp", "webp"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		if got := acceptFormat(req, nil); got != tt.want {
+			t.Errorf("acceptFormat(%q) returned %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+
+	// formats limits the negotiated formats, in its order of preference
+	formatTests := []struct {
+		accept  string
+		formats []string
+		want    string
+	}{
+		{"image/avif,image/webp", []string{"webp"}, "webp"},
+		{"image/avif,image/webp", []string{"webp", "avif"}, "webp"},
+		{"image/avif", []string{"webp"}, ""},
+		{"image/webp,image/png", []string{"png"}, ""},
+		{"image/avif,image/webp", []string{"avif", "webp"}, best},
+		{"image/avif,image/webp", []string{"avif"}, avif},
+		{"image/webp,*/*", []string{"avif"}, ""},
+	}
+	for _, tt := range formatTests {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Accept", tt.accept)
+		if got := acceptFormat(req, tt.formats); got != tt.want {
+			t.Errorf("acceptFormat(%q, %q) returned %q, want %q", tt.accept, tt.formats, got, tt.want)
+		}
+	}
 }
 
 func TestValidHost(t *testing.T) {
@@ -103,6 +275,7 @@ func TestValidHost(t *testing.T) {
 		{"http://b.test/image", true},
 		{"http://x.b.test/image", true},
 		{"http://x.y.b.test/image", true},
+		{"http://xb.test/image", false},
 
 		{"http://c.test/image", false},
 		{"http://xc.test/image", false},
@@ -125,12 +298,20 @@ func TestValidSignature(t *testing.T) {
 
 	tests := []struct {
 		url     string
+		hash    string
 		options Options
 		valid   bool
 	}{
-		{"http://test/image", Options{Signature: "NDx5zZHx7QfE8E-ijowRreq6CJJBZjwiRfOVk_mkfQQ="}, true},
-		{"http://test/image", Options{Signature: "NDx5zZHx7QfE8E-ijowRreq6CJJBZjwiRfOVk_mkfQQ"}, true},
-		{"http://test/image", emptyOptions, false},
+		{"http://test/image", "", Options{Signature: "NDx5zZHx7QfE8E-ijowRreq6CJJBZjwiRfOVk_mkfQQ="}, true},
+		{"http://test/image", "", Options{Signature: "NDx5zZHx7QfE8E-ijowRreq6CJJBZjwiRfOVk_mkfQQ"}, true},
+		{"http://test/image", "", emptyOptions, false},
+
+		// alternate hash functions
+		{"http://test/image", "sha256", Options{Signature: "NDx5zZHx7QfE8E-ijowRreq6CJJBZjwiRfOVk_mkfQQ="}, true},
+		{"http://test/image", "sha1", Options{Signature: "qXqlgLOJ4syFOrutCDO8Wb5Wjzo="}, true},
+		{"http://test/image", "sha1", Options{Signature: "NDx5zZHx7QfE8E-ijowRreq6CJJBZjwiRfOVk_mkfQQ="}, false},
+		{"http://test/image", "sha512", Options{Signature: "bxpJXtSdCwiGdlb3Lnb1ViJ45BQ4ir3WgibcstGxq0EPgh0vqTJFeYbjfAq5Uo7Rv1O5sLfv1DUCSzpov5jvSg"}, true},
+		{"http://test/image", "sha512", Options{Signature: "NDx5zZHx7QfE8E-ijowRreq6CJJBZjwiRfOVk_mkfQQ="}, false},
 	}
 
 	for _, tt := range tests {
@@ -139,8 +320,8 @@ func TestValidSignature(t *testing.T) {
 			t.Errorf("error parsing url %q: %v", tt.url, err)
 		}
 		req := &Request{u, tt.options, &http.Request{}}
-		if got, want := validSignature(key, req), tt.valid; got != want {
-			t.Errorf("validSignature(%v, %q) returned %v, want %v", key, u, got, want)
+		if got, want := validSignature(key, signatureHashes[tt.hash], req), tt.valid; got != want {
+			t.Errorf("validSignature(%v, %q, %q) returned %v, want %v", key, tt.hash, u, got, want)
 		}
 	}
 }
@@ -160,6 +341,26 @@ func TestCheck304(t *testing.T) {
 			"HTTP/1.1 200 OK\nLast-Modified: Sat, 01 Jan 2000 00:00:00 GMT\n\n",
 			true,
 		},
+		{ // last-modified equal
+			"GET / HTTP/1.1\nIf-Modified-Since: Sat, 01 Jan 2000 00:00:00 GMT\n\n",
+			"HTTP/1.1 200 OK\nLast-Modified: Sat, 01 Jan 2000 00:00:00 GMT\n\n",
+			true,
+		},
+		{ // etag in list
+			"GET / HTTP/1.1\nIf-None-Match: \"a\", \"v\"\n\n",
+			"HTTP/1.1 200 OK\nEtag: \"v\"\n\n",
+			true,
+		},
+		{ // weak etag match
+			"GET / HTTP/1.1\nIf-None-Match: W/\"v\"\n\n",
+			"HTTP/1.1 200 OK\nEtag: \"v\"\n\n",
+			true,
+		},
+		{ // wildcard etag
+			"GET / HTTP/1.1\nIf-None-Match: *\n\n",
+			"HTTP/1.1 200 OK\nEtag: \"v\"\n\n",
+			true,
+		},
 
 		// mismatches
 		{
@@ -197,6 +398,11 @@ func TestCheck304(t *testing.T) {
 			"HTTP/1.1 200 OK\nLast-Modified: Sat, 01 Jan 2000 00:00:00 GMT\n\n",
 			false,
 		},
+		{ // if-none-match takes precedence over if-modified-since
+			"GET / HTTP/1.1\nIf-None-Match: \"a\"\nIf-Modified-Since: Sun, 02 Jan 2000 00:00:00 GMT\n\n",
+			"HTTP/1.1 200 OK\nEtag: \"b\"\nLast-Modified: Sat, 01 Jan 2000 00:00:00 GMT\n\n",
+			false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -240,6 +446,12 @@ func (t testTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		png.Encode(img, m)
 
 		raw = fmt.Sprintf("HTTP/1.1 200 OK\nContent-Length: %d\n\n%s", len(img.Bytes()), img.Bytes())
+	case "/truncated":
+		// a jpeg whose download is cut short
+		img := new(bytes.Buffer)
+		jpeg.Encode(img, image.NewNRGBA(image.Rect(0, 0, 64, 64)), nil)
+		b := img.Bytes()[:img.Len()-16]
+		raw = fmt.Sprintf("HTTP/1.1 200 OK\nContent-Length: %d\nCache-Control: max-age=60\n\n%s", img.Len(), b)
 	default:
 		raw = "HTTP/1.1 404 Not Found\n\n"
 	}
@@ -254,6 +466,7 @@ func TestProxy_ServeHTTP(t *testing.T) {
 			Transport: testTransport{},
 		},
 		Whitelist: []string{"good.test"},
+		MaxWidth:  1000,
 	}
 
 	tests := []struct {
@@ -267,6 +480,8 @@ func TestProxy_ServeHTTP(t *testing.T) {
 		{"/http://good.test/nocontent", http.StatusNoContent},       // non-OK response
 
 		{"/100/http://good.test/ok", http.StatusOK},
+		{"/2000x/http://good.test/ok", http.StatusBadRequest},      // larger than MaxWidth
+		{"/600x,dpr:2/http://good.test/ok", http.StatusBadRequest}, // larger than MaxWidth after DPR
 	}
 
 	for _, tt := range tests {
@@ -280,6 +495,637 @@ func TestProxy_ServeHTTP(t *testing.T) {
 	}
 }
 
+// test that the DPR client hint applies to requests which do not specify one.
+func TestProxy_ServeHTTP_clientDPR(t *testing.T) {
+	p := &Proxy{
+		Client: &http.Client{
+			Transport: testTransport{},
+		},
+		MaxWidth: 1000,
+	}
+
+	tests := []struct {
+		url  string // request URL
+		dpr  string // DPR header
+		code int    // expected response status code
+		vary bool   // whether the response varies by DPR
+	}{
+		{"/600x/http://good.test/ok", "", http.StatusOK, true},
+		{"/600x/http://good.test/ok", "2", http.StatusBadRequest, true},
+		{"/600x,dpr:1/http://good.test/ok", "2", http.StatusOK, false},
+		{"/http://good.test/ok", "2", http.StatusOK, false},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost"+tt.url, nil)
+		if tt.dpr != "" {
+			req.Header.Set("DPR", tt.dpr)
+		}
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%v) with DPR %q returned status %d, want %d", tt.url, tt.dpr, got, want)
+		}
+		if got := resp.Header().Get("Vary") != ""; got != tt.vary {
+			t.Errorf("ServeHTTP(%v) returned Vary %q, want vary %t", tt.url, resp.Header().Get("Vary"), tt.vary)
+		}
+	}
+}
+
+// test that AutoFormat encodes images in the format accepted by the client.
+func TestProxy_ServeHTTP_autoFormat(t *testing.T) {
+	p := NewProxy(testTransport{}, nil)
+	p.AutoFormat = true
+
+	tests := []struct {
+		url    string // request URL
+		accept string // Accept header
+		want   string // expected content type
+		vary   bool   // whether the response varies by Accept
+	}{
+		{"/http://good.test/png", "image/webp,*/*", "image/webp", true},
+		{"/10x/http://good.test/png", "image/webp,*/*", "image/webp", true},
+		{"/http://good.test/png", "*/*", "", true}, // original response has no content type
+		{"/png/http://good.test/png", "image/webp,*/*", "image/png", false},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost"+tt.url, nil)
+		req.Header.Set("Accept", tt.accept)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got := resp.Header().Get("Content-Type"); got != tt.want {
+			t.Errorf("ServeHTTP(%v) with Accept %q returned Content-Type %q, want %q", tt.url, tt.accept, got, tt.want)
+		}
+		vary := strings.Join(resp.Header()["Vary"], ", ")
+		if got := strings.Contains(vary, "Accept"); got != tt.vary {
+			t.Errorf("ServeHTTP(%v) returned Vary %q, want vary %t", tt.url, vary, tt.vary)
+		}
+	}
+}
+
+// test that the transform config set after the proxy is created is used,
+// with qualities taking precedence over the deprecated DefaultQuality.
+func TestProxy_ServeHTTP_transformConfig(t *testing.T) {
+	p := NewProxy(testTransport{}, nil)
+	p.DefaultQuality = Qualities{JPEG: 50, WebP: 60}
+	p.TransformConfig = TransformConfig{Quality: Qualities{JPEG: 10}}
+
+	m := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img := new(bytes.Buffer)
+	png.Encode(img, m)
+
+	tests := []struct {
+		url  string
+		want Options
+	}{
+		{"http://localhost/jpeg/http://good.test/png", Options{Format: "jpeg", Quality: 10}},
+		{"http://localhost/webp/http://good.test/png", Options{Format: "webp", Quality: 60}},
+	}
+	for _, tt := range tests {
+		want, err := Transform(img.Bytes(), tt.want)
+		if err != nil {
+			t.Fatalf("Transform returned unexpected error: %v", err)
+		}
+
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got := resp.Body.Bytes(); !bytes.Equal(got, want) {
+			t.Errorf("ServeHTTP(%v) returned image not encoded with options %v", tt.url, tt.want)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		url         string
+		contentType string
+		want        string
+	}{
+		{"/download/http://good.test/cat.png", "image/png", `attachment; filename=cat.png`},
+		{"/download,jpeg/http://good.test/cat.png", "image/jpeg", `attachment; filename=cat.jpg`},
+		{"/download/http://good.test/img/cat", "image/webp", `attachment; filename=cat.webp`},
+		{"/download/http://good.test/", "image/gif", `attachment; filename=image.gif`},
+		{"/download/http://good.test/cat.tar.gz", "application/gzip", ""},
+		{"/download/http://good.test/cat.png", "text/plain; charset=utf-8", ""},
+		{"/filename:cat.png/http://good.test/x", "image/jpeg", `inline; filename=cat.jpg`},
+		{"/filename:my cat.png,download/http://good.test/x", "image/png", `attachment; filename="my cat.png"`},
+		{"/filename:katze.bmp/http://good.test/x", "image/x-unknown", `inline; filename=katze.bmp`},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest("GET", "http://localhost"+tt.url, nil)
+		req, err := NewRequest(r, nil)
+		if err != nil {
+			t.Fatalf("NewRequest(%q) returned unexpected error: %v", tt.url, err)
+		}
+		if got := contentDisposition(req, tt.contentType); got != tt.want {
+			t.Errorf("contentDisposition(%q, %q) returned %q, want %q", tt.url, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_download(t *testing.T) {
+	p := NewProxy(testTransport{}, nil)
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://localhost/webp,download/http://good.test/png", `attachment; filename=png.webp`},
+		{"http://localhost/jpeg,filename:photo.png/http://good.test/png", `inline; filename=photo.jpg`},
+		{"http://localhost/jpeg/http://good.test/png", ""},
+		{"http://localhost/download,color/http://good.test/png", ""},
+		{"http://localhost/download/http://good.test/nocontent", ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got := resp.Header().Get("Content-Disposition"); got != tt.want {
+			t.Errorf("ServeHTTP(%v) returned Content-Disposition %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+// test that default qualities set after the proxy is created are used.
+func TestProxy_ServeHTTP_defaultQuality(t *testing.T) {
+	p := NewProxy(testTransport{}, nil)
+	p.DefaultQuality = Qualities{JPEG: 10}
+
+	m := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img := new(bytes.Buffer)
+	png.Encode(img, m)
+	want, err := Transform(img.Bytes(), Options{Format: "jpeg", Quality: 10})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/jpeg/http://good.test/png", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got := resp.Body.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("ServeHTTP returned image not encoded with default JPEG quality 10")
+	}
+}
+
+// keyCache is a Cache that records the keys of the data set in it.
+type keyCache struct {
+	Cache
+	keys []string
+}
+
+func (c *keyCache) Set(key string, data []byte) {
+	c.keys = append(c.keys, key)
+	c.Cache.Set(key, data)
+}
+
+// test that responses negotiated from request headers are cached separately.
+func TestProxy_ServeHTTP_varyCache(t *testing.T) {
+	c := &keyCache{Cache: httpcache.NewMemoryCache()}
+	p := NewProxy(testTransport{}, c)
+	p.AutoFormat = true
+
+	get := func(accept, dpr string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost/1x/http://good.test/png", nil)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("DPR", dpr)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+		return resp
+	}
+
+	webp := get("image/webp,*/*", "1")
+	orig := get("*/*", "1")
+	hidpi := get("*/*", "2")
+	if got, want := webp.Header().Get("Content-Type"), "image/webp"; got != want {
+		t.Errorf("ServeHTTP accepting webp returned Content-Type %q, want %q", got, want)
+	}
+	if got, want := orig.Header().Get("Content-Type"), "image/png"; got != want {
+		t.Errorf("ServeHTTP not accepting webp returned Content-Type %q, want %q", got, want)
+	}
+	if got := hidpi.Header().Get(httpcache.XFromCache); got != "" {
+		t.Errorf("ServeHTTP with different DPR was served from cache")
+	}
+
+	// the remote image is cached once, and each transformed response
+	// under its own key
+	keys := make(map[string]bool)
+	for _, k := range c.keys {
+		keys[k] = true
+	}
+	if got, want := len(keys), 4; got != want {
+		t.Errorf("ServeHTTP cached %d distinct keys %q, want %d", got, c.keys, want)
+	}
+
+	// repeating a request is served from the matching cache entry
+	if got, want := get("image/webp", "1").Header().Get("Content-Type"), "image/webp"; got != want {
+		t.Errorf("ServeHTTP accepting webp again returned Content-Type %q, want %q", got, want)
+	}
+	if got, want := get("*/*", "1").Header().Get("Content-Type"), "image/png"; got != want {
+		t.Errorf("ServeHTTP not accepting webp again returned Content-Type %q, want %q", got, want)
+	}
+
+	// requests for a negotiated format share its cache entry
+	req, _ := http.NewRequest("GET", "http://localhost/1x,webp/http://good.test/png", nil)
+	req.Header.Set("DPR", "1")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	for _, k := range c.keys {
+		keys[k] = true
+	}
+	if got, want := len(keys), 4; got != want {
+		t.Errorf("ServeHTTP of explicit webp cached %d distinct keys %q, want %d", got, c.keys, want)
+	}
+}
+
+// test that AutoFormats limits the negotiated formats.
+func TestProxy_ServeHTTP_autoFormats(t *testing.T) {
+	p := NewProxy(testTransport{}, nil)
+	p.AutoFormat = true
+	p.AutoFormats = []string{"png"}
+
+	req, _ := http.NewRequest("GET", "http://localhost/http://good.test/png", nil)
+	req.Header.Set("Accept", "image/webp,*/*")
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+	if got := resp.Header().Get("Content-Type"); got != "" {
+		t.Errorf("ServeHTTP with AutoFormats %q returned Content-Type %q, want original response", p.AutoFormats, got)
+	}
+
+	p.AutoFormats = []string{"webp"}
+	resp = httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+	if got, want := resp.Header().Get("Content-Type"), "image/webp"; got != want {
+		t.Errorf("ServeHTTP with AutoFormats %q returned Content-Type %q, want %q", p.AutoFormats, got, want)
+	}
+}
+
+// sizeCache is a Cache that records the size of the data set in it.
+type sizeCache struct {
+	Cache
+	sizes map[string]int
+}
+
+func (c *sizeCache) Set(key string, data []byte) {
+	c.sizes[key] = len(data)
+	c.Cache.Set(key, data)
+}
+
+func (c *sizeCache) Delete(key string) {
+	delete(c.sizes, key)
+	c.Cache.Delete(key)
+}
+
+// BenchmarkProxy_CacheSize reports the number of entries and bytes cached for
+// images requested at several sizes by clients accepting different formats,
+// with and without format negotiation, and how many of the bytes are of
+// transformed images rather than remote images.
+func BenchmarkProxy_CacheSize(b *testing.B) {
+	img := new(bytes.Buffer)
+	png.Encode(img, newPhoto(256, 256))
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		raw := fmt.Sprintf("HTTP/1.1 200 OK\nContent-Length: %d\nCache-Control: max-age=3600\n\n%s", img.Len(), img.Bytes())
+		return http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), req)
+	})
+
+	accepts := []string{"image/avif,image/webp,*/*", "image/webp,*/*", "*/*"}
+	urls := []string{"/64x/http://good.test/a", "/128x/http://good.test/a", "/64x/http://good.test/b"}
+	benchmarks := []struct {
+		name       string
+		autoFormat bool
+		formats    []string
+	}{
+		{"negotiation=off", false, nil},
+		{"negotiation=on", true, nil},
+		{"negotiation=webp", true, []string{"webp"}},
+	}
+	for _, bb := range benchmarks {
+		b.Run(bb.name, func(b *testing.B) {
+			var entries, size, transformed int
+			for i := 0; i < b.N; i++ {
+				c := &sizeCache{Cache: httpcache.NewMemoryCache(), sizes: make(map[string]int)}
+				p := NewProxy(transport, c)
+				p.AutoFormat = bb.autoFormat
+				p.AutoFormats = bb.formats
+				for _, u := range urls {
+					for _, accept := range accepts {
+						req, _ := http.NewRequest("GET", "http://localhost"+u, nil)
+						req.Header.Set("Accept", accept)
+						p.ServeHTTP(httptest.NewRecorder(), req)
+					}
+				}
+				entries, size, transformed = len(c.sizes), 0, 0
+				for key, n := range c.sizes {
+					size += n
+					if strings.Contains(key, "#") {
+						transformed += n
+					}
+				}
+			}
+			b.ReportMetric(float64(entries), "cache-entries")
+			b.ReportMetric(float64(size), "cache-bytes")
+			b.ReportMetric(float64(transformed), "transformed-bytes")
+		})
+	}
+}
+
+// test that requests for hosts other than AllowHosts are never fetched.
+func TestProxy_ServeHTTP_allowHosts(t *testing.T) {
+	var fetched []string
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		fetched = append(fetched, req.URL.String())
+		raw := "HTTP/1.1 200 OK\n\n"
+		if req.URL.Path == "/redirect" {
+			raw = "HTTP/1.1 302 Found\nLocation: http://bad.test/image\n\n"
+		}
+		return http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), req)
+	})
+	p := NewProxy(transport, nil)
+	p.AllowHosts = []string{"*.good.test"}
+	p.SignatureKey = []byte("c0ffee")
+
+	tests := []struct {
+		url     string
+		code    int
+		fetched []string
+	}{
+		// allowed host, but unsigned
+		{"/http://good.test/image", http.StatusForbidden, nil},
+		// signed, but not an allowed host
+		{"/sNDx5zZHx7QfE8E-ijowRreq6CJJBZjwiRfOVk_mkfQQ/http://test/image", http.StatusForbidden, nil},
+		// signed and allowed
+		{"/s9f9BVB3Z0LgA0kqqX8clgx6QkLYdMFAQo-k3Y6XzriI=/http://x.good.test/image", http.StatusOK, []string{"http://x.good.test/image"}},
+		// signed and allowed, but redirected to a host that is not allowed
+		{"/sj2vi2qhsVdJH3CD4oVU5CyedEbXJYLH_p8TVUGlUtQ8=/http://x.good.test/redirect", http.StatusInternalServerError, []string{"http://x.good.test/redirect"}},
+	}
+
+	for _, tt := range tests {
+		fetched = nil
+		req, _ := http.NewRequest("GET", "http://localhost"+tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%v) returned status %d, want %d", tt.url, got, want)
+		}
+		if !reflect.DeepEqual(fetched, tt.fetched) {
+			t.Errorf("ServeHTTP(%v) fetched %v, want %v", tt.url, fetched, tt.fetched)
+		}
+	}
+}
+
+func TestProxy_checkRedirect(t *testing.T) {
+	get := func(url string) *http.Request {
+		req, _ := http.NewRequest("GET", url, nil)
+		return req
+	}
+	chain := func(n int) []*http.Request {
+		var via []*http.Request
+		for i := 0; i < n; i++ {
+			via = append(via, get(fmt.Sprintf("http://good.test/%d", i)))
+		}
+		return via
+	}
+
+	tests := []struct {
+		maxRedirects int
+		url          string
+		via          []*http.Request
+		allowed      bool
+	}{
+		{0, "http://good.test/image", chain(1), true},
+		{0, "http://good.test/image", chain(9), true},
+		{0, "http://good.test/image", chain(10), false},
+		{3, "http://good.test/image", chain(2), true},
+		{3, "http://good.test/image", chain(3), false},
+		{-1, "http://good.test/image", chain(1), false},
+		{0, "http://good.test/1", chain(3), false}, // loop
+		{0, "file:///etc/passwd", chain(1), false},
+		{0, "http://bad.test/image", chain(1), false},
+		{0, "http://x.good.test/image", chain(1), true},
+	}
+
+	for _, tt := range tests {
+		p := &Proxy{MaxRedirects: tt.maxRedirects, AllowHosts: []string{"*.good.test"}}
+		err := p.checkRedirect(get(tt.url), tt.via)
+		if got := err == nil; got != tt.allowed {
+			t.Errorf("checkRedirect(%v) with %d redirects and limit %d returned %v, want allowed %v", tt.url, len(tt.via), tt.maxRedirects, err, tt.allowed)
+		}
+	}
+}
+
+// test that redirect loops are detected rather than followed.
+func TestProxy_ServeHTTP_redirectLoop(t *testing.T) {
+	var fetches int
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		fetches++
+		raw := "HTTP/1.1 302 Found\nLocation: http://good.test/b\n\n"
+		if req.URL.Path == "/b" {
+			raw = "HTTP/1.1 302 Found\nLocation: http://good.test/a\n\n"
+		}
+		return http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), req)
+	})
+	p := NewProxy(transport, nil)
+
+	req, _ := http.NewRequest("GET", "http://localhost/http://good.test/a", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Code, http.StatusInternalServerError; got != want {
+		t.Errorf("ServeHTTP(%v) returned status %d, want %d", req, got, want)
+	}
+	if !strings.Contains(resp.Body.String(), "redirect loop") {
+		t.Errorf("ServeHTTP(%v) returned body %q, want redirect loop error", req, resp.Body.String())
+	}
+	if fetches != 2 {
+		t.Errorf("ServeHTTP(%v) fetched %d URLs, want 2", req, fetches)
+	}
+}
+
+// test that configured and forwarded headers reach the remote server.
+func TestProxy_ServeHTTP_upstreamHeader(t *testing.T) {
+	var got http.Header
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.Header
+		return http.ReadResponse(bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\n\n")), req)
+	})
+	p := NewProxy(transport, nil)
+	p.UserAgent = "imageproxy-test"
+	p.Header = http.Header{"X-Api-Key": {"c0ffee"}}
+	p.ForwardHeaders = []string{"accept-language"}
+
+	for _, url := range []string{"/http://good.test/image", "/100/http://good.test/image"} {
+		got = nil
+		req, _ := http.NewRequest("GET", "http://localhost"+url, nil)
+		req.Header.Set("Accept-Language", "de")
+		req.Header.Set("Cookie", "session=secret")
+		p.ServeHTTP(httptest.NewRecorder(), req)
+
+		want := http.Header{
+			"User-Agent":      {"imageproxy-test"},
+			"X-Api-Key":       {"c0ffee"},
+			"Accept-Language": {"de"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ServeHTTP(%v) sent remote headers %v, want %v", url, got, want)
+		}
+	}
+}
+
+// test that default options are applied to requests which do not set them.
+func TestProxy_ServeHTTP_defaultOptions(t *testing.T) {
+	var fragment string
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		fragment = req.URL.Fragment
+		return http.ReadResponse(bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\n\n")), req)
+	})
+	p := &Proxy{
+		Client:         &http.Client{Transport: transport},
+		DefaultOptions: Options{Quality: 80, StripMetadata: true},
+	}
+
+	tests := []struct {
+		url  string // request URL
+		want string // expected options
+	}{
+		{"/http://good.test/image", "0x0,q80,strip"},
+		{"/100x,q50/http://good.test/image", "100x0,q50,strip"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost"+tt.url, nil)
+		p.ServeHTTP(httptest.NewRecorder(), req)
+		if fragment != tt.want {
+			t.Errorf("ServeHTTP(%v) requested options %q, want %q", tt.url, fragment, tt.want)
+		}
+	}
+}
+
+// test that requests are rejected if default options make their options
+// invalid.
+func TestProxy_ServeHTTP_invalidDefaultOptions(t *testing.T) {
+	p := &Proxy{
+		Client:         &http.Client{Transport: testTransport{}},
+		DefaultOptions: Options{Pipeline: "resize"},
+	}
+
+	tests := []struct {
+		url  string // request URL
+		code int    // expected response status code
+	}{
+		{"/100x/http://good.test/png", http.StatusOK},
+		{"/100x,blur:2/http://good.test/png", http.StatusBadRequest}, // blur is not in the default pipeline
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost"+tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%v) returned status %d, want %d", tt.url, got, want)
+		}
+	}
+}
+
+// test that requests cannot scale images up unless the proxy allows it.
+func TestProxy_ServeHTTP_scaleUp(t *testing.T) {
+	var fragment string
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		fragment = req.URL.Fragment
+		return http.ReadResponse(bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\n\n")), req)
+	})
+
+	for _, scaleUp := range []bool{false, true} {
+		p := &Proxy{
+			Client:         &http.Client{Transport: transport},
+			DefaultOptions: Options{ScaleUp: true},
+			ScaleUp:        scaleUp,
+		}
+		req, _ := http.NewRequest("GET", "http://localhost/100x,scaleUp/http://good.test/image", nil)
+		p.ServeHTTP(httptest.NewRecorder(), req)
+		if got := ParseOptions(fragment).ScaleUp; got != scaleUp {
+			t.Errorf("ServeHTTP with ScaleUp %v requested ScaleUp %v", scaleUp, got)
+		}
+	}
+}
+
+// test that clients exceeding the rate limit are refused.
+func TestProxy_ServeHTTP_rateLimit(t *testing.T) {
+	p := &Proxy{
+		Client: &http.Client{
+			Transport: testTransport{},
+		},
+		RateLimiter:    NewRateLimiter(1, 1),
+		TrustedProxies: 1,
+	}
+
+	get := func(client string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost/http://good.test/ok", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", client)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+		return resp
+	}
+
+	if got, want := get("1.2.3.4").Code, http.StatusOK; got != want {
+		t.Errorf("ServeHTTP returned status %d, want %d", got, want)
+	}
+	resp := get("1.2.3.4")
+	if got, want := resp.Code, http.StatusTooManyRequests; got != want {
+		t.Errorf("ServeHTTP exceeding rate limit returned status %d, want %d", got, want)
+	}
+	if got, want := resp.Header().Get("Retry-After"), "1"; got != want {
+		t.Errorf("ServeHTTP exceeding rate limit returned Retry-After %q, want %q", got, want)
+	}
+	if got, want := get("5.6.7.8").Code, http.StatusOK; got != want {
+		t.Errorf("ServeHTTP for another client returned status %d, want %d", got, want)
+	}
+}
+
+// test that slow remote servers result in a timeout, and that their requests
+// are canceled.
+func TestProxy_ServeHTTP_timeout(t *testing.T) {
+	canceled := make(chan bool, 1)
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		select {
+		case <-req.Context().Done():
+			canceled <- true
+			return nil, req.Context().Err()
+		case <-time.After(5 * time.Second):
+			canceled <- false
+			return nil, errors.New("request was not canceled")
+		}
+	})
+
+	tests := []struct {
+		timeout, fetchTimeout time.Duration
+	}{
+		{0, 10 * time.Millisecond},
+		{10 * time.Millisecond, 0},
+	}
+
+	for _, tt := range tests {
+		p := NewProxy(transport, nil)
+		p.Timeout = tt.timeout
+		p.FetchTimeout = tt.fetchTimeout
+
+		req, _ := http.NewRequest("GET", "http://localhost/http://good.test/slow", nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, http.StatusGatewayTimeout; got != want {
+			t.Errorf("ServeHTTP with timeouts %v, %v returned status %d, want %d", tt.timeout, tt.fetchTimeout, got, want)
+		}
+		if !<-canceled {
+			t.Errorf("ServeHTTP with timeouts %v, %v did not cancel remote request", tt.timeout, tt.fetchTimeout)
+		}
+	}
+}
+
 // test that 304 Not Modified responses are returned properly.
 func TestProxy_ServeHTTP_is304(t *testing.T) {
 	p := &Proxy{
@@ -301,6 +1147,206 @@ func TestProxy_ServeHTTP_is304(t *testing.T) {
 	}
 }
 
+func TestUpdateMaxAge(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Add(-100 * time.Second).Format(http.TimeFormat)
+
+	tests := []struct {
+		header http.Header
+		want   string
+	}{
+		{http.Header{}, ""},
+		{http.Header{"Cache-Control": {"max-age=3600"}}, "max-age=3600"},
+		{http.Header{"Cache-Control": {"no-cache"}, "Date": {date}}, "no-cache"},
+		{http.Header{"Cache-Control": {"max-age=3600"}, "Date": {date}}, "max-age=3500"},
+		{http.Header{"Cache-Control": {"public,max-age=3600"}, "Date": {date}}, "public, max-age=3500"},
+		{http.Header{"Cache-Control": {"max-age=3600, s-maxage=60"}, "Date": {date}, "Age": {"500"}}, "max-age=3000, s-maxage=60"},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Date": {date}}, "max-age=0"},
+		{http.Header{"Cache-Control": {"max-age=invalid"}, "Date": {date}}, "max-age=invalid"},
+	}
+
+	for _, tt := range tests {
+		if got := updateMaxAge(tt.header, now); got != tt.want {
+			t.Errorf("updateMaxAge(%v) returned %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// test that cached responses are revalidated once they exceed their max-age.
+func TestProxy_ServeHTTP_maxAge(t *testing.T) {
+	var fetches, revalidations int
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		fetches++
+		raw := "HTTP/1.1 200 OK\n"
+		if req.Header.Get("If-None-Match") == `"tag"` {
+			revalidations++
+			raw = "HTTP/1.1 304 Not Modified\n"
+		}
+		maxAge := 3600
+		if req.URL.Path == "/stale" {
+			maxAge = 0
+		}
+		raw += fmt.Sprintf("Etag: \"tag\"\nDate: %s\nCache-Control: max-age=%d\n\n",
+			time.Now().UTC().Format(http.TimeFormat), maxAge)
+		return http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), req)
+	})
+	p := NewProxy(transport, httpcache.NewMemoryCache())
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost/"+url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// fresh responses are served from cache
+	get("http://good.test/fresh")
+	resp := get("http://good.test/fresh")
+	if fetches != 1 || revalidations != 0 {
+		t.Errorf("ServeHTTP made %d fetches and %d revalidations of fresh response, want 1 and 0", fetches, revalidations)
+	}
+	if got, want := resp.Header().Get("Cache-Control"), "max-age=3600"; got != want {
+		t.Errorf("ServeHTTP returned Cache-Control %q, want %q", got, want)
+	}
+
+	// stale responses are revalidated
+	fetches = 0
+	get("http://good.test/stale")
+	resp = get("http://good.test/stale")
+	if fetches != 2 || revalidations != 1 {
+		t.Errorf("ServeHTTP made %d fetches and %d revalidations of stale response, want 2 and 1", fetches, revalidations)
+	}
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("ServeHTTP returned status %d for revalidated response, want %d", got, want)
+	}
+}
+
+func TestTransformingTransport_Placeholder(t *testing.T) {
+	client := new(http.Client)
+	tr := &TransformingTransport{
+		Transport:     testTransport{},
+		CachingClient: client,
+	}
+	client.Transport = tr
+
+	req, _ := http.NewRequest("GET", "http://good.test/png#color", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip returned unexpected error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if got, want := string(body), `{"color":"#00000000"}`; got != want {
+		t.Errorf("RoundTrip returned body %s, want %s", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("RoundTrip returned content type %q, want %q", got, want)
+	}
+
+	req, _ = http.NewRequest("GET", "http://good.test/png#blurhash:1x1", nil)
+	resp, err = tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip returned unexpected error: %v", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	if got, want := string(body), "000000"; got != want {
+		t.Errorf("RoundTrip returned body %s, want %s", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+		t.Errorf("RoundTrip returned content type %q, want %q", got, want)
+	}
+
+	req, _ = http.NewRequest("GET", "http://good.test/ok#color", nil)
+	if resp, err := tr.RoundTrip(req); err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("RoundTrip of non-image returned %v, %v, want status %d", resp, err, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestTransformingTransport_ETag(t *testing.T) {
+	client := new(http.Client)
+	tr := &TransformingTransport{
+		Transport:     testTransport{},
+		CachingClient: client,
+	}
+	client.Transport = tr
+
+	etag := func(url string) string {
+		req, _ := http.NewRequest("GET", url, nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip(%v) returned unexpected error: %v", url, err)
+		}
+		return resp.Header.Get("Etag")
+	}
+
+	jpegTag := etag("http://good.test/png#jpeg")
+	if !strings.HasPrefix(jpegTag, `"`) || !strings.HasSuffix(jpegTag, `"`) {
+		t.Errorf("RoundTrip returned invalid strong etag %s", jpegTag)
+	}
+	if got := etag("http://good.test/png#jpeg"); got != jpegTag {
+		t.Errorf("RoundTrip of identical request returned etag %s, want %s", got, jpegTag)
+	}
+	if got := etag("http://good.test/png#gif"); got == jpegTag {
+		t.Errorf("RoundTrip of different transformation returned the same etag %s", got)
+	}
+
+	// untransformed images keep their original etag
+	if got, want := etag("http://good.test/etag#0x0"), `"tag"`; got != want {
+		t.Errorf("RoundTrip of untransformed image returned etag %s, want %s", got, want)
+	}
+
+	// revalidating a transformed image returns 304 Not Modified
+	p := &Proxy{Client: client}
+	req, _ := http.NewRequest("GET", "http://localhost/jpeg/http://good.test/png", nil)
+	req.Header.Add("If-None-Match", jpegTag)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+	if got, want := resp.Code, http.StatusNotModified; got != want {
+		t.Errorf("ServeHTTP(%v) returned status %d, want %d", req, got, want)
+	}
+}
+
+// test that images whose download is cut short are transformed if partial
+// images are allowed, and are not cached.
+func TestTransformingTransport_AllowPartial(t *testing.T) {
+	client := new(http.Client)
+	tr := &TransformingTransport{
+		Transport:     testTransport{},
+		CachingClient: client,
+	}
+	client.Transport = tr
+
+	req, _ := http.NewRequest("GET", "http://good.test/truncated#32x", nil)
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Errorf("RoundTrip of truncated image did not return expected error")
+	}
+
+	tr.Config = &TransformConfig{AllowPartial: true}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip of truncated image with AllowPartial returned error: %v", err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("RoundTrip returned status code %d, want %d", got, want)
+	}
+	if got, want := resp.Header.Get("Cache-Control"), "no-store"; got != want {
+		t.Errorf("RoundTrip returned Cache-Control %q, want %q", got, want)
+	}
+	m, err := jpeg.Decode(resp.Body)
+	if err != nil {
+		t.Fatalf("error decoding transformed image: %v", err)
+	}
+	if got := m.Bounds(); got.Dx() != 32 {
+		t.Errorf("RoundTrip returned image of width %d, want 32", got.Dx())
+	}
+}
+
 func TestTransformingTransport(t *testing.T) {
 	client := new(http.Client)
 	tr := &TransformingTransport{
@@ -316,6 +1362,8 @@ func TestTransformingTransport(t *testing.T) {
 	}{
 		{"http://good.test/png#1", http.StatusOK, false},
 		{"http://good.test/error#1", http.StatusInternalServerError, true},
+		{"http://good.test/ok#1", http.StatusUnsupportedMediaType, false}, // not an image
+		{"http://good.test/ok", http.StatusOK, false},                     // not transformed
 		// TODO: test more than just status code... verify that image
 		// is actually transformed and returned properly and that
 		// non-image responses are returned as-is
@@ -337,4 +1385,12 @@ func TestTransformingTransport(t *testing.T) {
 			t.Errorf("RoundTrip(%v) returned status code %d, want %d", tt.url, got, want)
 		}
 	}
+
+	// canceled requests are not transformed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequest("GET", "http://good.test/png#1", nil)
+	if _, err := tr.RoundTrip(req.WithContext(ctx)); err == nil {
+		t.Errorf("RoundTrip with canceled context did not return an error")
+	}
 }
@@ -0,0 +1,133 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lrucache provides an in-memory cache implementation limited to a
+// maximum size, which evicts the least recently used entries to stay within
+// it.
+package lrucache
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+)
+
+// Cache is an in-memory implementation of imageproxy.Cache with a maximum
+// size.  It is safe for concurrent use.
+type Cache struct {
+	maxSize int64
+
+	mu        sync.Mutex
+	size      int64
+	evictions int64
+	lru       *list.List // most recently used entries at the front
+	entries   map[string]*list.Element
+}
+
+type entry struct {
+	key  string
+	data []byte
+}
+
+// Stats describes the current state of a Cache.
+type Stats struct {
+	Size      int64 `json:"size"`      // total size in bytes of cached keys and data
+	Items     int   `json:"items"`     // number of cached entries
+	Evictions int64 `json:"evictions"` // number of entries evicted to stay within the maximum size
+}
+
+// New returns a new Cache which holds up to maxSize bytes of keys and data.
+// If maxSize is zero or less, the cache size is unlimited.
+func New(maxSize int64) *Cache {
+	return &Cache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get retrieves the cached data for the provided key, marking it as most
+// recently used.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*entry).data, true
+}
+
+// Set caches the provided data, evicting the least recently used entries
+// if needed to stay within the maximum size.  Data larger than the maximum
+// size is not cached.
+func (c *Cache) Set(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+
+	size := entrySize(key, data)
+	if c.maxSize > 0 && size > c.maxSize {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&entry{key, data})
+	c.size += size
+
+	for c.maxSize > 0 && c.size > c.maxSize {
+		c.removeElement(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// Delete deletes the cached data at the specified key.
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+}
+
+// Stats returns the current size of c and the number of entries evicted.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Size: c.size, Items: c.lru.Len(), Evictions: c.evictions}
+}
+
+// String returns the current Stats of c as JSON, so that c implements
+// expvar.Var and its size and evictions can be published with
+// expvar.Publish.
+func (c *Cache) String() string {
+	b, _ := json.Marshal(c.Stats())
+	return string(b)
+}
+
+// remove removes key from c, if present.  c.mu must be held.
+func (c *Cache) remove(key string) {
+	if e, ok := c.entries[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+// removeElement removes the entry e from c.  c.mu must be held.
+func (c *Cache) removeElement(e *list.Element) {
+	ent := c.lru.Remove(e).(*entry)
+	delete(c.entries, ent.key)
+	c.size -= entrySize(ent.key, ent.data)
+}
+
+// entrySize returns the size an entry counts toward the maximum cache size.
+func entrySize(key string, data []byte) int64 {
+	return int64(len(key) + len(data))
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lrucache
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	c := New(0)
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Get of missing key returned ok")
+	}
+	c.Set("a", []byte("data"))
+	if got, ok := c.Get("a"); !ok || string(got) != "data" {
+		t.Errorf("Get returned %q, %t; want %q, true", got, ok, "data")
+	}
+	c.Set("a", []byte("new"))
+	if got, want := c.Stats(), (Stats{Size: 4, Items: 1}); got != want {
+		t.Errorf("Stats after replacing entry returned %+v, want %+v", got, want)
+	}
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Get of deleted key returned ok")
+	}
+	if got, want := c.Stats(), (Stats{}); got != want {
+		t.Errorf("Stats after deleting entry returned %+v, want %+v", got, want)
+	}
+}
+
+func TestCache_Evict(t *testing.T) {
+	data := bytes.Repeat([]byte{0}, 9)
+	c := New(30) // room for three 10 byte entries
+
+	c.Set("a", data)
+	c.Set("b", data)
+	c.Set("c", data)
+	c.Get("a") // b is now the least recently used entry
+	c.Set("d", data)
+
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("least recently used entry was not evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("entry %q was evicted", key)
+		}
+	}
+
+	c.Set("e", data)
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("oldest entry was not evicted")
+	}
+	if got, want := c.Stats(), (Stats{Size: 30, Items: 3, Evictions: 2}); got != want {
+		t.Errorf("Stats returned %+v, want %+v", got, want)
+	}
+
+	// entries larger than the cache are not stored
+	c.Set("big", make([]byte, 100))
+	if _, ok := c.Get("big"); ok {
+		t.Errorf("entry larger than the cache was stored")
+	}
+	if got, want := c.Stats().Items, 3; got != want {
+		t.Errorf("Stats returned %d items, want %d", got, want)
+	}
+}
+
+// test that the stats published through expvar follow evictions.
+func TestCache_String(t *testing.T) {
+	c := New(20) // room for two 10 byte entries
+	var _ expvar.Var = c
+
+	stats := func() Stats {
+		var s Stats
+		if err := json.Unmarshal([]byte(c.String()), &s); err != nil {
+			t.Fatalf("String returned invalid JSON %q: %v", c.String(), err)
+		}
+		return s
+	}
+
+	data := bytes.Repeat([]byte{0}, 9)
+	c.Set("a", data)
+	c.Set("b", data)
+	if got, want := stats(), (Stats{Size: 20, Items: 2}); got != want {
+		t.Errorf("String returned %+v, want %+v", got, want)
+	}
+	c.Set("c", data)
+	c.Set("d", []byte{0})
+	if got, want := stats(), (Stats{Size: 12, Items: 2, Evictions: 2}); got != want {
+		t.Errorf("String after evictions returned %+v, want %+v", got, want)
+	}
+}
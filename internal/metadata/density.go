@@ -0,0 +1,120 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// jpegJFIFPrefix identifies APP0 segments containing a JFIF header, as
+// specified in the JFIF specification.
+var jpegJFIFPrefix = []byte("JFIF\x00")
+
+// jfifHeaderSize is the size of a JFIF header without a thumbnail, after
+// the marker and length bytes.
+const jfifHeaderSize = 14
+
+// Resolution units of JFIF headers and PNG pHYs chunks.
+const (
+	jfifUnitsDPI  = 1 // dots per inch
+	pngUnitsMeter = 1 // pixels per meter
+)
+
+// metersPerInch converts resolutions in dots per inch to pixels per meter.
+const metersPerInch = 0.0254
+
+// SetDPI returns the JPEG or PNG image img with its resolution set to dpi
+// dots per inch, in the density fields of its JFIF header or its pHYs chunk.
+// A JFIF header is added to JPEG images which have none.  Images in other
+// formats are returned unchanged.
+func SetDPI(img []byte, dpi int) ([]byte, error) {
+	if dpi <= 0 || dpi > 0xffff {
+		return nil, errors.New("metadata: DPI out of range")
+	}
+	switch {
+	case bytes.HasPrefix(img, jpegMagic):
+		return setJPEGDPI(img, dpi)
+	case bytes.HasPrefix(img, pngMagic):
+		return setPNGDPI(img, dpi)
+	}
+	return img, nil
+}
+
+// setJPEGDPI sets the density of the JFIF header of img to dpi.  Images
+// without a JFIF header, such as those written by the image/jpeg encoder,
+// have one added directly after the SOI marker, as required by the JFIF
+// specification.
+func setJPEGDPI(img []byte, dpi int) ([]byte, error) {
+	segments, rest, err := jpegSegments(img)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(img)+2+2+jfifHeaderSize)
+	out = append(out, 0xff, markerSOI)
+	i := 0
+	if len(segments) > 0 && segments[0].marker == markerAPP0 &&
+		bytes.HasPrefix(segments[0].payload(), jpegJFIFPrefix) && len(segments[0].payload()) >= jfifHeaderSize {
+		start := len(out)
+		out = append(out, segments[0].data...)
+		jfif := out[start+4:]
+		jfif[7] = jfifUnitsDPI
+		binary.BigEndian.PutUint16(jfif[8:], uint16(dpi))
+		binary.BigEndian.PutUint16(jfif[10:], uint16(dpi))
+		i++
+	} else {
+		n := 2 + jfifHeaderSize
+		out = append(out, 0xff, markerAPP0, byte(n>>8), byte(n))
+		out = append(out, jpegJFIFPrefix...)
+		out = append(out, 1, 2, jfifUnitsDPI, byte(dpi>>8), byte(dpi), byte(dpi>>8), byte(dpi), 0, 0)
+	}
+	for _, s := range segments[i:] {
+		out = append(out, s.data...)
+	}
+	return append(out, rest...), nil
+}
+
+// setPNGDPI replaces the pHYs chunk of img with one for dpi, converted to
+// pixels per meter.  The chunk is placed directly after the IHDR chunk,
+// since it must precede the IDAT chunks.
+func setPNGDPI(img []byte, dpi int) ([]byte, error) {
+	chunks, err := pngChunks(img)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 || chunks[0].typ != "IHDR" {
+		return nil, errors.New("metadata: missing IHDR chunk")
+	}
+
+	ppm := uint32(math.Floor(float64(dpi)/metersPerInch + 0.5))
+	data := make([]byte, 9)
+	binary.BigEndian.PutUint32(data[0:], ppm)
+	binary.BigEndian.PutUint32(data[4:], ppm)
+	data[8] = pngUnitsMeter
+
+	out := make([]byte, 0, len(img)+12+len(data))
+	out = append(out, pngMagic...)
+	out = append(out, chunks[0].data...)
+	out = appendPNGChunk(out, "pHYs", data)
+	for _, c := range chunks[1:] {
+		if c.typ != "pHYs" {
+			out = append(out, c.data...)
+		}
+	}
+	return out, nil
+}
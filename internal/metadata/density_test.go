@@ -0,0 +1,109 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// jpegDPI returns the units and density of the JFIF headers of img.
+func jpegDPI(t *testing.T, img []byte) (units []byte, density []int) {
+	segments, _, err := jpegSegments(img)
+	if err != nil {
+		t.Fatalf("error parsing jpeg: %v", err)
+	}
+	for _, s := range segments {
+		if p := s.payload(); s.marker == markerAPP0 && bytes.HasPrefix(p, jpegJFIFPrefix) {
+			units = append(units, p[7])
+			density = append(density, int(binary.BigEndian.Uint16(p[8:])), int(binary.BigEndian.Uint16(p[10:])))
+		}
+	}
+	return units, density
+}
+
+// pngDPI returns the pixels per unit and unit of the pHYs chunks of img.
+func pngDPI(t *testing.T, img []byte) (phys [][3]int) {
+	chunks, err := pngChunks(img)
+	if err != nil {
+		t.Fatalf("error parsing png: %v", err)
+	}
+	for _, c := range chunks {
+		if c.typ == "pHYs" {
+			d := c.data[8:]
+			phys = append(phys, [3]int{int(binary.BigEndian.Uint32(d)), int(binary.BigEndian.Uint32(d[4:])), int(d[8])})
+		}
+	}
+	return phys
+}
+
+func TestSetDPI_JPEG(t *testing.T) {
+	orig := newJPEG(t)
+	if units, _ := jpegDPI(t, orig); len(units) != 0 {
+		t.Fatalf("test jpeg already has a JFIF header")
+	}
+
+	// a JFIF header is added, and then updated
+	img := orig
+	for _, dpi := range []int{300, 72} {
+		var err error
+		if img, err = SetDPI(img, dpi); err != nil {
+			t.Fatalf("SetDPI(%d) returned unexpected error: %v", dpi, err)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(img)); err != nil {
+			t.Errorf("error decoding jpeg with DPI %d: %v", dpi, err)
+		}
+		units, density := jpegDPI(t, img)
+		if len(units) != 1 || units[0] != jfifUnitsDPI || density[0] != dpi || density[1] != dpi {
+			t.Errorf("SetDPI(%d) returned JFIF units %v, density %v", dpi, units, density)
+		}
+	}
+	if n := len(img) - len(orig); n != 2+2+jfifHeaderSize {
+		t.Errorf("SetDPI added %d bytes, want %d", n, 2+2+jfifHeaderSize)
+	}
+}
+
+func TestSetDPI_PNG(t *testing.T) {
+	img := newPNG(t)
+	for _, dpi := range []int{300, 72} {
+		var err error
+		if img, err = SetDPI(img, dpi); err != nil {
+			t.Fatalf("SetDPI(%d) returned unexpected error: %v", dpi, err)
+		}
+		if _, err := png.Decode(bytes.NewReader(img)); err != nil {
+			t.Errorf("error decoding png with DPI %d: %v", dpi, err)
+		}
+	}
+	// 72 dpi is 2834.6 pixels per meter
+	if got, want := pngDPI(t, img), [][3]int{{2835, 2835, pngUnitsMeter}}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("SetDPI returned pHYs chunks %v, want %v", got, want)
+	}
+}
+
+func TestSetDPI_Invalid(t *testing.T) {
+	for _, dpi := range []int{0, -1, 70000} {
+		if _, err := SetDPI(newPNG(t), dpi); err == nil {
+			t.Errorf("SetDPI(%d) did not return expected error", dpi)
+		}
+	}
+
+	gif := []byte("GIF89a")
+	if got, err := SetDPI(gif, 300); err != nil || !bytes.Equal(got, gif) {
+		t.Errorf("SetDPI of gif returned %q, %v, want unchanged image", got, err)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// jpegEXIFPrefix identifies APP1 segments containing EXIF data, as
+// specified in section 4.5.4 of the EXIF specification.
+var jpegEXIFPrefix = []byte("Exif\x00\x00")
+
+// maxJPEGEXIF is the maximum size of the EXIF data in an APP1 segment,
+// after the length and prefix bytes.
+const maxJPEGEXIF = 0xffff - 2 - 6
+
+// EXIF tags and field types, as specified in the EXIF specification.
+const (
+	tagOrientation = 0x0112
+	tagGPSIFD      = 0x8825
+
+	typeShort = 3
+	typeLong  = 4
+)
+
+// typeSizes are the sizes in bytes of the values of each EXIF field type.
+var typeSizes = map[uint16]int{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	5:  8, // RATIONAL
+	6:  1, // SBYTE
+	7:  1, // UNDEFINED
+	8:  2, // SSHORT
+	9:  4, // SLONG
+	10: 8, // SRATIONAL
+	11: 4, // FLOAT
+	12: 8, // DOUBLE
+}
+
+var errInvalidEXIF = errors.New("metadata: invalid EXIF data")
+
+func isJPEGEXIF(s jpegSegment) bool {
+	return s.marker == markerAPP1 && bytes.HasPrefix(s.payload(), jpegEXIFPrefix)
+}
+
+// EXIF returns the EXIF data embedded in the JPEG, PNG, or WebP image img,
+// which is a TIFF structure starting with its byte order header.  If img has
+// no EXIF data or is in another format, nil data and a nil error are
+// returned.
+func EXIF(img []byte) ([]byte, error) {
+	var exif []byte
+	switch {
+	case bytes.HasPrefix(img, jpegMagic):
+		return jpegEXIF(img)
+	case bytes.HasPrefix(img, pngMagic):
+		chunks, err := pngChunks(img)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range chunks {
+			if c.typ == "eXIf" {
+				exif = c.data[8 : len(c.data)-4]
+				break
+			}
+		}
+	case isWebP(img):
+		var err error
+		if exif, err = webpChunk(img, "EXIF"); err != nil {
+			return nil, err
+		}
+		// some encoders include the prefix of JPEG APP1 segments
+		exif = bytes.TrimPrefix(exif, jpegEXIFPrefix)
+	}
+	if exif == nil {
+		return nil, nil
+	}
+	if _, _, err := tiffHeader(exif); err != nil {
+		return nil, err
+	}
+	return append([]byte{}, exif...), nil
+}
+
+// jpegEXIF returns the EXIF data embedded in the JPEG image img.
+func jpegEXIF(img []byte) ([]byte, error) {
+	segments, _, err := jpegSegments(img)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range segments {
+		if isJPEGEXIF(s) {
+			exif := s.payload()[len(jpegEXIFPrefix):]
+			if _, _, err := tiffHeader(exif); err != nil {
+				return nil, err
+			}
+			return append([]byte{}, exif...), nil
+		}
+	}
+	return nil, nil
+}
+
+// SetEXIF returns the JPEG image img with exif embedded as its EXIF data,
+// replacing any existing EXIF data.  Images in other formats are returned
+// unchanged.
+func SetEXIF(img []byte, exif []byte) ([]byte, error) {
+	if !bytes.HasPrefix(img, jpegMagic) {
+		return img, nil
+	}
+	if _, _, err := tiffHeader(exif); err != nil {
+		return nil, err
+	}
+	if len(exif) > maxJPEGEXIF {
+		return nil, errors.New("metadata: EXIF data too large for JPEG")
+	}
+	segments, rest, err := jpegSegments(img)
+	if err != nil {
+		return nil, err
+	}
+
+	n := 2 + len(jpegEXIFPrefix) + len(exif)
+	out := make([]byte, 0, len(img)+2+n)
+	out = append(out, 0xff, markerSOI)
+	i := 0
+	if len(segments) > 0 && segments[0].marker == markerAPP0 {
+		out = append(out, segments[0].data...)
+		i++
+	}
+	out = append(out, 0xff, markerAPP1, byte(n>>8), byte(n))
+	out = append(out, jpegEXIFPrefix...)
+	out = append(out, exif...)
+	for _, s := range segments[i:] {
+		if !isJPEGEXIF(s) {
+			out = append(out, s.data...)
+		}
+	}
+	return append(out, rest...), nil
+}
+
+// Orientation returns the value of the Orientation tag of the EXIF data exif,
+// from 1 to 8, and whether it has a valid one.  TIFF images, which are
+// themselves TIFF structures, can also be passed as exif.
+func Orientation(exif []byte) (int, bool) {
+	order, ifd, err := tiffHeader(exif)
+	if err != nil {
+		return 0, false
+	}
+	entries, err := ifdEntries(exif, order, ifd)
+	if err != nil {
+		return 0, false
+	}
+	for _, e := range entries {
+		if order.Uint16(exif[e:]) == tagOrientation && order.Uint16(exif[e+2:]) == typeShort {
+			if o := int(order.Uint16(exif[e+8:])); o >= 1 && o <= 8 {
+				return o, true
+			}
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// SetOrientation returns a copy of the EXIF data exif with its Orientation
+// tag set to orientation.  If exif has no Orientation tag, it is returned
+// unchanged.
+func SetOrientation(exif []byte, orientation uint16) ([]byte, error) {
+	order, ifd, err := tiffHeader(exif)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ifdEntries(exif, order, ifd)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if order.Uint16(exif[e:]) == tagOrientation {
+			if order.Uint16(exif[e+2:]) != typeShort {
+				return nil, errInvalidEXIF
+			}
+			out := append([]byte{}, exif...)
+			// SHORT values are stored in the first bytes of the
+			// value offset field
+			order.PutUint16(out[e+8:], orientation)
+			return out, nil
+		}
+	}
+	return exif, nil
+}
+
+// StripGPS returns a copy of the EXIF data exif with its GPS IFD, which holds
+// the location the image was captured at, removed.  The pointer to the GPS
+// IFD is removed and the GPS data is zeroed, leaving all other tags in place.
+// If exif has no GPS IFD, it is returned unchanged.
+func StripGPS(exif []byte) ([]byte, error) {
+	order, ifd, err := tiffHeader(exif)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ifdEntries(exif, order, ifd)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if order.Uint16(exif[e:]) != tagGPSIFD {
+			continue
+		}
+		if order.Uint16(exif[e+2:]) != typeLong {
+			return nil, errInvalidEXIF
+		}
+		gps := int(order.Uint32(exif[e+8:]))
+		gpsEntries, err := ifdEntries(exif, order, gps)
+		if err != nil {
+			return nil, err
+		}
+
+		out := append([]byte{}, exif...)
+		for _, g := range gpsEntries {
+			size := typeSizes[order.Uint16(exif[g+2:])] * int(order.Uint32(exif[g+4:]))
+			if size <= 4 {
+				continue
+			}
+			// values of more than 4 bytes are stored elsewhere
+			if off := int(order.Uint32(exif[g+8:])); off >= 8 && off+size <= len(out) {
+				zero(out[off : off+size])
+			}
+		}
+		zero(out[gps : gps+2+len(gpsEntries)*12+4])
+
+		// remove the pointer entry, moving the following entries and
+		// the offset of the next IFD into its place
+		end := ifd + 2 + len(entries)*12 + 4
+		copy(out[e:end], out[e+12:end])
+		zero(out[end-12 : end])
+		order.PutUint16(out[ifd:], uint16(len(entries)-1))
+		return out, nil
+	}
+	return exif, nil
+}
+
+// zero sets all bytes of b to 0.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// tiffHeader returns the byte order of the TIFF structure b, and the offset
+// of its first IFD.
+func tiffHeader(b []byte) (binary.ByteOrder, int, error) {
+	if len(b) < 8 {
+		return nil, 0, errInvalidEXIF
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, errInvalidEXIF
+	}
+	if order.Uint16(b[2:]) != 42 {
+		return nil, 0, errInvalidEXIF
+	}
+	return order, int(order.Uint32(b[4:])), nil
+}
+
+// ifdEntries returns the offsets of the 12 byte entries of the IFD at
+// offset ifd in the TIFF structure b.
+func ifdEntries(b []byte, order binary.ByteOrder, ifd int) ([]int, error) {
+	if ifd < 8 || ifd+2 > len(b) {
+		return nil, errInvalidEXIF
+	}
+	n := int(order.Uint16(b[ifd:]))
+	if ifd+2+n*12+4 > len(b) {
+		return nil, errInvalidEXIF
+	}
+	entries := make([]int, n)
+	for i := range entries {
+		entries[i] = ifd + 2 + i*12
+	}
+	return entries, nil
+}
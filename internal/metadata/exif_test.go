@@ -0,0 +1,295 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/jpeg"
+	"testing"
+)
+
+// tiffEntry is an IFD entry for building test EXIF data.  Values of more
+// than 4 bytes are stored after the IFD.
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+// newEXIF returns EXIF data in the given byte order with a single IFD
+// containing entries.
+func newEXIF(order binary.ByteOrder, entries ...tiffEntry) []byte {
+	b := []byte("II*\x00\x08\x00\x00\x00")
+	if order == binary.BigEndian {
+		b = []byte("MM\x00*\x00\x00\x00\x08")
+	}
+	return append(b, newIFD(order, len(b), entries...)...)
+}
+
+// newIFD returns an IFD containing entries, followed by their values, to be
+// stored at offset in EXIF data.
+func newIFD(order binary.ByteOrder, offset int, entries ...tiffEntry) []byte {
+	b := appendUint16(order, nil, uint16(len(entries)))
+	data := offset + 2 + len(entries)*12 + 4
+	var values []byte
+	for _, e := range entries {
+		b = appendUint16(order, b, e.tag)
+		b = appendUint16(order, b, e.typ)
+		b = appendUint32(order, b, e.count)
+		if len(e.value) <= 4 {
+			v := make([]byte, 4)
+			copy(v, e.value)
+			b = append(b, v...)
+		} else {
+			b = appendUint32(order, b, uint32(data+len(values)))
+			values = append(values, e.value...)
+		}
+	}
+	b = appendUint32(order, b, 0)
+	return append(b, values...)
+}
+
+func appendUint16(order binary.ByteOrder, b []byte, v uint16) []byte {
+	var buf [2]byte
+	order.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(order binary.ByteOrder, b []byte, v uint32) []byte {
+	var buf [4]byte
+	order.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func short(order binary.ByteOrder, v uint16) []byte {
+	return appendUint16(order, nil, v)
+}
+
+func TestEXIF(t *testing.T) {
+	orig := newJPEG(t)
+	if exif, err := EXIF(orig); exif != nil || err != nil {
+		t.Errorf("EXIF of image without EXIF returned %v, %v", exif, err)
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		exif := newEXIF(order,
+			tiffEntry{0x010f, 2, 6, []byte("Canon\x00")},
+			tiffEntry{tagOrientation, typeShort, 1, short(order, 6)},
+		)
+		img, err := SetEXIF(orig, exif)
+		if err != nil {
+			t.Fatalf("SetEXIF returned unexpected error: %v", err)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(img)); err != nil {
+			t.Errorf("error decoding image with EXIF: %v", err)
+		}
+		if got, err := EXIF(img); err != nil || !bytes.Equal(got, exif) {
+			t.Errorf("EXIF returned %x, %v, want %x", got, err, exif)
+		}
+
+		// orientation is reset without changing other tags
+		reset, err := SetOrientation(exif, 1)
+		if err != nil {
+			t.Fatalf("SetOrientation returned unexpected error: %v", err)
+		}
+		want := newEXIF(order,
+			tiffEntry{0x010f, 2, 6, []byte("Canon\x00")},
+			tiffEntry{tagOrientation, typeShort, 1, short(order, 1)},
+		)
+		if !bytes.Equal(reset, want) {
+			t.Errorf("SetOrientation returned %x, want %x", reset, want)
+		}
+		if bytes.Equal(exif, reset) {
+			t.Errorf("SetOrientation modified its argument")
+		}
+
+		// replacing EXIF data
+		img, _ = SetEXIF(img, reset)
+		if got, _ := EXIF(img); !bytes.Equal(got, reset) {
+			t.Errorf("EXIF after replacing returned %x, want %x", got, reset)
+		}
+
+		// stripping removes EXIF data
+		img, _ = Strip(img)
+		if got, err := EXIF(img); got != nil || err != nil {
+			t.Errorf("EXIF of stripped image returned %v, %v", got, err)
+		}
+	}
+
+	// EXIF data without orientation is unchanged
+	exif := newEXIF(binary.LittleEndian, tiffEntry{0x010f, 2, 4, []byte("abc\x00")})
+	if got, err := SetOrientation(exif, 1); err != nil || !bytes.Equal(got, exif) {
+		t.Errorf("SetOrientation without orientation tag returned %x, %v", got, err)
+	}
+
+	// images in other formats are unchanged
+	if got, err := SetEXIF([]byte("GIF89a"), exif); err != nil || string(got) != "GIF89a" {
+		t.Errorf("SetEXIF of gif returned %q, %v", got, err)
+	}
+}
+
+func TestEXIF_Containers(t *testing.T) {
+	order := binary.LittleEndian
+	exif := newEXIF(order, tiffEntry{tagOrientation, typeShort, 1, short(order, 3)})
+
+	// a webp image with only an EXIF chunk, which is enough to find it
+	webp := func(chunk []byte) []byte {
+		b := []byte("RIFF\x00\x00\x00\x00WEBPEXIF")
+		b = appendUint32(order, b, uint32(len(chunk)))
+		b = append(b, chunk...)
+		if len(chunk)%2 == 1 {
+			b = append(b, 0)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name string
+		img  []byte
+		want []byte
+	}{
+		{"png", insertPNGChunk(newPNG(t), "eXIf", exif), exif},
+		{"png without exif", newPNG(t), nil},
+		{"webp", webp(exif), exif},
+		{"webp with prefix", webp(append(append([]byte{}, jpegEXIFPrefix...), exif...)), exif},
+		{"webp without exif", []byte("RIFF\x04\x00\x00\x00WEBP"), nil},
+		{"tiff", exif, nil},
+	}
+	for _, tt := range tests {
+		if got, err := EXIF(tt.img); err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("EXIF of %s returned %x, %v, want %x", tt.name, got, err, tt.want)
+		}
+	}
+
+	// truncated chunks
+	if _, err := EXIF(webp(exif)[:30]); err == nil {
+		t.Errorf("EXIF of truncated webp did not return expected error")
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		tests := []struct {
+			exif []byte
+			want int
+			ok   bool
+		}{
+			{newEXIF(order, tiffEntry{tagOrientation, typeShort, 1, short(order, 6)}), 6, true},
+			{newEXIF(order,
+				tiffEntry{0x010f, 2, 6, []byte("Canon\x00")},
+				tiffEntry{tagOrientation, typeShort, 1, short(order, 1)},
+			), 1, true},
+			{newEXIF(order, tiffEntry{0x010f, 2, 6, []byte("Canon\x00")}), 0, false},
+			{newEXIF(order, tiffEntry{tagOrientation, typeShort, 1, short(order, 9)}), 0, false},
+			{newEXIF(order, tiffEntry{tagOrientation, typeLong, 1, appendUint32(order, nil, 6)}), 0, false},
+			{nil, 0, false},
+			{[]byte("II*\x00\xff\x00\x00\x00"), 0, false},
+		}
+		for _, tt := range tests {
+			if got, ok := Orientation(tt.exif); got != tt.want || ok != tt.ok {
+				t.Errorf("Orientation(%x) returned %d, %t, want %d, %t", tt.exif, got, ok, tt.want, tt.ok)
+			}
+		}
+	}
+}
+
+func TestStripGPS(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		maker := tiffEntry{0x010f, 2, 6, []byte("Canon\x00")}
+		model := tiffEntry{0x0110, 2, 4, []byte("EOS\x00")}
+		latitude := []byte("\x00\x00\x00\x25\x00\x00\x00\x01\x00\x00\x00\x2e\x00\x00\x00\x01\x00\x00\x0b\xb8\x00\x00\x00\x64")
+
+		// the GPS IFD follows the first IFD and its values
+		base := newEXIF(order, maker, model, tiffEntry{tagGPSIFD, typeLong, 1, nil})
+		pointer := appendUint32(order, nil, uint32(len(base)))
+		exif := newEXIF(order, maker, model, tiffEntry{tagGPSIFD, typeLong, 1, pointer})
+		exif = append(exif, newIFD(order, len(exif),
+			tiffEntry{0x0001, 2, 2, []byte("N\x00")}, // GPSLatitudeRef
+			tiffEntry{0x0002, 5, 3, latitude},        // GPSLatitude
+		)...)
+
+		got, err := StripGPS(exif)
+		if err != nil {
+			t.Fatalf("StripGPS returned unexpected error: %v", err)
+		}
+		if bytes.Contains(got, latitude) || bytes.Contains(got, []byte("N\x00")) {
+			t.Errorf("StripGPS returned EXIF data containing GPS data: %x", got)
+		}
+
+		// the first IFD keeps its other tags and their values
+		_, ifd, err := tiffHeader(got)
+		if err != nil {
+			t.Fatalf("StripGPS returned invalid EXIF data: %v", err)
+		}
+		entries, err := ifdEntries(got, order, ifd)
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("StripGPS returned %d entries, %v, want 2", len(entries), err)
+		}
+		if tag := order.Uint16(got[entries[0]:]); tag != maker.tag {
+			t.Errorf("StripGPS returned first tag %x, want %x", tag, maker.tag)
+		}
+		if v := int(order.Uint32(got[entries[0]+8:])); string(got[v:v+6]) != "Canon\x00" {
+			t.Errorf("StripGPS returned Make %q, want %q", got[v:v+6], "Canon\x00")
+		}
+		if m := got[entries[1]:]; order.Uint16(m) != model.tag || string(m[8:12]) != "EOS\x00" {
+			t.Errorf("StripGPS returned second entry %x, want Model %q", m[:12], "EOS\x00")
+		}
+		if bytes.Equal(got, exif) {
+			t.Errorf("StripGPS modified its argument")
+		}
+	}
+
+	// EXIF data without GPS data is unchanged
+	exif := newEXIF(binary.LittleEndian, tiffEntry{0x010f, 2, 4, []byte("abc\x00")})
+	if got, err := StripGPS(exif); err != nil || !bytes.Equal(got, exif) {
+		t.Errorf("StripGPS without GPS data returned %x, %v", got, err)
+	}
+
+	// GPS IFD pointing past the end of the data
+	exif = newEXIF(binary.LittleEndian, tiffEntry{tagGPSIFD, typeLong, 1, []byte("\xff\x00\x00\x00")})
+	if _, err := StripGPS(exif); err == nil {
+		t.Errorf("StripGPS with invalid GPS IFD did not return expected error")
+	}
+}
+
+func TestEXIF_Invalid(t *testing.T) {
+	orig := newJPEG(t)
+	tests := [][]byte{
+		nil,
+		[]byte("II*"),
+		[]byte("XX*\x00\x08\x00\x00\x00"),
+		[]byte("II\x2b\x00\x08\x00\x00\x00"),
+	}
+	for _, exif := range tests {
+		if _, err := SetEXIF(orig, exif); err == nil {
+			t.Errorf("SetEXIF(%x) did not return expected error", exif)
+		}
+		img := insertJPEGSegment(orig, markerAPP1, append(append([]byte{}, jpegEXIFPrefix...), exif...))
+		if _, err := EXIF(img); err == nil {
+			t.Errorf("EXIF of image with EXIF %x did not return expected error", exif)
+		}
+	}
+
+	// IFD extending past the end of the data
+	exif := newEXIF(binary.LittleEndian, tiffEntry{tagOrientation, typeShort, 1, short(binary.LittleEndian, 6)})
+	if _, err := SetOrientation(exif[:len(exif)-6], 1); err == nil {
+		t.Errorf("SetOrientation of truncated EXIF did not return expected error")
+	}
+	large := append(newEXIF(binary.LittleEndian), make([]byte, maxJPEGEXIF)...)
+	if _, err := SetEXIF(orig, large); err == nil {
+		t.Errorf("SetEXIF with oversized EXIF did not return expected error")
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+)
+
+// iccHeaderSize is the size of the fixed ICC profile header.
+const iccHeaderSize = 128
+
+// jpegICCPrefix identifies APP2 segments containing an ICC profile, as
+// specified in section B.4 of the ICC specification.
+var jpegICCPrefix = []byte("ICC_PROFILE\x00")
+
+// maxJPEGICCChunk is the maximum size of the profile data in a single APP2
+// segment, after the length, prefix, and sequence bytes.
+const maxJPEGICCChunk = 0xffff - 2 - 14
+
+// validateICC returns an error if profile does not have a valid ICC profile
+// header.
+func validateICC(profile []byte) error {
+	if len(profile) < iccHeaderSize {
+		return errors.New("metadata: ICC profile too short")
+	}
+	if n := binary.BigEndian.Uint32(profile); int(n) != len(profile) {
+		return fmt.Errorf("metadata: ICC profile size %d does not match data length %d", n, len(profile))
+	}
+	if !bytes.Equal(profile[36:40], []byte("acsp")) {
+		return errors.New("metadata: missing ICC profile signature")
+	}
+	return nil
+}
+
+// ICCProfile returns the ICC color profile embedded in the JPEG or PNG
+// image img.  If img has no profile or is in another format, a nil profile
+// and nil error are returned.  An error is returned if img contains a
+// profile which cannot be parsed.
+func ICCProfile(img []byte) ([]byte, error) {
+	var profile []byte
+	var err error
+	switch {
+	case bytes.HasPrefix(img, jpegMagic):
+		profile, err = jpegICCProfile(img)
+	case bytes.HasPrefix(img, pngMagic):
+		profile, err = pngICCProfile(img)
+	}
+	if err != nil || profile == nil {
+		return nil, err
+	}
+	if err := validateICC(profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// SetICCProfile returns the JPEG or PNG image img with profile embedded as
+// its ICC color profile, replacing any existing profile.  Images in other
+// formats are returned unchanged.
+func SetICCProfile(img []byte, profile []byte) ([]byte, error) {
+	if err := validateICC(profile); err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(img, jpegMagic):
+		return setJPEGICCProfile(img, profile)
+	case bytes.HasPrefix(img, pngMagic):
+		return setPNGICCProfile(img, profile)
+	}
+	return img, nil
+}
+
+func isJPEGICC(s jpegSegment) bool {
+	return s.marker == markerAPP2 && bytes.HasPrefix(s.payload(), jpegICCPrefix)
+}
+
+// jpegICCProfile reassembles the ICC profile from the APP2 segments of img,
+// which may be split across multiple segments.
+func jpegICCProfile(img []byte) ([]byte, error) {
+	segments, _, err := jpegSegments(img)
+	if err != nil {
+		return nil, err
+	}
+	var chunks [][]byte
+	for _, s := range segments {
+		if !isJPEGICC(s) {
+			continue
+		}
+		p := s.payload()[len(jpegICCPrefix):]
+		if len(p) < 2 {
+			return nil, errors.New("metadata: invalid ICC profile segment")
+		}
+		seq, count := int(p[0]), int(p[1])
+		if chunks == nil {
+			chunks = make([][]byte, count)
+		}
+		if count != len(chunks) || seq < 1 || seq > count || chunks[seq-1] != nil {
+			return nil, errors.New("metadata: invalid ICC profile segment sequence")
+		}
+		chunks[seq-1] = p[2:]
+	}
+	if chunks == nil {
+		return nil, nil
+	}
+	var profile []byte
+	for _, c := range chunks {
+		if c == nil {
+			return nil, errors.New("metadata: missing ICC profile segment")
+		}
+		profile = append(profile, c...)
+	}
+	return profile, nil
+}
+
+// setJPEGICCProfile replaces the ICC profile segments in img with profile.
+// The new segments are placed after any JFIF segment, as required by the
+// JFIF specification.
+func setJPEGICCProfile(img []byte, profile []byte) ([]byte, error) {
+	segments, rest, err := jpegSegments(img)
+	if err != nil {
+		return nil, err
+	}
+
+	var icc []byte
+	count := (len(profile) + maxJPEGICCChunk - 1) / maxJPEGICCChunk
+	if count > 255 {
+		return nil, errors.New("metadata: ICC profile too large for JPEG")
+	}
+	for i := 0; i < count; i++ {
+		chunk := profile[i*maxJPEGICCChunk:]
+		if len(chunk) > maxJPEGICCChunk {
+			chunk = chunk[:maxJPEGICCChunk]
+		}
+		n := 2 + len(jpegICCPrefix) + 2 + len(chunk)
+		icc = append(icc, 0xff, markerAPP2, byte(n>>8), byte(n))
+		icc = append(icc, jpegICCPrefix...)
+		icc = append(icc, byte(i+1), byte(count))
+		icc = append(icc, chunk...)
+	}
+
+	out := make([]byte, 0, len(img)+len(icc))
+	out = append(out, 0xff, markerSOI)
+	i := 0
+	if len(segments) > 0 && segments[0].marker == markerAPP0 {
+		out = append(out, segments[0].data...)
+		i++
+	}
+	out = append(out, icc...)
+	for _, s := range segments[i:] {
+		if !isJPEGICC(s) {
+			out = append(out, s.data...)
+		}
+	}
+	return append(out, rest...), nil
+}
+
+// pngICCProfile returns the profile in the iCCP chunk of img.  The chunk
+// contains a profile name, a compression method, and the zlib compressed
+// profile.
+func pngICCProfile(img []byte) ([]byte, error) {
+	chunks, err := pngChunks(img)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range chunks {
+		if c.typ != "iCCP" {
+			continue
+		}
+		data := c.data[8 : len(c.data)-4]
+		i := bytes.IndexByte(data, 0)
+		if i < 0 || i+2 > len(data) || data[i+1] != 0 {
+			return nil, errors.New("metadata: invalid iCCP chunk")
+		}
+		r, err := zlib.NewReader(bytes.NewReader(data[i+2:]))
+		if err != nil {
+			return nil, fmt.Errorf("metadata: invalid iCCP chunk: %v", err)
+		}
+		defer r.Close()
+		profile, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("metadata: invalid iCCP chunk: %v", err)
+		}
+		return profile, nil
+	}
+	return nil, nil
+}
+
+// setPNGICCProfile replaces the iCCP chunk in img with one containing
+// profile.  The chunk is placed directly after the IHDR chunk, since it must
+// precede the PLTE and IDAT chunks.  Any sRGB chunk is removed, since the two
+// must not both be present.
+func setPNGICCProfile(img []byte, profile []byte) ([]byte, error) {
+	chunks, err := pngChunks(img)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 || chunks[0].typ != "IHDR" {
+		return nil, errors.New("metadata: missing IHDR chunk")
+	}
+
+	data := new(bytes.Buffer)
+	data.WriteString("ICC profile\x00\x00")
+	w := zlib.NewWriter(data)
+	w.Write(profile)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(img)+data.Len()+12)
+	out = append(out, pngMagic...)
+	out = append(out, chunks[0].data...)
+	out = appendPNGChunk(out, "iCCP", data.Bytes())
+	for _, c := range chunks[1:] {
+		if c.typ != "iCCP" && c.typ != "sRGB" {
+			out = append(out, c.data...)
+		}
+	}
+	return out, nil
+}
+
+// appendPNGChunk appends a PNG chunk of the given type and data to b.
+func appendPNGChunk(b []byte, typ string, data []byte) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	b = append(b, n[:]...)
+	start := len(b)
+	b = append(b, typ...)
+	b = append(b, data...)
+	binary.BigEndian.PutUint32(n[:], crc32.ChecksumIEEE(b[start:]))
+	return append(b, n[:]...)
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// newProfile returns a fake ICC profile of size n with a valid header.
+func newProfile(n int) []byte {
+	p := make([]byte, n)
+	binary.BigEndian.PutUint32(p, uint32(n))
+	copy(p[36:], "acsp")
+	for i := iccHeaderSize; i < n; i++ {
+		p[i] = byte(i)
+	}
+	return p
+}
+
+func TestICCProfile(t *testing.T) {
+	tests := []struct {
+		name   string
+		img    []byte
+		decode func([]byte) error
+	}{
+		{"jpeg", newJPEG(t), func(b []byte) error { _, err := jpeg.Decode(bytes.NewReader(b)); return err }},
+		{"png", newPNG(t), func(b []byte) error { _, err := png.Decode(bytes.NewReader(b)); return err }},
+	}
+
+	for _, tt := range tests {
+		if p, err := ICCProfile(tt.img); p != nil || err != nil {
+			t.Errorf("%s: ICCProfile of image without profile returned %v, %v", tt.name, p, err)
+		}
+
+		// large profiles are split across multiple JPEG segments
+		for _, size := range []int{200, 100000} {
+			profile := newProfile(size)
+			img, err := SetICCProfile(tt.img, profile)
+			if err != nil {
+				t.Errorf("%s: SetICCProfile returned unexpected error: %v", tt.name, err)
+				continue
+			}
+			if err := tt.decode(img); err != nil {
+				t.Errorf("%s: error decoding image with profile: %v", tt.name, err)
+			}
+			got, err := ICCProfile(img)
+			if err != nil {
+				t.Errorf("%s: ICCProfile returned unexpected error: %v", tt.name, err)
+			}
+			if !bytes.Equal(got, profile) {
+				t.Errorf("%s: ICCProfile returned profile of length %d, want %d", tt.name, len(got), len(profile))
+			}
+
+			// replacing a profile
+			img, _ = SetICCProfile(img, newProfile(300))
+			if got, _ := ICCProfile(img); len(got) != 300 {
+				t.Errorf("%s: ICCProfile after replacing profile returned length %d, want 300", tt.name, len(got))
+			}
+
+			// stripping removes the profile
+			img, _ = Strip(img)
+			if got, err := ICCProfile(img); got != nil || err != nil {
+				t.Errorf("%s: ICCProfile of stripped image returned %v, %v", tt.name, got, err)
+			}
+		}
+	}
+
+	// images in other formats are unchanged
+	if got, err := SetICCProfile([]byte("GIF89a"), newProfile(200)); err != nil || string(got) != "GIF89a" {
+		t.Errorf("SetICCProfile of gif returned %q, %v", got, err)
+	}
+}
+
+func TestICCProfile_Invalid(t *testing.T) {
+	orig := newJPEG(t)
+
+	// invalid profile header
+	bad := newProfile(200)
+	copy(bad[36:], "xxxx")
+	if _, err := SetICCProfile(orig, bad); err == nil {
+		t.Errorf("SetICCProfile with invalid profile did not return expected error")
+	}
+	img := insertJPEGSegment(orig, markerAPP2, append(append([]byte{}, jpegICCPrefix...), append([]byte{1, 1}, bad...)...))
+	if _, err := ICCProfile(img); err == nil {
+		t.Errorf("ICCProfile of image with invalid profile did not return expected error")
+	}
+
+	// missing segment of multi-segment profile
+	img = insertJPEGSegment(orig, markerAPP2, append(append([]byte{}, jpegICCPrefix...), append([]byte{1, 2}, newProfile(200)...)...))
+	if _, err := ICCProfile(img); err == nil {
+		t.Errorf("ICCProfile of image with missing profile segment did not return expected error")
+	}
+
+	// corrupt compressed png profile
+	img = insertPNGChunk(newPNG(t), "iCCP", []byte("icc\x00\x00garbage"))
+	if _, err := ICCProfile(img); err == nil {
+		t.Errorf("ICCProfile of png with corrupt profile did not return expected error")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import "encoding/binary"
+
+// JPEG markers, as specified in ITU T.81 table B.1.
+const (
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOS  = 0xda
+	markerAPP0 = 0xe0
+	markerAPP1 = 0xe1
+	markerAPP2 = 0xe2
+	markerAP14 = 0xee
+	markerAP15 = 0xef
+	markerCOM  = 0xfe
+	markerTEM  = 0x01
+	markerRST0 = 0xd0
+	markerRST7 = 0xd7
+)
+
+// jpegSegment is a marker segment of a JPEG image.  data includes the
+// marker and length bytes.
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+// payload returns the segment data following the marker and length.
+func (s jpegSegment) payload() []byte {
+	if len(s.data) < 4 {
+		return nil
+	}
+	return s.data[4:]
+}
+
+// jpegSegments splits the JPEG image img into the marker segments that
+// precede the first scan, and the remaining bytes starting with the first
+// SOS marker.
+func jpegSegments(img []byte) (segments []jpegSegment, rest []byte, err error) {
+	if len(img) < 2 || img[0] != 0xff || img[1] != markerSOI {
+		return nil, nil, errTruncated
+	}
+	i := 2
+	for {
+		// markers may be preceded by any number of fill bytes
+		for i < len(img) && img[i] == 0xff && i+1 < len(img) && img[i+1] == 0xff {
+			i++
+		}
+		if i+1 >= len(img) || img[i] != 0xff {
+			return nil, nil, errTruncated
+		}
+		marker := img[i+1]
+		if marker == markerSOS || marker == markerEOI {
+			return segments, img[i:], nil
+		}
+		if marker == markerTEM || (markerRST0 <= marker && marker <= markerRST7) {
+			segments = append(segments, jpegSegment{marker, img[i : i+2]})
+			i += 2
+			continue
+		}
+		if i+4 > len(img) {
+			return nil, nil, errTruncated
+		}
+		n := int(binary.BigEndian.Uint16(img[i+2:]))
+		if n < 2 || i+2+n > len(img) {
+			return nil, nil, errTruncated
+		}
+		segments = append(segments, jpegSegment{marker, img[i : i+2+n]})
+		i += 2 + n
+	}
+}
+
+// isJPEGMetadata returns whether segments with the given marker hold
+// metadata.  The JFIF (APP0) and Adobe (APP14) segments are kept, since they
+// affect how the image data is interpreted.
+func isJPEGMetadata(marker byte) bool {
+	if marker == markerCOM {
+		return true
+	}
+	return markerAPP0 <= marker && marker <= markerAP15 && marker != markerAPP0 && marker != markerAP14
+}
+
+// stripJPEG removes all metadata segments from the JPEG image img.
+func stripJPEG(img []byte) ([]byte, error) {
+	segments, rest, err := jpegSegments(img)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(img))
+	out = append(out, 0xff, markerSOI)
+	for _, s := range segments {
+		if !isJPEGMetadata(s.marker) {
+			out = append(out, s.data...)
+		}
+	}
+	return append(out, rest...), nil
+}
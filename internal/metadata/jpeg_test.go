@@ -0,0 +1,79 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// insertJPEGSegment returns img with a segment containing data inserted
+// after the SOI marker.
+func insertJPEGSegment(img []byte, marker byte, data []byte) []byte {
+	n := len(data) + 2
+	seg := append([]byte{0xff, marker, byte(n >> 8), byte(n)}, data...)
+	out := append([]byte{}, img[:2]...)
+	out = append(out, seg...)
+	return append(out, img[2:]...)
+}
+
+func newJPEG(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("error encoding jpeg: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestStrip_JPEG(t *testing.T) {
+	orig := newJPEG(t)
+
+	img := insertJPEGSegment(orig, markerAPP1, []byte("Exif\x00\x00II*\x00"))
+	img = insertJPEGSegment(img, markerCOM, []byte("a comment"))
+	img = insertJPEGSegment(img, markerAPP2, []byte("ICC_PROFILE\x00\x01\x01"))
+	img = insertJPEGSegment(img, markerAP14, []byte("Adobe\x00\x64\x00\x00\x00\x00\x01"))
+
+	got, err := Strip(img)
+	if err != nil {
+		t.Fatalf("Strip returned unexpected error: %v", err)
+	}
+	want := insertJPEGSegment(orig, markerAP14, []byte("Adobe\x00\x64\x00\x00\x00\x00\x01"))
+	if !bytes.Equal(got, want) {
+		t.Errorf("Strip returned %x, want %x", got, want)
+	}
+
+	// image without metadata is unchanged
+	if got, err := Strip(orig); err != nil || !bytes.Equal(got, orig) {
+		t.Errorf("Strip of image without metadata returned modified image, err %v", err)
+	}
+}
+
+func TestStrip_InvalidJPEG(t *testing.T) {
+	orig := newJPEG(t)
+	tests := [][]byte{
+		{0xff, 0xd8},
+		{0xff, 0xd8, 0xff, 0xe1, 0x00},
+		{0xff, 0xd8, 0xff, 0xe1, 0x00, 0x10, 0x00},
+		{0xff, 0xd8, 0x00, 0x00},
+		insertJPEGSegment(orig, markerAPP1, nil)[:6],
+	}
+	for _, img := range tests {
+		if _, err := Strip(img); err == nil {
+			t.Errorf("Strip(%x) did not return expected error", img)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metadata reads and removes the metadata embedded in encoded
+// images, without decoding or re-encoding the image data.
+package metadata
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	jpegMagic = []byte{0xff, 0xd8}
+	pngMagic  = []byte("\x89PNG\r\n\x1a\n")
+)
+
+var errTruncated = errors.New("metadata: truncated image data")
+
+// Strip returns the encoded image img with all metadata removed.  JPEG and
+// PNG images are supported; images in other formats are returned unchanged.
+func Strip(img []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(img, jpegMagic):
+		return stripJPEG(img)
+	case bytes.HasPrefix(img, pngMagic):
+		return stripPNG(img)
+	}
+	return img, nil
+}
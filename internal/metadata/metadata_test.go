@@ -0,0 +1,32 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStrip_UnknownFormat(t *testing.T) {
+	for _, img := range [][]byte{nil, []byte("GIF89a"), []byte("not an image")} {
+		got, err := Strip(img)
+		if err != nil {
+			t.Errorf("Strip(%q) returned unexpected error: %v", img, err)
+		}
+		if !bytes.Equal(got, img) {
+			t.Errorf("Strip(%q) returned %q, want unchanged image", img, got)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import "encoding/binary"
+
+// pngChunk is a chunk of a PNG image.  data includes the length, type, and
+// CRC fields.
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// pngChunks splits the PNG image img into its chunks.
+func pngChunks(img []byte) ([]pngChunk, error) {
+	if len(img) < len(pngMagic) {
+		return nil, errTruncated
+	}
+	var chunks []pngChunk
+	for i := len(pngMagic); i < len(img); {
+		if i+8 > len(img) {
+			return nil, errTruncated
+		}
+		n := int(binary.BigEndian.Uint32(img[i:]))
+		if n < 0 || i+12+n > len(img) {
+			return nil, errTruncated
+		}
+		chunks = append(chunks, pngChunk{string(img[i+4 : i+8]), img[i : i+12+n]})
+		i += 12 + n
+	}
+	return chunks, nil
+}
+
+// pngRenderingChunks are the ancillary chunks which affect how a PNG image
+// is displayed, and so are not considered metadata.
+var pngRenderingChunks = map[string]bool{
+	"tRNS": true,
+	"gAMA": true,
+	"cHRM": true,
+	"sRGB": true,
+	"sBIT": true,
+	"bKGD": true,
+	"hIST": true,
+	"pHYs": true,
+	"acTL": true, // APNG animation chunks
+	"fcTL": true,
+	"fdAT": true,
+}
+
+// isPNGMetadata returns whether chunks of the given type hold metadata.
+// Critical chunks have an upper case first letter.
+func isPNGMetadata(typ string) bool {
+	if typ[0]&0x20 == 0 {
+		return false
+	}
+	return !pngRenderingChunks[typ]
+}
+
+// stripPNG removes all metadata chunks from the PNG image img.
+func stripPNG(img []byte) ([]byte, error) {
+	chunks, err := pngChunks(img)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(img))
+	out = append(out, pngMagic...)
+	for _, c := range chunks {
+		if !isPNGMetadata(c.typ) {
+			out = append(out, c.data...)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// insertPNGChunk returns img with a chunk inserted after the IHDR chunk.
+func insertPNGChunk(img []byte, typ string, data []byte) []byte {
+	i := len(pngMagic) + 12 + 13 // end of IHDR chunk
+	out := append([]byte{}, img[:i]...)
+	out = appendPNGChunk(out, typ, data)
+	return append(out, img[i:]...)
+}
+
+func newPNG(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatalf("error encoding png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestStrip_PNG(t *testing.T) {
+	orig := newPNG(t)
+
+	img := insertPNGChunk(orig, "tEXt", []byte("Comment\x00hello"))
+	img = insertPNGChunk(img, "eXIf", []byte("II*\x00"))
+	img = insertPNGChunk(img, "iCCP", []byte("icc\x00\x00"))
+	img = insertPNGChunk(img, "gAMA", []byte{0, 0, 0xb1, 0x8f})
+	img = insertPNGChunk(img, "prVt", []byte("private"))
+
+	got, err := Strip(img)
+	if err != nil {
+		t.Fatalf("Strip returned unexpected error: %v", err)
+	}
+	want := insertPNGChunk(orig, "gAMA", []byte{0, 0, 0xb1, 0x8f})
+	if !bytes.Equal(got, want) {
+		t.Errorf("Strip returned %x, want %x", got, want)
+	}
+	if _, err := png.Decode(bytes.NewReader(got)); err != nil {
+		t.Errorf("error decoding stripped png: %v", err)
+	}
+
+	// image without metadata is unchanged
+	if got, err := Strip(orig); err != nil || !bytes.Equal(got, orig) {
+		t.Errorf("Strip of image without metadata returned modified image, err %v", err)
+	}
+}
+
+func TestStrip_InvalidPNG(t *testing.T) {
+	orig := newPNG(t)
+	tests := [][]byte{
+		orig[:len(pngMagic)+4],
+		orig[:len(pngMagic)+20],
+		orig[:len(orig)-1],
+	}
+	for _, img := range tests {
+		if _, err := Strip(img); err == nil {
+			t.Errorf("Strip(%x) did not return expected error", img)
+		}
+	}
+}
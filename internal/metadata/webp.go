@@ -0,0 +1,46 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// isWebP returns whether img is a WebP image, which is a RIFF container of
+// form type WEBP.
+func isWebP(img []byte) bool {
+	return len(img) >= 12 && bytes.HasPrefix(img, []byte("RIFF")) && string(img[8:12]) == "WEBP"
+}
+
+// webpChunk returns the payload of the first chunk of the given type in the
+// WebP image img, or nil if it has none.
+func webpChunk(img []byte, typ string) ([]byte, error) {
+	for i := 12; i < len(img); {
+		if i+8 > len(img) {
+			return nil, errTruncated
+		}
+		n := int(binary.LittleEndian.Uint32(img[i+4:]))
+		if n < 0 || i+8+n > len(img) {
+			return nil, errTruncated
+		}
+		if string(img[i:i+4]) == typ {
+			return img[i+8 : i+8+n], nil
+		}
+		// chunks are padded to an even size
+		i += 8 + n + n&1
+	}
+	return nil, nil
+}
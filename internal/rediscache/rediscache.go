@@ -0,0 +1,265 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rediscache provides a cache implementation that stores data in
+// Redis, so that it can be shared by multiple imageproxy instances.  It
+// speaks just enough of the Redis protocol to get, set, and delete keys.
+package rediscache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// maxIdle is the maximum number of idle connections kept for reuse.
+const maxIdle = 8
+
+// defaultTimeout is the dial, read, and write timeout used when
+// Options.Timeout is zero.
+const defaultTimeout = 5 * time.Second
+
+// Options specifies how to connect to Redis and store cached data.
+type Options struct {
+	// Addr is the host:port address of the Redis server.
+	Addr string
+
+	// Password used to authenticate with the server.  If empty, no
+	// authentication is performed.
+	Password string
+
+	// DB is the number of the database to select.
+	DB int
+
+	// Prefix is prepended to all keys, so that multiple applications can
+	// share a database.
+	Prefix string
+
+	// TTL is how long each entry is kept.  Zero means entries never expire.
+	TTL time.Duration
+
+	// Timeout for connecting to the server and each command.  Zero means
+	// to use a default of 5 seconds.
+	Timeout time.Duration
+}
+
+// Cache is an implementation of imageproxy.Cache backed by Redis.  Errors
+// communicating with the server are logged and treated as cache misses, so
+// that an unavailable server only results in images being fetched and
+// transformed again.
+type Cache struct {
+	opt Options
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+// New returns a new Cache which stores data in the Redis server specified by
+// opt.  No connection is made until the cache is first used.
+func New(opt Options) *Cache {
+	if opt.Timeout == 0 {
+		opt.Timeout = defaultTimeout
+	}
+	return &Cache{opt: opt}
+}
+
+// Get retrieves the cached data for the provided key.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	reply, err := c.do("GET", c.opt.Prefix+key)
+	if err != nil {
+		glog.Errorf("rediscache: error getting %q: %v", key, err)
+		return nil, false
+	}
+	data, ok := reply.([]byte)
+	return data, ok
+}
+
+// Set caches the provided data.
+func (c *Cache) Set(key string, data []byte) {
+	args := []interface{}{c.opt.Prefix + key, data}
+	if c.opt.TTL > 0 {
+		ms := int64(c.opt.TTL / time.Millisecond)
+		if ms < 1 {
+			ms = 1
+		}
+		args = append(args, "PX", ms)
+	}
+	if _, err := c.do("SET", args...); err != nil {
+		glog.Errorf("rediscache: error setting %q: %v", key, err)
+	}
+}
+
+// Delete deletes the cached data at the specified key.
+func (c *Cache) Delete(key string) {
+	if _, err := c.do("DEL", c.opt.Prefix+key); err != nil {
+		glog.Errorf("rediscache: error deleting %q: %v", key, err)
+	}
+}
+
+// do runs the Redis command cmd with args, returning its reply.  Bulk
+// string replies are returned as []byte, nil bulk strings as nil, integer
+// replies as int64, and status replies as string.
+func (c *Cache) do(cmd string, args ...interface{}) (interface{}, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := cn.do(c.opt.Timeout, cmd, args...)
+	if err != nil {
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return reply, nil
+}
+
+// get returns an idle connection, or opens a new one.
+func (c *Cache) get() (*conn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	nc, err := net.DialTimeout("tcp", c.opt.Addr, c.opt.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	if c.opt.Password != "" {
+		if _, err := cn.do(c.opt.Timeout, "AUTH", c.opt.Password); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	if c.opt.DB != 0 {
+		if _, err := cn.do(c.opt.Timeout, "SELECT", c.opt.DB); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// put returns cn to the pool of idle connections, or closes it if the pool
+// is full.
+func (c *Cache) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxIdle {
+		cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// conn is a connection to a Redis server.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends the command cmd with args and reads its reply, failing if both
+// do not complete within timeout.
+func (cn *conn) do(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	if err := cn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(cn.Conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args)+1)
+	writeBulk(w, []byte(cmd))
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case []byte:
+			writeBulk(w, arg)
+		case string:
+			writeBulk(w, []byte(arg))
+		case int:
+			writeBulk(w, []byte(strconv.Itoa(arg)))
+		case int64:
+			writeBulk(w, []byte(strconv.FormatInt(arg, 10)))
+		default:
+			return nil, fmt.Errorf("unsupported argument type %T", arg)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return cn.readReply()
+}
+
+// writeBulk writes b to w as a Redis bulk string.
+func writeBulk(w *bufio.Writer, b []byte) {
+	fmt.Fprintf(w, "$%d\r\n", len(b))
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+// readReply reads a single reply from the server.  Array replies are not
+// used by any of the commands sent, and are not supported.
+func (cn *conn) readReply() (interface{}, error) {
+	line, err := cn.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("server error: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk string length %q", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+	return nil, fmt.Errorf("unsupported reply %q", line)
+}
+
+// readLine reads a CRLF terminated line, without the line ending.
+func (cn *conn) readLine() (string, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("malformed reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
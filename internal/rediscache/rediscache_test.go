@@ -0,0 +1,219 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rediscache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is a minimal Redis server which supports the commands used by
+// Cache, and records the commands it receives.
+type testServer struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	data     map[string][]byte
+	commands [][]string
+}
+
+func newTestServer(t *testing.T, password string) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	s := &testServer{ln: ln, password: password, data: make(map[string][]byte)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := s.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[1] == s.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-ERR invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SELECT":
+			reply = "+OK\r\n"
+		case cmd == "GET":
+			if v, ok := s.data[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case cmd == "SET":
+			s.data[args[1]] = []byte(args[2])
+			reply = "+OK\r\n"
+		case cmd == "DEL":
+			_, ok := s.data[args[1]]
+			delete(s.data, args[1])
+			reply = ":0\r\n"
+			if ok {
+				reply = ":1\r\n"
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		s.mu.Unlock()
+		io.WriteString(c, reply)
+	}
+}
+
+// readCommand reads a command, sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		l, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, l+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:l])
+	}
+	return args, nil
+}
+
+func (s *testServer) lastCommand() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.commands) == 0 {
+		return nil
+	}
+	return s.commands[len(s.commands)-1]
+}
+
+func TestCache(t *testing.T) {
+	s := newTestServer(t, "")
+	defer s.ln.Close()
+	c := New(Options{Addr: s.ln.Addr().String(), Prefix: "imageproxy:"})
+
+	if _, ok := c.Get("k"); ok {
+		t.Errorf("Get of missing key returned ok")
+	}
+
+	data := []byte("data\r\nwith line endings")
+	c.Set("k", data)
+	if got := s.lastCommand(); !reflect.DeepEqual(got, []string{"SET", "imageproxy:k", string(data)}) {
+		t.Errorf("Set sent command %q", got)
+	}
+	if got, ok := c.Get("k"); !ok || string(got) != string(data) {
+		t.Errorf("Get returned %q, %t; want %q, true", got, ok, data)
+	}
+
+	c.Delete("k")
+	if _, ok := c.Get("k"); ok {
+		t.Errorf("Get of deleted key returned ok")
+	}
+}
+
+func TestCache_Options(t *testing.T) {
+	s := newTestServer(t, "secret")
+	defer s.ln.Close()
+	c := New(Options{Addr: s.ln.Addr().String(), Password: "secret", DB: 2, TTL: time.Hour})
+
+	c.Set("k", []byte("v"))
+	want := [][]string{
+		{"AUTH", "secret"},
+		{"SELECT", "2"},
+		{"SET", "k", "v", "PX", "3600000"},
+	}
+	s.mu.Lock()
+	got := s.commands
+	s.mu.Unlock()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Set sent commands %q, want %q", got, want)
+	}
+
+	// connections are reused, without authenticating again
+	if v, ok := c.Get("k"); !ok || string(v) != "v" {
+		t.Errorf("Get returned %q, %t; want %q, true", v, ok, "v")
+	}
+	s.mu.Lock()
+	n := len(s.commands)
+	s.mu.Unlock()
+	if n != 4 {
+		t.Errorf("server received %d commands, want 4", n)
+	}
+
+	// authentication failures are cache misses
+	c = New(Options{Addr: s.ln.Addr().String(), Password: "wrong"})
+	c.Set("k", []byte("v"))
+	if _, ok := c.Get("k"); ok {
+		t.Errorf("Get with wrong password returned ok")
+	}
+}
+
+func TestCache_Unavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := New(Options{Addr: addr, Timeout: time.Second})
+	c.Set("k", []byte("v"))
+	if _, ok := c.Get("k"); ok {
+		t.Errorf("Get from unavailable server returned ok")
+	}
+	c.Delete("k")
+}
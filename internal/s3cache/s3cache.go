@@ -0,0 +1,227 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package s3cache provides a cache implementation that stores data in Amazon
+// S3.  Cached responses are stored as objects containing just the response
+// body, with the Content-Type of the response, so that the bucket can also be
+// served directly by a CDN.  The rest of the response is stored in the object
+// metadata.
+package s3cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sqs/s3"
+	"github.com/sqs/s3/s3util"
+)
+
+// headerMeta is the object metadata header which stores the status line and
+// headers of cached responses.
+const headerMeta = "X-Amz-Meta-Imageproxy-Header"
+
+// maxMetaSize is the maximum size of user-defined object metadata allowed by
+// S3.
+const maxMetaSize = 2048
+
+// Cache is an implementation of imageproxy.Cache backed by Amazon S3.  Errors
+// communicating with S3 are logged and treated as cache misses, so that they
+// only result in images being fetched and transformed again.
+type Cache struct {
+	// Config is the Amazon S3 configuration, including credentials.
+	Config s3util.Config
+
+	// BucketURL is the URL of the bucket, which includes the bucket name
+	// and the AWS region, such as
+	// "https://s3-us-west-2.amazonaws.com/my-bucket".
+	BucketURL string
+
+	// Prefix is prepended to all object keys.
+	Prefix string
+}
+
+// New returns a new Cache which stores objects in bucket in the specified
+// AWS region, with keys beginning with prefix.  If region is empty, the
+// us-east-1 region is used.
+//
+// The environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY (or
+// AWS_SECRET_KEY) are used as the AWS credentials.  To use different
+// credentials, modify the Config of the returned Cache.
+func New(bucket, region, prefix string) *Cache {
+	secret := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if secret == "" {
+		secret = os.Getenv("AWS_SECRET_KEY")
+	}
+	return &Cache{
+		Config: s3util.Config{
+			Keys: &s3.Keys{
+				AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretKey: secret,
+			},
+			Service: s3.DefaultService,
+		},
+		BucketURL: bucketURL(bucket, region),
+		Prefix:    prefix,
+	}
+}
+
+// bucketURL returns the URL of bucket in the specified AWS region.
+func bucketURL(bucket, region string) string {
+	host := "s3.amazonaws.com"
+	if region != "" && region != "us-east-1" {
+		host = "s3-" + region + ".amazonaws.com"
+	}
+	return "https://" + host + "/" + bucket
+}
+
+// ObjectKey returns the key of the object used to cache the response to
+// the request URL key.  Keys are of the form "{prefix}{options}/{hash}",
+// where options are the transformation options in the URL fragment, or
+// "original" if there are none, and hash is the MD5 hash of the rest of the
+// URL.  All transformed versions of an image therefore share the same hash.
+func (c *Cache) ObjectKey(key string) string {
+	options := "original"
+	if i := strings.LastIndex(key, "#"); i >= 0 {
+		if key[i+1:] != "" {
+			options = key[i+1:]
+		}
+		key = key[:i]
+	}
+	sum := md5.Sum([]byte(key))
+	return c.Prefix + options + "/" + hex.EncodeToString(sum[:])
+}
+
+// url returns the URL of the object used to cache key.
+func (c *Cache) url(key string) string {
+	return strings.TrimSuffix(c.BucketURL, "/") + "/" + c.ObjectKey(key)
+}
+
+// Get retrieves the cached data for the provided key.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	resp, err := c.do("GET", c.url(key), nil, nil)
+	if err != nil {
+		glog.Errorf("s3cache: error getting %q: %v", key, err)
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false
+	}
+	if resp.StatusCode != http.StatusOK {
+		glog.Errorf("s3cache: error getting %q: unexpected status %s", key, resp.Status)
+		return nil, false
+	}
+
+	header, err := base64.StdEncoding.DecodeString(resp.Header.Get(headerMeta))
+	if err != nil || len(header) == 0 {
+		glog.Errorf("s3cache: object for %q has invalid header metadata", key)
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		glog.Errorf("s3cache: error reading %q: %v", key, err)
+		return nil, false
+	}
+	return append(header, body...), true
+}
+
+// Set caches the provided data, which is an HTTP response as cached by
+// httpcache.
+func (c *Cache) Set(key string, data []byte) {
+	header, body, err := splitResponse(data)
+	if err != nil {
+		glog.Errorf("s3cache: error setting %q: %v", key, err)
+		return
+	}
+	meta := base64.StdEncoding.EncodeToString(header)
+	if len(meta) > maxMetaSize {
+		glog.Errorf("s3cache: error setting %q: response headers too large", key)
+		return
+	}
+
+	h := make(http.Header)
+	h.Set(headerMeta, meta)
+	if r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(header)), nil); err == nil {
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			h.Set("Content-Type", ct)
+		}
+	}
+
+	resp, err := c.do("PUT", c.url(key), h, body)
+	if err != nil {
+		glog.Errorf("s3cache: error setting %q: %v", key, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		glog.Errorf("s3cache: error setting %q: unexpected status %s", key, resp.Status)
+	}
+}
+
+// Delete deletes the cached data at the specified key.
+func (c *Cache) Delete(key string) {
+	resp, err := c.do("DELETE", c.url(key), nil, nil)
+	if err != nil {
+		glog.Errorf("s3cache: error deleting %q: %v", key, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		glog.Errorf("s3cache: error deleting %q: unexpected status %s", key, resp.Status)
+	}
+}
+
+// do sends a signed request to S3.
+func (c *Cache) do(method, url string, h http.Header, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	c.Config.Sign(req, *c.Config.Keys)
+
+	client := c.Config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// splitResponse splits the HTTP response data into its status line and
+// headers, and its body.
+func splitResponse(data []byte) (header, body []byte, err error) {
+	i := bytes.Index(data, []byte("\r\n\r\n"))
+	if i < 0 || !bytes.HasPrefix(data, []byte("HTTP/")) {
+		return nil, nil, errors.New("malformed response")
+	}
+	return data[:i+4], data[i+4:], nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sqs/s3"
+	"github.com/sqs/s3/s3util"
+)
+
+type object struct {
+	header http.Header
+	body   []byte
+}
+
+// testServer is a minimal S3 server which stores objects in memory.
+type testServer struct {
+	mu      sync.Mutex
+	objects map[string]object
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS key:") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		s.objects[r.URL.Path] = object{r.Header, body}
+	case "GET":
+		o, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range o.header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" {
+				w.Header()[k] = v
+			}
+		}
+		w.Write(o.body)
+	case "DELETE":
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newTestCache(url string) *Cache {
+	return &Cache{
+		Config: s3util.Config{
+			Keys:    &s3.Keys{AccessKey: "key", SecretKey: "secret"},
+			Service: s3.DefaultService,
+		},
+		BucketURL: url + "/bucket",
+		Prefix:    "images/",
+	}
+}
+
+func TestCache(t *testing.T) {
+	s := &testServer{objects: make(map[string]object)}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	c := newTestCache(srv.URL)
+
+	key := "http://example.com/image.png#100x0"
+	if _, ok := c.Get(key); ok {
+		t.Errorf("Get of missing key returned ok")
+	}
+
+	data := "HTTP/1.1 200 OK\r\nContent-Type: image/png\r\nContent-Length: 4\r\n\r\n\x89PNG"
+	c.Set(key, []byte(data))
+
+	o, ok := s.objects["/bucket/"+c.ObjectKey(key)]
+	if !ok {
+		t.Fatalf("Set did not store object %q", c.ObjectKey(key))
+	}
+	if got, want := string(o.body), "\x89PNG"; got != want {
+		t.Errorf("Set stored object body %q, want %q", got, want)
+	}
+	if got, want := o.header.Get("Content-Type"), "image/png"; got != want {
+		t.Errorf("Set stored object with Content-Type %q, want %q", got, want)
+	}
+
+	if got, ok := c.Get(key); !ok || string(got) != data {
+		t.Errorf("Get returned %q, %t; want %q, true", got, ok, data)
+	}
+
+	c.Delete(key)
+	if _, ok := c.Get(key); ok {
+		t.Errorf("Get of deleted key returned ok")
+	}
+
+	// malformed responses are not stored
+	c.Set(key, []byte("not a response"))
+	if _, ok := c.Get(key); ok {
+		t.Errorf("Get of malformed response returned ok")
+	}
+}
+
+func TestCache_Errors(t *testing.T) {
+	s := &testServer{objects: make(map[string]object)}
+	srv := httptest.NewServer(s)
+	c := newTestCache(srv.URL)
+
+	// requests rejected by S3 are cache misses
+	c.Config.Keys = &s3.Keys{AccessKey: "wrong", SecretKey: "secret"}
+	c.Set("k", []byte("HTTP/1.1 200 OK\r\n\r\n"))
+	if _, ok := c.Get("k"); ok {
+		t.Errorf("Get with invalid credentials returned ok")
+	}
+
+	// as are requests which fail entirely
+	srv.Close()
+	if _, ok := c.Get("k"); ok {
+		t.Errorf("Get from unavailable server returned ok")
+	}
+	c.Delete("k")
+}
+
+func TestObjectKey(t *testing.T) {
+	c := &Cache{Prefix: "p/"}
+	tests := []struct {
+		key, want string
+	}{
+		{"http://example.com/a.jpg", "p/original/6c1fd52c961019f29e4aff02e2387768"},
+		{"http://example.com/a.jpg#", "p/original/6c1fd52c961019f29e4aff02e2387768"},
+		{"http://example.com/a.jpg#100x200,fit", "p/100x200,fit/6c1fd52c961019f29e4aff02e2387768"},
+		{"http://example.com/b.jpg#0x0", "p/0x0/c1312fa342e48cebf182916815614d81"},
+	}
+	for _, tt := range tests {
+		if got := c.ObjectKey(tt.key); got != tt.want {
+			t.Errorf("ObjectKey(%q) returned %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestBucketURL(t *testing.T) {
+	tests := []struct {
+		bucket, region, want string
+	}{
+		{"b", "", "https://s3.amazonaws.com/b"},
+		{"b", "us-east-1", "https://s3.amazonaws.com/b"},
+		{"b", "us-west-2", "https://s3-us-west-2.amazonaws.com/b"},
+	}
+	for _, tt := range tests {
+		if got := bucketURL(tt.bucket, tt.region); got != tt.want {
+			t.Errorf("bucketURL(%q, %q) returned %q, want %q", tt.bucket, tt.region, got, tt.want)
+		}
+	}
+}
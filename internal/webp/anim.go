@@ -0,0 +1,110 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// maxDelay is the longest frame duration which can be encoded, in
+// milliseconds.
+const maxDelay = 1<<24 - 1
+
+// Animation is an animated image.  Each frame covers the whole canvas, and
+// replaces the previous frame when it is displayed.
+type Animation struct {
+	// Image contains the frames of the animation, which must all have
+	// the same bounds.
+	Image []image.Image
+
+	// Delay is the display duration of each frame, in milliseconds.
+	Delay []int
+
+	// LoopCount is the number of times the animation is played.  If zero,
+	// it is played forever.
+	LoopCount int
+
+	// Background is the color viewers may use to fill the canvas where
+	// it is transparent.
+	Background color.NRGBA
+}
+
+// EncodeAll writes the animation a to w in WebP format with the given
+// options.  Default parameters are used if a nil *Options is passed.
+func EncodeAll(w io.Writer, a *Animation, o *Options) error {
+	if len(a.Image) == 0 {
+		return errors.New("webp: animation has no frames")
+	}
+	if len(a.Delay) != len(a.Image) {
+		return errors.New("webp: mismatched image and delay lengths")
+	}
+	if a.LoopCount < 0 || a.LoopCount > 0xffff {
+		return errors.New("webp: invalid loop count")
+	}
+	b := a.Image[0].Bounds()
+	if err := checkBounds(b); err != nil {
+		return err
+	}
+
+	frames := new(bytes.Buffer)
+	flags := byte(vp8xAnimation)
+	for i, m := range a.Image {
+		if m.Bounds() != b {
+			return errors.New("webp: animation frames have different bounds")
+		}
+		delay := a.Delay[i]
+		if delay < 0 {
+			delay = 0
+		} else if delay > maxDelay {
+			delay = maxDelay
+		}
+		f, err := encodeFrame(m, o)
+		if err != nil {
+			return err
+		}
+		if !f.opaque {
+			flags |= vp8xAlpha
+		}
+
+		// the frame offset is zero, and its size is that of the canvas.
+		// Frames are not blended with the previous frame, and are not
+		// disposed of.
+		data := new(bytes.Buffer)
+		var anmf [16]byte
+		put24(anmf[6:], uint32(b.Dx()-1))
+		put24(anmf[9:], uint32(b.Dy()-1))
+		put24(anmf[12:], uint32(delay))
+		anmf[15] = 1 << 1 // do not blend
+		data.Write(anmf[:])
+		writeFrame(data, f)
+		writeChunk(frames, "ANMF", data.Bytes())
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("WEBP")
+	writeVP8X(buf, flags, b)
+	var anim [6]byte
+	bg := a.Background
+	anim[0], anim[1], anim[2], anim[3] = bg.B, bg.G, bg.R, bg.A
+	binary.LittleEndian.PutUint16(anim[4:], uint16(a.LoopCount))
+	writeChunk(buf, "ANIM", anim[:])
+	frames.WriteTo(buf)
+	return writeRIFF(w, buf)
+}
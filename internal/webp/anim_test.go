@@ -0,0 +1,139 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+type chunk struct {
+	fourCC string
+	data   []byte
+}
+
+// readChunks returns the RIFF chunks in b, which must not include the RIFF
+// header.
+func readChunks(t *testing.T, b []byte) []chunk {
+	var chunks []chunk
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("truncated chunk header %q", b)
+		}
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if len(b) < 8+n {
+			t.Fatalf("chunk %q of size %d is truncated", b[:4], n)
+		}
+		chunks = append(chunks, chunk{string(b[:4]), b[8 : 8+n]})
+		b = b[8+n+n%2:]
+	}
+	return chunks
+}
+
+func TestEncodeAll(t *testing.T) {
+	a := &Animation{
+		Image: []image.Image{
+			testImage(20, 10, opaque),
+			testImage(20, 10, func(x, y int) uint8 { return uint8(x * 12) }),
+			testImage(20, 10, opaque),
+		},
+		Delay:     []int{100, 250, 70},
+		LoopCount: 3,
+	}
+	buf := new(bytes.Buffer)
+	if err := EncodeAll(buf, a, nil); err != nil {
+		t.Fatalf("EncodeAll returned error: %v", err)
+	}
+
+	b := buf.Bytes()
+	if string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		t.Fatalf("EncodeAll returned invalid header %q", b[:12])
+	}
+	if n := binary.LittleEndian.Uint32(b[4:]); int(n) != len(b)-8 {
+		t.Errorf("RIFF size is %d, want %d", n, len(b)-8)
+	}
+	chunks := readChunks(t, b[12:])
+	if len(chunks) != 2+len(a.Image) {
+		t.Fatalf("EncodeAll returned %d chunks, want %d", len(chunks), 2+len(a.Image))
+	}
+
+	vp8x := chunks[0]
+	if vp8x.fourCC != "VP8X" {
+		t.Fatalf("first chunk is %q, want VP8X", vp8x.fourCC)
+	}
+	if want := byte(vp8xAnimation | vp8xAlpha); vp8x.data[0] != want {
+		t.Errorf("VP8X flags are %#x, want %#x", vp8x.data[0], want)
+	}
+	if w, h := get24(vp8x.data[4:])+1, get24(vp8x.data[7:])+1; w != 20 || h != 10 {
+		t.Errorf("canvas size is %dx%d, want 20x10", w, h)
+	}
+
+	anim := chunks[1]
+	if anim.fourCC != "ANIM" {
+		t.Fatalf("second chunk is %q, want ANIM", anim.fourCC)
+	}
+	if got := int(binary.LittleEndian.Uint16(anim.data[4:])); got != a.LoopCount {
+		t.Errorf("loop count is %d, want %d", got, a.LoopCount)
+	}
+
+	for i, c := range chunks[2:] {
+		if c.fourCC != "ANMF" {
+			t.Errorf("frame %d chunk is %q, want ANMF", i, c.fourCC)
+			continue
+		}
+		if got := get24(c.data[12:]); got != a.Delay[i] {
+			t.Errorf("frame %d has duration %d, want %d", i, got, a.Delay[i])
+		}
+
+		// decode the frame as a still image
+		still := new(bytes.Buffer)
+		still.WriteString("WEBP")
+		if bytes.HasPrefix(c.data[16:], []byte("ALPH")) {
+			writeVP8X(still, vp8xAlpha, a.Image[i].Bounds())
+		}
+		still.Write(c.data[16:])
+		file := new(bytes.Buffer)
+		writeRIFF(file, still)
+		m, err := webp.Decode(file)
+		if err != nil {
+			t.Errorf("frame %d could not be decoded: %v", i, err)
+			continue
+		}
+		if diff, alphaDiff := meanDiff(m, a.Image[i]); diff > 8 || alphaDiff != 0 {
+			t.Errorf("frame %d differs by %v with alpha difference %v", i, diff, alphaDiff)
+		}
+	}
+}
+
+func TestEncodeAll_Errors(t *testing.T) {
+	m := testImage(4, 4, opaque)
+	tests := []*Animation{
+		{},
+		{Image: []image.Image{m}},
+		{Image: []image.Image{m}, Delay: []int{10}, LoopCount: -1},
+		{Image: []image.Image{m, testImage(4, 5, opaque)}, Delay: []int{10, 10}},
+		{Image: []image.Image{image.NewNRGBA(image.Rect(0, 0, 0, 0))}, Delay: []int{10}},
+	}
+
+	for i, a := range tests {
+		if err := EncodeAll(new(bytes.Buffer), a, nil); err == nil {
+			t.Errorf("%d. EncodeAll did not return expected error", i)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webp
+
+// uniformProb represents a 50% probability that the next bit is 0.
+const uniformProb = 128
+
+// boolEncoder is the boolean entropy encoder specified in section 7 of RFC
+// 6386.  Each VP8 partition is written by its own boolEncoder.
+type boolEncoder struct {
+	buf      []byte
+	rng      uint32 // always in the range [128, 255]
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{rng: 255, bitCount: 24}
+}
+
+// addOne propagates a carry into the bytes that have already been written.
+func (e *boolEncoder) addOne() {
+	i := len(e.buf) - 1
+	for i >= 0 && e.buf[i] == 255 {
+		e.buf[i] = 0
+		i--
+	}
+	if i >= 0 {
+		e.buf[i]++
+	}
+}
+
+// writeBool writes b, which is expected to be false with probability
+// prob/256.
+func (e *boolEncoder) writeBool(prob uint8, b bool) {
+	split := 1 + ((e.rng-1)*uint32(prob))>>8
+	if b {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.addOne()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.buf = append(e.buf, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// writeBit writes the low bit of v with the given probability.
+func (e *boolEncoder) writeBit(prob uint8, v int) {
+	e.writeBool(prob, v&1 != 0)
+}
+
+// writeUint writes the n least significant bits of v, most significant bit
+// first, each with uniform probability.
+func (e *boolEncoder) writeUint(v uint32, n uint) {
+	for n > 0 {
+		n--
+		e.writeBool(uniformProb, v&(1<<n) != 0)
+	}
+}
+
+// writeOptionalInt writes a flag indicating whether v is non-zero, followed
+// by the n-bit magnitude and sign of v if it is.
+func (e *boolEncoder) writeOptionalInt(v int32, n uint) {
+	if v == 0 {
+		e.writeBool(uniformProb, false)
+		return
+	}
+	e.writeBool(uniformProb, true)
+	if v < 0 {
+		e.writeUint(uint32(-v), n)
+		e.writeBool(uniformProb, true)
+	} else {
+		e.writeUint(uint32(v), n)
+		e.writeBool(uniformProb, false)
+	}
+}
+
+// flush writes any remaining bits and returns the encoded partition.
+func (e *boolEncoder) flush() []byte {
+	c := e.bitCount
+	v := e.bottom
+	if v&(1<<uint(32-c)) != 0 {
+		e.addOne()
+	}
+	v <<= uint(c & 7)
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for i := 0; i < 4; i++ {
+		e.buf = append(e.buf, byte(v>>24))
+		v <<= 8
+	}
+	return e.buf
+}
@@ -0,0 +1,179 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/webp"
+)
+
+var errInvalidAnimation = errors.New("webp: invalid animation")
+
+// flags of the ANMF chunk of each animation frame.
+const (
+	anmfDispose = 1 << 0 // dispose of the frame after it is displayed
+	anmfNoBlend = 1 << 1 // replace the canvas rather than blend with it
+)
+
+// IsAnimated reports whether the WebP image whose leading bytes are b is
+// animated.  b must include the VP8X chunk of the extended format, which
+// immediately follows the RIFF header.
+func IsAnimated(b []byte) bool {
+	return len(b) >= 21 && string(b[:4]) == "RIFF" && string(b[8:16]) == "WEBPVP8X" &&
+		b[20]&vp8xAnimation != 0
+}
+
+// riffChunk is a chunk of a RIFF file.
+type riffChunk struct {
+	fourCC string
+	data   []byte
+}
+
+// parseAnimation returns the chunks of the animated WebP image img, after
+// checking that it begins with the VP8X and ANIM chunks.
+func parseAnimation(img []byte) ([]riffChunk, error) {
+	if !IsAnimated(img) {
+		return nil, errInvalidAnimation
+	}
+	var chunks []riffChunk
+	for b := img[12:]; len(b) > 0; {
+		if len(b) < 8 {
+			return nil, errInvalidAnimation
+		}
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if n < 0 || n > len(b)-8 {
+			return nil, errInvalidAnimation
+		}
+		chunks = append(chunks, riffChunk{string(b[:4]), b[8 : 8+n]})
+		if n += n % 2; n > len(b)-8 {
+			// the padding of the last chunk may be omitted
+			break
+		}
+		b = b[8+n:]
+	}
+	if len(chunks) < 2 || len(chunks[0].data) < 10 || chunks[1].fourCC != "ANIM" || len(chunks[1].data) < 6 {
+		return nil, errInvalidAnimation
+	}
+	return chunks, nil
+}
+
+// DecodeAnimationConfig returns the canvas size and number of frames of the
+// animated WebP image img, without decoding the frames.
+func DecodeAnimationConfig(img []byte) (image.Config, int, error) {
+	chunks, err := parseAnimation(img)
+	if err != nil {
+		return image.Config{}, 0, err
+	}
+	var frames int
+	for _, c := range chunks {
+		if c.fourCC == "ANMF" {
+			frames++
+		}
+	}
+	vp8x := chunks[0].data
+	cfg := image.Config{
+		ColorModel: color.NRGBAModel,
+		Width:      get24(vp8x[4:]) + 1,
+		Height:     get24(vp8x[7:]) + 1,
+	}
+	return cfg, frames, nil
+}
+
+// DecodeAll decodes the first n frames of the animated WebP image img, or all
+// of its frames if n is zero or negative.  Each frame is returned as it is
+// displayed, composed onto the full canvas after all previous frames have
+// been drawn and disposed of.  Disposed frames are cleared to transparent,
+// rather than to the background color, as recommended by the specification.
+func DecodeAll(img []byte, n int) (*Animation, error) {
+	chunks, err := parseAnimation(img)
+	if err != nil {
+		return nil, err
+	}
+	vp8x, anim := chunks[0].data, chunks[1].data
+	canvas := image.NewNRGBA(image.Rect(0, 0, get24(vp8x[4:])+1, get24(vp8x[7:])+1))
+	a := &Animation{
+		LoopCount:  int(binary.LittleEndian.Uint16(anim[4:])),
+		Background: color.NRGBA{R: anim[2], G: anim[1], B: anim[0], A: anim[3]},
+	}
+
+	for _, c := range chunks[2:] {
+		if n > 0 && len(a.Image) >= n {
+			break
+		}
+		if c.fourCC != "ANMF" {
+			continue
+		}
+		if len(c.data) < 16 {
+			return nil, errInvalidAnimation
+		}
+		x, y := get24(c.data)*2, get24(c.data[3:])*2
+		r := image.Rect(x, y, x+get24(c.data[6:])+1, y+get24(c.data[9:])+1)
+		if !r.In(canvas.Bounds()) {
+			return nil, errInvalidAnimation
+		}
+		m, err := decodeFrame(c.data[16:], r.Dx(), r.Dy())
+		if err != nil {
+			return nil, err
+		}
+		if m.Bounds().Dx() != r.Dx() || m.Bounds().Dy() != r.Dy() {
+			return nil, errInvalidAnimation
+		}
+
+		flags := c.data[15]
+		op := draw.Over
+		if flags&anmfNoBlend != 0 {
+			op = draw.Src
+		}
+		draw.Draw(canvas, r, m, m.Bounds().Min, op)
+
+		frame := image.NewNRGBA(canvas.Bounds())
+		copy(frame.Pix, canvas.Pix)
+		a.Image = append(a.Image, frame)
+		a.Delay = append(a.Delay, get24(c.data[12:]))
+
+		if flags&anmfDispose != 0 {
+			draw.Draw(canvas, r, image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+	if len(a.Image) == 0 {
+		return nil, errors.New("webp: animation has no frames")
+	}
+	return a, nil
+}
+
+// decodeFrame decodes the chunks of an animation frame of size w by h as a
+// still WebP image.  Frames with an ALPH chunk are wrapped in the extended
+// format, which the decoder requires for separate alpha values.
+func decodeFrame(data []byte, w, h int) (image.Image, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("WEBP")
+	if bytes.HasPrefix(data, []byte("ALPH")) {
+		writeVP8X(buf, vp8xAlpha, image.Rect(0, 0, w, h))
+	}
+	buf.Write(data)
+	file := new(bytes.Buffer)
+	writeRIFF(file, buf)
+	return webp.Decode(file)
+}
+
+func get24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
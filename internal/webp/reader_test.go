@@ -0,0 +1,230 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// animation returns an animated WebP image with a canvas of size b and the
+// given ANMF chunks.
+func animation(t *testing.T, b image.Rectangle, loopCount int, frames ...[]byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("WEBP")
+	writeVP8X(buf, vp8xAnimation|vp8xAlpha, b)
+	var anim [6]byte
+	binary.LittleEndian.PutUint16(anim[4:], uint16(loopCount))
+	writeChunk(buf, "ANIM", anim[:])
+	for _, f := range frames {
+		writeChunk(buf, "ANMF", f)
+	}
+	file := new(bytes.Buffer)
+	if err := writeRIFF(file, buf); err != nil {
+		t.Fatalf("writeRIFF returned error: %v", err)
+	}
+	return file.Bytes()
+}
+
+// anmf returns the data of an ANMF chunk drawing m at (x, y), which must be
+// even, with the given duration and flags.
+func anmf(t *testing.T, x, y int, m image.Image, delay int, flags byte) []byte {
+	f, err := encodeFrame(m, nil)
+	if err != nil {
+		t.Fatalf("encodeFrame returned error: %v", err)
+	}
+	var hdr [16]byte
+	put24(hdr[0:], uint32(x/2))
+	put24(hdr[3:], uint32(y/2))
+	put24(hdr[6:], uint32(m.Bounds().Dx()-1))
+	put24(hdr[9:], uint32(m.Bounds().Dy()-1))
+	put24(hdr[12:], uint32(delay))
+	hdr[15] = flags
+	buf := bytes.NewBuffer(hdr[:])
+	writeFrame(buf, f)
+	return buf.Bytes()
+}
+
+// alphaAt returns the alpha value of m at (x, y).
+func alphaAt(m image.Image, x, y int) uint8 {
+	return color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA).A
+}
+
+func TestIsAnimated(t *testing.T) {
+	m := testImage(4, 4, opaque)
+	still := new(bytes.Buffer)
+	Encode(still, m, nil)
+	transparent := new(bytes.Buffer)
+	Encode(transparent, testImage(4, 4, func(x, y int) uint8 { return 0 }), nil)
+	animated := new(bytes.Buffer)
+	EncodeAll(animated, &Animation{Image: []image.Image{m}, Delay: []int{10}}, nil)
+
+	tests := []struct {
+		b    []byte
+		want bool
+	}{
+		{nil, false},
+		{still.Bytes(), false},
+		{transparent.Bytes(), false}, // extended format without animation
+		{animated.Bytes(), true},
+		{animated.Bytes()[:21], true},
+		{animated.Bytes()[:20], false},
+	}
+
+	for i, tt := range tests {
+		if got := IsAnimated(tt.b); got != tt.want {
+			t.Errorf("%d. IsAnimated returned %t, want %t", i, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	want := &Animation{
+		Image: []image.Image{
+			testImage(20, 10, opaque),
+			testImage(20, 10, func(x, y int) uint8 { return uint8(x * 12) }),
+			testImage(20, 10, opaque),
+		},
+		Delay:      []int{100, 250, 70},
+		LoopCount:  3,
+		Background: color.NRGBA{1, 2, 3, 4},
+	}
+	buf := new(bytes.Buffer)
+	if err := EncodeAll(buf, want, nil); err != nil {
+		t.Fatalf("EncodeAll returned error: %v", err)
+	}
+
+	cfg, frames, err := DecodeAnimationConfig(buf.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeAnimationConfig returned error: %v", err)
+	}
+	if cfg.Width != 20 || cfg.Height != 10 || frames != 3 {
+		t.Errorf("DecodeAnimationConfig returned %d frames of %dx%d, want 3 frames of 20x10", frames, cfg.Width, cfg.Height)
+	}
+
+	got, err := DecodeAll(buf.Bytes(), 0)
+	if err != nil {
+		t.Fatalf("DecodeAll returned error: %v", err)
+	}
+	if !reflect.DeepEqual(got.Delay, want.Delay) {
+		t.Errorf("DecodeAll returned delays %v, want %v", got.Delay, want.Delay)
+	}
+	if got.LoopCount != want.LoopCount || got.Background != want.Background {
+		t.Errorf("DecodeAll returned loop count %d and background %v, want %d and %v", got.LoopCount, got.Background, want.LoopCount, want.Background)
+	}
+	if len(got.Image) != len(want.Image) {
+		t.Fatalf("DecodeAll returned %d frames, want %d", len(got.Image), len(want.Image))
+	}
+	for i, m := range got.Image {
+		if b := m.Bounds(); b != want.Image[i].Bounds() {
+			t.Errorf("frame %d has bounds %v, want %v", i, b, want.Image[i].Bounds())
+			continue
+		}
+		for x := 0; x < 20; x++ {
+			if got, want := alphaAt(m, x, 5), alphaAt(want.Image[i], x, 5); got != want {
+				t.Errorf("frame %d has alpha %d at (%d, 5), want %d", i, got, x, want)
+			}
+		}
+	}
+
+	// only the first frames are decoded if requested
+	got, err = DecodeAll(buf.Bytes(), 2)
+	if err != nil {
+		t.Fatalf("DecodeAll of 2 frames returned error: %v", err)
+	}
+	if len(got.Image) != 2 || len(got.Delay) != 2 {
+		t.Errorf("DecodeAll of 2 frames returned %d frames and %d delays", len(got.Image), len(got.Delay))
+	}
+}
+
+// test that frames are composed onto the canvas as they are displayed.
+func TestDecodeAll_Compose(t *testing.T) {
+	full := testImage(8, 8, opaque)
+	small := testImage(4, 4, opaque)
+	half := testImage(2, 2, func(x, y int) uint8 { return 128 })
+	img := animation(t, image.Rect(0, 0, 8, 8), 0,
+		anmf(t, 0, 0, full, 10, anmfNoBlend|anmfDispose),
+		anmf(t, 2, 2, small, 20, 0),
+		anmf(t, 0, 0, half, 30, 0),
+	)
+
+	a, err := DecodeAll(img, 0)
+	if err != nil {
+		t.Fatalf("DecodeAll returned error: %v", err)
+	}
+	if len(a.Image) != 3 {
+		t.Fatalf("DecodeAll returned %d frames, want 3", len(a.Image))
+	}
+
+	// opaque rectangles of each frame
+	tests := []struct {
+		frame int
+		rects []image.Rectangle
+		alpha []uint8
+	}{
+		{0, []image.Rectangle{image.Rect(0, 0, 8, 8)}, []uint8{255}},
+		// the first frame is disposed of
+		{1, []image.Rectangle{image.Rect(2, 2, 6, 6)}, []uint8{255}},
+		// the third frame is blended with the second
+		{2, []image.Rectangle{image.Rect(2, 2, 6, 6), image.Rect(0, 0, 2, 2)}, []uint8{255, 128}},
+	}
+	for _, tt := range tests {
+		m := a.Image[tt.frame]
+		if b := m.Bounds(); b != image.Rect(0, 0, 8, 8) {
+			t.Errorf("frame %d has bounds %v, want the canvas", tt.frame, b)
+			continue
+		}
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				var want uint8
+				for i, r := range tt.rects {
+					if image.Pt(x, y).In(r) {
+						want = tt.alpha[i]
+						break
+					}
+				}
+				if got := alphaAt(m, x, y); got != want {
+					t.Errorf("frame %d has alpha %d at (%d, %d), want %d", tt.frame, got, x, y, want)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeAll_Errors(t *testing.T) {
+	m := testImage(4, 4, opaque)
+	still := new(bytes.Buffer)
+	Encode(still, m, nil)
+	valid := animation(t, image.Rect(0, 0, 4, 4), 0, anmf(t, 0, 0, m, 10, 0))
+
+	tests := [][]byte{
+		nil,
+		still.Bytes(),
+		valid[:len(valid)-10],                   // truncated frame
+		animation(t, image.Rect(0, 0, 4, 4), 0), // no frames
+		animation(t, image.Rect(0, 0, 4, 4), 0, []byte{0, 0}),            // short frame header
+		animation(t, image.Rect(0, 0, 4, 4), 0, anmf(t, 2, 0, m, 10, 0)), // frame outside canvas
+	}
+
+	for i, img := range tests {
+		if _, err := DecodeAll(img, 0); err == nil {
+			t.Errorf("%d. DecodeAll did not return expected error", i)
+		}
+	}
+}
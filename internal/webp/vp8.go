@@ -0,0 +1,743 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webp
+
+// This file implements a simple VP8 key frame encoder, as specified in RFC
+// 6386.  Every macroblock is predicted as a whole using one of the four 16x16
+// luma and 8x8 chroma prediction modes, and all coefficients are written
+// using the default token probabilities.
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"math"
+)
+
+// Prediction modes.  The 4x4 luma modes (B_PRED) are never used.
+const (
+	predDC = iota
+	predTM
+	predVE
+	predHE
+	nPredModes
+)
+
+// quant holds the DC and AC quantizer step sizes of a single plane.
+type quant [2]int32
+
+// mbInfo holds the macroblock header values written to the first partition.
+type mbInfo struct {
+	predY, predC uint8
+	skip         bool
+}
+
+// nzContext records which 4x4 blocks along a macroblock edge have non-zero
+// coefficients.  Y has 4 blocks along each edge, U and V have 2 each, and Y2
+// has a single block.
+type nzContext struct {
+	y    [4]uint8
+	u, v [2]uint8
+	y2   uint8
+}
+
+// vp8Encoder encodes a single VP8 key frame.
+type vp8Encoder struct {
+	width, height int
+	mbw, mbh      int
+
+	// source and reconstructed planes, padded to a multiple of the
+	// macroblock size.  Chroma planes are subsampled by two in both
+	// directions.
+	src, rec [3]plane
+
+	qIndex      int
+	filterLevel int
+	y1, y2, uv  quant
+
+	tokens *boolEncoder
+	mbs    []mbInfo
+	left   nzContext
+	top    []nzContext
+}
+
+// plane is an 8-bit image plane.
+type plane struct {
+	pix    []uint8
+	stride int
+}
+
+func newPlane(w, h int) plane {
+	return plane{pix: make([]uint8, w*h), stride: w}
+}
+
+func (p plane) at(x, y int) int32 {
+	return int32(p.pix[y*p.stride+x])
+}
+
+// qualityToIndex maps a quality value in the range [1, 100] to a VP8
+// quantizer index in the range [0, 127], using the same curve as libwebp.
+func qualityToIndex(quality int) int {
+	c := float64(quality) / 100
+	if c < 0.75 {
+		c = c * 2 / 3
+	} else {
+		c = 2*c - 1
+	}
+	q := int(127*(1-math.Cbrt(c)) + 0.5)
+	if q < 0 {
+		q = 0
+	}
+	if q > 127 {
+		q = 127
+	}
+	return q
+}
+
+func clamp8(v int32) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// newVP8Encoder returns an encoder for the RGB values of m.  Alpha values
+// are ignored (see encodeAlpha).
+func newVP8Encoder(m *image.NRGBA, quality int) *vp8Encoder {
+	b := m.Bounds()
+	e := &vp8Encoder{
+		width:  b.Dx(),
+		height: b.Dy(),
+		mbw:    (b.Dx() + 15) / 16,
+		mbh:    (b.Dy() + 15) / 16,
+	}
+
+	e.qIndex = qualityToIndex(quality)
+	e.filterLevel = e.qIndex / 2
+	q := e.qIndex
+	e.y1 = quant{dcTable[q], acTable[q]}
+	e.y2 = quant{dcTable[q] * 2, acTable[q] * 155 / 100}
+	if e.y2[1] < 8 {
+		e.y2[1] = 8
+	}
+	uvq := q
+	if uvq > 117 {
+		uvq = 117
+	}
+	e.uv = quant{dcTable[uvq], acTable[q]}
+
+	w, h := 16*e.mbw, 16*e.mbh
+	for i := range e.src {
+		if i == 1 {
+			w, h = w/2, h/2
+		}
+		e.src[i] = newPlane(w, h)
+		e.rec[i] = newPlane(w, h)
+	}
+	e.convert(m)
+
+	e.top = make([]nzContext, e.mbw)
+	e.mbs = make([]mbInfo, 0, e.mbw*e.mbh)
+	e.tokens = newBoolEncoder()
+	return e
+}
+
+// convert converts the pixels of m to Y'CbCr using the BT.601 studio range
+// coefficients expected by WebP decoders, padding the planes by replicating
+// the right and bottom edges.
+func (e *vp8Encoder) convert(m *image.NRGBA) {
+	pixel := func(x, y int) (r, g, b int32) {
+		if x >= e.width {
+			x = e.width - 1
+		}
+		if y >= e.height {
+			y = e.height - 1
+		}
+		i := m.PixOffset(m.Rect.Min.X+x, m.Rect.Min.Y+y)
+		return int32(m.Pix[i]), int32(m.Pix[i+1]), int32(m.Pix[i+2])
+	}
+
+	Y, U, V := e.src[0], e.src[1], e.src[2]
+	for y := 0; y < 16*e.mbh; y++ {
+		for x := 0; x < 16*e.mbw; x++ {
+			r, g, b := pixel(x, y)
+			Y.pix[y*Y.stride+x] = uint8((16839*r + 33059*g + 6420*b + 1<<15 + 16<<16) >> 16)
+		}
+	}
+	for y := 0; y < 8*e.mbh; y++ {
+		for x := 0; x < 8*e.mbw; x++ {
+			var r, g, b int32
+			for j := 0; j < 2; j++ {
+				for i := 0; i < 2; i++ {
+					pr, pg, pb := pixel(2*x+i, 2*y+j)
+					r, g, b = r+pr, g+pg, b+pb
+				}
+			}
+			U.pix[y*U.stride+x] = clamp8((-9719*r - 19081*g + 28800*b + 1<<17 + 128<<18) >> 18)
+			V.pix[y*V.stride+x] = clamp8((28800*r - 24116*g - 4684*b + 1<<17 + 128<<18) >> 18)
+		}
+	}
+}
+
+// predict fills pred with the n x n prediction for the block at (x, y) of
+// the reconstructed plane p, using the given mode.  Edges outside the image
+// are handled as specified in section 12.2.
+func predict(pred []int32, p plane, x, y, n int, mode uint8) {
+	var top, left [16]int32
+	var corner int32
+	for i := 0; i < n; i++ {
+		if y == 0 {
+			top[i] = 127
+		} else {
+			top[i] = p.at(x+i, y-1)
+		}
+		if x == 0 {
+			left[i] = 129
+		} else {
+			left[i] = p.at(x-1, y+i)
+		}
+	}
+	switch {
+	case y == 0:
+		corner = 127
+	case x == 0:
+		corner = 129
+	default:
+		corner = p.at(x-1, y-1)
+	}
+
+	shift := uint(3)
+	if n == 16 {
+		shift = 4
+	}
+	for j := 0; j < n; j++ {
+		for i := 0; i < n; i++ {
+			var v int32
+			switch mode {
+			case predDC:
+				var sum int32
+				switch {
+				case x > 0 && y > 0:
+					for k := 0; k < n; k++ {
+						sum += top[k] + left[k]
+					}
+					v = (sum + int32(n)) >> (shift + 1)
+				case y > 0:
+					for k := 0; k < n; k++ {
+						sum += top[k]
+					}
+					v = (sum + int32(n)/2) >> shift
+				case x > 0:
+					for k := 0; k < n; k++ {
+						sum += left[k]
+					}
+					v = (sum + int32(n)/2) >> shift
+				default:
+					v = 128
+				}
+			case predTM:
+				v = int32(clamp8(left[j] + top[i] - corner))
+			case predVE:
+				v = top[i]
+			case predHE:
+				v = left[j]
+			}
+			pred[j*n+i] = v
+		}
+	}
+}
+
+// fdct computes the forward DCT of the 4x4 residual block in, as implemented
+// by libwebp.
+func fdct(in *[16]int32, out *[16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		d := in[4*i : 4*i+4]
+		a0 := d[0] + d[3]
+		a1 := d[1] + d[2]
+		a2 := d[1] - d[2]
+		a3 := d[0] - d[3]
+		tmp[0+i*4] = (a0 + a1) * 8
+		tmp[1+i*4] = (a2*2217 + a3*5352 + 1812) >> 9
+		tmp[2+i*4] = (a0 - a1) * 8
+		tmp[3+i*4] = (a3*2217 - a2*5352 + 937) >> 9
+	}
+	for i := 0; i < 4; i++ {
+		a0 := tmp[0+i] + tmp[12+i]
+		a1 := tmp[4+i] + tmp[8+i]
+		a2 := tmp[4+i] - tmp[8+i]
+		a3 := tmp[0+i] - tmp[12+i]
+		out[0+i] = (a0 + a1 + 7) >> 4
+		out[4+i] = (a2*2217 + a3*5352 + 12000) >> 16
+		if a3 != 0 {
+			out[4+i]++
+		}
+		out[8+i] = (a0 - a1 + 7) >> 4
+		out[12+i] = (a3*2217 - a2*5352 + 51000) >> 16
+	}
+}
+
+// idct adds the inverse DCT of the coefficients in to the 4x4 block at (x,
+// y) of p, exactly as a decoder would.
+func idct(in *[16]int32, p plane, x, y int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2).
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2).
+	)
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := in[i] + in[8+i]
+		b := in[i] - in[8+i]
+		c := (in[4+i]*c2)>>16 - (in[12+i]*c1)>>16
+		d := (in[4+i]*c1)>>16 + (in[12+i]*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + c
+		m[i][2] = b - c
+		m[i][3] = a - d
+	}
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		c := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		row := p.pix[(y+j)*p.stride+x:]
+		row[0] = clamp8(int32(row[0]) + (a+d)>>3)
+		row[1] = clamp8(int32(row[1]) + (b+c)>>3)
+		row[2] = clamp8(int32(row[2]) + (b-c)>>3)
+		row[3] = clamp8(int32(row[3]) + (a-d)>>3)
+	}
+}
+
+// fwht computes the forward Walsh-Hadamard transform of the 16 luma DC
+// coefficients in, as implemented by libwebp.
+func fwht(in *[16]int32, out *[16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := in[4*i+0] + in[4*i+2]
+		a1 := in[4*i+1] + in[4*i+3]
+		a2 := in[4*i+1] - in[4*i+3]
+		a3 := in[4*i+0] - in[4*i+2]
+		tmp[0+i*4] = a0 + a1
+		tmp[1+i*4] = a3 + a2
+		tmp[2+i*4] = a3 - a2
+		tmp[3+i*4] = a0 - a1
+	}
+	for i := 0; i < 4; i++ {
+		a0 := tmp[0+i] + tmp[8+i]
+		a1 := tmp[4+i] + tmp[12+i]
+		a2 := tmp[4+i] - tmp[12+i]
+		a3 := tmp[0+i] - tmp[8+i]
+		out[0+i] = (a0 + a1) >> 1
+		out[4+i] = (a3 + a2) >> 1
+		out[8+i] = (a3 - a2) >> 1
+		out[12+i] = (a0 - a1) >> 1
+	}
+}
+
+// iwht computes the inverse Walsh-Hadamard transform of in, exactly as a
+// decoder would.
+func iwht(in *[16]int32, out *[16]int32) {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := in[0+i] + in[12+i]
+		a1 := in[4+i] + in[8+i]
+		a2 := in[4+i] - in[8+i]
+		a3 := in[0+i] - in[12+i]
+		m[0+i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		dc := m[0+i*4] + 3
+		a0 := dc + m[3+i*4]
+		a1 := m[1+i*4] + m[2+i*4]
+		a2 := m[1+i*4] - m[2+i*4]
+		a3 := dc - m[3+i*4]
+		out[4*i+0] = (a0 + a1) >> 3
+		out[4*i+1] = (a3 + a2) >> 3
+		out[4*i+2] = (a0 - a1) >> 3
+		out[4*i+3] = (a3 - a2) >> 3
+	}
+}
+
+// quantize quantizes the coefficients of c starting at position first,
+// storing the quantized levels in zigzag order in levels and replacing c
+// with the dequantized values.  It returns whether any level is non-zero.
+func quantize(c *[16]int32, levels *[16]int32, q quant, first int) bool {
+	nz := false
+	for n := 0; n < 16; n++ {
+		levels[n] = 0
+	}
+	for n := first; n < 16; n++ {
+		z := zigzag[n]
+		step, v := q[1], c[z]
+		bias := step / 3
+		if z == 0 {
+			step = q[0]
+			bias = step / 2
+		}
+		neg := v < 0
+		if neg {
+			v = -v
+		}
+		level := (v + bias) / step
+		if level > 2047 {
+			level = 2047
+		}
+		if neg {
+			level = -level
+		}
+		levels[n] = level
+		c[z] = level * step
+		if level != 0 {
+			nz = true
+		}
+	}
+	return nz
+}
+
+// block holds the quantized levels for one 4x4 block.
+type block struct {
+	levels [16]int32
+	nz     bool
+}
+
+// sad returns the sum of absolute differences between the n x n block at
+// (x, y) of p and pred.
+func sad(p plane, x, y, n int, pred []int32) int32 {
+	var sum int32
+	for j := 0; j < n; j++ {
+		for i := 0; i < n; i++ {
+			d := p.at(x+i, y+j) - pred[j*n+i]
+			if d < 0 {
+				d = -d
+			}
+			sum += d
+		}
+	}
+	return sum
+}
+
+// bestMode returns the prediction mode with the lowest SAD for the n x n
+// blocks at (x, y) of the given planes.
+func (e *vp8Encoder) bestMode(planes []int, x, y, n int) uint8 {
+	pred := make([]int32, n*n)
+	best, bestSAD := uint8(predDC), int32(math.MaxInt32)
+	for mode := uint8(0); mode < nPredModes; mode++ {
+		var s int32
+		for _, i := range planes {
+			predict(pred, e.rec[i], x, y, n, mode)
+			s += sad(e.src[i], x, y, n, pred)
+		}
+		if s < bestSAD {
+			best, bestSAD = mode, s
+		}
+	}
+	return best
+}
+
+// encodeMacroblock predicts, transforms, and quantizes the macroblock at
+// (mbx, mby), writes its coefficients to the token partition, and updates
+// the reconstructed planes.
+func (e *vp8Encoder) encodeMacroblock(mbx, mby int) {
+	var (
+		y2       block
+		y1       [16]block
+		u, v     [4]block
+		in, c    [16]int32
+		dc, rdc  [16]int32
+		coeffs   [16][16]int32
+		predY    = make([]int32, 16*16)
+		predC    = make([]int32, 8*8)
+		info     mbInfo
+		nonzero  bool
+		x16, y16 = 16 * mbx, 16 * mby
+	)
+
+	// luma
+	info.predY = e.bestMode([]int{0}, x16, y16, 16)
+	predict(predY, e.rec[0], x16, y16, 16, info.predY)
+	src, rec := e.src[0], e.rec[0]
+	for n := 0; n < 16; n++ {
+		bx, by := 4*(n%4), 4*(n/4)
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				p := predY[(by+j)*16+bx+i]
+				in[j*4+i] = src.at(x16+bx+i, y16+by+j) - p
+				rec.pix[(y16+by+j)*rec.stride+x16+bx+i] = uint8(p)
+			}
+		}
+		fdct(&in, &coeffs[n])
+		dc[n] = coeffs[n][0]
+	}
+	fwht(&dc, &c)
+	y2.nz = quantize(&c, &y2.levels, e.y2, 0)
+	nonzero = nonzero || y2.nz
+	iwht(&c, &rdc)
+	for n := 0; n < 16; n++ {
+		y1[n].nz = quantize(&coeffs[n], &y1[n].levels, e.y1, 1)
+		nonzero = nonzero || y1[n].nz
+		coeffs[n][0] = rdc[n]
+		idct(&coeffs[n], rec, x16+4*(n%4), y16+4*(n/4))
+	}
+
+	// chroma
+	x8, y8 := 8*mbx, 8*mby
+	info.predC = e.bestMode([]int{1, 2}, x8, y8, 8)
+	for i, blocks := range [][]block{u[:], v[:]} {
+		src, rec := e.src[i+1], e.rec[i+1]
+		predict(predC, rec, x8, y8, 8, info.predC)
+		for n := 0; n < 4; n++ {
+			bx, by := 4*(n%2), 4*(n/2)
+			for j := 0; j < 4; j++ {
+				for i := 0; i < 4; i++ {
+					p := predC[(by+j)*8+bx+i]
+					in[j*4+i] = src.at(x8+bx+i, y8+by+j) - p
+					rec.pix[(y8+by+j)*rec.stride+x8+bx+i] = uint8(p)
+				}
+			}
+			fdct(&in, &c)
+			blocks[n].nz = quantize(&c, &blocks[n].levels, e.uv, 0)
+			nonzero = nonzero || blocks[n].nz
+			idct(&c, rec, x8+bx, y8+by)
+		}
+	}
+
+	info.skip = !nonzero
+	e.mbs = append(e.mbs, info)
+	top := &e.top[mbx]
+	if info.skip {
+		e.left, *top = nzContext{}, nzContext{}
+		return
+	}
+
+	// write tokens in the order expected by the decoder
+	nz := e.writeBlock(&y2, planeY2, e.left.y2+top.y2, 0)
+	e.left.y2, top.y2 = nz, nz
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			nz := e.writeBlock(&y1[4*y+x], planeY1WithY2, e.left.y[y]+top.y[x], 1)
+			e.left.y[y], top.y[x] = nz, nz
+		}
+	}
+	for i, blocks := range [][]block{u[:], v[:]} {
+		left, above := &e.left.u, &top.u
+		if i == 1 {
+			left, above = &e.left.v, &top.v
+		}
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 2; x++ {
+				nz := e.writeBlock(&blocks[2*y+x], planeUV, left[y]+above[x], 0)
+				left[y], above[x] = nz, nz
+			}
+		}
+	}
+}
+
+// writeBlock writes the quantized levels of b to the token partition, as
+// specified in section 13.  It returns 1 if b had any non-zero levels.
+func (e *vp8Encoder) writeBlock(b *block, plane int, ctx uint8, first int) uint8 {
+	t := e.tokens
+	probs := &defaultTokenProb[plane]
+	p := &probs[bands[first]][ctx]
+
+	last := -1
+	for n := 15; n >= first; n-- {
+		if b.levels[n] != 0 {
+			last = n
+			break
+		}
+	}
+	if last < 0 {
+		t.writeBool(p[0], false)
+		return 0
+	}
+	t.writeBool(p[0], true)
+
+	for n := first; n < 16; {
+		v := b.levels[n]
+		neg := v < 0
+		if neg {
+			v = -v
+		}
+		n++
+		if v == 0 {
+			t.writeBool(p[1], false)
+			p = &probs[bands[n]][0]
+			continue
+		}
+		t.writeBool(p[1], true)
+		if v == 1 {
+			t.writeBool(p[2], false)
+			p = &probs[bands[n]][1]
+		} else {
+			t.writeBool(p[2], true)
+			switch {
+			case v <= 4:
+				t.writeBool(p[3], false)
+				if v == 2 {
+					t.writeBool(p[4], false)
+				} else {
+					t.writeBool(p[4], true)
+					t.writeBit(p[5], int(v-3))
+				}
+			case v <= 10:
+				t.writeBool(p[3], true)
+				t.writeBool(p[6], false)
+				if v <= 6 {
+					t.writeBool(p[7], false)
+					t.writeBit(159, int(v-5))
+				} else {
+					t.writeBool(p[7], true)
+					t.writeBit(165, int(v-7)>>1)
+					t.writeBit(145, int(v-7))
+				}
+			default:
+				t.writeBool(p[3], true)
+				t.writeBool(p[6], true)
+				cat := 3
+				for cat > 0 && v < 3+(8<<uint(cat)) {
+					cat--
+				}
+				t.writeBit(p[8], cat>>1)
+				t.writeBit(p[9+cat>>1], cat)
+				extra := v - (3 + 8<<uint(cat))
+				tab := cat3456[cat]
+				for i, prob := range tab {
+					t.writeBit(prob, int(extra>>uint(len(tab)-1-i)))
+				}
+			}
+			p = &probs[bands[n]][2]
+		}
+		t.writeBool(uniformProb, neg)
+		if n == 16 {
+			break
+		}
+		t.writeBool(p[0], n <= last)
+		if n > last {
+			break
+		}
+	}
+	return 1
+}
+
+// encode encodes the frame and returns the VP8 bitstream.
+func (e *vp8Encoder) encode() ([]byte, error) {
+	if e.width > 1<<14-1 || e.height > 1<<14-1 {
+		return nil, errors.New("webp: image is too large to encode")
+	}
+	for mby := 0; mby < e.mbh; mby++ {
+		e.left = nzContext{}
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.encodeMacroblock(mbx, mby)
+		}
+	}
+	tokens := e.tokens.flush()
+
+	// first partition: frame header and per-macroblock modes
+	fp := newBoolEncoder()
+	fp.writeUint(0, 1) // color space
+	fp.writeUint(0, 1) // clamping type
+	fp.writeUint(0, 1) // segmentation disabled
+	fp.writeUint(0, 1) // normal loop filter
+	fp.writeUint(uint32(e.filterLevel), 6)
+	fp.writeUint(0, 3) // sharpness
+	fp.writeUint(0, 1) // no loop filter adjustments
+	fp.writeUint(0, 2) // one token partition
+	fp.writeUint(uint32(e.qIndex), 7)
+	for i := 0; i < 5; i++ {
+		fp.writeOptionalInt(0, 4) // no quantizer deltas
+	}
+	fp.writeUint(0, 1) // refresh entropy probs
+	for i := range tokenProbUpdateProb {
+		for j := range tokenProbUpdateProb[i] {
+			for k := range tokenProbUpdateProb[i][j] {
+				for _, prob := range tokenProbUpdateProb[i][j][k] {
+					fp.writeBool(prob, false)
+				}
+			}
+		}
+	}
+
+	var skipped int
+	for _, mb := range e.mbs {
+		if mb.skip {
+			skipped++
+		}
+	}
+	skipProb := 255 - skipped*255/len(e.mbs)
+	if skipProb < 1 {
+		skipProb = 1
+	}
+	if skipProb > 254 {
+		skipProb = 254
+	}
+	fp.writeUint(1, 1) // use skip probability
+	fp.writeUint(uint32(skipProb), 8)
+
+	for _, mb := range e.mbs {
+		fp.writeBool(uint8(skipProb), mb.skip)
+		fp.writeBool(145, true) // 16x16 luma prediction
+		switch mb.predY {
+		case predDC:
+			fp.writeBool(156, false)
+			fp.writeBool(163, false)
+		case predVE:
+			fp.writeBool(156, false)
+			fp.writeBool(163, true)
+		case predHE:
+			fp.writeBool(156, true)
+			fp.writeBool(128, false)
+		case predTM:
+			fp.writeBool(156, true)
+			fp.writeBool(128, true)
+		}
+		switch mb.predC {
+		case predDC:
+			fp.writeBool(142, false)
+		case predVE:
+			fp.writeBool(142, true)
+			fp.writeBool(114, false)
+		case predHE:
+			fp.writeBool(142, true)
+			fp.writeBool(114, true)
+			fp.writeBool(183, false)
+		case predTM:
+			fp.writeBool(142, true)
+			fp.writeBool(114, true)
+			fp.writeBool(183, true)
+		}
+	}
+	first := fp.flush()
+	if len(first) >= 1<<19 {
+		return nil, errors.New("webp: first partition is too large")
+	}
+
+	// frame tag and key frame header, as specified in sections 9.1 and 19.1
+	out := make([]byte, 10, 10+len(first)+len(tokens))
+	tag := uint32(len(first))<<5 | 1<<4 // key frame, version 0, show frame
+	out[0], out[1], out[2] = byte(tag), byte(tag>>8), byte(tag>>16)
+	out[3], out[4], out[5] = 0x9d, 0x01, 0x2a
+	binary.LittleEndian.PutUint16(out[6:], uint16(e.width))
+	binary.LittleEndian.PutUint16(out[8:], uint16(e.height))
+	out = append(out, first...)
+	out = append(out, tokens...)
+	return out, nil
+}
@@ -0,0 +1,466 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webp
+
+import (
+	"image"
+	"math/bits"
+	"sort"
+)
+
+// Parameters of the VP8L lossless format, as specified in
+// https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+const (
+	vp8lMagic            = 0x2f
+	vp8lSubtractGreen    = 2
+	vp8lLiteralCodes     = 256
+	vp8lLengthCodes      = 24
+	vp8lDistanceCodes    = 40
+	vp8lMaxLength        = 4096
+	vp8lDistanceMapCodes = 120 // distance codes for the 2D neighborhood
+	vp8lMaxCodeLength    = 15
+	vp8lMaxCodeLenCode   = 7 // maximum length of the code length code
+)
+
+// vp8lCodeLengthOrder is the order in which the code lengths of the code
+// length code are written.
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// Parameters of the LZ77 backward reference search.
+const (
+	lz77HashBits  = 16
+	lz77MaxChain  = 32
+	lz77MinLength = 3
+	lz77Window    = 1<<20 - vp8lDistanceMapCodes
+)
+
+// bitWriter writes values to a byte slice, least significant bit first.
+type bitWriter struct {
+	buf  []byte
+	bits uint64
+	n    uint
+}
+
+// writeBits writes the n least significant bits of v.  n is at most 32.
+func (w *bitWriter) writeBits(v uint32, n uint) {
+	w.bits |= uint64(v) << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits >>= 8
+		w.n -= 8
+	}
+}
+
+// bytes returns the written bytes, padding the last byte with zero bits.
+func (w *bitWriter) bytes() []byte {
+	if w.n > 0 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits, w.n = 0, 0
+	}
+	return w.buf
+}
+
+// prefixCode is a canonical Huffman code.
+type prefixCode struct {
+	lengths []int    // code length of each symbol, or 0 if it is unused
+	codes   []uint32 // codes of each symbol, bit reversed for writing
+	single  bool     // only one symbol is used, which is written with no bits
+}
+
+// write writes the code of symbol s to w.
+func (c *prefixCode) write(w *bitWriter, s int) {
+	if !c.single {
+		w.writeBits(c.codes[s], uint(c.lengths[s]))
+	}
+}
+
+// newPrefixCode returns a canonical Huffman code for symbols with the given
+// frequencies, with codes of at most maxLength bits.  At least one symbol is
+// given a code, even if all frequencies are zero.
+func newPrefixCode(freq []int, maxLength int) *prefixCode {
+	c := &prefixCode{lengths: huffmanLengths(freq, maxLength)}
+	used := 0
+	for _, l := range c.lengths {
+		if l > 0 {
+			used++
+		}
+	}
+	if used == 0 {
+		c.lengths[0] = 1
+		used = 1
+	}
+	c.single = used == 1
+
+	// assign codes in order of length, and then symbol, as in
+	// section 3.2.2 of RFC 1951
+	var count [vp8lMaxCodeLength + 2]uint32
+	for _, l := range c.lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [vp8lMaxCodeLength + 2]uint32
+	code := uint32(0)
+	for l := 1; l < len(next); l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	c.codes = make([]uint32, len(c.lengths))
+	for s, l := range c.lengths {
+		if l > 0 {
+			c.codes[s] = bits.Reverse32(next[l]) >> (32 - uint(l))
+			next[l]++
+		}
+	}
+	return c
+}
+
+// huffmanLengths returns the Huffman code lengths for symbols with the given
+// frequencies, limited to maxLength bits.  If the optimal code is too long,
+// the frequencies are repeatedly flattened, which brings the code closer to a
+// balanced tree.
+func huffmanLengths(freq []int, maxLength int) []int {
+	f := append([]int{}, freq...)
+	for {
+		lengths, max := huffmanTree(f)
+		if max <= maxLength {
+			return lengths
+		}
+		for i, v := range f {
+			if v > 0 {
+				f[i] = v/2 + 1
+			}
+		}
+	}
+}
+
+// huffmanTree returns the optimal code lengths for symbols with the given
+// frequencies, along with the longest length.  Unused symbols have a length
+// of zero, and a single used symbol has a length of 1.
+func huffmanTree(freq []int) (lengths []int, max int) {
+	lengths = make([]int, len(freq))
+	var leaves []int
+	for s, f := range freq {
+		if f > 0 {
+			leaves = append(leaves, s)
+		}
+	}
+	if len(leaves) == 1 {
+		lengths[leaves[0]] = 1
+		return lengths, 1
+	}
+	if len(leaves) == 0 {
+		return lengths, 0
+	}
+	sort.SliceStable(leaves, func(i, j int) bool { return freq[leaves[i]] < freq[leaves[j]] })
+
+	// nodes 0 to n-1 are the leaves in order of frequency, and the
+	// internal nodes follow in the order they are created, which is also
+	// in order of frequency.  The two lowest frequency nodes are merged
+	// until only the root remains.
+	n := len(leaves)
+	weight := make([]int, 2*n-1)
+	parent := make([]int, 2*n-1)
+	for i, s := range leaves {
+		weight[i] = freq[s]
+	}
+	leaf, node := 0, n
+	lowest := func(next int) int {
+		if leaf < n && (node >= next || weight[leaf] <= weight[node]) {
+			leaf++
+			return leaf - 1
+		}
+		node++
+		return node - 1
+	}
+	for next := n; next < 2*n-1; next++ {
+		a := lowest(next)
+		b := lowest(next)
+		weight[next] = weight[a] + weight[b]
+		parent[a], parent[b] = next, next
+	}
+
+	depth := make([]int, 2*n-1)
+	for i := 2*n - 3; i >= 0; i-- {
+		depth[i] = depth[parent[i]] + 1
+	}
+	for i, s := range leaves {
+		lengths[s] = depth[i]
+		if depth[i] > max {
+			max = depth[i]
+		}
+	}
+	return lengths, max
+}
+
+// writePrefixCode writes c to w, as a simple code if it has at most two
+// symbols with values below 256, and otherwise as a normal code whose code
+// lengths are themselves prefix coded.
+func writePrefixCode(w *bitWriter, c *prefixCode) {
+	var symbols []int
+	for s, l := range c.lengths {
+		if l > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	if len(symbols) <= 2 && symbols[len(symbols)-1] < 256 {
+		w.writeBits(1, 1)
+		w.writeBits(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			w.writeBits(0, 1)
+			w.writeBits(uint32(symbols[0]), 1)
+		} else {
+			w.writeBits(1, 1)
+			w.writeBits(uint32(symbols[0]), 8)
+		}
+		if len(symbols) == 2 {
+			w.writeBits(uint32(symbols[1]), 8)
+		}
+		return
+	}
+
+	// run length encode the code lengths with symbols 0 to 15 for
+	// lengths, 16 to repeat the previous non-zero length 3 to 6 times, 17 to
+	// repeat zero 3 to 10 times, and 18 to repeat zero 11 to 138 times.
+	type token struct{ sym, extra int }
+	var tokens []token
+	var freq [19]int
+	emit := func(sym, extra int) {
+		tokens = append(tokens, token{sym, extra})
+		freq[sym]++
+	}
+	prev := 8
+	for i := 0; i < len(c.lengths); {
+		l := c.lengths[i]
+		run := 1
+		for i+run < len(c.lengths) && c.lengths[i+run] == l {
+			run++
+		}
+		i += run
+		if l == 0 {
+			for run >= 11 {
+				n := run
+				if n > 138 {
+					n = 138
+				}
+				emit(18, n-11)
+				run -= n
+			}
+			if run >= 3 {
+				emit(17, run-3)
+				run = 0
+			}
+			for ; run > 0; run-- {
+				emit(0, 0)
+			}
+			continue
+		}
+		if l != prev {
+			emit(l, 0)
+			prev = l
+			run--
+		}
+		for run >= 3 {
+			n := run
+			if n > 6 {
+				n = 6
+			}
+			emit(16, n-3)
+			run -= n
+		}
+		for ; run > 0; run-- {
+			emit(l, 0)
+		}
+	}
+
+	lc := newPrefixCode(freq[:], vp8lMaxCodeLenCode)
+	n := len(vp8lCodeLengthOrder)
+	for n > 4 && lc.lengths[vp8lCodeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	w.writeBits(0, 1)
+	w.writeBits(uint32(n-4), 4)
+	for _, s := range vp8lCodeLengthOrder[:n] {
+		w.writeBits(uint32(lc.lengths[s]), 3)
+	}
+	w.writeBits(0, 1) // code lengths are given for all symbols
+	for _, t := range tokens {
+		lc.write(w, t.sym)
+		switch t.sym {
+		case 16:
+			w.writeBits(uint32(t.extra), 2)
+		case 17:
+			w.writeBits(uint32(t.extra), 3)
+		case 18:
+			w.writeBits(uint32(t.extra), 7)
+		}
+	}
+}
+
+// vp8lPrefix returns the prefix symbol of the LZ77 length or distance code
+// v, along with the number and value of the extra bits following it.
+func vp8lPrefix(v int) (symbol int, n uint, extra uint32) {
+	if v <= 4 {
+		return v - 1, 0, 0
+	}
+	d := v - 1
+	h := bits.Len(uint(d)) - 1
+	second := (d >> uint(h-1)) & 1
+	n = uint(h - 1)
+	return 2*h + second, n, uint32(d) & (1<<n - 1)
+}
+
+// vp8lToken is a literal pixel, or an LZ77 backward reference to length
+// pixels at distance pixels before it.
+type vp8lToken struct {
+	argb     uint32
+	length   int
+	distance int
+}
+
+// lz77 returns the tokens which encode argb, finding backward references
+// with hash chains over pairs of pixels.
+func lz77(argb []uint32) []vp8lToken {
+	var tokens []vp8lToken
+	head := make([]int32, 1<<lz77HashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(argb))
+	hash := func(i int) uint32 {
+		return (argb[i]*0x1e35a7bd ^ argb[i+1]*0x9e3779b1) >> (32 - lz77HashBits)
+	}
+	insert := func(i int) {
+		if i+1 < len(argb) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	for i := 0; i < len(argb); {
+		bestLength, bestDistance := 0, 0
+		if i+1 < len(argb) {
+			maxLength := len(argb) - i
+			if maxLength > vp8lMaxLength {
+				maxLength = vp8lMaxLength
+			}
+			for j, chain := int(head[hash(i)]), 0; j >= 0 && i-j <= lz77Window && chain < lz77MaxChain; j, chain = int(prev[j]), chain+1 {
+				n := 0
+				for n < maxLength && argb[j+n] == argb[i+n] {
+					n++
+				}
+				if n > bestLength {
+					bestLength, bestDistance = n, i-j
+					if n == maxLength {
+						break
+					}
+				}
+			}
+		}
+		if bestLength < lz77MinLength {
+			tokens = append(tokens, vp8lToken{argb: argb[i]})
+			insert(i)
+			i++
+			continue
+		}
+		tokens = append(tokens, vp8lToken{length: bestLength, distance: bestDistance})
+		for end := i + bestLength; i < end; i++ {
+			insert(i)
+		}
+	}
+	return tokens
+}
+
+// encodeVP8L encodes m as a lossless VP8L image.  The subtract green
+// transform is applied to the pixels, which are then encoded as literals
+// and LZ77 backward references with a single set of prefix codes.
+func encodeVP8L(m *image.NRGBA) []byte {
+	b := m.Bounds()
+	argb := make([]uint32, 0, b.Dx()*b.Dy())
+	alpha := false
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := m.PixOffset(b.Min.X, y)
+		for x := b.Min.X; x < b.Max.X; x, i = x+1, i+4 {
+			pr, pg, pb, pa := m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3]
+			if pa != 0xff {
+				alpha = true
+			}
+			argb = append(argb, uint32(pa)<<24|uint32(pr-pg)<<16|uint32(pg)<<8|uint32(pb-pg))
+		}
+	}
+	tokens := lz77(argb)
+
+	var green [vp8lLiteralCodes + vp8lLengthCodes]int
+	var red, blue, alphas [256]int
+	var dist [vp8lDistanceCodes]int
+	for _, t := range tokens {
+		if t.length == 0 {
+			green[t.argb>>8&0xff]++
+			red[t.argb>>16&0xff]++
+			blue[t.argb&0xff]++
+			alphas[t.argb>>24]++
+			continue
+		}
+		l, _, _ := vp8lPrefix(t.length)
+		d, _, _ := vp8lPrefix(t.distance + vp8lDistanceMapCodes)
+		green[vp8lLiteralCodes+l]++
+		dist[d]++
+	}
+	codes := [5]*prefixCode{
+		newPrefixCode(green[:], vp8lMaxCodeLength),
+		newPrefixCode(red[:], vp8lMaxCodeLength),
+		newPrefixCode(blue[:], vp8lMaxCodeLength),
+		newPrefixCode(alphas[:], vp8lMaxCodeLength),
+		newPrefixCode(dist[:], vp8lMaxCodeLength),
+	}
+
+	w := new(bitWriter)
+	w.writeBits(vp8lMagic, 8)
+	w.writeBits(uint32(b.Dx()-1), 14)
+	w.writeBits(uint32(b.Dy()-1), 14)
+	if alpha {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+	w.writeBits(0, 3) // version
+
+	w.writeBits(1, 1) // transform present
+	w.writeBits(vp8lSubtractGreen, 2)
+	w.writeBits(0, 1) // no more transforms
+	w.writeBits(0, 1) // no color cache
+	w.writeBits(0, 1) // no meta prefix codes
+	for _, c := range codes {
+		writePrefixCode(w, c)
+	}
+
+	for _, t := range tokens {
+		if t.length == 0 {
+			codes[0].write(w, int(t.argb>>8&0xff))
+			codes[1].write(w, int(t.argb>>16&0xff))
+			codes[2].write(w, int(t.argb&0xff))
+			codes[3].write(w, int(t.argb>>24))
+			continue
+		}
+		l, n, extra := vp8lPrefix(t.length)
+		codes[0].write(w, vp8lLiteralCodes+l)
+		w.writeBits(extra, n)
+		d, n, extra := vp8lPrefix(t.distance + vp8lDistanceMapCodes)
+		codes[4].write(w, d)
+		w.writeBits(extra, n)
+	}
+	return w.bytes()
+}
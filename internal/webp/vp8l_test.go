@@ -0,0 +1,151 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncode_Lossless(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	noise := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	r.Read(noise.Pix)
+	pattern := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	for i := range pattern.Pix {
+		pattern.Pix[i] = uint8(i % 12 * 20)
+	}
+	uniform := image.NewNRGBA(image.Rect(0, 0, 30, 20))
+	for i := range uniform.Pix {
+		uniform.Pix[i] = 0x80
+	}
+
+	tests := []struct {
+		name string
+		m    *image.NRGBA
+	}{
+		{"opaque", testImage(37, 23, opaque)},
+		{"alpha", testImage(40, 40, func(x, y int) uint8 { return uint8(x * 6) })},
+		{"noise", noise},
+		{"pattern", pattern},
+		{"uniform", uniform},
+		{"pixel", testImage(1, 1, opaque)},
+		{"wide", testImage(5000, 2, opaque)},
+	}
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		if err := Encode(buf, tt.m, &Options{Lossless: true}); err != nil {
+			t.Errorf("%s: Encode returned error: %v", tt.name, err)
+			continue
+		}
+		m, err := webp.Decode(buf)
+		if err != nil {
+			t.Errorf("%s: error decoding lossless image: %v", tt.name, err)
+			continue
+		}
+		got, ok := m.(*image.NRGBA)
+		if !ok || got.Bounds() != tt.m.Bounds() || !bytes.Equal(got.Pix, tt.m.Pix) {
+			t.Errorf("%s: decoded lossless image does not match the original", tt.name)
+		}
+	}
+}
+
+func TestEncodeAll_Lossless(t *testing.T) {
+	frames := []image.Image{
+		testImage(16, 16, opaque),
+		testImage(16, 16, func(x, y int) uint8 { return uint8(x * 16) }),
+	}
+	buf := new(bytes.Buffer)
+	a := &Animation{Image: frames, Delay: []int{100, 100}}
+	if err := EncodeAll(buf, a, &Options{Lossless: true}); err != nil {
+		t.Fatalf("EncodeAll returned error: %v", err)
+	}
+	got, err := DecodeAll(buf.Bytes(), 0)
+	if err != nil {
+		t.Fatalf("DecodeAll returned error: %v", err)
+	}
+	for i, m := range got.Image {
+		want := frames[i]
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 16; x++ {
+				if c, w := color.NRGBAModel.Convert(m.At(x, y)), want.At(x, y); c != w {
+					t.Fatalf("frame %d has color %v at (%d, %d), want %v", i, c, x, y, w)
+				}
+			}
+		}
+	}
+}
+
+func TestHuffmanLengths(t *testing.T) {
+	// fibonacci frequencies produce the deepest possible tree
+	fib := []int{1, 1}
+	for len(fib) < 30 {
+		fib = append(fib, fib[len(fib)-1]+fib[len(fib)-2])
+	}
+	tests := []struct {
+		freq      []int
+		maxLength int
+	}{
+		{[]int{5}, 15},
+		{[]int{0, 3, 0, 3}, 15},
+		{[]int{1, 2, 3, 4, 5, 6}, 15},
+		{fib, 15},
+		{fib, 7},
+	}
+	for _, tt := range tests {
+		lengths := huffmanLengths(tt.freq, tt.maxLength)
+		var kraft float64
+		used := 0
+		for s, l := range lengths {
+			if (l > 0) != (tt.freq[s] > 0) {
+				t.Errorf("huffmanLengths(%v) gave symbol %d length %d", tt.freq, s, l)
+			}
+			if l > tt.maxLength {
+				t.Errorf("huffmanLengths(%v, %d) gave symbol %d length %d", tt.freq, tt.maxLength, s, l)
+			}
+			if l > 0 {
+				kraft += 1 / float64(uint(1)<<uint(l))
+				used++
+			}
+		}
+		// codes must form a complete prefix code
+		if used > 1 && kraft != 1 {
+			t.Errorf("huffmanLengths(%v) returned incomplete code %v", tt.freq, lengths)
+		}
+	}
+}
+
+func TestVP8LPrefix(t *testing.T) {
+	for v := 1; v <= 1<<20; v++ {
+		symbol, n, extra := vp8lPrefix(v)
+		// decode as specified in section 4.2.2 of the specification
+		got := symbol + 1
+		if symbol >= 4 {
+			bits := uint(symbol-2) >> 1
+			if bits != n {
+				t.Fatalf("vp8lPrefix(%d) returned %d extra bits, want %d", v, n, bits)
+			}
+			got = (2+symbol&1)<<bits + int(extra) + 1
+		}
+		if got != v {
+			t.Fatalf("vp8lPrefix(%d) returned %d, %d, %d, which decodes to %d", v, symbol, n, extra, got)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webp implements a WebP image encoder, and a decoder for animated
+// WebP images.
+//
+// Images are encoded as a single VP8 key frame, with an uncompressed alpha
+// channel if the image is not fully opaque, or as a lossless VP8L image.  The
+// resulting files can be read by any WebP decoder, including
+// golang.org/x/image/webp.  Animations are encoded as a sequence of such
+// frames, which golang.org/x/image/webp does not support decoding.  DecodeAll decodes animations by passing each frame
+// to golang.org/x/image/webp as a still image.
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// DefaultQuality is the default quality encoding parameter.
+const DefaultQuality = 75
+
+// Options are the encoding parameters.
+// Quality ranges from 1 to 100 inclusive, higher is better.  If Lossless is
+// true, images are encoded losslessly, and Quality is ignored.
+type Options struct {
+	Quality  int
+	Lossless bool
+}
+
+// Encode writes the Image m to w in WebP format with the given options.
+// Default parameters are used if a nil *Options is passed.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	if err := checkBounds(m.Bounds()); err != nil {
+		return err
+	}
+	f, err := encodeFrame(m, o)
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("WEBP")
+	if f.alpha != nil {
+		// extended format, as specified in
+		// https://developers.google.com/speed/webp/docs/riff_container.
+		// Lossless images have their own alpha channel.
+		writeVP8X(buf, vp8xAlpha, m.Bounds())
+	}
+	writeFrame(buf, f)
+	return writeRIFF(w, buf)
+}
+
+// flags of the VP8X chunk of the extended format.
+const (
+	vp8xAnimation = 1 << 1
+	vp8xAlpha     = 1 << 4
+)
+
+// checkBounds returns an error if images of size b cannot be encoded.
+func checkBounds(b image.Rectangle) error {
+	if b.Dx() <= 0 || b.Dy() <= 0 {
+		return errors.New("webp: image has no pixels")
+	}
+	if b.Dx() >= 1<<14 || b.Dy() >= 1<<14 {
+		return errors.New("webp: image is too large to encode")
+	}
+	return nil
+}
+
+// quality returns the quality of o, clamped to the valid range.
+func quality(o *Options) int {
+	quality := DefaultQuality
+	if o != nil {
+		quality = o.Quality
+	}
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	return quality
+}
+
+// encodedFrame is an encoded image: either a VP8 key frame, with the alpha
+// values of the image if it is not fully opaque, or a lossless VP8L image.
+type encodedFrame struct {
+	data     []byte
+	alpha    []byte
+	lossless bool
+	opaque   bool
+}
+
+// encodeFrame encodes m as a VP8 key frame, or as a VP8L image if o
+// requests lossless encoding.
+func encodeFrame(m image.Image, o *Options) (encodedFrame, error) {
+	b := m.Bounds()
+	nrgba, ok := m.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(b)
+		draw.Draw(nrgba, b, m, b.Min, draw.Src)
+	}
+
+	if o != nil && o.Lossless {
+		return encodedFrame{data: encodeVP8L(nrgba), lossless: true, opaque: alphaValues(nrgba) == nil}, nil
+	}
+	data, err := newVP8Encoder(nrgba, quality(o)).encode()
+	if err != nil {
+		return encodedFrame{}, err
+	}
+	alpha := alphaValues(nrgba)
+	return encodedFrame{data: data, alpha: alpha, opaque: alpha == nil}, nil
+}
+
+// writeVP8X writes a VP8X chunk with the given flags for a canvas of size b
+// to buf.
+func writeVP8X(buf *bytes.Buffer, flags byte, b image.Rectangle) {
+	var vp8x [10]byte
+	vp8x[0] = flags
+	put24(vp8x[4:], uint32(b.Dx()-1))
+	put24(vp8x[7:], uint32(b.Dy()-1))
+	writeChunk(buf, "VP8X", vp8x[:])
+}
+
+// writeFrame writes the chunks of the encoded frame f to buf, with the
+// alpha values of VP8 frames, if any, first.
+func writeFrame(buf *bytes.Buffer, f encodedFrame) {
+	if f.lossless {
+		writeChunk(buf, "VP8L", f.data)
+		return
+	}
+	if f.alpha != nil {
+		// a single header byte indicating no preprocessing, no
+		// filtering, and no compression, followed by the raw values.
+		writeChunk(buf, "ALPH", append([]byte{0}, f.alpha...))
+	}
+	writeChunk(buf, "VP8 ", f.data)
+}
+
+// writeRIFF writes the RIFF header for the contents of buf to w, followed by
+// the contents.
+func writeRIFF(w io.Writer, buf *bytes.Buffer) error {
+	var riff [8]byte
+	copy(riff[:], "RIFF")
+	binary.LittleEndian.PutUint32(riff[4:], uint32(buf.Len()))
+	if _, err := w.Write(riff[:]); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// alphaValues returns the alpha values of m in row order, or nil if m is
+// fully opaque.
+func alphaValues(m *image.NRGBA) []byte {
+	b := m.Bounds()
+	alpha := make([]byte, 0, b.Dx()*b.Dy())
+	opaque := true
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := m.PixOffset(b.Min.X, y)
+		for x := b.Min.X; x < b.Max.X; x, i = x+1, i+4 {
+			a := m.Pix[i+3]
+			if a != 0xff {
+				opaque = false
+			}
+			alpha = append(alpha, a)
+		}
+	}
+	if opaque {
+		return nil
+	}
+	return alpha
+}
+
+// writeChunk writes a RIFF chunk with the given data to buf, padding it to
+// an even length.
+func writeChunk(buf *bytes.Buffer, fourCC string, data []byte) {
+	var hdr [8]byte
+	copy(hdr[:], fourCC)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(data)))
+	buf.Write(hdr[:])
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func put24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
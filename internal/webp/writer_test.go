@@ -0,0 +1,182 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// testImage returns a w x h image with smooth gradients, with alpha values
+// generated by the alpha function.
+func testImage(w, h int, alpha func(x, y int) uint8) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(255 * x / w),
+				G: uint8(255 * y / h),
+				B: uint8(128 + 127*(x-y)/(w+h)),
+				A: alpha(x, y),
+			})
+		}
+	}
+	return m
+}
+
+func opaque(x, y int) uint8 { return 0xff }
+
+// studioNRGBA returns the color of the decoded WebP image m at (x, y).
+// The golang.org/x/image/webp decoder returns Y'CbCr values which Go
+// interprets as full range, but VP8 uses the BT.601 studio range, so the
+// conversion is done here instead.
+func studioNRGBA(m image.Image, x, y int) color.NRGBA {
+	var ycbcr *image.YCbCr
+	a := uint8(0xff)
+	switch m := m.(type) {
+	case *image.YCbCr:
+		ycbcr = m
+	case *image.NYCbCrA:
+		ycbcr = &m.YCbCr
+		a = m.A[m.AOffset(x, y)]
+	default:
+		panic("unexpected image type")
+	}
+	Y := float64(ycbcr.Y[ycbcr.YOffset(x, y)]) - 16
+	cb := float64(ycbcr.Cb[ycbcr.COffset(x, y)]) - 128
+	cr := float64(ycbcr.Cr[ycbcr.COffset(x, y)]) - 128
+	clip := func(v float64) uint8 {
+		if v < 0 {
+			return 0
+		}
+		if v > 255 {
+			return 255
+		}
+		return uint8(v + 0.5)
+	}
+	return color.NRGBA{
+		R: clip(1.164*Y + 1.596*cr),
+		G: clip(1.164*Y - 0.392*cb - 0.813*cr),
+		B: clip(1.164*Y + 2.017*cb),
+		A: a,
+	}
+}
+
+// meanDiff returns the mean absolute difference of the color channels and
+// the maximum difference of the alpha channel between the decoded image a
+// and the original image b.
+func meanDiff(a, b image.Image) (float64, int) {
+	var sum, n float64
+	var maxAlpha int
+	r := a.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c1 := studioNRGBA(a, x, y)
+			c2 := color.NRGBAModel.Convert(b.At(x, y)).(color.NRGBA)
+			for _, d := range []int{
+				int(c1.R) - int(c2.R),
+				int(c1.G) - int(c2.G),
+				int(c1.B) - int(c2.B),
+			} {
+				if d < 0 {
+					d = -d
+				}
+				sum += float64(d)
+				n++
+			}
+			if d := int(c1.A) - int(c2.A); d > maxAlpha || -d > maxAlpha {
+				if d < 0 {
+					d = -d
+				}
+				maxAlpha = d
+			}
+		}
+	}
+	return sum / n, maxAlpha
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name    string
+		img     image.Image
+		quality int
+		maxDiff float64
+	}{
+		{"1x1", testImage(1, 1, opaque), 90, 4},
+		{"16x16", testImage(16, 16, opaque), 90, 6},
+		{"odd size", testImage(37, 21, opaque), 90, 4},
+		{"multiple macroblocks", testImage(100, 60, opaque), 90, 4},
+		{"low quality", testImage(100, 60, opaque), 10, 12},
+		{"alpha", testImage(40, 30, func(x, y int) uint8 { return uint8(x * 6) }), 90, 4},
+		{"ycbcr", image.NewYCbCr(image.Rect(0, 0, 20, 20), image.YCbCrSubsampleRatio420), 75, 4},
+		{"gray", image.NewGray(image.Rect(0, 0, 10, 10)), 0, 4},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		if err := Encode(buf, tt.img, &Options{Quality: tt.quality}); err != nil {
+			t.Errorf("%s: Encode returned error: %v", tt.name, err)
+			continue
+		}
+
+		got, err := webp.Decode(buf)
+		if err != nil {
+			t.Errorf("%s: webp.Decode returned error: %v", tt.name, err)
+			continue
+		}
+		if got, want := got.Bounds(), tt.img.Bounds(); got != want {
+			t.Errorf("%s: decoded bounds is %v, want %v", tt.name, got, want)
+			continue
+		}
+		diff, alphaDiff := meanDiff(got, tt.img)
+		if diff > tt.maxDiff {
+			t.Errorf("%s: mean difference is %v, want <= %v", tt.name, diff, tt.maxDiff)
+		}
+		if alphaDiff != 0 {
+			t.Errorf("%s: alpha values differ by %v, want exact match", tt.name, alphaDiff)
+		}
+	}
+}
+
+func TestEncode_Errors(t *testing.T) {
+	tests := []image.Image{
+		image.NewNRGBA(image.Rect(0, 0, 0, 0)),
+		image.NewNRGBA(image.Rect(0, 0, 1<<14, 1)),
+	}
+
+	for _, m := range tests {
+		if err := Encode(new(bytes.Buffer), m, nil); err == nil {
+			t.Errorf("Encode(%v) did not return expected error", m.Bounds())
+		}
+	}
+}
+
+func TestQualityToIndex(t *testing.T) {
+	prev := 128
+	for quality := 1; quality <= 100; quality++ {
+		q := qualityToIndex(quality)
+		if q < 0 || q > 127 {
+			t.Errorf("qualityToIndex(%d) returned %d, want value in [0, 127]", quality, q)
+		}
+		if q > prev {
+			t.Errorf("qualityToIndex(%d) returned %d, want <= %d", quality, q, prev)
+		}
+		prev = q
+	}
+}
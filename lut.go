@@ -0,0 +1,198 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// LUTs are the 3D color lookup tables which transformed images can be color
+// graded with, by the name given in their options' LUT field.
+var LUTs map[string]*LUT
+
+// maxLUTSize is the largest number of nodes along each axis of a LUT.
+const maxLUTSize = 256
+
+// A LUT is a 3D color lookup table, which maps each input color to an output
+// color.  Colors between the nodes of the table are mapped by trilinear
+// interpolation.
+type LUT struct {
+	size     int
+	min, max [3]float64
+
+	// output colors of the nodes, with red changing fastest, then green,
+	// then blue
+	table [][3]float64
+}
+
+// ReadCubeFile reads the LUT in the .cube file at path.
+func ReadCubeFile(path string) (*LUT, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseCube(f)
+}
+
+// ParseCube parses a 3D LUT in the .cube format, as exported by most color
+// grading software, such as Photoshop and DaVinci Resolve.  1D LUTs are not
+// supported.
+func ParseCube(r io.Reader) (*LUT, error) {
+	l := &LUT{max: [3]float64{1, 1, 1}}
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var err error
+		switch fields[0] {
+		case "TITLE":
+		case "LUT_1D_SIZE":
+			return nil, errors.New("cube: 1D LUTs are not supported")
+		case "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				err = errors.New("invalid LUT_3D_SIZE")
+				break
+			}
+			l.size, err = strconv.Atoi(fields[1])
+			if err == nil && (l.size < 2 || l.size > maxLUTSize) {
+				err = fmt.Errorf("invalid LUT_3D_SIZE %d", l.size)
+			}
+		case "DOMAIN_MIN":
+			l.min, err = parseCubeTriple(fields[1:])
+		case "DOMAIN_MAX":
+			l.max, err = parseCubeTriple(fields[1:])
+		case "LUT_3D_INPUT_RANGE":
+			// the same range for each channel, written by some software
+			// instead of DOMAIN_MIN and DOMAIN_MAX
+			var v []float64
+			if v, err = parseCubeValues(fields[1:], 2); err == nil {
+				l.min = [3]float64{v[0], v[0], v[0]}
+				l.max = [3]float64{v[1], v[1], v[1]}
+			}
+		default:
+			if l.size == 0 {
+				err = errors.New("node before LUT_3D_SIZE")
+				break
+			}
+			var v [3]float64
+			if v, err = parseCubeTriple(fields); err == nil {
+				l.table = append(l.table, v)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cube: line %d: %v", line, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if l.size == 0 {
+		return nil, errors.New("cube: missing LUT_3D_SIZE")
+	}
+	if n := l.size * l.size * l.size; len(l.table) != n {
+		return nil, fmt.Errorf("cube: found %d nodes, want %d", len(l.table), n)
+	}
+	for i := range l.min {
+		if !(l.min[i] < l.max[i]) {
+			return nil, fmt.Errorf("cube: invalid domain %v to %v", l.min, l.max)
+		}
+	}
+	return l, nil
+}
+
+// parseCubeValues parses the n numbers in fields.
+func parseCubeValues(fields []string, n int) ([]float64, error) {
+	if len(fields) != n {
+		return nil, fmt.Errorf("expected %d values, found %d", n, len(fields))
+	}
+	v := make([]float64, n)
+	for i, f := range fields {
+		var err error
+		if v[i], err = strconv.ParseFloat(f, 64); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// parseCubeTriple parses the three numbers in fields.
+func parseCubeTriple(fields []string) ([3]float64, error) {
+	var t [3]float64
+	v, err := parseCubeValues(fields, 3)
+	copy(t[:], v)
+	return t, err
+}
+
+// node returns the output color of the node at index r, g, b.
+func (l *LUT) node(r, g, b int) [3]float64 {
+	return l.table[(b*l.size+g)*l.size+r]
+}
+
+// Map returns the output color of l for c.  Transparency is not affected.
+func (l *LUT) Map(c color.NRGBA) color.NRGBA {
+	// position of c in l, and the index of the node below it on each axis
+	var pos [3]float64
+	var lo [3]int
+	for i, v := range [3]uint8{c.R, c.G, c.B} {
+		x := (float64(v)/255 - l.min[i]) / (l.max[i] - l.min[i])
+		x = math.Max(0, math.Min(1, x)) * float64(l.size-1)
+		lo[i] = int(x)
+		if lo[i] == l.size-1 {
+			lo[i]--
+		}
+		pos[i] = x - float64(lo[i])
+	}
+
+	// interpolate along red, then green, then blue
+	var out [3]float64
+	for i := range out {
+		var z [2]float64
+		for db := 0; db < 2; db++ {
+			var y [2]float64
+			for dg := 0; dg < 2; dg++ {
+				v0 := l.node(lo[0], lo[1]+dg, lo[2]+db)[i]
+				v1 := l.node(lo[0]+1, lo[1]+dg, lo[2]+db)[i]
+				y[dg] = v0 + (v1-v0)*pos[0]
+			}
+			z[db] = y[0] + (y[1]-y[0])*pos[1]
+		}
+		out[i] = z[0] + (z[1]-z[0])*pos[2]
+	}
+
+	channel := func(v float64) uint8 {
+		return uint8(math.Max(0, math.Min(255, v*255+0.5)))
+	}
+	return color.NRGBA{R: channel(out[0]), G: channel(out[1]), B: channel(out[2]), A: c.A}
+}
+
+// applyLUT returns m with the colors of each pixel mapped by l.
+func applyLUT(m image.Image, l *LUT) *image.NRGBA {
+	return imaging.AdjustFunc(m, l.Map)
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// identityLUT returns a LUT of the given size which maps each color to
+// itself.
+func identityLUT(size int) *LUT {
+	l := &LUT{size: size, max: [3]float64{1, 1, 1}}
+	for b := 0; b < size; b++ {
+		for g := 0; g < size; g++ {
+			for r := 0; r < size; r++ {
+				n := float64(size - 1)
+				l.table = append(l.table, [3]float64{float64(r) / n, float64(g) / n, float64(b) / n})
+			}
+		}
+	}
+	return l
+}
+
+func TestParseCube(t *testing.T) {
+	// a LUT which inverts colors, within a domain of 0 to 2
+	cube := `# inverted
+TITLE "invert"
+LUT_3D_SIZE 2
+DOMAIN_MIN 0 0 0
+DOMAIN_MAX 2 2 2
+
+1 1 1
+0 1 1
+1 0 1
+0 0 1
+1 1 0
+0 1 0
+1 0 0
+0 0 0
+`
+	l, err := ParseCube(strings.NewReader(cube))
+	if err != nil {
+		t.Fatalf("ParseCube returned unexpected error: %v", err)
+	}
+	tests := []struct {
+		c, want color.NRGBA
+	}{
+		{color.NRGBA{0, 0, 0, 255}, color.NRGBA{255, 255, 255, 255}},
+		{color.NRGBA{255, 0, 0, 128}, color.NRGBA{128, 255, 255, 128}},
+		{color.NRGBA{51, 102, 255, 255}, color.NRGBA{230, 204, 128, 255}},
+	}
+	for _, tt := range tests {
+		if got := l.Map(tt.c); got != tt.want {
+			t.Errorf("Map(%v) returned %v, want %v", tt.c, got, tt.want)
+		}
+	}
+
+	resolve := "LUT_3D_INPUT_RANGE 0 1\nLUT_3D_SIZE 2\n" + strings.Repeat("0.5 0.5 0.5\n", 8)
+	if l, err := ParseCube(strings.NewReader(resolve)); err != nil {
+		t.Errorf("ParseCube with LUT_3D_INPUT_RANGE returned unexpected error: %v", err)
+	} else if got, want := l.Map(color.NRGBA{10, 20, 30, 255}), (color.NRGBA{128, 128, 128, 255}); got != want {
+		t.Errorf("Map returned %v, want %v", got, want)
+	}
+}
+
+func TestParseCube_Invalid(t *testing.T) {
+	nodes := strings.Repeat("0 0 0\n", 8)
+	tests := []string{
+		"",
+		nodes,
+		"LUT_1D_SIZE 2\n0 0 0\n1 1 1\n",
+		"LUT_3D_SIZE 1\n0 0 0\n",
+		"LUT_3D_SIZE x\n" + nodes,
+		"LUT_3D_SIZE 2\n" + strings.Repeat("0 0 0\n", 7),
+		"LUT_3D_SIZE 2\n" + nodes + "0 0 0\n",
+		"LUT_3D_SIZE 2\n0 0\n" + nodes,
+		"LUT_3D_SIZE 2\n0 0 x\n" + nodes,
+		"LUT_3D_SIZE 2\nDOMAIN_MAX 1 0 1\n" + nodes,
+		fmt.Sprintf("LUT_3D_SIZE %d\n", maxLUTSize+1),
+	}
+	for _, tt := range tests {
+		if _, err := ParseCube(strings.NewReader(tt)); err == nil {
+			t.Errorf("ParseCube(%q) did not return expected error", tt)
+		}
+	}
+}
+
+func TestLUT_Map(t *testing.T) {
+	// colors between nodes are interpolated on each axis
+	l := &LUT{size: 2, max: [3]float64{1, 1, 1}, table: make([][3]float64, 8)}
+	l.table[7] = [3]float64{1, 1, 1}
+	tests := []struct {
+		c, want color.NRGBA
+	}{
+		{color.NRGBA{255, 255, 255, 255}, color.NRGBA{255, 255, 255, 255}},
+		{color.NRGBA{255, 255, 0, 255}, color.NRGBA{0, 0, 0, 255}},
+		{color.NRGBA{255, 255, 51, 255}, color.NRGBA{51, 51, 51, 255}},
+		{color.NRGBA{51, 51, 51, 255}, color.NRGBA{2, 2, 2, 255}},
+	}
+	for _, tt := range tests {
+		if got := l.Map(tt.c); got != tt.want {
+			t.Errorf("Map(%v) returned %v, want %v", tt.c, got, tt.want)
+		}
+	}
+
+	id := identityLUT(17)
+	for _, c := range []color.NRGBA{{0, 0, 0, 0}, {1, 2, 3, 4}, {128, 64, 200, 255}, {255, 255, 255, 255}} {
+		if got := id.Map(c); got != c {
+			t.Errorf("identity LUT mapped %v to %v", c, got)
+		}
+	}
+}
+
+func TestTransformImage_LUT(t *testing.T) {
+	defer func(luts map[string]*LUT) { LUTs = luts }(LUTs)
+	LUTs = map[string]*LUT{"invert": {size: 2, max: [3]float64{1, 1, 1}, table: [][3]float64{
+		{1, 1, 1}, {0, 1, 1}, {1, 0, 1}, {0, 0, 1}, {1, 1, 0}, {0, 1, 0}, {1, 0, 0}, {0, 0, 0},
+	}}}
+
+	m := mustTransformImage(t, newImage(2, 2, red), Options{LUT: "invert"})
+	if got, want := color.NRGBAModel.Convert(m.At(1, 1)), (color.NRGBA{0, 255, 255, 255}); got != want {
+		t.Errorf("transformImage with LUT returned color %v, want %v", got, want)
+	}
+
+	// LUTs are applied after other color adjustments
+	m = mustTransformImage(t, newImage(2, 2, red), Options{LUT: "invert", Invert: true})
+	if got, want := color.NRGBAModel.Convert(m.At(1, 1)), (color.NRGBA{255, 0, 0, 255}); got != want {
+		t.Errorf("transformImage with LUT and invert returned color %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import "time"
+
+// Metrics receives measurements of the requests served by a Proxy, so that
+// they can be exported to a monitoring system such as Prometheus without this
+// package depending on it.  Implementations must be safe for concurrent use.
+type Metrics interface {
+	// TransformDuration records the time taken to transform an image into
+	// the given output format, such as "jpeg".
+	TransformDuration(format string, d time.Duration)
+
+	// FetchDuration records the time taken to receive the response headers
+	// when fetching an image from its remote server.  Images served from
+	// the cache are not fetched.
+	FetchDuration(d time.Duration)
+
+	// CacheLookup records whether a lookup in the Cache of the proxy found
+	// a cached response.
+	CacheLookup(hit bool)
+
+	// BytesFetched records the size of an original image, before it is
+	// transformed.
+	BytesFetched(n int64)
+
+	// BytesServed records the number of bytes of a response body written
+	// to a client.
+	BytesServed(n int64)
+
+	// Error records an error serving a request, of one of the kinds listed
+	// below, such as ErrorKindFetch.
+	Error(kind string)
+}
+
+// Kinds of errors recorded by Metrics.Error.
+const (
+	ErrorKindRequest   = "request"   // malformed or too large request
+	ErrorKindForbidden = "forbidden" // request is not allowed
+	ErrorKindRateLimit = "ratelimit" // client exceeded the rate limit
+	ErrorKindTimeout   = "timeout"   // remote image not fetched in time
+	ErrorKindFetch     = "fetch"     // error fetching remote image
+	ErrorKindTransform = "transform" // error transforming image
+)
+
+// nopMetrics is a Metrics implementation that discards all measurements.
+type nopMetrics struct{}
+
+func (nopMetrics) TransformDuration(string, time.Duration) {}
+func (nopMetrics) FetchDuration(time.Duration)             {}
+func (nopMetrics) CacheLookup(bool)                        {}
+func (nopMetrics) BytesFetched(int64)                      {}
+func (nopMetrics) BytesServed(int64)                       {}
+func (nopMetrics) Error(string)                            {}
+
+// proxyMetrics is a Metrics implementation that forwards measurements to the
+// Metrics of a proxy.  This allows the transport and cache created by
+// NewProxy to record measurements to Metrics set on the proxy after it is
+// created.
+type proxyMetrics struct {
+	p *Proxy
+}
+
+func (m proxyMetrics) metrics() Metrics {
+	if m.p.Metrics == nil {
+		return nopMetrics{}
+	}
+	return m.p.Metrics
+}
+
+func (m proxyMetrics) TransformDuration(format string, d time.Duration) {
+	m.metrics().TransformDuration(format, d)
+}
+func (m proxyMetrics) FetchDuration(d time.Duration) { m.metrics().FetchDuration(d) }
+func (m proxyMetrics) CacheLookup(hit bool)          { m.metrics().CacheLookup(hit) }
+func (m proxyMetrics) BytesFetched(n int64)          { m.metrics().BytesFetched(n) }
+func (m proxyMetrics) BytesServed(n int64)           { m.metrics().BytesServed(n) }
+func (m proxyMetrics) Error(kind string)             { m.metrics().Error(kind) }
+
+// metricsCache is a Cache that records the result of each lookup.
+type metricsCache struct {
+	Cache
+	metrics Metrics
+}
+
+func (c metricsCache) Get(key string) ([]byte, bool) {
+	data, ok := c.Cache.Get(key)
+	c.metrics.CacheLookup(ok)
+	return data, ok
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gregjones/httpcache"
+)
+
+// testMetrics is a Metrics implementation that counts measurements.
+type testMetrics struct {
+	mu         sync.Mutex
+	transforms map[string]int
+	fetches    int
+	hits       int
+	misses     int
+	fetched    int64
+	served     int64
+	errors     map[string]int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{transforms: make(map[string]int), errors: make(map[string]int)}
+}
+
+func (m *testMetrics) TransformDuration(format string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transforms[format]++
+}
+
+func (m *testMetrics) FetchDuration(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetches++
+}
+
+func (m *testMetrics) CacheLookup(hit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hit {
+		m.hits++
+	} else {
+		m.misses++
+	}
+}
+
+func (m *testMetrics) BytesFetched(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetched += n
+}
+
+func (m *testMetrics) BytesServed(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.served += n
+}
+
+func (m *testMetrics) Error(kind string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[kind]++
+}
+
+func TestProxy_Metrics(t *testing.T) {
+	// responses are fresh, so that cached responses are not revalidated
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := testTransport{}.RoundTrip(req)
+		if err == nil {
+			resp.Header.Set("Cache-Control", "max-age=3600")
+			resp.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		}
+		return resp, err
+	})
+	p := NewProxy(transport, httpcache.NewMemoryCache())
+	p.AllowHosts = []string{"good.test"}
+	m := newTestMetrics()
+	p.Metrics = m
+
+	get := func(url string) {
+		req, _ := http.NewRequest("GET", "http://localhost"+url, nil)
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// the second request is served from cache
+	get("/10x,jpeg/http://good.test/png")
+	get("/10x,jpeg/http://good.test/png")
+	if got, want := m.transforms["jpeg"], 1; got != want {
+		t.Errorf("recorded %d jpeg transforms, want %d", got, want)
+	}
+	if got, want := m.fetches, 1; got != want {
+		t.Errorf("recorded %d fetches, want %d", got, want)
+	}
+	if m.hits != 1 || m.misses != 2 {
+		t.Errorf("recorded %d cache hits and %d misses, want 1 and 2", m.hits, m.misses)
+	}
+	if m.fetched == 0 || m.served == 0 {
+		t.Errorf("recorded %d bytes fetched and %d served, want nonzero", m.fetched, m.served)
+	}
+
+	get("//foo")
+	get("/http://bad.test/")
+	get("/http://good.test/error")
+	want := map[string]int{ErrorKindRequest: 1, ErrorKindForbidden: 1, ErrorKindFetch: 1}
+	for kind, n := range want {
+		if got := m.errors[kind]; got != n {
+			t.Errorf("recorded %d %s errors, want %d", got, kind, n)
+		}
+	}
+}
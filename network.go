@@ -0,0 +1,137 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// PrivateNetworks are the loopback, private, link-local, and other special
+// purpose IP networks which a proxy exposed to the internet should not
+// usually connect to.  This includes the link-local address 169.254.169.254
+// used by cloud metadata services.
+var PrivateNetworks = mustParseNetworks(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local
+	"172.16.0.0/12",  // private
+	"192.168.0.0/16", // private
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+)
+
+// NetworkFilter restricts the IP addresses that a proxy connects to, in
+// order to prevent server-side request forgery.  Because addresses are
+// checked when connecting, after the remote host is resolved, this also
+// covers IP addresses in URLs, redirects, and hosts whose DNS records are
+// changed to point to internal addresses.
+type NetworkFilter struct {
+	// Deny lists the networks which connections are refused to.
+	Deny []*net.IPNet
+
+	// Allow lists the networks which connections are allowed to, even if
+	// they are also included in Deny.
+	Allow []*net.IPNet
+}
+
+// Allowed returns whether connections to ip are allowed by f.
+func (f NetworkFilter) Allowed(ip net.IP) bool {
+	for _, n := range f.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range f.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Transport returns a copy of http.DefaultTransport which refuses to connect
+// to addresses not allowed by f.  It is intended to be passed to NewProxy.
+func (f NetworkFilter) Transport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   f.control,
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil // connections through a proxy would not be checked
+	t.DialContext = dialer.DialContext
+	return t
+}
+
+// control is used as the Control function of a net.Dialer, which is called
+// with the resolved address of each connection before it is made.
+func (f NetworkFilter) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address %q", host)
+	}
+	if !f.Allowed(ip) {
+		return fmt.Errorf("connections to %v are not allowed", ip)
+	}
+	return nil
+}
+
+// ParseNetworks parses a list of networks in CIDR notation, such as
+// "192.168.0.0/16".  Single IP addresses are also accepted.
+func ParseNetworks(networks []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range networks {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseNetworks(networks ...string) []*net.IPNet {
+	nets, err := ParseNetworks(networks)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
@@ -0,0 +1,117 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNetworkFilter_Allowed(t *testing.T) {
+	f := NetworkFilter{
+		Deny:  PrivateNetworks,
+		Allow: mustParseNetworks("10.1.0.0/16", "fd00::1"),
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"172.20.1.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::2", false},
+		{"0.0.0.0", false},
+
+		// explicitly allowed
+		{"10.1.2.3", true},
+		{"fd00::1", true},
+	}
+
+	for _, tt := range tests {
+		if got := f.Allowed(net.ParseIP(tt.ip)); got != tt.allowed {
+			t.Errorf("Allowed(%v) returned %v, want %v", tt.ip, got, tt.allowed)
+		}
+	}
+
+	if !(NetworkFilter{}).Allowed(net.ParseIP("127.0.0.1")) {
+		t.Errorf("empty NetworkFilter did not allow all addresses")
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	tests := []struct {
+		networks []string
+		want     []string
+		wantErr  bool
+	}{
+		{nil, nil, false},
+		{[]string{"10.0.0.0/8", " 192.168.0.0/16"}, []string{"10.0.0.0/8", "192.168.0.0/16"}, false},
+		{[]string{"169.254.169.254"}, []string{"169.254.169.254/32"}, false},
+		{[]string{"::1"}, []string{"::1/128"}, false},
+		{[]string{"10.0.0.0/33"}, nil, true},
+		{[]string{"example.com"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		nets, err := ParseNetworks(tt.networks)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseNetworks(%q) returned error %v, want error %t", tt.networks, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, n := range nets {
+			got = append(got, n.String())
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseNetworks(%q) returned %v, want %v", tt.networks, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseNetworks(%q) returned %v, want %v", tt.networks, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestNetworkFilter_Transport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// the test server listens on a loopback address
+	client := &http.Client{Transport: NetworkFilter{Deny: PrivateNetworks}.Transport()}
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Errorf("Transport connected to denied address %v", srv.URL)
+	}
+
+	f := NetworkFilter{Deny: PrivateNetworks, Allow: mustParseNetworks("127.0.0.0/8", "::1")}
+	client = &http.Client{Transport: f.Transport()}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Transport returned error connecting to allowed address: %v", err)
+	}
+	resp.Body.Close()
+}
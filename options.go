@@ -0,0 +1,324 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"fmt"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// An Option sets one or more fields of Options.  See the documentation of
+// the Options fields for the interpretation of their values.
+type Option func(*Options)
+
+// NewOptions returns Options with each of opts applied in order.  An error is
+// returned if any of the resulting values are out of range, or if they are
+// combined in a way that would not have the requested effect.
+//
+// For example, to resize an image to 300 pixels wide within a 300x200 box and
+// encode it at quality 80:
+//
+// 	opt, err := NewOptions(WithWidth(300), WithHeight(200), WithFit(), WithQuality(80))
+func NewOptions(opts ...Option) (Options, error) {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validateNew(); err != nil {
+		return Options{}, err
+	}
+	return o, nil
+}
+
+// validateNew returns an error if o contains invalid option values.  It is
+// stricter than validate, which is used for options parsed from request
+// URLs, rejecting values that URLs have historically been allowed to
+// include.
+func (o Options) validateNew() error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if o.Width < 0 || o.Height < 0 {
+		return fmt.Errorf("invalid size: %vx%v", o.Width, o.Height)
+	}
+	if o.Quality < 0 || o.Quality > 100 {
+		return fmt.Errorf("invalid quality: %d", o.Quality)
+	}
+	if o.Effort < 0 || o.Effort > 10 {
+		return fmt.Errorf("invalid effort: %d", o.Effort)
+	}
+	if o.Pad && (o.Width == 0 || o.Height == 0) {
+		return fmt.Errorf("pad requires both a width and height")
+	}
+	if o.Format != "" && o.Format != "jpeg" && (o.Progressive || o.Subsampling != 0) {
+		return fmt.Errorf("progressive and subsampling options require jpeg output, not %s", o.Format)
+	}
+	if o.Format != "" && o.Lossless && !losslessFormats[o.Format] {
+		return fmt.Errorf("lossless option requires a lossless output format, not %s", o.Format)
+	}
+	return nil
+}
+
+// WithWidth sets the width, in pixels or as a percentage between 0 and 1.
+func WithWidth(w float64) Option { return func(o *Options) { o.Width, o.WidthPercent = w, false } }
+
+// WithHeight sets the height, in pixels or as a percentage between 0 and 1.
+func WithHeight(h float64) Option { return func(o *Options) { o.Height, o.HeightPercent = h, false } }
+
+// WithWidthPercent sets the width as a percentage of the original width,
+// where 100 is the full width.
+func WithWidthPercent(p float64) Option {
+	return func(o *Options) { o.Width, o.WidthPercent = p, true }
+}
+
+// WithHeightPercent sets the height as a percentage of the original height,
+// where 100 is the full height.
+func WithHeightPercent(p float64) Option {
+	return func(o *Options) { o.Height, o.HeightPercent = p, true }
+}
+
+// WithFit resizes the image to fit within the width and height.
+func WithFit() Option { return func(o *Options) { o.Fit = true } }
+
+// WithPad resizes the image to fit within the width and height, and pads it
+// to exactly that size.
+func WithPad() Option { return func(o *Options) { o.Pad = true } }
+
+// WithMegapixels limits the size of the resized image to mp million pixels.
+func WithMegapixels(mp float64) Option { return func(o *Options) { o.Megapixels = mp } }
+
+// WithDPR multiplies the width and height by the device pixel ratio dpr.
+func WithDPR(dpr float64) Option { return func(o *Options) { o.DPR = dpr } }
+
+// WithFilter sets the resampling filter used to resize the image, such as
+// "nearest" for pixel art.
+func WithFilter(name string) Option { return func(o *Options) { o.Filter = name } }
+
+// WithRotate rotates the image by degrees counter-clockwise.  Any finite
+// angle is allowed.
+func WithRotate(degrees float64) Option { return func(o *Options) { o.Rotate = degrees } }
+
+// WithRotateFill sets the color of the corners exposed by rotations.
+func WithRotateFill(c color.NRGBA) Option { return func(o *Options) { o.RotateFill = c } }
+
+// WithFlipVertical flips the image vertically.
+func WithFlipVertical() Option { return func(o *Options) { o.FlipVertical = true } }
+
+// WithFlipHorizontal flips the image horizontally.
+func WithFlipHorizontal() Option { return func(o *Options) { o.FlipHorizontal = true } }
+
+// WithAutoContrast stretches the levels of the image, ignoring the clip
+// percentage of the darkest and brightest pixels.
+func WithAutoContrast(clip float64) Option {
+	return func(o *Options) { o.AutoContrast, o.AutoContrastClip = true, clip }
+}
+
+// WithAutoContrastRGB stretches the levels of each color channel separately,
+// with WithAutoContrast.
+func WithAutoContrastRGB() Option { return func(o *Options) { o.AutoContrastRGB = true } }
+
+// WithBrightness adjusts the brightness, from -100 to 100.
+func WithBrightness(b float64) Option { return func(o *Options) { o.Brightness = b } }
+
+// WithContrast adjusts the contrast, from -100 to 100.
+func WithContrast(c float64) Option { return func(o *Options) { o.Contrast = c } }
+
+// WithGamma applies gamma correction.
+func WithGamma(g float64) Option { return func(o *Options) { o.Gamma = g } }
+
+// WithSaturation adjusts the saturation, from -100 to 100.
+func WithSaturation(s float64) Option { return func(o *Options) { o.Saturation = s } }
+
+// WithHue rotates the hue by degrees, from 0 to 360.
+func WithHue(degrees float64) Option { return func(o *Options) { o.Hue = degrees } }
+
+// WithGrayscale converts the image to grayscale.
+func WithGrayscale() Option { return func(o *Options) { o.Grayscale = true } }
+
+// WithSepia applies a sepia tone with intensity, from 0 to 100.
+func WithSepia(intensity float64) Option { return func(o *Options) { o.Sepia = intensity } }
+
+// WithInvert inverts the colors of the image.
+func WithInvert() Option { return func(o *Options) { o.Invert = true } }
+
+// WithLUT color grades the image with the package LUT of the given name.
+func WithLUT(name string) Option { return func(o *Options) { o.LUT = name } }
+
+// WithRoundedCorners rounds the corners of the image with radius r.
+func WithRoundedCorners(r float64) Option { return func(o *Options) { o.RoundedCorners = r } }
+
+// WithBorder draws a border of the given width and color around the image.
+func WithBorder(width int, c color.NRGBA) Option {
+	return func(o *Options) { o.BorderWidth, o.BorderColor = width, c }
+}
+
+// WithBorderInset draws the border over the edges of the image.
+func WithBorderInset() Option { return func(o *Options) { o.BorderInset = true } }
+
+// WithWatermark overlays the package Watermark image at position.
+func WithWatermark(position string) Option {
+	return func(o *Options) { o.WatermarkPosition = position }
+}
+
+// WithWatermarkOpacity sets the opacity of the watermark, from 0 to 1.
+func WithWatermarkOpacity(opacity float64) Option {
+	return func(o *Options) { o.WatermarkOpacity = opacity }
+}
+
+// WithWatermarkMargin sets the distance in pixels between the watermark and
+// the edges of the image.
+func WithWatermarkMargin(margin int) Option {
+	return func(o *Options) { o.WatermarkMargin = margin }
+}
+
+// WithBackground flattens the image onto a background color.
+func WithBackground(c color.NRGBA) Option { return func(o *Options) { o.Background = c } }
+
+// WithBlur blurs the image with sigma.
+func WithBlur(sigma float64) Option { return func(o *Options) { o.Blur = sigma } }
+
+// WithSharpen sharpens the image with sigma.
+func WithSharpen(sigma float64) Option { return func(o *Options) { o.Sharpen = sigma } }
+
+// WithAutoSharpen sharpens the image if it is downscaled to less than half of
+// its original size.
+func WithAutoSharpen() Option { return func(o *Options) { o.AutoSharpen = true } }
+
+// WithPixelate pixelates the image into blocks of size pixels.
+func WithPixelate(size int) Option { return func(o *Options) { o.Pixelate = size } }
+
+// WithQuality sets the quality of the output image, from 0 to 100.
+func WithQuality(q int) Option { return func(o *Options) { o.Quality = q } }
+
+// WithFormat sets the format of the output image.
+func WithFormat(format string) Option { return func(o *Options) { o.Format = format } }
+
+// WithEffort sets the compression effort of the encoder, from 1 to 10.
+func WithEffort(effort int) Option { return func(o *Options) { o.Effort = effort } }
+
+// WithLossless encodes WebP output losslessly, ignoring the quality.
+func WithLossless() Option { return func(o *Options) { o.Lossless = true } }
+
+// WithOptimize returns the smallest of the image encoded in the requested
+// format, as PNG, and as JPEG, if that would not lose transparency.
+func WithOptimize() Option { return func(o *Options) { o.Optimize = true } }
+
+// WithPNGCompression sets the compression level of PNG output.
+func WithPNGCompression(level png.CompressionLevel) Option {
+	return func(o *Options) { o.PNGCompression = level }
+}
+
+// WithTIFFCompression sets the compression of TIFF output.
+func WithTIFFCompression(c TIFFCompression) Option {
+	return func(o *Options) { o.TIFFCompression = c }
+}
+
+// WithICOSizes sets the sizes of the images in ICO output, up to 256 pixels.
+// Only the first 8 sizes are used.
+func WithICOSizes(sizes ...int) Option {
+	return func(o *Options) {
+		o.ICOSizes = ICOSizes{}
+		copy(o.ICOSizes[:], sizes)
+	}
+}
+
+// WithDither dithers 16-bit images when reducing them to 8 bits, and PNG
+// images when reducing them to a palette.
+func WithDither() Option { return func(o *Options) { o.Dither = true } }
+
+// WithProgressive encodes JPEG output as a progressive JPEG.
+func WithProgressive() Option { return func(o *Options) { o.Progressive = true } }
+
+// WithSubsampling sets the chroma subsampling of JPEG output to 444, 422, or
+// 420.
+func WithSubsampling(s int) Option { return func(o *Options) { o.Subsampling = s } }
+
+// WithStripMetadata removes metadata from the output image.
+func WithStripMetadata() Option { return func(o *Options) { o.StripMetadata = true } }
+
+// WithPreserveColorProfile embeds the color profile of the original image in
+// the output image.
+func WithPreserveColorProfile() Option {
+	return func(o *Options) { o.PreserveColorProfile = true }
+}
+
+// WithPreserveEXIF embeds the EXIF metadata of the original image in the
+// output image.
+func WithPreserveEXIF() Option { return func(o *Options) { o.PreserveEXIF = true } }
+
+// WithStripGPS removes the GPS location from the EXIF metadata of the output
+// image.
+func WithStripGPS() Option { return func(o *Options) { o.StripGPS = true } }
+
+// WithDPI sets the resolution of JPEG and PNG output in dots per inch.
+func WithDPI(dpi int) Option { return func(o *Options) { o.DPI = dpi } }
+
+// WithColor requests the dominant color of the image from the proxy, rather
+// than the image itself.
+func WithColor() Option { return func(o *Options) { o.Color = true } }
+
+// WithBlurHash requests the BlurHash of the image with x by y components
+// from the proxy, rather than the image itself.
+func WithBlurHash(x, y int) Option {
+	return func(o *Options) { o.BlurHashX, o.BlurHashY = x, y }
+}
+
+// WithDownload asks browsers to download the image, rather than display it.
+func WithDownload() Option { return func(o *Options) { o.Download = true } }
+
+// WithFilename sets the name the image is saved as.  Its extension is
+// replaced by that of the output format.
+func WithFilename(name string) Option { return func(o *Options) { o.Filename = name } }
+
+// WithSignature sets the signature of a signed request.
+func WithSignature(sig string) Option { return func(o *Options) { o.Signature = sig } }
+
+// WithFrame extracts frame n, starting at 0, of animated GIFs.
+func WithFrame(n int) Option { return func(o *Options) { o.ExtractFrame, o.Frame = true, n } }
+
+// WithTrim trims uniform borders, up to tolerance from the border color.
+func WithTrim(tolerance float64) Option {
+	return func(o *Options) { o.Trim, o.TrimTolerance = true, tolerance }
+}
+
+// WithCrop crops the image to the rectangle at x, y of size w by h, before
+// resizing.  Negative x and y are offsets from the right and bottom edges.
+func WithCrop(x, y, w, h float64) Option {
+	return func(o *Options) { o.CropX, o.CropY, o.CropWidth, o.CropHeight = x, y, w, h }
+}
+
+// WithSmartCrop crops to the most interesting region of the image.
+func WithSmartCrop() Option { return func(o *Options) { o.SmartCrop = true } }
+
+// WithFocalPoint crops around the focal point at x, y, as fractions of the
+// image width and height, rather than the center of the image.
+func WithFocalPoint(x, y float64) Option {
+	return func(o *Options) { o.FocalX, o.FocalY = x, y }
+}
+
+// WithGravity crops against the edge or corner of the image named by gravity,
+// such as "north", rather than its center.
+func WithGravity(gravity string) Option { return func(o *Options) { o.Gravity = gravity } }
+
+// WithPipeline performs the requested operations in the order of operations,
+// which must include each of them, rather than the default order.
+func WithPipeline(operations ...string) Option {
+	return func(o *Options) { o.Pipeline = strings.Join(operations, pipelineSeparator) }
+}
+
+// WithScaleUp allows the image to be scaled beyond its original size.
+func WithScaleUp() Option { return func(o *Options) { o.ScaleUp = true } }
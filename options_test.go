@@ -0,0 +1,149 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestNewOptions(t *testing.T) {
+	defer func(luts map[string]*LUT) { LUTs = luts }(LUTs)
+	LUTs = map[string]*LUT{"brand": identityLUT(2)}
+
+	red := color.NRGBA{255, 0, 0, 255}
+	tests := []struct {
+		opts []Option
+		want Options
+	}{
+		{nil, Options{}},
+		{
+			[]Option{WithWidth(300), WithFit(), WithQuality(80)},
+			Options{Width: 300, Fit: true, Quality: 80},
+		},
+		{
+			[]Option{WithWidth(100), WithWidth(200)},
+			Options{Width: 200},
+		},
+		{
+			[]Option{
+				WithWidth(0.5), WithHeight(200), WithPad(), WithMegapixels(2), WithDPR(2),
+				WithFilter("box"), WithRotate(45), WithRotateFill(red), WithFlipVertical(), WithFlipHorizontal(),
+				WithAutoContrast(0.5), WithAutoContrastRGB(),
+				WithBrightness(10), WithContrast(-10), WithGamma(2), WithGrayscale(),
+				WithSaturation(-20), WithHue(90), WithSepia(50), WithInvert(), WithLUT("brand"),
+				WithRoundedCorners(8), WithBorder(2, red), WithBorderInset(),
+				WithWatermark("center"), WithWatermarkOpacity(0.5), WithWatermarkMargin(4),
+				WithBackground(red), WithBlur(1), WithSharpen(2), WithAutoSharpen(), WithPixelate(4),
+				WithQuality(90), WithFormat("jpeg"), WithEffort(3), WithPNGCompression(png.BestSpeed),
+				WithTIFFCompression(TIFFLZW), WithICOSizes(16, 32), WithOptimize(),
+				WithDither(), WithProgressive(), WithSubsampling(444), WithStripMetadata(),
+				WithPreserveColorProfile(), WithPreserveEXIF(), WithStripGPS(), WithDPI(300), WithColor(),
+				WithDownload(), WithFilename("photo.jpg"), WithSignature("c0ffee"), WithFrame(2),
+				WithTrim(10), WithCrop(1, 2, 30, 40), WithSmartCrop(),
+				WithFocalPoint(0.3, 0.6), WithGravity("north"), WithScaleUp(),
+			},
+			Options{
+				Width: 0.5, Height: 200, Pad: true, Megapixels: 2, DPR: 2,
+				Filter: "box", Rotate: 45, RotateFill: red, FlipVertical: true, FlipHorizontal: true,
+				AutoContrast: true, AutoContrastClip: 0.5, AutoContrastRGB: true,
+				Brightness: 10, Contrast: -10, Gamma: 2, Grayscale: true,
+				Saturation: -20, Hue: 90, Sepia: 50, Invert: true, LUT: "brand",
+				RoundedCorners: 8, BorderWidth: 2, BorderColor: red, BorderInset: true,
+				WatermarkPosition: "center", WatermarkOpacity: 0.5, WatermarkMargin: 4,
+				Background: red, Blur: 1, Sharpen: 2, AutoSharpen: true, Pixelate: 4, Quality: 90,
+				Format: "jpeg", Effort: 3, PNGCompression: png.BestSpeed, TIFFCompression: TIFFLZW,
+				ICOSizes: ICOSizes{16, 32}, Optimize: true, Dither: true, Progressive: true, Subsampling: 444, StripMetadata: true,
+				PreserveColorProfile: true, PreserveEXIF: true, StripGPS: true, DPI: 300, Color: true,
+				Download: true, Filename: "photo.jpg", Signature: "c0ffee", ExtractFrame: true, Frame: 2,
+				Trim: true, TrimTolerance: 10, CropX: 1, CropY: 2, CropWidth: 30, CropHeight: 40, SmartCrop: true,
+				FocalX: 0.3, FocalY: 0.6, Gravity: "north", ScaleUp: true,
+			},
+		},
+		{
+			[]Option{WithWidthPercent(50), WithHeightPercent(200)},
+			Options{Width: 50, WidthPercent: true, Height: 200, HeightPercent: true},
+		},
+		{
+			[]Option{WithWidthPercent(50), WithWidth(100)},
+			Options{Width: 100},
+		},
+		{
+			[]Option{WithWidth(20), WithBlur(1), WithPipeline("blur", "resize")},
+			Options{Width: 20, Blur: 1, Pipeline: "blur+resize"},
+		},
+		{
+			[]Option{WithFormat("webp"), WithLossless()},
+			Options{Format: "webp", Lossless: true},
+		},
+		{
+			[]Option{WithWidth(20), WithBlurHash(4, 3)},
+			Options{Width: 20, BlurHashX: 4, BlurHashY: 3},
+		},
+	}
+	for _, tt := range tests {
+		got, err := NewOptions(tt.opts...)
+		if err != nil {
+			t.Errorf("NewOptions(%v) returned error: %v", tt.want, err)
+		}
+		if got != tt.want {
+			t.Errorf("NewOptions returned %v, want %v", got, tt.want)
+		}
+	}
+}
+
+func TestNewOptions_Invalid(t *testing.T) {
+	tests := [][]Option{
+		{WithQuality(101)},
+		{WithQuality(-1)},
+		{WithEffort(11)},
+		{WithWidth(-100)},
+		{WithBrightness(200)},
+		{WithBlur(101)},
+		{WithSharpen(101)},
+		{WithBorder(1001, color.NRGBA{})},
+		{WithBorder(-1, color.NRGBA{})},
+		{WithLUT("missing")},
+		{WithAutoContrast(50)},
+		{WithAutoContrast(-1)},
+		{WithFormat("pdf")},
+		{WithSubsampling(411)},
+		{WithFrame(-1)},
+		{WithWidth(100), WithPad()},
+		{WithFormat("png"), WithProgressive()},
+		{WithFormat("webp"), WithSubsampling(444)},
+		{WithFormat("jpeg"), WithLossless()},
+		{WithTIFFCompression(TIFFCompression(3))},
+		{WithICOSizes(16, 512)},
+		{WithDPI(-72)},
+		{WithGravity("up")},
+		{WithFilter("bicubic")},
+		{WithWidthPercent(0)},
+		{WithPipeline("zoom")},
+		{WithBlur(1), WithPipeline("resize")},
+		{WithWidth(10), WithHeight(10), WithPad(), WithPipeline("pad", "resize")},
+		{WithHeightPercent(-50)},
+		{WithFilename("../photo.jpg")},
+		{WithFilename("a,b.jpg")},
+		{WithBlurHash(0, 3)},
+		{WithBlurHash(4, 3), WithColor()},
+	}
+	for i, opts := range tests {
+		if o, err := NewOptions(opts...); err == nil {
+			t.Errorf("%d. NewOptions returned %v, want error", i, o)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// pipelineSeparator separates the operations of the Pipeline option.  Commas
+// can not be used, since they separate options.
+const pipelineSeparator = "+"
+
+// transformState is the state shared by the steps of a transformation.
+type transformState struct {
+	// scale is the factor the image was resized by
+	scale float64
+
+	// padW and padH are the size of the canvas to pad the image to, or
+	// zero if it is not padded
+	padW, padH int
+
+	// err is the error which stopped the transformation, such as a canvas
+	// exceeding MaxPixels
+	err error
+}
+
+// A transformStep is a single operation of transformImage.
+type transformStep struct {
+	// name identifies the step in the Pipeline option
+	name string
+
+	// requested returns whether opt requests the step
+	requested func(opt Options) bool
+
+	// apply performs the step on m
+	apply func(m image.Image, opt Options, s *transformState) image.Image
+}
+
+// transformSteps are the steps of transformImage, in the order they are
+// performed unless the Pipeline option specifies another.
+var transformSteps = []transformStep{
+	{"crop", Options.crop, cropStep},
+	{"trim", func(opt Options) bool { return opt.Trim }, trimStep},
+	{"resize", func(opt Options) bool { return opt.Width != 0 || opt.Height != 0 || opt.Megapixels != 0 }, resizeStep},
+
+	// adjust colors
+	{"autocontrast", func(opt Options) bool { return opt.AutoContrast }, func(m image.Image, opt Options, _ *transformState) image.Image {
+		return autoContrast(m, opt.AutoContrastClip, opt.AutoContrastRGB)
+	}},
+	{"brightness", func(opt Options) bool { return opt.Brightness != 0 }, func(m image.Image, opt Options, _ *transformState) image.Image {
+		return imaging.AdjustBrightness(m, opt.Brightness)
+	}},
+	{"contrast", func(opt Options) bool { return opt.Contrast != 0 }, func(m image.Image, opt Options, _ *transformState) image.Image {
+		return imaging.AdjustContrast(m, opt.Contrast)
+	}},
+	{"gamma", Options.gamma, func(m image.Image, opt Options, _ *transformState) image.Image {
+		return imaging.AdjustGamma(m, opt.Gamma)
+	}},
+	{"saturation", func(opt Options) bool { return opt.Saturation != 0 }, func(m image.Image, opt Options, _ *transformState) image.Image {
+		return adjustSaturation(m, opt.Saturation)
+	}},
+	{"hue", Options.hue, func(m image.Image, opt Options, _ *transformState) image.Image {
+		return adjustHue(m, opt.Hue)
+	}},
+	{"gray", func(opt Options) bool { return opt.Grayscale }, func(m image.Image, _ Options, _ *transformState) image.Image {
+		return imaging.Grayscale(m)
+	}},
+	{"sepia", func(opt Options) bool { return opt.Sepia != 0 }, func(m image.Image, opt Options, _ *transformState) image.Image {
+		return sepia(m, opt.Sepia)
+	}},
+	{"invert", func(opt Options) bool { return opt.Invert }, func(m image.Image, _ Options, _ *transformState) image.Image {
+		return imaging.Invert(m)
+	}},
+	{"lut", func(opt Options) bool { return opt.LUT != "" }, func(m image.Image, opt Options, _ *transformState) image.Image {
+		if l := LUTs[opt.LUT]; l != nil {
+			return applyLUT(m, l)
+		}
+		return m
+	}},
+
+	// apply filters
+	{"blur", func(opt Options) bool { return opt.Blur > 0 }, func(m image.Image, opt Options, _ *transformState) image.Image {
+		return imaging.Blur(m, opt.Blur)
+	}},
+	{"sharpen", func(opt Options) bool { return opt.Sharpen > 0 || opt.AutoSharpen }, sharpenStep},
+	{"pixelate", func(opt Options) bool { return opt.Pixelate > 1 }, func(m image.Image, opt Options, _ *transformState) image.Image {
+		return pixelate(m, opt.Pixelate)
+	}},
+
+	{"pad", Options.pad, padStep},
+	{"flip", func(opt Options) bool { return opt.FlipVertical || opt.FlipHorizontal }, flipStep},
+	{"rotate", func(opt Options) bool { return math.Mod(opt.Rotate, 360) != 0 }, rotateStep},
+	{"watermark", func(opt Options) bool { return opt.WatermarkPosition != "" }, func(m image.Image, opt Options, _ *transformState) image.Image {
+		if Watermark == nil {
+			return m
+		}
+		return watermark(m, Watermark, opt)
+	}},
+
+	// add border and round corners, which borders do themselves
+	{"border", func(opt Options) bool { return opt.BorderWidth > 0 }, func(m image.Image, opt Options, s *transformState) image.Image {
+		if b := m.Bounds(); !opt.BorderInset {
+			if s.err = checkCanvas(b.Dx()+2*opt.BorderWidth, b.Dy()+2*opt.BorderWidth); s.err != nil {
+				return m
+			}
+		}
+		return addBorder(m, opt)
+	}},
+	{"round", func(opt Options) bool { return opt.BorderWidth <= 0 && opt.RoundedCorners != 0 }, func(m image.Image, opt Options, _ *transformState) image.Image {
+		b := m.Bounds()
+		return roundCorners(m, cornerRadius(b.Dx(), b.Dy(), opt))
+	}},
+
+	// flatten onto background color
+	{"background", Options.background, func(m image.Image, opt Options, _ *transformState) image.Image {
+		b := m.Bounds()
+		bg := imaging.New(b.Dx(), b.Dy(), opt.Background)
+		return imaging.Overlay(bg, m, image.Pt(0, 0), 1)
+	}},
+}
+
+// transformStepNames are the names of transformSteps, in order.
+var transformStepNames = func() []string {
+	names := make([]string, len(transformSteps))
+	for i, step := range transformSteps {
+		names[i] = step.name
+	}
+	return names
+}()
+
+// findTransformStep returns the step of transformSteps with the given name.
+func findTransformStep(name string) (transformStep, bool) {
+	for _, step := range transformSteps {
+		if step.name == name {
+			return step, true
+		}
+	}
+	return transformStep{}, false
+}
+
+// parsePipeline returns the steps of the Pipeline option pipeline, in order.
+// An error is returned if it names an unknown step, or names a step more than
+// once.
+func parsePipeline(pipeline string) ([]transformStep, error) {
+	var steps []transformStep
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(pipeline, pipelineSeparator) {
+		step, ok := findTransformStep(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown operation %q (supported operations: %s)", name, strings.Join(transformStepNames, ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("operation %q is repeated", name)
+		}
+		seen[name] = true
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// validatePipeline returns an error if the Pipeline option of o is invalid,
+// or does not include every step that o requests.  Padding uses the canvas
+// size determined when resizing, so it must follow the resize step.
+func (o Options) validatePipeline() error {
+	if o.Pipeline == "" {
+		return nil
+	}
+	steps, err := parsePipeline(o.Pipeline)
+	if err != nil {
+		return fmt.Errorf("invalid pipeline: %v", err)
+	}
+	included := make(map[string]bool)
+	for _, step := range steps {
+		if step.name == "pad" && !included["resize"] {
+			return fmt.Errorf("invalid pipeline: pad must follow resize")
+		}
+		included[step.name] = true
+	}
+	for _, step := range transformSteps {
+		if step.requested(o) && !included[step.name] {
+			return fmt.Errorf("invalid pipeline: requested operation %q is not included", step.name)
+		}
+	}
+	return nil
+}
+
+// steps returns the steps of transformImage for o, in the order they are
+// performed.
+func (o Options) steps() []transformStep {
+	if o.Pipeline == "" {
+		return transformSteps
+	}
+	steps, err := parsePipeline(o.Pipeline)
+	if err != nil {
+		return transformSteps
+	}
+	return steps
+}
+
+func cropStep(m image.Image, opt Options, _ *transformState) image.Image {
+	if r := cropParams(m, opt); r != m.Bounds() {
+		m = imaging.Crop(m, r)
+	}
+	return m
+}
+
+func trimStep(m image.Image, opt Options, _ *transformState) image.Image {
+	if r := trimBounds(m, opt.TrimTolerance); r != m.Bounds() {
+		m = imaging.Crop(m, r)
+	}
+	return m
+}
+
+func resizeStep(m image.Image, opt Options, s *transformState) image.Image {
+	s.padW, s.padH = padParams(m, opt)
+	w, h, resize := resizeParams(m, opt)
+	if !resize {
+		return m
+	}
+	src := m.Bounds()
+	filter := resampleFilter(opt.Filter)
+	if opt.Fit || opt.pad() {
+		// imaging.Fit never enlarges images, even if they may be
+		// scaled up, so resize them to the fitted size directly
+		if fw, fh := fitDimensions(src.Dx(), src.Dy(), w, h); fw != src.Dx() || fh != src.Dy() {
+			m = imaging.Resize(m, fw, fh, filter)
+		}
+	} else {
+		if w == 0 || h == 0 {
+			m = imaging.Resize(m, w, h, filter)
+		} else {
+			if opt.focalPoint() {
+				m = imaging.Crop(m, focalCrop(m, w, h, opt.FocalX, opt.FocalY))
+			} else if opt.Gravity != "" {
+				m = imaging.Crop(m, gravityCrop(m, w, h, opt.Gravity))
+			} else if opt.SmartCrop {
+				m = imaging.Crop(m, smartCrop(m, w, h))
+			}
+			m = imaging.Thumbnail(m, w, h, filter)
+		}
+	}
+	s.scale = resizeScale(src, m.Bounds())
+	return m
+}
+
+func sharpenStep(m image.Image, opt Options, s *transformState) image.Image {
+	if opt.Sharpen > 0 {
+		return imaging.Sharpen(m, opt.Sharpen)
+	}
+	if s.scale < autoSharpenRatio {
+		return imaging.Sharpen(m, autoSharpenSigma)
+	}
+	return m
+}
+
+func padStep(m image.Image, _ Options, s *transformState) image.Image {
+	if s.padW > 0 && s.padH > 0 {
+		if b := m.Bounds(); b.Dx() != s.padW || b.Dy() != s.padH {
+			if s.err = checkCanvas(s.padW, s.padH); s.err != nil {
+				return m
+			}
+			m = imaging.PasteCenter(imaging.New(s.padW, s.padH, color.NRGBA{}), m)
+		}
+	}
+	return m
+}
+
+func flipStep(m image.Image, opt Options, _ *transformState) image.Image {
+	if opt.FlipVertical {
+		m = imaging.FlipV(m)
+	}
+	if opt.FlipHorizontal {
+		m = imaging.FlipH(m)
+	}
+	return m
+}
+
+func rotateStep(m image.Image, opt Options, _ *transformState) image.Image {
+	switch opt.Rotate {
+	case 90:
+		return imaging.Rotate90(m)
+	case 180:
+		return imaging.Rotate180(m)
+	case 270:
+		return imaging.Rotate270(m)
+	}
+	return rotate(m, opt.Rotate, opt.RotateFill)
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestTransformImage_Pipeline(t *testing.T) {
+	tests := []struct {
+		src   []color.NRGBA // pixels of a 2x1 image
+		opt   Options
+		want  []color.NRGBA
+		wantW int
+		wantH int
+	}{
+		// by default images are cropped before they are rotated
+		{
+			[]color.NRGBA{red, blue},
+			Options{Rotate: 90, CropHeight: 0.5},
+			[]color.NRGBA{blue, red}, 1, 2,
+		},
+		{
+			[]color.NRGBA{red, blue},
+			Options{Rotate: 90, CropHeight: 0.5, Pipeline: "rotate+crop"},
+			[]color.NRGBA{blue}, 1, 1,
+		},
+		{
+			[]color.NRGBA{red, blue},
+			Options{FlipHorizontal: true, CropWidth: 1, Pipeline: "flip+crop"},
+			[]color.NRGBA{blue}, 1, 1,
+		},
+		{
+			[]color.NRGBA{red, blue},
+			Options{FlipHorizontal: true, CropWidth: 1},
+			[]color.NRGBA{red}, 1, 1,
+		},
+	}
+	for _, tt := range tests {
+		m := mustTransformImage(t, newImage(2, 1, tt.src...), tt.opt)
+		if b := m.Bounds(); b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+			t.Errorf("transformImage(%v) returned %dx%d image, want %dx%d", tt.opt, b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+			continue
+		}
+		if got, want := imaging.Clone(m), newImage(tt.wantW, tt.wantH, tt.want...); !reflect.DeepEqual(got.Pix, want.(*image.NRGBA).Pix) {
+			t.Errorf("transformImage(%v) returned pixels %v, want %v", tt.opt, got.Pix, want.(*image.NRGBA).Pix)
+		}
+	}
+
+	// blurring before resizing a sharp edge softens it less
+	src := newImage(8, 1, red, red, red, red, blue, blue, blue, blue)
+	before := imaging.Clone(mustTransformImage(t, src, Options{Width: 4, Blur: 1, Pipeline: "blur+resize"}))
+	after := imaging.Clone(mustTransformImage(t, src, Options{Width: 4, Blur: 1}))
+	if reflect.DeepEqual(before.Pix, after.Pix) {
+		t.Errorf("transformImage returned the same image blurring before and after resizing")
+	}
+}
+
+func TestOptions_validatePipeline(t *testing.T) {
+	tests := []struct {
+		opt     Options
+		wantErr bool
+	}{
+		{Options{}, false},
+		{Options{Blur: 2}, false},
+		{Options{Pipeline: "blur"}, false},
+		{Options{Blur: 2, Pipeline: "blur"}, false},
+		{Options{Width: 10, Blur: 2, Pipeline: "blur+resize"}, false},
+		{Options{Width: 10, Height: 10, Pad: true, Pipeline: "resize+pad"}, false},
+		{Options{BorderWidth: 2, RoundedCorners: 4, Pipeline: "border"}, false},
+		{Options{RoundedCorners: 4, Pipeline: "round"}, false},
+
+		{Options{Pipeline: "zoom"}, true},
+		{Options{Pipeline: "blur+blur"}, true},
+		{Options{Pipeline: "blur+"}, true},
+		{Options{Blur: 2, Pipeline: "blur+zoom"}, true},
+		{Options{Width: 10, Blur: 2, Pipeline: "blur"}, true},
+		{Options{AutoSharpen: true, Pipeline: "resize"}, true},
+		{Options{Width: 10, Height: 10, Pad: true, Pipeline: "pad+resize"}, true},
+		{Options{RoundedCorners: 4, Pipeline: "border"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.opt.validatePipeline(); (err != nil) != tt.wantErr {
+			t.Errorf("validatePipeline(%v) returned error %v, want error %t", tt.opt, err, tt.wantErr)
+		}
+	}
+}
+
+// test that the default order of operations is the one documented.
+func TestTransformSteps(t *testing.T) {
+	want := []string{
+		"crop", "trim", "resize", "autocontrast", "brightness", "contrast", "gamma", "saturation", "hue",
+		"gray", "sepia", "invert", "lut", "blur", "sharpen", "pixelate", "pad", "flip", "rotate",
+		"watermark", "border", "round", "background",
+	}
+	if !reflect.DeepEqual(transformStepNames, want) {
+		t.Errorf("transformStepNames = %v, want %v", transformStepNames, want)
+	}
+	if got := (Options{}).steps(); len(got) != len(transformSteps) {
+		t.Errorf("steps without a pipeline returned %d steps, want %d", len(got), len(transformSteps))
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+// pixelate returns m divided into blocks of size by size pixels, starting
+// at the top left corner, with each block filled with its average color.
+// Blocks at the right and bottom edges may be smaller.  Block sizes of 1 or
+// less return m unchanged.
+func pixelate(m image.Image, size int) image.Image {
+	if size <= 1 {
+		return m
+	}
+	dst := imaging.Clone(m)
+	b := dst.Bounds()
+	for y0 := b.Min.Y; y0 < b.Max.Y; y0 += size {
+		y1 := y0 + size
+		if y1 > b.Max.Y {
+			y1 = b.Max.Y
+		}
+		for x0 := b.Min.X; x0 < b.Max.X; x0 += size {
+			x1 := x0 + size
+			if x1 > b.Max.X {
+				x1 = b.Max.X
+			}
+
+			// average colors weighted by alpha, so that transparent
+			// pixels do not darken the block
+			var r, g, bl, a, n int
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					i := dst.PixOffset(x, y)
+					pa := int(dst.Pix[i+3])
+					r += int(dst.Pix[i]) * pa
+					g += int(dst.Pix[i+1]) * pa
+					bl += int(dst.Pix[i+2]) * pa
+					a += pa
+					n++
+				}
+			}
+			var c [4]uint8
+			if a > 0 {
+				c = [4]uint8{uint8((r + a/2) / a), uint8((g + a/2) / a), uint8((bl + a/2) / a), uint8((a + n/2) / n)}
+			}
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					copy(dst.Pix[dst.PixOffset(x, y):], c[:])
+				}
+			}
+		}
+	}
+	return dst
+}
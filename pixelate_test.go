@@ -0,0 +1,57 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestPixelate(t *testing.T) {
+	transparent := color.NRGBA{}
+	tests := []struct {
+		src  image.Image
+		size int
+		want image.Image
+	}{
+		{newImage(2, 1, red, blue), 0, newImage(2, 1, red, blue)},
+		{newImage(2, 1, red, blue), 1, newImage(2, 1, red, blue)},
+		{ // blocks are filled with their average color
+			newImage(4, 1, red, blue, green, green),
+			2,
+			newImage(4, 1,
+				color.NRGBA{128, 0, 128, 255}, color.NRGBA{128, 0, 128, 255},
+				green, green),
+		},
+		{ // blocks at the edges are smaller
+			newImage(3, 3, red, red, blue, red, red, blue, green, green, yellow),
+			2,
+			newImage(3, 3, red, red, blue, red, red, blue, green, green, yellow),
+		},
+		{ // transparent pixels only affect the alpha channel
+			newImage(2, 1, red, transparent),
+			2,
+			newImage(2, 1, color.NRGBA{255, 0, 0, 128}, color.NRGBA{255, 0, 0, 128}),
+		},
+		{newImage(2, 1, transparent, transparent), 4, newImage(2, 1, transparent, transparent)},
+	}
+	for _, tt := range tests {
+		if got := pixelate(tt.src, tt.size); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pixelate(%v, %d) returned %v, want %v", tt.src, tt.size, got, tt.want)
+		}
+	}
+}
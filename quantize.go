@@ -0,0 +1,198 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// pngPaletteSize returns the number of colors that PNG images encoded with
+// the given quality are quantized to, or 0 if they are not quantized.
+// Qualities of 100 or more, and the zero value, keep full color.
+func pngPaletteSize(quality int) int {
+	if quality <= 0 || quality >= 100 {
+		return 0
+	}
+	n := 256 * quality / 100
+	if n < 2 {
+		n = 2
+	}
+	return n
+}
+
+// colorCount is a color and the number of pixels of that color.
+type colorCount struct {
+	c [4]uint8
+	n int
+}
+
+// colorBox is a set of colors, which median cut repeatedly splits in two.
+type colorBox []colorCount
+
+// widestChannel returns the color channel with the largest range of values
+// in b, along with its range.
+func (b colorBox) widestChannel() (channel int, width int) {
+	for ch := 0; ch < 4; ch++ {
+		lo, hi := 255, 0
+		for _, cc := range b {
+			v := int(cc.c[ch])
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo > width {
+			channel, width = ch, hi-lo
+		}
+	}
+	return channel, width
+}
+
+// pixels returns the number of pixels of the colors in b.
+func (b colorBox) pixels() int {
+	var n int
+	for _, cc := range b {
+		n += cc.n
+	}
+	return n
+}
+
+// split sorts b along its widest channel and splits it at the median pixel.
+func (b colorBox) split() (colorBox, colorBox) {
+	ch, _ := b.widestChannel()
+	sort.SliceStable(b, func(i, j int) bool { return b[i].c[ch] < b[j].c[ch] })
+	half := b.pixels() / 2
+	var n int
+	for i, cc := range b[:len(b)-1] {
+		n += cc.n
+		if n >= half {
+			return b[:i+1], b[i+1:]
+		}
+	}
+	return b[:len(b)-1], b[len(b)-1:]
+}
+
+// average returns the average color of the pixels in b.
+func (b colorBox) average() color.NRGBA {
+	var sum [4]int
+	var n int
+	for _, cc := range b {
+		for ch := range sum {
+			sum[ch] += int(cc.c[ch]) * cc.n
+		}
+		n += cc.n
+	}
+	return color.NRGBA{
+		R: uint8((sum[0] + n/2) / n),
+		G: uint8((sum[1] + n/2) / n),
+		B: uint8((sum[2] + n/2) / n),
+		A: uint8((sum[3] + n/2) / n),
+	}
+}
+
+// medianCut returns a palette of at most n colors for m, chosen by the
+// median cut algorithm: the colors of m are repeatedly split at the median
+// of their widest channel, and each resulting set is replaced by its
+// average.  Images with at most n colors are represented exactly.
+func medianCut(m *image.NRGBA, n int) color.Palette {
+	counts := make(map[[4]uint8]int)
+	for i := 0; i+3 < len(m.Pix); i += 4 {
+		var c [4]uint8
+		copy(c[:], m.Pix[i:i+4])
+		counts[c]++
+	}
+	colors := make(colorBox, 0, len(counts))
+	for c, count := range counts {
+		colors = append(colors, colorCount{c, count})
+	}
+	// sort colors so that the palette does not depend on map order
+	sort.Slice(colors, func(i, j int) bool {
+		a, b := colors[i].c, colors[j].c
+		for ch := range a {
+			if a[ch] != b[ch] {
+				return a[ch] < b[ch]
+			}
+		}
+		return false
+	})
+
+	boxes := []colorBox{colors}
+	for len(boxes) < n {
+		// split the box whose widest channel spans the most pixels
+		best, bestScore := -1, 0
+		for i, b := range boxes {
+			if len(b) < 2 {
+				continue
+			}
+			if _, width := b.widestChannel(); width*b.pixels() > bestScore {
+				best, bestScore = i, width*b.pixels()
+			}
+		}
+		if best < 0 {
+			break
+		}
+		lo, hi := boxes[best].split()
+		boxes[best] = lo
+		boxes = append(boxes, hi)
+	}
+
+	p := make(color.Palette, 0, len(boxes))
+	for _, b := range boxes {
+		if len(b) > 0 {
+			p = append(p, b.average())
+		}
+	}
+	return p
+}
+
+// quantize returns m reduced to a paletted image of at most n colors.  If
+// dither is true, the difference between each pixel and its palette color is
+// diffused to its neighbors using the Floyd-Steinberg algorithm, so that
+// smooth gradients do not become visible bands.  Otherwise, each pixel is
+// mapped to its nearest palette color.
+func quantize(m image.Image, n int, dither bool) *image.Paletted {
+	src := imaging.Clone(m)
+	b := src.Bounds()
+	p := medianCut(src, n)
+	dst := image.NewPaletted(b, p)
+	if dither {
+		draw.FloydSteinberg.Draw(dst, b, src, b.Min)
+		return dst
+	}
+
+	// many pixels share colors, so look each one up only once
+	index := make(map[[4]uint8]uint8)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := src.PixOffset(x, y)
+			var c [4]uint8
+			copy(c[:], src.Pix[i:i+4])
+			idx, ok := index[c]
+			if !ok {
+				idx = uint8(p.Index(color.NRGBA{c[0], c[1], c[2], c[3]}))
+				index[c] = idx
+			}
+			dst.Pix[dst.PixOffset(x, y)] = idx
+		}
+	}
+	return dst
+}
@@ -0,0 +1,198 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// newPhoto returns an image of size w by h resembling a photograph, with
+// smooth gradients and noise, so that nearly every pixel has a distinct
+// color.
+func newPhoto(w, h int) *image.NRGBA {
+	r := rand.New(rand.NewSource(1))
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			noise := func(v int) uint8 { return clampUint8(float64(v + r.Intn(16) - 8)) }
+			m.SetNRGBA(x, y, color.NRGBA{
+				R: noise(255 * x / w),
+				G: noise(255 * y / h),
+				B: noise(128 + 64*(x-y)/(w+h)),
+				A: 255,
+			})
+		}
+	}
+	return m
+}
+
+func TestPNGPaletteSize(t *testing.T) {
+	tests := []struct {
+		quality, want int
+	}{
+		{0, 0},
+		{100, 0},
+		{101, 0},
+		{-1, 0},
+		{99, 253},
+		{50, 128},
+		{1, 2},
+	}
+	for _, tt := range tests {
+		if got := pngPaletteSize(tt.quality); got != tt.want {
+			t.Errorf("pngPaletteSize(%d) returned %d, want %d", tt.quality, got, tt.want)
+		}
+	}
+}
+
+func TestMedianCut(t *testing.T) {
+	// images with few colors are represented exactly
+	m := newImage(2, 2, red, green, blue, red).(*image.NRGBA)
+	p := medianCut(m, 4)
+	if len(p) != 3 {
+		t.Errorf("medianCut returned %d colors, want 3", len(p))
+	}
+	for _, c := range []color.NRGBA{red, green, blue} {
+		if p[p.Index(c)] != c {
+			t.Errorf("medianCut palette %v does not contain %v", p, c)
+		}
+	}
+
+	photo := newPhoto(64, 64)
+	for _, n := range []int{2, 16, 256} {
+		if got := len(medianCut(photo, n)); got != n {
+			t.Errorf("medianCut of photo returned %d colors, want %d", got, n)
+		}
+	}
+
+	// the palette does not depend on map iteration order
+	want := medianCut(photo, 32)
+	for i := 0; i < 3; i++ {
+		if !samePalette(medianCut(photo, 32), want) {
+			t.Errorf("medianCut returned different palettes for the same image")
+		}
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	for _, dither := range []bool{false, true} {
+		m := quantize(newImage(2, 1, red, color.NRGBA{0, 0, 255, 128}), 4, dither)
+		if got := m.At(0, 0); got != red {
+			t.Errorf("quantize(dither %t) returned pixel %v, want %v", dither, got, red)
+		}
+		if got, want := m.At(1, 0), (color.NRGBA{0, 0, 255, 128}); got != want {
+			t.Errorf("quantize(dither %t) returned pixel %v, want %v", dither, got, want)
+		}
+	}
+}
+
+// bandError returns the mean absolute difference between the red channels of
+// the averages of each block of 8 by 8 pixels of m and src, which is large
+// where a gradient in src is quantized to visible bands in m.
+func bandError(m, src image.Image) float64 {
+	b := src.Bounds()
+	var sum float64
+	var blocks int
+	for y := b.Min.Y; y+8 <= b.Max.Y; y += 8 {
+		for x := b.Min.X; x+8 <= b.Max.X; x += 8 {
+			var d int
+			for dy := 0; dy < 8; dy++ {
+				for dx := 0; dx < 8; dx++ {
+					r1, _, _, _ := m.At(x+dx, y+dy).RGBA()
+					r2, _, _, _ := src.At(x+dx, y+dy).RGBA()
+					d += int(r1>>8) - int(r2>>8)
+				}
+			}
+			sum += math.Abs(float64(d) / 64)
+			blocks++
+		}
+	}
+	return sum / float64(blocks)
+}
+
+func TestQuantize_Dither(t *testing.T) {
+	// a smooth gradient reduced to a few colors
+	src := image.NewNRGBA(image.Rect(0, 0, 256, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 256; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{uint8(x), 0, 0, 255})
+		}
+	}
+
+	banded := bandError(quantize(src, 4, false), src)
+	dithered := bandError(quantize(src, 4, true), src)
+	if banded < 10 {
+		t.Errorf("quantize without dithering has band error %v, want at least 10", banded)
+	}
+	if dithered > banded/2 {
+		t.Errorf("quantize with dithering has band error %v, want at most half of %v without", dithered, banded)
+	}
+
+	// dithering does not change the palette
+	if a, b := quantize(src, 4, false).Palette, quantize(src, 4, true).Palette; !samePalette(a, b) {
+		t.Errorf("quantize with dithering returned palette %v, want %v", b, a)
+	}
+}
+
+func TestTransform_PNGQuality(t *testing.T) {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, newPhoto(128, 128))
+	in := buf.Bytes()
+
+	full, err := Transform(in, Options{Format: "png"})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	for _, quality := range []int{0, 100} {
+		out, err := Transform(in, Options{Format: "png", Quality: quality})
+		if err != nil || !bytes.Equal(out, full) {
+			t.Errorf("Transform with quality %d did not encode full color image, err %v", quality, err)
+		}
+	}
+
+	out, err := Transform(in, Options{Format: "png", Quality: 80})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	m, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Transform returned invalid png: %v", err)
+	}
+	if p, ok := m.(*image.Paletted); !ok || len(p.Palette) > 256*80/100 {
+		t.Errorf("Transform with quality 80 returned %T, want paletted image of at most %d colors", m, 256*80/100)
+	}
+	if len(out) > len(full)/2 {
+		t.Errorf("Transform with quality 80 returned %d bytes, want at most half of full color %d bytes", len(out), len(full))
+	}
+
+	dithered, err := Transform(in, Options{Format: "png", Quality: 80, Dither: true})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	if m, err := png.Decode(bytes.NewReader(dithered)); err != nil {
+		t.Errorf("Transform with dither returned invalid png: %v", err)
+	} else if _, ok := m.(*image.Paletted); !ok {
+		t.Errorf("Transform with quality 80 and dither returned %T, want paletted image", m)
+	}
+	if bytes.Equal(dithered, out) {
+		t.Errorf("Transform with quality 80 and dither returned the same image as without")
+	}
+}
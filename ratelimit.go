@@ -0,0 +1,145 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A RateLimiter limits the rate of requests served by a Proxy from each
+// client.  Implementations must be safe for concurrent use, and may share
+// their limits between multiple proxies.
+type RateLimiter interface {
+	// Allow reports whether a request from the client identified by key,
+	// such as its IP address, may be served now.  If not, it returns how
+	// long the client should wait before retrying.
+	Allow(key string) (ok bool, retryAfter time.Duration)
+}
+
+// NewRateLimiter returns a RateLimiter which allows each client an average of
+// rate requests per second, in bursts of up to burst requests, using a token
+// bucket for each client.  Rate must be positive.  Clients are forgotten once
+// their bucket is full again, so memory use depends only on the number of
+// recently active clients.
+func NewRateLimiter(rate float64, burst int) RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBuckets{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// tokenBuckets is the RateLimiter returned by NewRateLimiter.
+type tokenBuckets struct {
+	rate  float64 // tokens added per second
+	burst float64 // capacity of each bucket
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket holds the tokens of a client at the time of its last request.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *tokenBuckets) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep removes the buckets which have become full since their last request,
+// since they are no different from the buckets of new clients.  To keep
+// requests fast, it only does so once per time taken to fill a bucket.
+func (l *tokenBuckets) sweep(now time.Time) {
+	fill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < fill {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= fill {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// clientIP returns the IP address of the client which made r.  If trusted is
+// greater than zero, r is assumed to have passed through that many reverse
+// proxies, each appending the address it received the request from to the
+// X-Forwarded-For header, so the address appended by the first of them is
+// used.  Addresses before it may have been sent by the client, and are not
+// trusted.
+func clientIP(r *http.Request, trusted int) string {
+	if trusted > 0 {
+		var addrs []string
+		for _, h := range r.Header.Values("X-Forwarded-For") {
+			for _, addr := range strings.Split(h, ",") {
+				if addr = strings.TrimSpace(addr); addr != "" {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+		if len(addrs) >= trusted {
+			return addrs[len(addrs)-trusted]
+		}
+		if len(addrs) > 0 {
+			return addrs[0]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// retryAfter returns the value of a Retry-After header for a client which may
+// retry after d, in whole seconds, rounded up.
+func retryAfter(d time.Duration) string {
+	s := int64(math.Ceil(d.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+	return strconv.FormatInt(s, 10)
+}
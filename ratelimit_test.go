@@ -0,0 +1,104 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(2, 3).(*tokenBuckets)
+	l.now = func() time.Time { return now }
+
+	allow := func(key string, want bool, wantWait time.Duration) {
+		t.Helper()
+		ok, wait := l.Allow(key)
+		if ok != want || wait != wantWait {
+			t.Errorf("Allow(%q) at %v returned %v, %v, want %v, %v", key, now.Format("15:04:05.000"), ok, wait, want, wantWait)
+		}
+	}
+
+	// a full burst is allowed, then requests must wait for new tokens
+	allow("a", true, 0)
+	allow("a", true, 0)
+	allow("a", true, 0)
+	allow("a", false, 500*time.Millisecond)
+
+	// other clients have their own buckets
+	allow("b", true, 0)
+
+	now = now.Add(250 * time.Millisecond)
+	allow("a", false, 250*time.Millisecond)
+	now = now.Add(250 * time.Millisecond)
+	allow("a", true, 0)
+	allow("a", false, 500*time.Millisecond)
+
+	// buckets are never filled beyond the burst size
+	now = now.Add(time.Minute)
+	allow("a", true, 0)
+	allow("a", true, 0)
+	allow("a", true, 0)
+	allow("a", false, 500*time.Millisecond)
+
+	// clients with full buckets are forgotten
+	if _, ok := l.buckets["b"]; ok {
+		t.Errorf("NewRateLimiter kept the bucket of an inactive client")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		xff        []string
+		trusted    int
+		want       string
+	}{
+		{"1.2.3.4:5678", nil, 0, "1.2.3.4"},
+		{"[::1]:5678", nil, 0, "::1"},
+		{"1.2.3.4:5678", []string{"5.6.7.8"}, 0, "1.2.3.4"},
+		{"10.0.0.1:5678", []string{"5.6.7.8"}, 1, "5.6.7.8"},
+		{"10.0.0.1:5678", []string{"9.9.9.9, 5.6.7.8"}, 1, "5.6.7.8"},
+		{"10.0.0.1:5678", []string{"9.9.9.9, 5.6.7.8", "10.0.0.2"}, 2, "5.6.7.8"},
+		{"10.0.0.1:5678", []string{"5.6.7.8"}, 2, "5.6.7.8"},
+		{"10.0.0.1:5678", nil, 1, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{"X-Forwarded-For": tt.xff}}
+		if got := clientIP(r, tt.trusted); got != tt.want {
+			t.Errorf("clientIP(%v, %v, %d) returned %q, want %q", tt.remoteAddr, tt.xff, tt.trusted, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "1"},
+		{100 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+	}
+	for _, tt := range tests {
+		if got := retryAfter(tt.d); got != tt.want {
+			t.Errorf("retryAfter(%v) returned %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
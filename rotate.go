@@ -0,0 +1,92 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// rotate rotates m by angle degrees counter-clockwise.  The returned image is
+// large enough to hold all of the rotated image, and the corners exposed by
+// the rotation are filled with fill.  Pixels are sampled using bilinear
+// interpolation, blending with fill along the edges of the original image.
+func rotate(m image.Image, angle float64, fill color.Color) *image.NRGBA {
+	src := imaging.Clone(m)
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	// the rotated corners are rarely exactly on a pixel boundary, so allow
+	// for a little floating point error before rounding up.
+	const epsilon = 1e-6
+	dstW := int(math.Ceil(math.Abs(float64(srcW)*cos) + math.Abs(float64(srcH)*sin) - epsilon))
+	dstH := int(math.Ceil(math.Abs(float64(srcW)*sin) + math.Abs(float64(srcH)*cos) - epsilon))
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+
+	// fill color and source pixels are blended as premultiplied values
+	fr, fg, fb, fa := fill.RGBA()
+	bg := [4]float64{float64(fr >> 8), float64(fg >> 8), float64(fb >> 8), float64(fa >> 8)}
+	pixel := func(x, y int) [4]float64 {
+		if x < 0 || y < 0 || x >= srcW || y >= srcH {
+			return bg
+		}
+		i := src.PixOffset(x, y)
+		s := src.Pix[i : i+4 : i+4]
+		a := float64(s[3]) / 255
+		return [4]float64{float64(s[0]) * a, float64(s[1]) * a, float64(s[2]) * a, float64(s[3])}
+	}
+
+	srcCX, srcCY := float64(srcW)/2, float64(srcH)/2
+	dstCX, dstCY := float64(dstW)/2, float64(dstH)/2
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			// map the center of the destination pixel back to the source
+			dx, dy := float64(x)+0.5-dstCX, float64(y)+0.5-dstCY
+			sx := dx*cos - dy*sin + srcCX - 0.5
+			sy := dx*sin + dy*cos + srcCY - 0.5
+
+			x0, y0 := math.Floor(sx), math.Floor(sy)
+			tx, ty := sx-x0, sy-y0
+			ix, iy := int(x0), int(y0)
+			p00, p10 := pixel(ix, iy), pixel(ix+1, iy)
+			p01, p11 := pixel(ix, iy+1), pixel(ix+1, iy+1)
+
+			var c [4]float64
+			for k := range c {
+				top := p00[k]*(1-tx) + p10[k]*tx
+				bottom := p01[k]*(1-tx) + p11[k]*tx
+				c[k] = top*(1-ty) + bottom*ty
+			}
+
+			i := dst.PixOffset(x, y)
+			if c[3] > 0 {
+				a := c[3] / 255
+				dst.Pix[i+0] = clampUint8(c[0] / a)
+				dst.Pix[i+1] = clampUint8(c[1] / a)
+				dst.Pix[i+2] = clampUint8(c[2] / a)
+				dst.Pix[i+3] = clampUint8(c[3])
+			}
+		}
+	}
+	return dst
+}
+
+// clampUint8 rounds v to the nearest integer in the range 0 to 255.
+func clampUint8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
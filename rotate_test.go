@@ -0,0 +1,110 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestRotate_Orthogonal(t *testing.T) {
+	src := newImage(3, 2, red, green, blue, yellow, red, green)
+
+	tests := []struct {
+		angle float64
+		want  image.Image
+	}{
+		{90, imaging.Rotate90(src)},
+		{180, imaging.Rotate180(src)},
+		{270, imaging.Rotate270(src)},
+		{-90, imaging.Rotate270(src)},
+		{360, imaging.Clone(src)},
+	}
+
+	for _, tt := range tests {
+		got := rotate(src, tt.angle, color.Black)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rotate(%v) returned image %#v, want %#v", tt.angle, got, tt.want)
+		}
+	}
+}
+
+func TestRotate_Size(t *testing.T) {
+	tests := []struct {
+		w, h  int
+		angle float64
+		want  image.Rectangle
+	}{
+		{10, 10, 45, image.Rect(0, 0, 15, 15)},
+		{10, 10, -45, image.Rect(0, 0, 15, 15)},
+		{100, 50, 3.5, image.Rect(0, 0, 103, 57)},
+		{100, 50, 93.5, image.Rect(0, 0, 57, 103)},
+	}
+
+	for _, tt := range tests {
+		got := rotate(image.NewNRGBA(image.Rect(0, 0, tt.w, tt.h)), tt.angle, color.Black).Bounds()
+		if got != tt.want {
+			t.Errorf("rotate(%dx%d, %v) returned bounds %v, want %v", tt.w, tt.h, tt.angle, got, tt.want)
+		}
+	}
+}
+
+func TestRotate_Fill(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for i := 0; i < len(src.Pix); i += 4 {
+		copy(src.Pix[i:], []uint8{255, 0, 0, 255})
+	}
+
+	tests := []struct {
+		fill   color.NRGBA
+		corner color.NRGBA
+	}{
+		{color.NRGBA{}, color.NRGBA{}},
+		{color.NRGBA{255, 255, 255, 255}, color.NRGBA{255, 255, 255, 255}},
+		{color.NRGBA{0, 0, 255, 128}, color.NRGBA{0, 0, 255, 128}},
+	}
+
+	for _, tt := range tests {
+		m := rotate(src, 45, tt.fill)
+		if got := m.NRGBAAt(0, 0); got != tt.corner {
+			t.Errorf("rotate with fill %v returned corner %v, want %v", tt.fill, got, tt.corner)
+		}
+		c := m.Bounds().Max.Div(2)
+		if got, want := m.NRGBAAt(c.X, c.Y), red; got != want {
+			t.Errorf("rotate with fill %v returned center %v, want %v", tt.fill, got, want)
+		}
+	}
+
+	// edge pixels blended with a transparent fill should be partially
+	// transparent, but not darkened.
+	m := rotate(src, 45, color.NRGBA{})
+	var blended int
+	for x := 0; x < m.Bounds().Dx(); x++ {
+		c := m.NRGBAAt(x, m.Bounds().Dy()/2)
+		if c.A > 0 && c.A < 255 {
+			blended++
+			if c.R != 255 || c.G != 0 || c.B != 0 {
+				t.Errorf("rotate with transparent fill returned edge pixel %v, want unpremultiplied red", c)
+			}
+		}
+	}
+	if blended == 0 {
+		t.Errorf("rotate with transparent fill returned no partially transparent edge pixels")
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// sepia tones m with the given intensity, from 0 to 100, by blending each
+// pixel with its sepia toned color.  At 100, pixels are fully sepia toned.
+func sepia(m image.Image, intensity float64) *image.NRGBA {
+	k := math.Max(0, math.Min(100, intensity)) / 100
+	return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
+		// commonly used sepia tone matrix
+		tone := func(v, kr, kg, kb float64) uint8 {
+			t := math.Min(255, r*kr+g*kg+b*kb)
+			return uint8(v + (t-v)*k + 0.5)
+		}
+		return color.NRGBA{
+			R: tone(r, 0.393, 0.769, 0.189),
+			G: tone(g, 0.349, 0.686, 0.168),
+			B: tone(b, 0.272, 0.534, 0.131),
+			A: c.A,
+		}
+	})
+}
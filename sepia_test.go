@@ -0,0 +1,41 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestSepia(t *testing.T) {
+	tests := []struct {
+		c         color.NRGBA
+		intensity float64
+		want      color.NRGBA
+	}{
+		{color.NRGBA{100, 150, 200, 255}, 0, color.NRGBA{100, 150, 200, 255}},
+		{color.NRGBA{100, 150, 200, 255}, 100, color.NRGBA{192, 171, 134, 255}},
+		{color.NRGBA{100, 150, 200, 255}, 50, color.NRGBA{146, 161, 167, 255}},
+		{color.NRGBA{100, 150, 200, 255}, 200, color.NRGBA{192, 171, 134, 255}}, // clamped to 100
+		{color.NRGBA{255, 255, 255, 128}, 100, color.NRGBA{255, 255, 239, 128}},
+		{color.NRGBA{0, 0, 0, 255}, 100, color.NRGBA{0, 0, 0, 255}},
+	}
+	for _, tt := range tests {
+		m := newImage(1, 1, tt.c)
+		if got := sepia(m, tt.intensity).NRGBAAt(0, 0); got != tt.want {
+			t.Errorf("sepia(%v, %v) returned %v, want %v", tt.c, tt.intensity, got, tt.want)
+		}
+	}
+}
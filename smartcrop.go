@@ -0,0 +1,243 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// smartCropAnalysisSize is the maximum dimension of the downscaled copy of
+// an image that is analyzed to find the most interesting crop.
+const smartCropAnalysisSize = 256
+
+// smartCropMinSize is the minimum dimension of an image for which smart
+// cropping is attempted.  Smaller images are center cropped.
+const smartCropMinSize = 16
+
+// smartCrop returns the rectangle of m with the aspect ratio of w:h that
+// contains the most detail, as measured by the strength of edges.  Images
+// too small to analyze meaningfully fall back to a center crop.
+func smartCrop(m image.Image, w, h int) image.Rectangle {
+	b := m.Bounds()
+	imgW, imgH := b.Dx(), b.Dy()
+
+	// size of the crop at full resolution
+	cw, ch := cropSize(imgW, imgH, w, h)
+	center := image.Rect(0, 0, cw, ch).Add(b.Min).Add(image.Pt((imgW-cw)/2, (imgH-ch)/2))
+	if (cw == imgW && ch == imgH) || imgW < smartCropMinSize || imgH < smartCropMinSize {
+		return center
+	}
+
+	// analyze a downscaled copy of the image
+	scale := 1.0
+	if imgW > smartCropAnalysisSize || imgH > smartCropAnalysisSize {
+		scale = float64(smartCropAnalysisSize) / math.Max(float64(imgW), float64(imgH))
+	}
+	aw := int(float64(imgW)*scale + 0.5)
+	ah := int(float64(imgH)*scale + 0.5)
+	var small *image.NRGBA
+	if scale == 1 {
+		small = imaging.Clone(m)
+	} else {
+		small = imaging.Resize(m, aw, ah, imaging.Box)
+	}
+	aw, ah = small.Bounds().Dx(), small.Bounds().Dy()
+
+	// crop size in analysis coordinates
+	acw := int(float64(cw)*scale + 0.5)
+	ach := int(float64(ch)*scale + 0.5)
+	if acw > aw {
+		acw = aw
+	}
+	if ach > ah {
+		ach = ah
+	}
+	if acw < 1 || ach < 1 {
+		return center
+	}
+
+	sum := integralEnergy(small)
+	total := sum[ah*(aw+1)+aw]
+	if total == 0 {
+		return center
+	}
+
+	// find the window with the most energy, preferring windows closer
+	// to the center when scores are equal.
+	bestX, bestY := (aw-acw)/2, (ah-ach)/2
+	bestScore := windowSum(sum, aw, bestX, bestY, acw, ach)
+	bestDist := 0
+	for y := 0; y+ach <= ah; y++ {
+		for x := 0; x+acw <= aw; x++ {
+			score := windowSum(sum, aw, x, y, acw, ach)
+			dist := abs(x-(aw-acw)/2) + abs(y-(ah-ach)/2)
+			if score > bestScore || (score == bestScore && dist < bestDist) {
+				bestX, bestY, bestScore, bestDist = x, y, score, dist
+			}
+		}
+	}
+
+	// map back to full resolution, keeping the crop inside the image
+	x0 := int(float64(bestX)/scale + 0.5)
+	y0 := int(float64(bestY)/scale + 0.5)
+	if x0+cw > imgW {
+		x0 = imgW - cw
+	}
+	if y0+ch > imgH {
+		y0 = imgH - ch
+	}
+	return image.Rect(x0, y0, x0+cw, y0+ch).Add(b.Min)
+}
+
+// cropSize returns the size of the largest rectangle with the aspect ratio
+// of w:h that fits within an image of size imgW by imgH.
+func cropSize(imgW, imgH, w, h int) (cw, ch int) {
+	cw, ch = imgW, imgH
+	if imgW*h > imgH*w {
+		cw = int(float64(imgH)*float64(w)/float64(h) + 0.5)
+	} else {
+		ch = int(float64(imgW)*float64(h)/float64(w) + 0.5)
+	}
+	if cw < 1 {
+		cw = 1
+	}
+	if ch < 1 {
+		ch = 1
+	}
+	return cw, ch
+}
+
+// focalCrop returns the rectangle of m with the aspect ratio of w:h that is
+// centered as closely as possible on the focal point (fx, fy), given as
+// fractions of the width and height of m.  Zero values center the rectangle
+// along that axis.
+func focalCrop(m image.Image, w, h int, fx, fy float64) image.Rectangle {
+	b := m.Bounds()
+	imgW, imgH := b.Dx(), b.Dy()
+	cw, ch := cropSize(imgW, imgH, w, h)
+
+	// offset of the crop along an axis of the given size, keeping it
+	// inside the image
+	offset := func(f float64, size, crop int) int {
+		if f == 0 {
+			return (size - crop) / 2
+		}
+		o := int(math.Round(f*float64(size) - float64(crop)/2))
+		if o > size-crop {
+			o = size - crop
+		}
+		if o < 0 {
+			o = 0
+		}
+		return o
+	}
+	x0, y0 := offset(fx, imgW, cw), offset(fy, imgH, ch)
+	return image.Rect(x0, y0, x0+cw, y0+ch).Add(b.Min)
+}
+
+// gravities are the valid values of Options.Gravity.
+var gravities = []string{"north", "northeast", "east", "southeast", "south", "southwest", "west", "northwest", "center"}
+
+// isGravity returns whether gravity is a valid crop gravity.
+func isGravity(gravity string) bool {
+	for _, g := range gravities {
+		if g == gravity {
+			return true
+		}
+	}
+	return false
+}
+
+// gravityCrop returns the rectangle of m to crop to for a w by h thumbnail,
+// placed against the edges of m named by gravity, such as the top edge for
+// "north", and centered along the other axis.
+func gravityCrop(m image.Image, w, h int, gravity string) image.Rectangle {
+	b := m.Bounds()
+	imgW, imgH := b.Dx(), b.Dy()
+	cw, ch := cropSize(imgW, imgH, w, h)
+
+	x0, y0 := (imgW-cw)/2, (imgH-ch)/2
+	switch {
+	case strings.HasSuffix(gravity, "west"):
+		x0 = 0
+	case strings.HasSuffix(gravity, "east"):
+		x0 = imgW - cw
+	}
+	switch {
+	case strings.HasPrefix(gravity, "north"):
+		y0 = 0
+	case strings.HasPrefix(gravity, "south"):
+		y0 = imgH - ch
+	}
+	return image.Rect(x0, y0, x0+cw, y0+ch).Add(b.Min)
+}
+
+// integralEnergy computes the edge energy of each pixel of m and returns its
+// summed area table, which has a stride of width+1 and a leading row and
+// column of zeros.
+func integralEnergy(m *image.NRGBA) []int64 {
+	w, h := m.Bounds().Dx(), m.Bounds().Dy()
+	lum := make([]int32, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := m.NRGBAAt(x, y)
+			lum[y*w+x] = int32(color.GrayModel.Convert(c).(color.Gray).Y) * int32(c.A) / 255
+		}
+	}
+	at := func(x, y int) int32 {
+		if x < 0 {
+			x = 0
+		} else if x >= w {
+			x = w - 1
+		}
+		if y < 0 {
+			y = 0
+		} else if y >= h {
+			y = h - 1
+		}
+		return lum[y*w+x]
+	}
+
+	stride := w + 1
+	sum := make([]int64, stride*(h+1))
+	for y := 0; y < h; y++ {
+		var row int64
+		for x := 0; x < w; x++ {
+			e := abs(int(at(x+1, y)-at(x-1, y))) + abs(int(at(x, y+1)-at(x, y-1)))
+			row += int64(e)
+			sum[(y+1)*stride+x+1] = sum[y*stride+x+1] + row
+		}
+	}
+	return sum
+}
+
+// windowSum returns the sum of the w x h window at (x, y) of the summed area
+// table sum, for an image of the given width.
+func windowSum(sum []int64, width, x, y, w, h int) int64 {
+	stride := width + 1
+	return sum[(y+h)*stride+x+w] - sum[y*stride+x+w] - sum[(y+h)*stride+x] + sum[y*stride+x]
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,198 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// detailedImage returns a w x h gray image with a checkerboard pattern in
+// the rectangle r.
+func detailedImage(w, h int, r image.Rectangle) image.Image {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{128, 128, 128, 255}
+			if (image.Point{x, y}).In(r) && (x/4+y/4)%2 == 0 {
+				c = color.NRGBA{0, 0, 0, 255}
+			}
+			m.SetNRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+func TestSmartCrop(t *testing.T) {
+	tests := []struct {
+		name string
+		m    image.Image
+		w, h int
+		want image.Rectangle
+	}{
+		{
+			"uniform image is center cropped",
+			newImage(400, 100, red), 1, 1,
+			image.Rect(150, 0, 250, 100),
+		},
+		{
+			"small image is center cropped",
+			detailedImage(12, 4, image.Rect(0, 0, 4, 4)), 1, 1,
+			image.Rect(4, 0, 8, 4),
+		},
+		{
+			"same aspect ratio",
+			detailedImage(400, 100, image.Rect(300, 10, 380, 90)), 8, 2,
+			image.Rect(0, 0, 400, 100),
+		},
+	}
+
+	for _, tt := range tests {
+		if got := smartCrop(tt.m, tt.w, tt.h); got != tt.want {
+			t.Errorf("%s: smartCrop returned %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSmartCrop_Detail(t *testing.T) {
+	tests := []struct {
+		name   string
+		m      image.Image
+		w, h   int
+		size   image.Point     // expected size of crop
+		detail image.Rectangle // region expected to be inside crop
+	}{
+		{
+			"detail on the right",
+			detailedImage(400, 100, image.Rect(300, 10, 380, 90)), 1, 1,
+			image.Pt(100, 100), image.Rect(300, 10, 380, 90),
+		},
+		{
+			"detail at the top",
+			detailedImage(100, 400, image.Rect(10, 0, 90, 40)), 2, 1,
+			image.Pt(100, 50), image.Rect(10, 0, 90, 40),
+		},
+	}
+
+	for _, tt := range tests {
+		got := smartCrop(tt.m, tt.w, tt.h)
+		if got.Size() != tt.size {
+			t.Errorf("%s: smartCrop returned %v, want size %v", tt.name, got, tt.size)
+		}
+		if !tt.detail.In(got) {
+			t.Errorf("%s: smartCrop returned %v, want rectangle containing %v", tt.name, got, tt.detail)
+		}
+	}
+}
+
+func TestSmartCrop_Downscaled(t *testing.T) {
+	// images larger than smartCropAnalysisSize are analyzed at a smaller
+	// size, so the result is only approximate.
+	m := detailedImage(1000, 200, image.Rect(40, 20, 160, 180))
+	got := smartCrop(m, 1, 1)
+	if got.Dx() != 200 || got.Dy() != 200 {
+		t.Errorf("smartCrop returned %v, want 200x200 rectangle", got)
+	}
+	if !image.Rect(40, 20, 160, 180).In(got) {
+		t.Errorf("smartCrop returned %v, want rectangle containing detail", got)
+	}
+}
+
+func TestFocalCrop(t *testing.T) {
+	m := newImage(400, 100, red)
+	tests := []struct {
+		w, h   int
+		fx, fy float64
+		want   image.Rectangle
+	}{
+		{1, 1, 0, 0, image.Rect(150, 0, 250, 100)},
+		{1, 1, 0.3, 0.6, image.Rect(70, 0, 170, 100)},
+		{1, 1, 0.05, 0, image.Rect(0, 0, 100, 100)},
+		{1, 1, 1, 1, image.Rect(300, 0, 400, 100)},
+		{8, 1, 0.5, 0.1, image.Rect(0, 0, 400, 50)},
+		{8, 1, 0.5, 0.6, image.Rect(0, 35, 400, 85)},
+		{8, 1, 0, 0.9, image.Rect(0, 50, 400, 100)},
+		{4, 1, 0.9, 0.9, image.Rect(0, 0, 400, 100)},
+	}
+	for _, tt := range tests {
+		if got := focalCrop(m, tt.w, tt.h, tt.fx, tt.fy); got != tt.want {
+			t.Errorf("focalCrop(%d, %d, %v, %v) returned %v, want %v", tt.w, tt.h, tt.fx, tt.fy, got, tt.want)
+		}
+	}
+}
+
+func TestGravityCrop(t *testing.T) {
+	m := newImage(400, 100, red)
+	tests := []struct {
+		w, h    int
+		gravity string
+		want    image.Rectangle
+	}{
+		{1, 1, "center", image.Rect(150, 0, 250, 100)},
+		{1, 1, "west", image.Rect(0, 0, 100, 100)},
+		{1, 1, "northeast", image.Rect(300, 0, 400, 100)},
+		{1, 1, "north", image.Rect(150, 0, 250, 100)},
+		{8, 1, "north", image.Rect(0, 0, 400, 50)},
+		{8, 1, "south", image.Rect(0, 50, 400, 100)},
+		{8, 1, "southwest", image.Rect(0, 50, 400, 100)},
+		{8, 1, "east", image.Rect(0, 25, 400, 75)},
+	}
+	for _, tt := range tests {
+		if got := gravityCrop(m, tt.w, tt.h, tt.gravity); got != tt.want {
+			t.Errorf("gravityCrop(%d, %d, %q) returned %v, want %v", tt.w, tt.h, tt.gravity, got, tt.want)
+		}
+	}
+}
+
+func TestTransformImage_Gravity(t *testing.T) {
+	// gravity overrides smart cropping, which would keep the detail on
+	// the left
+	m := detailedImage(400, 100, image.Rect(0, 10, 80, 90))
+	want := mustTransformImage(t, imaging.Crop(m, image.Rect(300, 0, 400, 100)), Options{Width: 50, Height: 50})
+	got := mustTransformImage(t, m, Options{Width: 50, Height: 50, Gravity: "east", SmartCrop: true})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("transformImage with gravity did not crop against the east edge")
+	}
+}
+
+func TestTransformImage_FocalPoint(t *testing.T) {
+	// the focal point on the right overrides smart cropping, which would
+	// keep the detail on the left
+	m := detailedImage(400, 100, image.Rect(0, 10, 80, 90))
+	want := mustTransformImage(t, imaging.Crop(m, image.Rect(300, 0, 400, 100)), Options{Width: 50, Height: 50})
+	got := mustTransformImage(t, m, Options{Width: 50, Height: 50, FocalX: 0.9, FocalY: 0.5, SmartCrop: true})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("transformImage with focal point did not crop around the focal point")
+	}
+}
+
+func TestTransformImage_SmartCrop(t *testing.T) {
+	m := detailedImage(400, 100, image.Rect(300, 10, 380, 90))
+
+	got := mustTransformImage(t, m, Options{Width: 50, Height: 50, SmartCrop: true})
+	if got, want := got.Bounds(), image.Rect(0, 0, 50, 50); got != want {
+		t.Errorf("transformImage returned image with bounds %v, want %v", got, want)
+	}
+
+	// smart cropping should not scale images up
+	got = mustTransformImage(t, m, Options{Width: 200, Height: 400, SmartCrop: true})
+	if got, want := got.Bounds(), image.Rect(0, 0, 200, 100); got != want {
+		t.Errorf("transformImage returned image with bounds %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// rasterizeSVG draws the SVG image img, scaled from its viewBox to w by h
+// pixels.  It is nil unless imageproxy is built with the "svg" build tag.
+var rasterizeSVG func(img []byte, w, h int) (image.Image, error)
+
+// errNoSVG is the cause of errors for SVG images when imageproxy is built
+// without SVG support.
+var errNoSVG = errors.New("SVG images require the svg build tag")
+
+// svgUnsafeElements are the SVG elements which run scripts or embed other
+// documents, and are not rasterized.
+var svgUnsafeElements = map[string]bool{
+	"script":        true,
+	"foreignObject": true,
+	"iframe":        true,
+	"object":        true,
+	"embed":         true,
+	"audio":         true,
+	"video":         true,
+}
+
+// svgExternalURL matches CSS url() references and imports to anything but
+// fragments of the SVG image itself.
+var svgExternalURL = regexp.MustCompile(`(?i)url\(\s*['"]?\s*[^#'"\s)]|@import`)
+
+// isSVG returns whether b, the start of a document, is an SVG image.  The
+// root element must be an svg element, after any XML declaration, comments,
+// and doctype.
+func isSVG(b []byte) bool {
+	d := xml.NewDecoder(bytes.NewReader(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))))
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			return false
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			return t.Name.Local == "svg"
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return false
+			}
+		}
+	}
+}
+
+// parseSVG checks that the SVG image img does not run scripts or reference
+// external resources, and returns its intrinsic size, which is the size of
+// its viewBox, or its width and height if it has no viewBox.  Entity
+// declarations are rejected as well, since they can expand to arbitrarily
+// large documents.
+func parseSVG(img []byte) (w, h float64, err error) {
+	unsafe := func(format string, args ...interface{}) error {
+		return &TransformError{ErrDecode, fmt.Errorf("unsafe SVG: "+format, args...)}
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(img))
+	root := true
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, &TransformError{ErrDecode, err}
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if svgUnsafeElements[t.Name.Local] {
+				return 0, 0, unsafe("%s element", t.Name.Local)
+			}
+			for _, a := range t.Attr {
+				name := strings.ToLower(a.Name.Local)
+				switch {
+				case strings.HasPrefix(name, "on"):
+					return 0, 0, unsafe("%s attribute", a.Name.Local)
+				case name == "href" && !strings.HasPrefix(strings.TrimSpace(a.Value), "#"):
+					return 0, 0, unsafe("reference to %q", a.Value)
+				case svgExternalURL.MatchString(a.Value):
+					return 0, 0, unsafe("reference in %s attribute", a.Name.Local)
+				}
+			}
+			if root {
+				w, h = svgSize(t)
+				root = false
+			}
+		case xml.CharData:
+			if svgExternalURL.Match(t) {
+				return 0, 0, unsafe("reference in stylesheet")
+			}
+		case xml.Directive:
+			if bytes.Contains(t, []byte("ENTITY")) {
+				return 0, 0, unsafe("entity declaration")
+			}
+		case xml.ProcInst:
+			if t.Target == "xml-stylesheet" {
+				return 0, 0, unsafe("external stylesheet")
+			}
+		}
+	}
+	if w <= 0 || h <= 0 || math.IsInf(w, 0) || math.IsInf(h, 0) {
+		return 0, 0, &TransformError{ErrDecode, errors.New("SVG image has no size")}
+	}
+	return w, h, nil
+}
+
+// svgSize returns the intrinsic size of the svg root element e, or zero if
+// it has none.  Widths and heights in units other than pixels are ignored.
+func svgSize(e xml.StartElement) (w, h float64) {
+	for _, a := range e.Attr {
+		if a.Name.Local == "viewBox" {
+			f := strings.FieldsFunc(a.Value, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+			if len(f) == 4 {
+				w, _ = strconv.ParseFloat(f[2], 64)
+				h, _ = strconv.ParseFloat(f[3], 64)
+				return w, h
+			}
+		}
+	}
+	for _, a := range e.Attr {
+		v, err := strconv.ParseFloat(strings.TrimSuffix(a.Value, "px"), 64)
+		if err != nil {
+			continue
+		}
+		switch a.Name.Local {
+		case "width":
+			w = v
+		case "height":
+			h = v
+		}
+	}
+	return w, h
+}
+
+// svgScale returns the factor that an SVG image with the intrinsic size w by
+// h is rasterized at for opt, so that it is drawn at the requested size
+// rather than resized from its intrinsic size, along with the options for
+// transforming the rasterized image.  SVG images have no pixel size to scale
+// up from, so they can always be drawn larger.  Cropped images are rasterized
+// at their intrinsic size, which the crop rectangle refers to.
+func svgScale(w, h float64, opt Options) (float64, Options) {
+	opt.ScaleUp = true
+	if opt.crop() {
+		return 1, opt
+	}
+	m := image.Rect(0, 0, int(math.Ceil(w)), int(math.Ceil(h)))
+	rw, rh, resize := resizeParams(m, opt)
+	if !resize {
+		return 1, opt
+	}
+
+	// the rasterized image already has the requested size, which is not
+	// scaled by the DPR or percentages again
+	opt.Width, opt.Height = float64(rw), float64(rh)
+	opt.WidthPercent, opt.HeightPercent = false, false
+	opt.DPR, opt.Megapixels = 0, 0
+	sx, sy := float64(rw)/w, float64(rh)/h
+	switch {
+	case rw == 0:
+		return sy, opt
+	case rh == 0:
+		return sx, opt
+	case opt.Fit || opt.pad():
+		return math.Min(sx, sy), opt
+	}
+	return math.Max(sx, sy), opt
+}
+
+// decodeSVG rasterizes the SVG image img at the size requested by opt, or its
+// intrinsic size if opt does not request one.  The returned options are
+// those for transforming the rasterized image, as returned by svgScale.
+func decodeSVG(img []byte, opt Options) (image.Image, Options, error) {
+	w, h, err := parseSVG(img)
+	if err != nil {
+		return nil, opt, err
+	}
+	if rasterizeSVG == nil {
+		return nil, opt, &TransformError{ErrUnsupportedFormat, errNoSVG}
+	}
+	s, opt := svgScale(w, h, opt)
+	cfg := image.Config{
+		Width:  int(math.Max(1, math.Floor(w*s+0.5))),
+		Height: int(math.Max(1, math.Floor(h*s+0.5))),
+	}
+	if err := checkPixels(cfg); err != nil {
+		return nil, opt, err
+	}
+	m, err := rasterizeSVG(img, cfg.Width, cfg.Height)
+	if err != nil {
+		return nil, opt, &TransformError{ErrDecode, err}
+	}
+	return m, opt, nil
+}
+
+// transformSVG rasterizes the SVG image read from r and transforms it as
+// specified by opt, and writes the encoded result to w.  There is no SVG
+// encoder, so images are encoded as PNG unless another format is requested.
+func transformSVG(ctx context.Context, w io.Writer, r io.Reader, opt Options, q Qualities) error {
+	img, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m, opt, err := decodeSVG(img, opt)
+	if err != nil {
+		return err
+	}
+
+	format := opt.Format
+	if format == "" {
+		format = "png"
+	}
+	if opt.transparent() && (format == "jpeg" || format == "bmp") {
+		format = "png"
+	}
+	quality := opt.Quality
+	if quality == 0 {
+		quality = q.quality(format)
+	}
+
+	if m, err = transformImageContext(ctx, m, opt); err != nil {
+		return err
+	}
+	return encodeImage(w, m, format, quality, opt)
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build svg
+// +build svg
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+func init() {
+	rasterizeSVG = rasterizeOKSVG
+}
+
+// rasterizeOKSVG draws the SVG image img at w by h pixels with oksvg.
+func rasterizeOKSVG(img []byte, w, h int) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(img))
+	if err != nil {
+		return nil, err
+	}
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	scanner := rasterx.NewScannerGV(w, h, m, m.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+	return m, nil
+}
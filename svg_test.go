@@ -0,0 +1,162 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+)
+
+const testSVG = `<?xml version="1.0"?>
+<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 40 20">
+  <rect width="40" height="20" fill="#f00"/>
+</svg>`
+
+func TestIsSVG(t *testing.T) {
+	tests := []struct {
+		b    string
+		want bool
+	}{
+		{"", false},
+		{testSVG, true},
+		{"\xef\xbb\xbf<svg>", true},
+		{"<!-- icon -->\n<!DOCTYPE svg>\n<svg xmlns='http://www.w3.org/2000/svg'>", true},
+		{"<svg", false},
+		{"<html><svg></svg></html>", false},
+		{"text <svg></svg>", false},
+		{"\x89PNG\r\n\x1a\n", false},
+	}
+	for _, tt := range tests {
+		if got := isSVG([]byte(tt.b)); got != tt.want {
+			t.Errorf("isSVG(%q) returned %v, want %v", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseSVG(t *testing.T) {
+	tests := []struct {
+		svg  string
+		w, h float64
+	}{
+		{testSVG, 40, 20},
+		{`<svg viewBox="0,0,10.5,4"/>`, 10.5, 4},
+		{`<svg width="30" height="15px"/>`, 30, 15},
+		{`<svg width="30" height="15" viewBox="0 0 3 1.5"/>`, 3, 1.5},
+		{`<svg><defs><path id="p"/></defs><use href="#p"/></svg>`, 0, 0},
+		{`<svg viewBox="0 0 1 1"><style>.a { fill: url(#g) }</style></svg>`, 1, 1},
+	}
+	for _, tt := range tests {
+		w, h, err := parseSVG([]byte(tt.svg))
+		if tt.w == 0 {
+			if !errors.Is(err, ErrDecode) {
+				t.Errorf("parseSVG(%q) returned error %v, want ErrDecode", tt.svg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSVG(%q) returned unexpected error: %v", tt.svg, err)
+		} else if w != tt.w || h != tt.h {
+			t.Errorf("parseSVG(%q) returned size %vx%v, want %vx%v", tt.svg, w, h, tt.w, tt.h)
+		}
+	}
+}
+
+func TestParseSVG_Unsafe(t *testing.T) {
+	for _, svg := range []string{
+		`<svg viewBox="0 0 1 1"><script>alert(1)</script></svg>`,
+		`<svg viewBox="0 0 1 1" onload="alert(1)"/>`,
+		`<svg viewBox="0 0 1 1"><image href="http://example.com/a.png"/></svg>`,
+		`<svg viewBox="0 0 1 1" xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="file:///etc/passwd#a"/></svg>`,
+		`<svg viewBox="0 0 1 1"><rect style="fill: url('http://example.com/a.svg#g')"/></svg>`,
+		`<svg viewBox="0 0 1 1"><style>@import "http://example.com/a.css";</style></svg>`,
+		`<svg viewBox="0 0 1 1"><foreignObject><p>text</p></foreignObject></svg>`,
+		`<!DOCTYPE svg [<!ENTITY a "aaaa">]><svg viewBox="0 0 1 1">&a;</svg>`,
+		`<?xml-stylesheet href="http://example.com/a.css"?><svg viewBox="0 0 1 1"/>`,
+	} {
+		if _, _, err := parseSVG([]byte(svg)); !errors.Is(err, ErrDecode) {
+			t.Errorf("parseSVG(%q) returned error %v, want ErrDecode", svg, err)
+		}
+	}
+}
+
+func TestSVGScale(t *testing.T) {
+	tests := []struct {
+		opt  Options
+		want float64
+	}{
+		{emptyOptions, 1},
+		{Options{Width: 80}, 2},
+		{Options{Height: 10}, 0.5},
+		{Options{Width: 0.5}, 0.5},
+		{Options{Width: 20, DPR: 2}, 1},
+		{Options{Width: 80, Height: 80}, 4},
+		{Options{Width: 80, Height: 80, Fit: true}, 2},
+		{Options{Width: 80, CropWidth: 10}, 1},
+	}
+	for _, tt := range tests {
+		if got, _ := svgScale(40, 20, tt.opt); got != tt.want {
+			t.Errorf("svgScale(40, 20, %v) returned %v, want %v", tt.opt, got, tt.want)
+		}
+	}
+}
+
+func TestTransform_SVG(t *testing.T) {
+	if rasterizeSVG == nil {
+		_, err := Transform([]byte(testSVG), Options{Width: 80})
+		if !errors.Is(err, ErrUnsupportedFormat) || !errors.Is(err, errNoSVG) {
+			t.Errorf("Transform returned error %v, want %v", err, errNoSVG)
+		}
+
+		// stand in for the rasterizer, which requires the svg build tag
+		rasterizeSVG = func(img []byte, w, h int) (image.Image, error) {
+			return newImage(w, h, red), nil
+		}
+		defer func() { rasterizeSVG = nil }()
+	}
+
+	tests := []struct {
+		opt    Options
+		format string
+		w, h   int
+	}{
+		{Options{Format: "png"}, "png", 40, 20},
+		{Options{Width: 400}, "png", 400, 200},
+		{Options{Width: 100, Height: 100}, "png", 100, 100},
+		{Options{Width: 100, Height: 100, Fit: true, Format: "jpeg"}, "jpeg", 100, 50},
+		{Options{Width: 0.5, Format: "webp"}, "webp", 20, 10},
+	}
+	for _, tt := range tests {
+		out, err := Transform([]byte(testSVG), tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("Transform(%v) returned undecodable image: %v", tt.opt, err)
+			continue
+		}
+		if format != tt.format || cfg.Width != tt.w || cfg.Height != tt.h {
+			t.Errorf("Transform(%v) returned %s image of %dx%d, want %s image of %dx%d", tt.opt, format, cfg.Width, cfg.Height, tt.format, tt.w, tt.h)
+		}
+	}
+
+	unsafe := `<svg viewBox="0 0 1 1" onload="alert(1)"/>`
+	if _, err := Transform([]byte(unsafe), Options{Format: "png"}); !errors.Is(err, ErrDecode) {
+		t.Errorf("Transform returned error %v for unsafe SVG, want ErrDecode", err)
+	}
+}
@@ -7,6 +7,7 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net/http"
@@ -23,6 +24,9 @@ import (
 // After such a timeout, writes by h to its ResponseWriter will return
 // ErrHandlerTimeout.
 //
+// The context of the request passed to h is canceled once the time
+// limit is reached, so that h can stop any work in progress.
+//
 // TimeoutHandler buffers all Handler writes to memory and does not
 // support the Hijacker or Flusher interfaces.
 func TimeoutHandler(h http.Handler, dt time.Duration, msg string) http.Handler {
@@ -61,6 +65,9 @@ func (h *timeoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		t = time.NewTimer(h.dt)
 		timeout = t.C
 	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
 	done := make(chan struct{})
 	tw := &timeoutWriter{
 		w: w,
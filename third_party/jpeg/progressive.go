@@ -0,0 +1,216 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"image"
+)
+
+// component holds the quantized DCT coefficients of one image component, in
+// zig-zag order, for progressive encoding.
+type component struct {
+	// blocks is a bw x bh grid of blocks in raster order. The grid covers
+	// whole MCUs, so it may extend past the component's edge.
+	blocks []block
+	bw, bh int
+	// sw and sh are the number of blocks that a non-interleaved scan covers,
+	// which is the component's size rounded up to a whole block. See section
+	// A.2.2 of the spec.
+	sw, sh int
+	// q is the quantization table, which also selects the Huffman tables.
+	q quantIndex
+}
+
+func newComponent(bw, bh, sw, sh int, q quantIndex) *component {
+	return &component{
+		blocks: make([]block, bw*bh),
+		bw:     bw,
+		bh:     bh,
+		sw:     sw,
+		sh:     sh,
+		q:      q,
+	}
+}
+
+// at returns the block in column x and row y of the grid.
+func (c *component) at(x, y int) *block {
+	return &c.blocks[y*c.bw+x]
+}
+
+// quantize transforms b and stores its quantized coefficients in dst, in
+// zig-zag order. b is in natural (not zig-zag) order.
+func (e *encoder) quantize(dst, b *block, q quantIndex) {
+	fdct(b)
+	for zig := 0; zig < blockSize; zig++ {
+		dst[zig] = div(b[unzig[zig]], 8*int32(e.quant[q][zig]))
+	}
+}
+
+// components converts m to its quantized Y, Cb and Cr components, or just the
+// Y component if m is grayscale.
+func (e *encoder) components(m image.Image) []*component {
+	var (
+		// Scratch buffers to hold the YCbCr values.
+		// The blocks are in natural (not zig-zag) order.
+		b      block
+		cb, cr [4]block
+	)
+	bounds := m.Bounds()
+	sw := (bounds.Dx() + 7) / 8
+	sh := (bounds.Dy() + 7) / 8
+	switch m := m.(type) {
+	// TODO(wathiede): switch on m.ColorModel() instead of type.
+	case *image.Gray:
+		y := newComponent(sw, sh, sw, sh, quantIndexLuminance)
+		for by := 0; by < sh; by++ {
+			for bx := 0; bx < sw; bx++ {
+				p := image.Pt(bounds.Min.X+8*bx, bounds.Min.Y+8*by)
+				grayToY(m, p, &b)
+				e.quantize(y.at(bx, by), &b, quantIndexLuminance)
+			}
+		}
+		return []*component{y}
+	default:
+		rgba, _ := m.(*image.RGBA)
+		ycbcr, _ := m.(*image.YCbCr)
+		hs, vs := e.hs, e.vs
+		mw := (bounds.Dx() + 8*hs - 1) / (8 * hs)
+		mh := (bounds.Dy() + 8*vs - 1) / (8 * vs)
+		y := newComponent(hs*mw, vs*mh, sw, sh, quantIndexLuminance)
+		u := newComponent(mw, mh, mw, mh, quantIndexChrominance)
+		v := newComponent(mw, mh, mw, mh, quantIndexChrominance)
+		for my := 0; my < mh; my++ {
+			for mx := 0; mx < mw; mx++ {
+				for i := 0; i < hs*vs; i++ {
+					xOff := (i % hs) * 8
+					yOff := (i / hs) * 8
+					p := image.Pt(bounds.Min.X+8*hs*mx+xOff, bounds.Min.Y+8*vs*my+yOff)
+					if rgba != nil {
+						rgbaToYCbCr(rgba, p, &b, &cb[i], &cr[i])
+					} else if ycbcr != nil {
+						yCbCrToYCbCr(ycbcr, p, &b, &cb[i], &cr[i])
+					} else {
+						toYCbCr(m, p, &b, &cb[i], &cr[i])
+					}
+					e.quantize(y.at(hs*mx+i%hs, vs*my+i/hs), &b, quantIndexLuminance)
+				}
+				scale(&b, &cb, hs, vs)
+				e.quantize(u.at(mx, my), &b, quantIndexChrominance)
+				scale(&b, &cr, hs, vs)
+				e.quantize(v.at(mx, my), &b, quantIndexChrominance)
+			}
+		}
+		return []*component{y, u, v}
+	}
+}
+
+// writeScanHeader writes the SOS marker for a scan of the given components
+// (indexes into the frame's components) and spectral selection ss to se.
+// Successive approximation is not used, so Ah and Al are always zero.
+func (e *encoder) writeScanHeader(comps []int, ss, se uint8) {
+	e.writeMarkerHeader(sosMarker, 6+2*len(comps))
+	e.writeByte(uint8(len(comps)))
+	for _, i := range comps {
+		e.writeByte(uint8(i + 1))
+		// The luminance component uses DC table 0 and AC table 0, the
+		// chrominance components use DC table 1 and AC table 1.
+		e.writeByte("\x00\x11\x11"[i])
+	}
+	e.writeByte(ss)
+	e.writeByte(se)
+	e.writeByte(0x00)
+}
+
+// finishScan pads the last byte of a scan with 1's, so that the next scan
+// starts on a byte boundary.
+func (e *encoder) finishScan() {
+	if e.nBits > 0 {
+		n := 8 - e.nBits
+		e.emit(1<<n-1, n)
+	}
+}
+
+// writeDCScan writes the DC coefficients of all components in a single
+// interleaved scan.
+func (e *encoder) writeDCScan(comps []*component) {
+	idx := make([]int, len(comps))
+	for i := range idx {
+		idx[i] = i
+	}
+	e.writeScanHeader(idx, 0, 0)
+	prevDC := make([]int32, len(comps))
+	emit := func(i int, b *block) {
+		h := huffIndex(2*comps[i].q + 0)
+		e.emitHuffRLE(h, 0, b[0]-prevDC[i])
+		prevDC[i] = b[0]
+	}
+	if len(comps) == 1 {
+		// A scan of a single component is non-interleaved.
+		c := comps[0]
+		for y := 0; y < c.sh; y++ {
+			for x := 0; x < c.sw; x++ {
+				emit(0, c.at(x, y))
+			}
+		}
+	} else {
+		// Each MCU holds hs*vs luminance blocks then 1 block of each
+		// chrominance component.
+		hs, vs := e.hs, e.vs
+		for my := 0; my < comps[1].bh; my++ {
+			for mx := 0; mx < comps[1].bw; mx++ {
+				for i := 0; i < hs*vs; i++ {
+					emit(0, comps[0].at(hs*mx+i%hs, vs*my+i/hs))
+				}
+				emit(1, comps[1].at(mx, my))
+				emit(2, comps[2].at(mx, my))
+			}
+		}
+	}
+	e.finishScan()
+}
+
+// writeACScan writes the AC coefficients ss to se (in zig-zag order) of the
+// i'th component in a non-interleaved scan.
+func (e *encoder) writeACScan(c *component, i int, ss, se uint8) {
+	e.writeScanHeader([]int{i}, ss, se)
+	h := huffIndex(2*c.q + 1)
+	for y := 0; y < c.sh; y++ {
+		for x := 0; x < c.sw; x++ {
+			b := c.at(x, y)
+			runLength := int32(0)
+			for zig := int(ss); zig <= int(se); zig++ {
+				if ac := b[zig]; ac == 0 {
+					runLength++
+				} else {
+					for runLength > 15 {
+						e.emitHuff(h, 0xf0)
+						runLength -= 16
+					}
+					e.emitHuffRLE(h, runLength, ac)
+					runLength = 0
+				}
+			}
+			if runLength > 0 {
+				// End of band, for this block only.
+				e.emitHuff(h, 0x00)
+			}
+		}
+	}
+	e.finishScan()
+}
+
+// writeProgressive writes the image data as a sequence of progressive scans,
+// using spectral selection only: first the DC coefficients of all components,
+// then the low and high frequency AC coefficients of the luminance and the
+// AC coefficients of each chrominance component.
+func (e *encoder) writeProgressive(m image.Image) {
+	comps := e.components(m)
+	e.writeDCScan(comps)
+	e.writeACScan(comps[0], 0, 1, 5)
+	for i := 1; i < len(comps); i++ {
+		e.writeACScan(comps[i], i, 1, 63)
+	}
+	e.writeACScan(comps[0], 0, 6, 63)
+}
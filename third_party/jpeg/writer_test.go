@@ -0,0 +1,180 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	stdjpeg "image/jpeg"
+	"testing"
+)
+
+// sofMarker returns the Start Of Frame marker of the JPEG data b, or 0 if
+// there is none.
+func sofMarker(b []byte) byte {
+	for i := 2; i+4 <= len(b) && b[i] == 0xff; {
+		marker := b[i+1]
+		if marker == sof0Marker || marker == sof2Marker {
+			return marker
+		}
+		if marker == sosMarker {
+			break
+		}
+		i += 2 + (int(b[i+2])<<8 | int(b[i+3]))
+	}
+	return 0
+}
+
+func newTestImage(kind string, w, h int) image.Image {
+	r := image.Rect(0, 0, w, h)
+	switch kind {
+	case "gray":
+		m := image.NewGray(r)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				m.SetGray(x, y, color.Gray{uint8(x*7 + y*13)})
+			}
+		}
+		return m
+	case "ycbcr":
+		m := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				m.Y[m.YOffset(x, y)] = uint8(x*5 + y*3)
+				m.Cb[m.COffset(x, y)] = uint8(x * 11)
+				m.Cr[m.COffset(x, y)] = uint8(y * 17)
+			}
+		}
+		return m
+	case "rgba":
+		m := image.NewRGBA(r)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				m.Set(x, y, color.RGBA{uint8(x * 9), uint8(y * 5), uint8(x*y + 40), 255})
+			}
+		}
+		return m
+	default:
+		m := image.NewNRGBA(r)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				m.Set(x, y, color.NRGBA{uint8(y * 9), uint8(x * 5), uint8(x ^ y), 255})
+			}
+		}
+		return m
+	}
+}
+
+func TestEncode_Progressive(t *testing.T) {
+	sizes := []image.Point{{1, 1}, {8, 8}, {16, 16}, {17, 9}, {33, 47}, {100, 64}}
+	for _, kind := range []string{"gray", "ycbcr", "rgba", "nrgba"} {
+		for _, size := range sizes {
+			for _, quality := range []int{10, 75, 100} {
+				m := newTestImage(kind, size.X, size.Y)
+
+				baseline := new(bytes.Buffer)
+				if err := Encode(baseline, m, &Options{Quality: quality}); err != nil {
+					t.Fatalf("Encode(%s %v, baseline) returned error: %v", kind, size, err)
+				}
+				progressive := new(bytes.Buffer)
+				if err := Encode(progressive, m, &Options{Quality: quality, Progressive: true}); err != nil {
+					t.Fatalf("Encode(%s %v, progressive) returned error: %v", kind, size, err)
+				}
+
+				if got, want := sofMarker(baseline.Bytes()), byte(sof0Marker); got != want {
+					t.Errorf("%s %v q%d baseline SOF marker is %#x, want %#x", kind, size, quality, got, want)
+				}
+				if got, want := sofMarker(progressive.Bytes()), byte(sof2Marker); got != want {
+					t.Errorf("%s %v q%d progressive SOF marker is %#x, want %#x", kind, size, quality, got, want)
+				}
+
+				// Both encodings quantize the same coefficients, so they
+				// should decode to exactly the same pixels.
+				want, err := stdjpeg.Decode(baseline)
+				if err != nil {
+					t.Fatalf("error decoding %s %v q%d baseline: %v", kind, size, quality, err)
+				}
+				got, err := stdjpeg.Decode(progressive)
+				if err != nil {
+					t.Fatalf("error decoding %s %v q%d progressive: %v", kind, size, quality, err)
+				}
+				if !samePixels(got, want) {
+					t.Errorf("%s %v q%d progressive image differs from baseline", kind, size, quality)
+				}
+			}
+		}
+	}
+}
+
+func samePixels(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	r := a.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if a.At(x, y) != b.At(x, y) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestEncode_Subsampling(t *testing.T) {
+	tests := []struct {
+		subsampling Subsampling
+		want        image.YCbCrSubsampleRatio
+	}{
+		{Subsampling420, image.YCbCrSubsampleRatio420},
+		{Subsampling422, image.YCbCrSubsampleRatio422},
+		{Subsampling444, image.YCbCrSubsampleRatio444},
+	}
+	sizes := []image.Point{{1, 1}, {8, 8}, {17, 9}, {33, 47}}
+	for _, tt := range tests {
+		for _, kind := range []string{"ycbcr", "rgba", "nrgba"} {
+			for _, size := range sizes {
+				m := newTestImage(kind, size.X, size.Y)
+				var decoded [2]image.Image
+				for i, progressive := range []bool{false, true} {
+					buf := new(bytes.Buffer)
+					if err := Encode(buf, m, &Options{Quality: 90, Progressive: progressive, Subsampling: tt.subsampling}); err != nil {
+						t.Fatalf("Encode(%s %v, %v) returned error: %v", kind, size, tt.want, err)
+					}
+					got, err := stdjpeg.Decode(buf)
+					if err != nil {
+						t.Fatalf("error decoding %s %v %v: %v", kind, size, tt.want, err)
+					}
+					if ycbcr, ok := got.(*image.YCbCr); !ok || ycbcr.SubsampleRatio != tt.want {
+						t.Errorf("%s %v decoded as %T, want subsample ratio %v", kind, size, got, tt.want)
+					}
+					decoded[i] = got
+				}
+				if !samePixels(decoded[0], decoded[1]) {
+					t.Errorf("%s %v %v progressive image differs from baseline", kind, size, tt.want)
+				}
+			}
+		}
+	}
+
+	// alternating red and blue columns keep their colors without
+	// chroma subsampling
+	m := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			m.Set(x, y, []color.RGBA{{255, 0, 0, 255}, {0, 0, 255, 255}}[x%2])
+		}
+	}
+	buf := new(bytes.Buffer)
+	Encode(buf, m, &Options{Quality: 100, Subsampling: Subsampling444})
+	got, err := stdjpeg.Decode(buf)
+	if err != nil {
+		t.Fatalf("error decoding 4:4:4 image: %v", err)
+	}
+	if r, _, b, _ := got.At(4, 4).RGBA(); r>>8 < 200 || b>>8 > 55 {
+		t.Errorf("4:4:4 image has color %v at a red pixel", got.At(4, 4))
+	}
+}
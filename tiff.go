@@ -0,0 +1,193 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+
+	"golang.org/x/image/tiff" // also registers tiff decoder
+)
+
+func init() {
+	registerEncoder("tiff", encodeTIFF)
+}
+
+// TIFFCompression is the lossless compression applied to TIFF images.
+type TIFFCompression int
+
+// TIFF compression types.
+const (
+	TIFFUncompressed TIFFCompression = iota
+	TIFFDeflate
+	TIFFLZW
+)
+
+// encodeTIFF encodes m as a TIFF image with the compression in opt.  The
+// tiff encoder does not support LZW compression, so LZW images are encoded
+// uncompressed and then compressed by compressTIFFLZW.
+func encodeTIFF(w io.Writer, m image.Image, opt Options) error {
+	switch opt.TIFFCompression {
+	case TIFFDeflate:
+		return tiff.Encode(w, m, &tiff.Options{Compression: tiff.Deflate})
+	case TIFFLZW:
+		buf := new(bytes.Buffer)
+		if err := tiff.Encode(buf, m, nil); err != nil {
+			return err
+		}
+		b, err := compressTIFFLZW(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	return tiff.Encode(w, m, nil)
+}
+
+// TIFF tags and values, as specified in the TIFF 6.0 specification.
+const (
+	tiffTagCompression     = 259
+	tiffTagStripByteCounts = 279
+	tiffCompressionLZW     = 5
+)
+
+// tiffTypeSizes are the sizes in bytes of the values of the TIFF field types
+// written by the tiff encoder: BYTE, ASCII, SHORT, LONG, and RATIONAL.
+var tiffTypeSizes = []int{0, 1, 1, 2, 4, 8}
+
+var errTIFFLayout = errors.New("unexpected tiff layout")
+
+// compressTIFFLZW compresses the uncompressed TIFF image b, as written by the
+// tiff encoder, with LZW compression.  The encoder writes the pixels as a
+// single strip following the header, followed by the IFD and the values it
+// points to, so the IFD and its offsets are moved to follow the compressed
+// strip.
+func compressTIFFLZW(b []byte) ([]byte, error) {
+	if len(b) < 8 || string(b[:4]) != "II*\x00" {
+		return nil, errTIFFLayout
+	}
+	le := binary.LittleEndian
+	ifd := int(le.Uint32(b[4:]))
+	if ifd < 8 || ifd+2 > len(b) {
+		return nil, errTIFFLayout
+	}
+	n := int(le.Uint16(b[ifd:]))
+	if ifd+2+n*12+4 > len(b) {
+		return nil, errTIFFLayout
+	}
+
+	strip := lzwEncode(b[8:ifd])
+	newIFD := 8 + len(strip) + len(strip)%2 // IFDs begin on a word boundary
+	delta := newIFD - ifd
+
+	out := make([]byte, newIFD, newIFD+len(b)-ifd)
+	copy(out, b[:4])
+	le.PutUint32(out[4:], uint32(newIFD))
+	copy(out[8:], strip)
+	out = append(out, b[ifd:]...)
+	for i := 0; i < n; i++ {
+		e := out[newIFD+2+i*12:]
+		typ, count := int(le.Uint16(e[2:])), int(le.Uint32(e[4:]))
+		if typ >= len(tiffTypeSizes) {
+			return nil, errTIFFLayout
+		}
+		switch tag := le.Uint16(e); {
+		case tag == tiffTagCompression:
+			le.PutUint16(e[8:], tiffCompressionLZW)
+		case tag == tiffTagStripByteCounts:
+			le.PutUint32(e[8:], uint32(len(strip)))
+		case tiffTypeSizes[typ]*count > 4:
+			// values of more than 4 bytes follow the IFD
+			le.PutUint32(e[8:], uint32(int(le.Uint32(e[8:]))+delta))
+		}
+	}
+	return out, nil
+}
+
+// LZW codes and code widths, as specified in section 13 of the TIFF 6.0
+// specification.
+const (
+	lzwClear    = 256
+	lzwEOI      = 257
+	lzwFirst    = 258
+	lzwMinWidth = 9
+	lzwMaxWidth = 12
+
+	// the table is reset before it fills up, since decoders stop adding
+	// codes one code early
+	lzwMaxCode = 1<<lzwMaxWidth - 2
+)
+
+// lzwEncode compresses src with the variant of LZW used by TIFF, which
+// packs codes most significant bit first and increases the code width one
+// code earlier than GIF.
+func lzwEncode(src []byte) []byte {
+	var out []byte
+	var bits uint32
+	var nBits uint
+	width := uint(lzwMinWidth)
+	write := func(code int) {
+		bits = bits<<width | uint32(code)
+		nBits += width
+		for nBits >= 8 {
+			out = append(out, byte(bits>>(nBits-8)))
+			nBits -= 8
+		}
+	}
+
+	// table maps a code followed by a byte to the code of that string
+	table := make(map[int]int)
+	next := lzwFirst
+	// add assigns the next code, as decoders do after each code they read
+	add := func() {
+		next++
+		if next >= 1<<width && width < lzwMaxWidth {
+			width++
+		}
+	}
+
+	write(lzwClear)
+	if len(src) > 0 {
+		prefix := int(src[0])
+		for _, c := range src[1:] {
+			key := prefix<<8 | int(c)
+			if code, ok := table[key]; ok {
+				prefix = code
+				continue
+			}
+			write(prefix)
+			if next < lzwMaxCode {
+				table[key] = next
+				add()
+			} else {
+				write(lzwClear)
+				table = make(map[int]int)
+				next, width = lzwFirst, lzwMinWidth
+			}
+			prefix = int(c)
+		}
+		write(prefix)
+		add()
+	}
+	write(lzwEOI)
+	if nBits > 0 {
+		out = append(out, byte(bits<<(8-nBits)))
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/tiff/lzw"
+)
+
+func TestTransform_TIFF(t *testing.T) {
+	src := newImage(8, 8, red, green, blue, yellow)
+	buf := new(bytes.Buffer)
+	png.Encode(buf, src)
+
+	for _, c := range []TIFFCompression{TIFFUncompressed, TIFFLZW, TIFFDeflate} {
+		opt := Options{Format: "tiff", TIFFCompression: c}
+		out, err := Transform(buf.Bytes(), opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", opt, err)
+			continue
+		}
+		if got := imageContentType(out); got != "image/tiff" {
+			t.Errorf("Transform(%v) returned content type %q, want image/tiff", opt, got)
+		}
+		m, err := tiff.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("Transform(%v) returned invalid tiff: %v", opt, err)
+			continue
+		}
+		if !reflect.DeepEqual(imaging.Clone(m), src) {
+			t.Errorf("Transform(%v) did not preserve the image losslessly", opt)
+		}
+
+		// tiff input is encoded as tiff again
+		resized, err := Transform(out, Options{Width: 4})
+		if err != nil {
+			t.Errorf("Transform with tiff input returned unexpected error: %v", err)
+			continue
+		}
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(resized))
+		if err != nil || format != "tiff" {
+			t.Errorf("Transform with tiff input returned format %q, err %v; want tiff", format, err)
+		} else if cfg.Width != 4 {
+			t.Errorf("Transform with tiff input returned width %d, want 4", cfg.Width)
+		}
+	}
+}
+
+func TestLZWEncode(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 20000)
+	r.Read(random)
+	tests := [][]byte{
+		nil,
+		{0},
+		[]byte("TOBEORNOTTOBEORTOBEORNOT"),
+		bytes.Repeat([]byte{7}, 100000), // long runs of a single byte
+		random[:300],                    // crosses the 9 to 10 bit boundary
+		random,                          // resets the table
+	}
+
+	for i, src := range tests {
+		got, err := ioutil.ReadAll(lzw.NewReader(bytes.NewReader(lzwEncode(src)), lzw.MSB, 8))
+		if err != nil {
+			t.Errorf("%d. decoding lzwEncode output returned error: %v", i, err)
+			continue
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("%d. lzwEncode output decoded to %d bytes which differ from the %d byte input", i, len(got), len(src))
+		}
+	}
+}
+
+func TestEncodeTIFF_LZW(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 16, 9))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 3)
+	}
+	paletted := image.NewPaletted(image.Rect(0, 0, 5, 5), color.Palette{red, green, blue})
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i % 3)
+	}
+
+	for _, m := range []image.Image{gray, paletted, newImage(7, 3, red, green, blue)} {
+		buf := new(bytes.Buffer)
+		if err := encodeTIFF(buf, m, Options{TIFFCompression: TIFFLZW}); err != nil {
+			t.Errorf("encodeTIFF of %T returned error: %v", m, err)
+			continue
+		}
+		got, err := tiff.Decode(buf)
+		if err != nil {
+			t.Errorf("encodeTIFF of %T returned invalid tiff: %v", m, err)
+			continue
+		}
+		if !reflect.DeepEqual(imaging.Clone(got), imaging.Clone(m)) {
+			t.Errorf("encodeTIFF of %T did not preserve the image", m)
+		}
+	}
+}
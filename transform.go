@@ -16,67 +16,1244 @@ package imageproxy
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"image"
-	_ "image/gif" // register gif format
+	"image/color"
+	"image/draw"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
 
 	"github.com/disintegration/imaging"
-	"willnorris.com/go/gifresize"
+	"github.com/golang/glog"
+	_ "golang.org/x/image/webp" // register webp format
+	"willnorris.com/go/imageproxy/internal/metadata"
+	"willnorris.com/go/imageproxy/internal/webp"
+	tpjpeg "willnorris.com/go/imageproxy/third_party/jpeg"
 )
 
-// default compression quality of resized jpegs
+// default compression quality of resized jpegs and webps
 const defaultQuality = 95
 
-// resample filter used when resizing images
-var resampleFilter = imaging.Lanczos
+// Qualities are the compression qualities, from 1 to 100, that images are
+// encoded with in each output format when their Options do not specify a
+// quality.  Zero values use the package defaults: 95 for JPEG and WebP, and
+// the default of the encoder for AVIF.
+type Qualities struct {
+	JPEG int
+	WebP int
+	AVIF int
+}
+
+// quality returns the default quality of images encoded in format, or zero
+// to use the default of the encoder.
+func (q Qualities) quality(format string) int {
+	var quality int
+	switch format {
+	case "jpeg":
+		quality = q.JPEG
+	case "webp":
+		quality = q.WebP
+	case "avif":
+		return q.AVIF
+	}
+	if quality == 0 {
+		quality = defaultQuality
+	}
+	return quality
+}
+
+// or returns q with its zero qualities replaced by those of d.
+func (q Qualities) or(d Qualities) Qualities {
+	if q.JPEG == 0 {
+		q.JPEG = d.JPEG
+	}
+	if q.WebP == 0 {
+		q.WebP = d.WebP
+	}
+	if q.AVIF == 0 {
+		q.AVIF = d.AVIF
+	}
+	return q
+}
+
+// A TransformConfig holds the defaults used to transform images whose
+// Options do not specify them.  Each Proxy has its own TransformConfig, so
+// proxies with different defaults can serve requests concurrently, and a
+// TransformConfig may be used by multiple goroutines as long as it is not
+// modified.  The zero value uses the package defaults.
+type TransformConfig struct {
+	// Quality holds the qualities that images are encoded with in each
+	// output format, if their Options do not specify a quality.
+	Quality Qualities
+
+	// Filter is the name of the resampling filter used to resize images
+	// if their Options do not specify one, such as "box".  It accepts the
+	// same names as Options.Filter, and the empty string uses Lanczos.
+	Filter string
+
+	// AllowPartial allows JPEG images which can not be fully decoded,
+	// such as truncated ones, to be transformed as far as they can be
+	// decoded, rather than returning an ErrDecode error.  The missing
+	// part of the image is filled in from the decoded part.
+	AllowPartial bool
+
+	// TransformFunc, if not nil, is called to apply custom transformations
+	// to images after the built-in transformations of their Options, and
+	// before they are encoded.  It is called for each frame of animated
+	// images.  Images which are not transformed at all, because their
+	// Options do not request any transformation, are not passed to it.
+	TransformFunc TransformFunc
+}
+
+// A TransformFunc applies custom transformations to the image m, which has
+// already been transformed as specified by opt, such as a filter which is not
+// built in.  It must not modify m, which may be shared, and should return a
+// new image instead.
+type TransformFunc func(m image.Image, opt Options) image.Image
+
+// transformFuncKey is the context key of the TransformFunc of the
+// TransformConfig used by transformStream.  It is passed in the context so
+// that transformImageContext can apply it to each frame of animated images,
+// without passing it through every function which decodes them.
+type transformFuncKey struct{}
+
+// options returns opt with the defaults in c applied to it.  Qualities
+// depend on the output format, so they are applied when encoding instead.
+func (c TransformConfig) options(opt Options) Options {
+	if opt.Filter == "" {
+		opt.Filter = c.Filter
+	}
+	return opt
+}
+
+// images downscaled below autoSharpenRatio of their original size are
+// sharpened with autoSharpenSigma by the AutoSharpen option
+const (
+	autoSharpenRatio = 0.5
+	autoSharpenSigma = 0.5
+)
+
+// defaultFilter is the name of the resampling filter used to resize images
+// if neither their Options nor the TransformConfig specify one.
+const defaultFilter = "lanczos"
+
+// resampleFilters are the resample filters selected by Options.Filter.
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"linear":     imaging.Linear,
+	"box":        imaging.Box,
+	"nearest":    imaging.NearestNeighbor,
+}
+
+// resampleFilter returns the resampling filter named name, or the default
+// filter if name is empty.
+func resampleFilter(name string) imaging.ResampleFilter {
+	if f, ok := resampleFilters[name]; ok {
+		return f
+	}
+	return resampleFilters[defaultFilter]
+}
+
+// MaxPixels is the maximum number of pixels (width * height) of images that
+// will be transformed.  Larger images are rejected before being decoded, to
+// protect against decompression bombs.  If zero or negative, images of any
+// size are transformed.
+var MaxPixels = 50 * 1000 * 1000
+
+// MaxFrames is the maximum number of frames of animated GIFs and WebP images
+// that will be transformed.  The total number of pixels of all frames is
+// also limited by MaxPixels.  Animations exceeding either limit are
+// rejected, unless TruncateFrames is true.  If zero or negative, animations
+// with any number of frames are transformed.
+var MaxFrames = 500
+
+// TruncateFrames specifies whether animated GIFs and WebP images exceeding
+// MaxFrames or MaxPixels are truncated to the frames within the limits,
+// rather than rejected.
+var TruncateFrames = false
+
+// MaxDPR is the largest device pixel ratio that Width and Height are
+// multiplied by.  Larger ratios are reduced to it.  If zero or negative,
+// ratios are not limited.
+var MaxDPR = 4.0
+
+// jpegSubsampling maps the values of Options.Subsampling to the chroma
+// subsampling ratios of the jpeg encoder.
+var jpegSubsampling = map[int]tpjpeg.Subsampling{
+	420: tpjpeg.Subsampling420,
+	422: tpjpeg.Subsampling422,
+	444: tpjpeg.Subsampling444,
+}
+
+// encodeFunc encodes the image m to w using the options in opt.
+type encodeFunc func(w io.Writer, m image.Image, opt Options) error
+
+// encoders holds the encoders for additional image formats, some of which
+// are only available when imageproxy is built with the appropriate build
+// tags.
+var encoders = make(map[string]encodeFunc)
+
+// registerEncoder registers an encoder for the named image format.  The
+// format can then be used as an output format, and images decoded in that
+// format are re-encoded using it.
+func registerEncoder(format string, fn encodeFunc) {
+	encoders[format] = fn
+}
 
 // Transform the provided image.  img should contain the raw bytes of an
-// encoded image in one of the supported formats (gif, jpeg, or png).  The
-// bytes of a similarly encoded image is returned.
+// encoded image in one of the supported formats (gif, jpeg, png, or webp).
+// The bytes of a similarly encoded image is returned, except for still webp
+// images which are encoded as png, unless a different output format is
+// specified in opt.Format.  Images which can not be transformed because of
+// their format, content, or size result in a *TransformError.
 func Transform(img []byte, opt Options) ([]byte, error) {
+	return TransformContext(context.Background(), img, opt)
+}
+
+// TransformContext is like Transform, but stops transforming the image if
+// ctx is canceled, returning ctx.Err().  The context is checked between each
+// stage of the transformation, and between the frames of animated GIFs.
+func TransformContext(ctx context.Context, img []byte, opt Options) ([]byte, error) {
+	return TransformConfig{}.TransformContext(ctx, img, opt)
+}
+
+// Transform is like the package function Transform, but uses the defaults
+// in c for anything opt does not specify.
+func (c TransformConfig) Transform(img []byte, opt Options) ([]byte, error) {
+	return c.TransformContext(context.Background(), img, opt)
+}
+
+// TransformContext is like the package function TransformContext, but uses
+// the defaults in c for anything opt does not specify.
+func (c TransformConfig) TransformContext(ctx context.Context, img []byte, opt Options) ([]byte, error) {
+	return transformContext(ctx, img, opt, c, nil)
+}
+
+// TransformMany transforms img as specified by each of opts, such as to
+// create thumbnails of several sizes, and returns the transformed images in
+// the same order.  Each is the same as the result of calling Transform with
+// the corresponding options, including its output format, but still images
+// are only decoded once for all of them.  If any of the transformations
+// fail, the error of the first is returned.
+func TransformMany(img []byte, opts []Options) ([][]byte, error) {
+	return TransformConfig{}.TransformMany(img, opts)
+}
+
+// TransformMany is like the package function TransformMany, but uses the
+// defaults in c for anything opts do not specify.
+func (c TransformConfig) TransformMany(img []byte, opts []Options) ([][]byte, error) {
+	d := new(decodeCache)
+	out := make([][]byte, len(opts))
+	for i, opt := range opts {
+		b, err := transformContext(context.Background(), img, opt, c, d)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = b
+	}
+	return out, nil
+}
+
+// decodeCache holds the still image decoded from an encoded image, so that
+// transforming it with several Options only decodes it once.  The decoded
+// image can be shared because transformImage never modifies its source.
+type decodeCache struct {
+	m    image.Image
+	err  error
+	done bool
+}
+
+// decode returns the image decoded from r by decodeStill, only decoding it
+// the first time it is called.  Later calls return the same image, without
+// reading r.  A nil decodeCache decodes r every time.
+func (d *decodeCache) decode(r io.Reader, partial bool) (image.Image, error) {
+	if d == nil {
+		return decodeStill(r, partial)
+	}
+	if !d.done {
+		d.m, d.err = decodeStill(r, partial)
+		d.done = true
+	}
+	return d.m, d.err
+}
+
+// decodeStill decodes the still image read from r.  If partial is true, JPEG
+// images which can not be decoded are decoded again as if the data after the
+// point of failure were zero, which continues the last decoded colors, and
+// the image is returned if that succeeds.
+func decodeStill(r io.Reader, partial bool) (image.Image, error) {
+	if !partial {
+		m, _, err := image.Decode(r)
+		return m, err
+	}
+	raw := new(bytes.Buffer)
+	m, format, err := image.Decode(io.TeeReader(r, raw))
+	if err == nil || format != "jpeg" {
+		return m, err
+	}
+	cfg, cerr := jpeg.DecodeConfig(bytes.NewReader(raw.Bytes()))
+	if cerr != nil {
+		return nil, err
+	}
+	// every 8x8 block of each color component needs fewer than 32 bits of
+	// zeros, so a quarter of a byte per pixel is enough padding
+	padding := int64(cfg.Width)*int64(cfg.Height)/4 + 1024
+	pm, perr := jpeg.Decode(io.MultiReader(
+		bytes.NewReader(raw.Bytes()), r,
+		io.LimitReader(zeroReader{}, padding),
+		bytes.NewReader([]byte{0xff, 0xd9}), // end of image marker
+	))
+	if perr != nil {
+		return nil, err
+	}
+	glog.Warningf("transforming partially decoded jpeg image: %v", err)
+	return pm, nil
+}
+
+// zeroReader is an io.Reader which reads an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// transformContext is like TransformContext, but uses the defaults in c for
+// anything opt does not specify.  Still images are decoded using d, which
+// may be nil.
+func transformContext(ctx context.Context, img []byte, opt Options, c TransformConfig, d *decodeCache) ([]byte, error) {
 	if !opt.transform() {
 		// bail if no transformation was requested
+		if opt.StripMetadata || opt.StripGPS || opt.DPI != 0 {
+			return processMetadata(img, img, opt)
+		}
 		return img, nil
 	}
 
-	// decode image
-	m, format, err := image.Decode(bytes.NewReader(img))
+	buf := new(bytes.Buffer)
+	if err := transformStream(ctx, buf, bytes.NewReader(img), opt, c, d); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	out, err := processMetadata(img, buf.Bytes(), opt)
 	if err != nil {
 		return nil, err
 	}
+	if opt.Optimize && len(out) > len(img) && keepOriginal(img, opt) {
+		// re-encoding the unchanged pixels made the image larger
+		if orig, err := processMetadata(img, img, opt); err == nil && len(orig) < len(out) {
+			return orig, nil
+		}
+	}
+	return out, nil
+}
 
-	// transform and encode image
-	buf := new(bytes.Buffer)
-	switch format {
-	case "gif":
-		fn := func(img image.Image) image.Image {
-			return transformImage(img, opt)
+// keepOriginal returns whether the encoded image img may be returned instead
+// of transforming it with opt, because opt only changes how it is encoded,
+// and img is in a format that the optimize option could have chosen.
+func keepOriginal(img []byte, opt Options) bool {
+	if _, ok := optimizedFormats[opt.Format]; opt.Format != "" && !ok {
+		return false
+	}
+	if !opt.encodeOnly() || isSVG(img) {
+		return false
+	}
+	_, format, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		return false
+	}
+	_, ok := optimizedFormats[format]
+	return ok || format == "gif"
+}
+
+// TransformStream is like Transform, but reads the encoded image from r and
+// writes the transformed image to w, without holding either of them in
+// memory in their entirety.  Only the decoded image is held in memory, along
+// with the header bytes read while checking its dimensions.
+//
+// Some options still require the full image: stripping metadata, setting the
+// DPI, optimizing, or preserving the color profile or EXIF metadata reads all
+// of r and buffers the output before writing it to w, and GIFs are always
+// read fully to decode all of their frames.  If an error is returned, part of
+// the transformed image may already have been written to w.
+func TransformStream(w io.Writer, r io.Reader, opt Options) error {
+	return TransformConfig{}.TransformStream(w, r, opt)
+}
+
+// TransformStream is like the package function TransformStream, but uses
+// the defaults in c for anything opt does not specify.
+func (c TransformConfig) TransformStream(w io.Writer, r io.Reader, opt Options) error {
+	if opt.StripMetadata || opt.PreserveColorProfile || opt.PreserveEXIF || opt.StripGPS || opt.DPI != 0 || opt.Optimize {
+		img, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
 		}
-		err = gifresize.Process(buf, bytes.NewReader(img), fn)
+		out, err := c.Transform(img, opt)
 		if err != nil {
-			return nil, err
+			return err
 		}
-	case "jpeg":
-		quality := opt.Quality
+		_, err = w.Write(out)
+		return err
+	}
+
+	if !opt.transform() {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	return transformStream(context.Background(), w, r, opt, c, nil)
+}
+
+// sniffImage returns an ErrNotAnImage error if the leading bytes b of an
+// encoded image are clearly not an image, such as an html error page.  Only
+// the first 512 bytes of b are considered.
+func sniffImage(b []byte) error {
+	if contentType := http.DetectContentType(b); len(b) > 0 && !isImageContentType(contentType) {
+		return &TransformError{ErrNotAnImage, fmt.Errorf("detected content type %s", contentType)}
+	}
+	return nil
+}
+
+// checkPixels returns an ErrTooLarge error if an image with the given config
+// exceeds MaxPixels.
+func checkPixels(cfg image.Config) error {
+	if MaxPixels > 0 && int64(cfg.Width)*int64(cfg.Height) > int64(MaxPixels) {
+		return &TransformError{ErrTooLarge, fmt.Errorf("image dimensions %dx%d exceed limit of %d pixels", cfg.Width, cfg.Height, MaxPixels)}
+	}
+	return nil
+}
+
+// checkCanvas returns an error if a canvas of w by h pixels, which a
+// transformation such as padding would draw the image onto, exceeds
+// MaxPixels.  Canvases are not limited by the size of the source image, so
+// small images could otherwise be padded to enormous sizes.
+func checkCanvas(w, h int) error {
+	if MaxPixels > 0 && int64(w)*int64(h) > int64(MaxPixels) {
+		return &TransformError{ErrTooLarge, fmt.Errorf("canvas dimensions %dx%d exceed limit of %d pixels", w, h, MaxPixels)}
+	}
+	return nil
+}
+
+// decodeImage decodes the first frame of the encoded image img, with the same
+// checks as Transform.  SVG images are rasterized at their intrinsic size.
+func decodeImage(img []byte) (image.Image, error) {
+	if isSVG(img) {
+		m, _, err := decodeSVG(img, Options{})
+		return m, err
+	}
+	if err := sniffImage(img); err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		return nil, decodeConfigError(img, err)
+	}
+	if err := checkPixels(cfg); err != nil {
+		return nil, err
+	}
+	var m image.Image
+	if webp.IsAnimated(img) {
+		m, err = webpFrame(bytes.NewReader(img))
+	} else {
+		m, _, err = image.Decode(bytes.NewReader(img))
+	}
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return convertCMYK(m), nil
+}
+
+// transformStream transforms the encoded image read from r as specified by
+// opt, and writes the encoded result to w.  Metadata options are not applied.
+// The defaults in c are used for anything opt does not specify, and still
+// images are decoded using d, which may be nil.
+func transformStream(ctx context.Context, w io.Writer, r io.Reader, opt Options, c TransformConfig, d *decodeCache) error {
+	opt = c.options(opt)
+	if err := opt.validate(); err != nil {
+		return err
+	}
+	if c.TransformFunc != nil {
+		ctx = context.WithValue(ctx, transformFuncKey{}, c.TransformFunc)
+	}
+
+	// reject content which is clearly not an image, such as html error
+	// pages, before trying to decode it.  SVG images are sniffed as text,
+	// and are rasterized instead.
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(r, sniff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	sniff = sniff[:n]
+	r = io.MultiReader(bytes.NewReader(sniff), r)
+	if isSVG(sniff) {
+		return transformSVG(ctx, w, r, opt, c.Quality)
+	}
+	if err := sniffImage(sniff); err != nil {
+		return err
+	}
+
+	// check image dimensions before allocating the full image.  The bytes
+	// read while decoding the config are read again to decode the image.
+	header := new(bytes.Buffer)
+	cfg, srcFormat, err := image.DecodeConfig(io.TeeReader(r, header))
+	if err != nil {
+		return decodeConfigError(header.Bytes(), err)
+	}
+	if err := checkPixels(cfg); err != nil {
+		return err
+	}
+	animated := srcFormat == "webp" && webp.IsAnimated(header.Bytes())
+	r = io.MultiReader(header, r)
+
+	// encode in the requested output format, if any
+	format := srcFormat
+	if opt.ExtractFrame && srcFormat == "gif" {
+		// extracted frames are not animated
+		format = "png"
+	}
+	if srcFormat == "heic" {
+		// heic images can only be decoded
+		format = "jpeg"
+	}
+	if opt.Format != "" {
+		format = opt.Format
+	}
+	// jpeg and bmp do not support transparency
+	if opt.transparent() && (format == "jpeg" || format == "bmp") {
+		format = "png"
+	}
+
+	// images which are already the requested size are returned unchanged,
+	// rather than being re-encoded in the same format, unless they may be
+	// changed by a TransformFunc.  Still webp images are encoded as png, so
+	// they are always changed.
+	if c.TransformFunc == nil && opt.resizeOnly() && format == srcFormat && (format != "webp" || animated) {
+		if _, _, resize := resizeParams(image.Rect(0, 0, cfg.Width, cfg.Height), opt); !resize {
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+
+	quality := opt.Quality
+	if quality == 0 {
+		quality = c.Quality.quality(format)
+	}
+	if opt.Lossless && !losslessFormats[format] {
+		glog.Warningf("lossless option has no effect on %s images", format)
+	}
+
+	// decode image.  Animated gifs are decoded frame by frame as they are
+	// transformed, unless a single frame is extracted.  Animated WebP images
+	// remain animated if they are encoded as WebP, and are otherwise reduced
+	// to their first frame.
+	var m image.Image
+	switch {
+	case opt.ExtractFrame && srcFormat == "gif":
+		m, err = gifFrame(r, opt.Frame)
+	case format == "gif":
+		return transformGIF(ctx, w, r, opt)
+	case format == "webp" && srcFormat == "gif":
+		return transformGIFToWebP(ctx, w, r, opt, quality)
+	case format == "webp" && animated:
+		return transformWebP(ctx, w, r, opt, quality)
+	case animated:
+		m, err = webpFrame(r)
+	default:
+		m, err = d.decode(r, c.AllowPartial)
+	}
+	if err != nil {
+		return decodeError(err)
+	}
+	m = convertCMYK(m)
+	if m, err = transformImageContext(ctx, m, opt); err != nil {
+		return err
+	}
+	if opt.Optimize {
+		return encodeSmallest(w, m, format, quality, opt)
+	}
+	return encodeImage(w, m, format, quality, opt)
+}
+
+// optimizedFormats are the output formats which the optimize option applies
+// to, and whether they are lossy.
+var optimizedFormats = map[string]bool{"jpeg": true, "png": false, "webp": true, "avif": true}
+
+// encodeSmallest encodes m as encodeImage does, and also as PNG and, if the
+// format is lossy and m is opaque, as JPEG, and writes the smallest encoding
+// to w.  Formats other than optimizedFormats are encoded as usual.
+func encodeSmallest(w io.Writer, m image.Image, format string, quality int, opt Options) error {
+	lossy, ok := optimizedFormats[format]
+	if !ok {
+		return encodeImage(w, m, format, quality, opt)
+	}
+	if lossy && opt.Lossless {
+		lossy = false
+	}
+
+	var best []byte
+	encode := func(format string, quality int, opt Options) error {
+		buf := new(bytes.Buffer)
+		if err := encodeImage(buf, m, format, quality, opt); err != nil {
+			return err
+		}
+		if best == nil || buf.Len() < len(best) {
+			best = buf.Bytes()
+		}
+		return nil
+	}
+	if err := encode(format, quality, opt); err != nil {
+		return err
+	}
+	if format != "png" {
+		// full color, so that the image is not changed further
+		if err := encode("png", 0, Options{PNGCompression: opt.PNGCompression}); err != nil {
+			return err
+		}
+	}
+	if o, ok := m.(interface{ Opaque() bool }); format != "jpeg" && lossy && ok && o.Opaque() {
 		if quality == 0 {
+			// the avif encoder default has no jpeg equivalent
 			quality = defaultQuality
 		}
+		if err := encode("jpeg", quality, Options{}); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(best)
+	return err
+}
 
-		m = transformImage(m, opt)
-		err = jpeg.Encode(buf, m, &jpeg.Options{Quality: quality})
-		if err != nil {
-			return nil, err
+// encodeImage encodes m in format with quality, and writes it to w.
+func encodeImage(w io.Writer, m image.Image, format string, quality int, opt Options) error {
+	switch format {
+	case "jpeg":
+		if opt.Progressive || opt.Subsampling != 0 {
+			return tpjpeg.Encode(w, m, &tpjpeg.Options{
+				Quality:     quality,
+				Progressive: opt.Progressive,
+				Subsampling: jpegSubsampling[opt.Subsampling],
+			})
 		}
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: quality})
 	case "png":
-		m = transformImage(m, opt)
-		err = png.Encode(buf, m)
+		return encodePNG(w, m, opt)
+	case "webp":
+		if opt.Format == "webp" {
+			return webp.Encode(w, m, &webp.Options{Quality: quality, Lossless: opt.Lossless})
+		}
+		// webp images are encoded as png by default, which
+		// preserves any transparency in the original image.
+		return encodePNG(w, m, opt)
+	default:
+		encode, ok := encoders[format]
+		if !ok {
+			return &TransformError{ErrUnsupportedFormat, fmt.Errorf("no encoder for %s images, supported output formats are: %s", format, strings.Join(SupportedOutputFormats(), ", "))}
+		}
+		opt.Quality = quality
+		return encode(w, m, opt)
+	}
+}
+
+// transformGIF transforms the GIF read from r as specified by opt, and
+// writes the encoded result to w.  Animated GIFs are transformed frame by
+// frame, while GIFs with a single frame are transformed as static images.
+// Each frame of an animated GIF is transformed as it is displayed, after all
+// previous frames have been drawn and disposed of, and the transformed
+// frames are then optimized again by optimizeGIF.
+func transformGIF(ctx context.Context, w io.Writer, r io.Reader, opt Options) error {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return decodeError(err)
+	}
+	if _, err := limitGIF(g); err != nil {
+		return err
+	}
+	if opt.transparent() {
+		transformGIFPalettes(g, transparentPalette)
+	}
+	// transformed frames are mapped back onto the palettes of the original
+	// frames, which must have the same colors adjusted
+	palette := func(p color.Palette) color.Palette {
+		if opt.adjustsColors() {
+			return adjustPalette(p, opt)
+		}
+		return p
+	}
+
+	if frame := g.Image[0]; len(g.Image) == 1 && frame.Bounds() == image.Rect(0, 0, g.Config.Width, g.Config.Height) {
+		m, err := transformImageContext(ctx, frame, opt)
+		if err != nil {
+			return err
+		}
+		return gif.Encode(w, palettedImage(m, palette(frame.Palette)), nil)
+	}
+
+	frames := make([]*image.Paletted, 0, len(g.Image))
+	err = composeGIF(g, len(g.Image), func(i int, m *image.NRGBA) error {
+		// m is drawn over by the following frames
+		frame, err := transformImageContext(ctx, imaging.Clone(m), opt)
+		if err != nil {
+			return err
+		}
+		frames = append(frames, palettedImage(frame, palette(g.Image[i].Palette)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	optimizeGIF(g, frames)
+	return gif.EncodeAll(w, g)
+}
+
+// optimizeGIF replaces the frames of g with frames, which each show the
+// whole canvas of the animation, and sets their disposal methods.  Frames
+// which are drawn over the previous frame are cropped to the part of the
+// canvas they change.  A frame which makes part of the previous frame
+// transparent must be drawn over an empty canvas instead, so the previous
+// frame is kept whole and disposed of to the background.  Frames of
+// different sizes, such as trimmed frames, are each drawn over an empty
+// canvas.
+func optimizeGIF(g *gif.GIF, frames []*image.Paletted) {
+	n := len(frames)
+	b := frames[0].Bounds()
+	g.Image = frames
+	g.Disposal = make([]byte, n)
+	g.Config.Width, g.Config.Height = b.Dx(), b.Dy()
+
+	// empty[i] is whether frame i must be drawn over an empty canvas.  The
+	// first frame is drawn over the last when the animation loops.
+	empty := make([]bool, n)
+	for i, m := range frames {
+		prev := frames[(i+n-1)%n]
+		empty[i] = m.Bounds() != b || prev.Bounds() != b || revealsGIFFrame(prev, m)
+	}
+	for i, m := range frames {
+		next := (i + 1) % n
+		if empty[next] {
+			g.Disposal[i] = gif.DisposalBackground
+		} else {
+			g.Disposal[i] = gif.DisposalNone
+		}
+		if i > 0 && !empty[i] && !empty[next] {
+			g.Image[i] = cropGIFFrame(frames[i-1], m)
+		}
+	}
+}
+
+// revealsGIFFrame returns whether any transparent pixel of the frame m
+// differs from the frame prev of the same size, which would show through it
+// if m were drawn over prev.
+func revealsGIFFrame(prev, m *image.Paletted) bool {
+	pc, mc := paletteRGBA(prev.Palette), paletteRGBA(m.Palette)
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := mc[m.Pix[m.PixOffset(x, y)]]
+			if c[3] == 0 && c != pc[prev.Pix[prev.PixOffset(x, y)]] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cropGIFFrame returns the frame m cropped to the smallest rectangle
+// containing all of its pixels which differ from the frame prev of the same
+// size.  If no pixels differ, a single pixel is returned.
+func cropGIFFrame(prev, m *image.Paletted) *image.Paletted {
+	pc, mc := paletteRGBA(prev.Palette), paletteRGBA(m.Palette)
+	b := m.Bounds()
+	var r image.Rectangle
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if mc[m.Pix[m.PixOffset(x, y)]] != pc[prev.Pix[prev.PixOffset(x, y)]] {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if r.Empty() {
+		r = image.Rect(b.Min.X, b.Min.Y, b.Min.X+1, b.Min.Y+1)
+	}
+	return m.SubImage(r).(*image.Paletted)
+}
+
+// paletteRGBA returns the alpha-premultiplied colors of p, which are the
+// same for all fully transparent colors, indexed by every possible pixel
+// value of a paletted image.  Indexes past the end of p are transparent.
+func paletteRGBA(p color.Palette) [256][4]uint32 {
+	var colors [256][4]uint32
+	for i, c := range p {
+		if i >= len(colors) {
+			break
+		}
+		r, g, b, a := c.RGBA()
+		colors[i] = [4]uint32{r, g, b, a}
+	}
+	return colors
+}
+
+// gifFrame decodes the gif read from r and returns frame n, as it is
+// displayed after all previous frames have been drawn and disposed of.  If n
+// is past the last frame, the last frame is returned.
+func gifFrame(r io.Reader, n int) (image.Image, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	if n >= len(g.Image) {
+		n = len(g.Image) - 1
+	}
+
+	var frame image.Image
+	err = composeGIF(g, n+1, func(i int, m *image.NRGBA) error {
+		frame = m
+		return nil
+	})
+	return frame, err
+}
+
+// transformGIFToWebP transforms each frame of the GIF read from r as
+// specified by opt, and writes them to w as an animated WebP image with the
+// same frame delays and loop count.  If the frames cannot be encoded as
+// WebP, the GIF is transformed as an animated GIF instead.
+func transformGIFToWebP(ctx context.Context, w io.Writer, r io.Reader, opt Options, quality int) error {
+	img, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(img))
+	if err != nil {
+		return decodeError(err)
+	}
+	if _, err := limitGIF(g); err != nil {
+		return err
+	}
+
+	a := &webp.Animation{LoopCount: webpLoopCount(g.LoopCount)}
+	err = composeGIF(g, len(g.Image), func(i int, m *image.NRGBA) error {
+		// m is drawn over by the following frames
+		frame, err := transformImageContext(ctx, imaging.Clone(m), opt)
+		if err != nil {
+			return err
+		}
+		a.Image = append(a.Image, frame)
+		a.Delay = append(a.Delay, g.Delay[i]*10) // milliseconds
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	if len(a.Image) == 1 {
+		err = webp.Encode(buf, a.Image[0], &webp.Options{Quality: quality, Lossless: opt.Lossless})
+	} else {
+		err = webp.EncodeAll(buf, a, &webp.Options{Quality: quality, Lossless: opt.Lossless})
+	}
+	if err != nil {
+		glog.Warningf("encoding animated webp, falling back to gif: %v", err)
+		return transformGIF(ctx, w, bytes.NewReader(img), opt)
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// transformWebP transforms each frame of the animated WebP image read from r
+// as specified by opt, and writes them to w as an animated WebP image with
+// the same frame delays and loop count.
+func transformWebP(ctx context.Context, w io.Writer, r io.Reader, opt Options, quality int) error {
+	img, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	cfg, frames, err := webp.DecodeAnimationConfig(img)
+	if err != nil {
+		return decodeError(err)
+	}
+	n := frameLimit(frames, cfg.Width, cfg.Height)
+	if n < frames && !TruncateFrames {
+		return &TransformError{ErrTooLarge, fmt.Errorf("webp with %d frames of %dx%d exceeds limit of %d frames and %d total pixels", frames, cfg.Width, cfg.Height, MaxFrames, MaxPixels)}
+	}
+	if n < 1 {
+		// canvases exceeding MaxPixels are rejected by checkPixels, so
+		// there is always at least one frame to decode
+		n = 1
+	}
+	a, err := webp.DecodeAll(img, n)
+	if err != nil {
+		return decodeError(err)
+	}
+	for i, m := range a.Image {
+		if a.Image[i], err = transformImageContext(ctx, m, opt); err != nil {
+			return err
+		}
+	}
+
+	if len(a.Image) == 1 {
+		return webp.Encode(w, a.Image[0], &webp.Options{Quality: quality, Lossless: opt.Lossless})
+	}
+	return webp.EncodeAll(w, a, &webp.Options{Quality: quality, Lossless: opt.Lossless})
+}
+
+// webpFrame decodes the first frame of the animated WebP image read from r.
+func webpFrame(r io.Reader) (image.Image, error) {
+	img, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	a, err := webp.DecodeAll(img, 1)
+	if err != nil {
+		return nil, err
+	}
+	return a.Image[0], nil
+}
+
+// webpLoopCount converts the loop count of a gif, which is the number of
+// times the animation is repeated after it is first played, to the number of
+// times a WebP animation is played.  Both use 0 to loop forever.
+func webpLoopCount(n int) int {
+	switch {
+	case n == 0:
+		return 0
+	case n < 0:
+		return 1
+	case n >= 0xffff:
+		return 0xffff
+	}
+	return n + 1
+}
+
+// composeGIF calls fn with each of the first n frames of g, as it is
+// displayed after all previous frames have been drawn and disposed of.  The
+// image passed to fn is drawn over by the following frames.
+func composeGIF(g *gif.GIF, n int, fn func(i int, m *image.NRGBA) error) error {
+	m := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image[:n] {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = imaging.Clone(m)
+		}
+
+		b := frame.Bounds()
+		draw.Draw(m, b, frame, b.Min, draw.Over)
+		if err := fn(i, m); err != nil {
+			return err
+		}
+		if i == n-1 {
+			break
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(m, b, image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			m = previous
+		}
+	}
+	return nil
+}
+
+// limitGIF applies MaxFrames and MaxPixels to the animated gif g, returning
+// an error if it exceeds them.  If TruncateFrames is true, g is truncated to
+// the frames within the limits instead, and limitGIF returns whether it was
+// truncated.
+func limitGIF(g *gif.GIF) (bool, error) {
+	n := gifFrameLimit(g)
+	if n >= len(g.Image) {
+		return false, nil
+	}
+	if !TruncateFrames {
+		return false, &TransformError{ErrTooLarge, fmt.Errorf("gif with %d frames of %dx%d exceeds limit of %d frames and %d total pixels", len(g.Image), g.Config.Width, g.Config.Height, MaxFrames, MaxPixels)}
+	}
+	truncateGIF(g, n)
+	return true, nil
+}
+
+// gifFrameLimit returns the number of frames of the animated gif g which
+// are within MaxFrames, and whose total number of pixels is within
+// MaxPixels.  Each frame is transformed at the full size of the gif.
+func gifFrameLimit(g *gif.GIF) int {
+	return frameLimit(len(g.Image), g.Config.Width, g.Config.Height)
+}
+
+// frameLimit returns the number of the first n frames of an animation with
+// a canvas of size w by h which are within MaxFrames, and whose total number
+// of pixels is within MaxPixels.
+func frameLimit(n, w, h int) int {
+	if MaxFrames > 0 && n > MaxFrames {
+		n = MaxFrames
+	}
+	if size := int64(w) * int64(h); MaxPixels > 0 && size > 0 {
+		if max := int64(MaxPixels) / size; int64(n) > max {
+			n = int(max)
+		}
+	}
+	return n
+}
+
+// truncateGIF removes all but the first n frames of g.
+func truncateGIF(g *gif.GIF, n int) {
+	g.Image = g.Image[:n]
+	if len(g.Delay) > n {
+		g.Delay = g.Delay[:n]
+	}
+	if len(g.Disposal) > n {
+		g.Disposal = g.Disposal[:n]
+	}
+}
+
+// palettedImage returns m mapped onto the palette p, the same way that the
+// frames of animated GIFs are mapped onto their original palettes.
+// Paletted images which already use p are returned unchanged.
+func palettedImage(m image.Image, p color.Palette) *image.Paletted {
+	if pm, ok := m.(*image.Paletted); ok && samePalette(pm.Palette, p) {
+		return pm
+	}
+	b := m.Bounds()
+	pm := image.NewPaletted(b, p)
+	draw.FloydSteinberg.Draw(pm, b, m, b.Min)
+	return pm
+}
+
+// samePalette returns whether palettes a and b contain the same colors.
+func samePalette(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		r1, g1, b1, a1 := a[i].RGBA()
+		r2, g2, b2, a2 := b[i].RGBA()
+		if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+			return false
+		}
+	}
+	return true
+}
+
+// transformImageContext transforms m as specified by opt, followed by any
+// TransformFunc in ctx, and returns ctx.Err() if ctx is canceled before or
+// during the transformation.
+func transformImageContext(ctx context.Context, m image.Image, opt Options) (image.Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m, err := transformImage(m, opt)
+	if err != nil {
+		return nil, err
+	}
+	if fn, ok := ctx.Value(transformFuncKey{}).(TransformFunc); ok {
+		m = fn(m, opt)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// convertCMYK converts CMYK images to NRGBA, so that they are transformed
+// and encoded as RGB images.  The image/jpeg decoder returns CMYK images for
+// both CMYK and YCCK jpegs, after applying the color transform and inversion
+// specified by any Adobe APP14 marker, so the colors of the converted image
+// match the original.  Images in other color models are returned unchanged.
+func convertCMYK(m image.Image) image.Image {
+	if _, ok := m.(*image.CMYK); !ok {
+		return m
+	}
+	return imaging.Clone(m)
+}
+
+// encodePNG encodes m to w as a PNG image, using the compression level
+// specified in opt.  If opt specifies a quality below 100, and does not
+// request lossless encoding, the image is quantized to a paletted image, with
+// fewer colors at lower qualities, which is dithered if opt.Dither is true.
+func encodePNG(w io.Writer, m image.Image, opt Options) error {
+	if n := pngPaletteSize(opt.Quality); n > 0 && !opt.Lossless {
+		m = quantize(m, n, opt.Dither)
+	}
+	enc := png.Encoder{CompressionLevel: opt.PNGCompression}
+	return enc.Encode(w, m)
+}
+
+// orientation returns the EXIF orientation of the encoded image img in the
+// named format, from 1 to 8, and whether it has one.  The orientation of
+// JPEG, PNG, and WebP images is read from their embedded EXIF data, and that
+// of TIFF images from their first IFD.  HEIC images are decoded upright, so
+// they have no orientation left to apply.
+func orientation(img []byte, format string) (int, bool) {
+	switch format {
+	case "jpeg", "png", "webp":
+		exif, err := metadata.EXIF(img)
+		if err != nil {
+			return 0, false
+		}
+		return metadata.Orientation(exif)
+	case "tiff":
+		return metadata.Orientation(img)
+	}
+	return 0, false
+}
+
+// processMetadata applies the metadata related options in opt to out, the
+// encoded result of transforming the original image src.
+func processMetadata(src, out []byte, opt Options) ([]byte, error) {
+	var err error
+	if opt.StripMetadata {
+		out, err = metadata.Strip(out)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return buf.Bytes(), nil
+	if opt.PreserveColorProfile {
+		profile, err := metadata.ICCProfile(src)
+		if err != nil {
+			glog.Warningf("dropping color profile: %v", err)
+			return out, nil
+		}
+		if profile != nil {
+			if b, err := metadata.SetICCProfile(out, profile); err != nil {
+				glog.Warningf("dropping color profile: %v", err)
+			} else {
+				out = b
+			}
+		}
+	}
+
+	if opt.PreserveEXIF {
+		exif, err := metadata.EXIF(src)
+		_, format, _ := image.DecodeConfig(bytes.NewReader(src))
+		if o, ok := orientation(src, format); err == nil && ok && o != 1 {
+			// the orientation is not applied to the transformed
+			// image, so it must not be applied by viewers either
+			exif, err = metadata.SetOrientation(exif, 1)
+		}
+		if err == nil && exif != nil {
+			var b []byte
+			if b, err = metadata.SetEXIF(out, exif); err == nil {
+				out = b
+			}
+		}
+		if err != nil {
+			glog.Warningf("dropping EXIF data: %v", err)
+		}
+	}
+
+	if opt.DPI != 0 {
+		b, err := metadata.SetDPI(out, opt.DPI)
+		if err != nil {
+			glog.Warningf("not setting DPI: %v", err)
+		} else {
+			out = b
+		}
+	}
+
+	if opt.StripGPS {
+		exif, err := metadata.EXIF(out)
+		if err == nil && exif != nil {
+			var b []byte
+			if exif, err = metadata.StripGPS(exif); err == nil {
+				if b, err = metadata.SetEXIF(out, exif); err == nil {
+					out = b
+				}
+			}
+		}
+		if err != nil {
+			// rather than risk leaking the location, drop all
+			// metadata that cannot be parsed
+			glog.Warningf("dropping metadata: %v", err)
+			return metadata.Strip(out)
+		}
+	}
+
+	return out, nil
+}
+
+// evaluateFloat interprets the option value f relative to the size max.
+// Values between 0 and 1 are percentages of max, rounded to the nearest pixel
+// but at least 1 if max is not zero.  A value of exactly 1 is a single pixel,
+// other positive values are absolute pixel values, and negative values are
+// treated as 0.
+func evaluateFloat(f float64, max int) int {
+	if 0 < f && f < 1 {
+		if max <= 0 {
+			return 0
+		}
+		return int(math.Max(1, math.Round(float64(max)*f)))
+	}
+	if f < 0 {
+		return 0
+	}
+	return int(f)
+}
+
+// evaluateSize interprets the Width or Height option value f relative to the
+// size max, like evaluateFloat, or as a percentage of max if percent is true.
+func evaluateSize(f float64, percent bool, max int) int {
+	if !percent {
+		return evaluateFloat(f, max)
+	}
+	if f <= 0 || max <= 0 {
+		return 0
+	}
+	return int(math.Max(1, math.Round(float64(max)*f/100)))
+}
+
+// cropOffset interprets the crop offset f relative to the size max, like
+// evaluateFloat, except that negative values are offsets from the end of max
+// rather than its start, clamped to the start.
+func cropOffset(f float64, max int) int {
+	if f >= 0 {
+		return evaluateFloat(f, max)
+	}
+	if n := max - evaluateFloat(-f, max); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// cropParams determines the rectangle of m to crop to, clamped to the bounds
+// of m.
+func cropParams(m image.Image, opt Options) image.Rectangle {
+	b := m.Bounds()
+	if b.Empty() {
+		return b
+	}
+	imgW, imgH := b.Dx(), b.Dy()
+
+	x0 := cropOffset(opt.CropX, imgW)
+	y0 := cropOffset(opt.CropY, imgH)
+	if x0 >= imgW {
+		x0 = imgW - 1
+	}
+	if y0 >= imgH {
+		y0 = imgH - 1
+	}
+
+	w := evaluateFloat(opt.CropWidth, imgW)
+	h := evaluateFloat(opt.CropHeight, imgH)
+	if w == 0 || x0+w > imgW {
+		w = imgW - x0
+	}
+	if h == 0 || y0+h > imgH {
+		h = imgH - y0
+	}
+
+	return image.Rect(x0, y0, x0+w, y0+h).Add(b.Min)
 }
 
 // resizeParams determines if the image needs to be resized, and if so, the
@@ -85,20 +1262,9 @@ func resizeParams(m image.Image, opt Options) (w, h int, resize bool) {
 	// convert percentage width and height values to absolute values
 	imgW := m.Bounds().Max.X - m.Bounds().Min.X
 	imgH := m.Bounds().Max.Y - m.Bounds().Min.Y
-	if 0 < opt.Width && opt.Width < 1 {
-		w = int(float64(imgW) * opt.Width)
-	} else if opt.Width < 0 {
-		w = 0
-	} else {
-		w = int(opt.Width)
-	}
-	if 0 < opt.Height && opt.Height < 1 {
-		h = int(float64(imgH) * opt.Height)
-	} else if opt.Height < 0 {
-		h = 0
-	} else {
-		h = int(opt.Height)
-	}
+	w = evaluateSize(opt.Width, opt.WidthPercent, imgW)
+	h = evaluateSize(opt.Height, opt.HeightPercent, imgH)
+	w, h = dprDimensions(w, h, imgW, imgH, opt)
 
 	// never resize larger than the original image unless specifically allowed
 	if !opt.ScaleUp {
@@ -110,6 +1276,21 @@ func resizeParams(m image.Image, opt Options) (w, h int, resize bool) {
 		}
 	}
 
+	// scale down further if the resized image would exceed the pixel budget
+	if opt.Megapixels > 0 {
+		outW, outH := resizedDimensions(w, h, imgW, imgH, opt.Fit || opt.pad())
+		if bw, bh := megapixelDimensions(outW, outH, opt.Megapixels); bw != outW || bh != outH {
+			switch {
+			case h == 0:
+				w = bw
+			case w == 0:
+				h = bh
+			default:
+				w, h = bw, bh
+			}
+		}
+	}
+
 	// if requested width and height match the original, skip resizing
 	if (w == imgW || w == 0) && (h == imgH || h == 0) {
 		return 0, 0, false
@@ -118,39 +1299,244 @@ func resizeParams(m image.Image, opt Options) (w, h int, resize bool) {
 	return w, h, true
 }
 
+// resizeScale returns the factor that an image with bounds src was scaled by
+// to produce an image with bounds dst.  Images which were cropped to a
+// different aspect ratio are scaled by the larger of the two axis ratios.
+func resizeScale(src, dst image.Rectangle) float64 {
+	if src.Empty() {
+		return 1
+	}
+	return math.Max(float64(dst.Dx())/float64(src.Dx()), float64(dst.Dy())/float64(src.Dy()))
+}
+
+// ResizeDimensions returns the dimensions that an image with the given config
+// is resized to by opt, without decoding it, and whether it is resized at all.
+// Any crop rectangle in opt is applied first, and padded images have the size
+// of their canvas.  The dimensions match those of images transformed with opt,
+// except that Trim, which depends on the image pixels, is not accounted for,
+// nor are transformations such as rotations and borders that are applied after
+// resizing.  If the image is not resized, the dimensions are those of the
+// original or cropped image.
+func ResizeDimensions(config image.Config, opt Options) (w, h int, resize bool) {
+	var m image.Image = image.Rect(0, 0, config.Width, config.Height)
+	if opt.crop() {
+		r := cropParams(m, opt)
+		m = image.Rect(0, 0, r.Dx(), r.Dy())
+	}
+	imgW, imgH := m.Bounds().Dx(), m.Bounds().Dy()
+
+	padW, padH := padParams(m, opt)
+	w, h, resize = resizeParams(m, opt)
+	switch {
+	case !resize:
+		w, h = imgW, imgH
+	case opt.Fit || opt.pad():
+		w, h = fitDimensions(imgW, imgH, w, h)
+	case w == 0 || h == 0:
+		w, h = scaledDimensions(imgW, imgH, w, h)
+	}
+	if padW > 0 && padH > 0 {
+		return padW, padH, true
+	}
+	return w, h, resize
+}
+
+// fitDimensions returns the dimensions of an image of size imgW by imgH after
+// being fit within w by h, where either may be zero to fit only the other,
+// rounded like imaging.Fit.  Unlike imaging.Fit, images smaller than w by h
+// are enlarged to fill them, so w and h must already be limited to the size
+// of the image unless it may be scaled up.
+func fitDimensions(imgW, imgH, w, h int) (int, int) {
+	if w < 0 || h < 0 || (w == 0 && h == 0) || imgW <= 0 || imgH <= 0 {
+		return 0, 0
+	}
+	if w == 0 || h == 0 {
+		return scaledDimensions(imgW, imgH, w, h)
+	}
+	aspect := float64(imgW) / float64(imgH)
+	if aspect > float64(w)/float64(h) {
+		return scaledDimensions(imgW, imgH, w, int(float64(w)/aspect))
+	}
+	return scaledDimensions(imgW, imgH, int(float64(h)*aspect), h)
+}
+
+// scaledDimensions returns the dimensions of an image of size imgW by imgH
+// after being resized to w by h, where either may be zero to preserve the
+// aspect ratio, matching imaging.Resize.
+func scaledDimensions(imgW, imgH, w, h int) (int, int) {
+	if imgW <= 0 || imgH <= 0 {
+		return w, h
+	}
+	if w == 0 {
+		w = int(math.Max(1, math.Floor(float64(h)*float64(imgW)/float64(imgH)+0.5)))
+	}
+	if h == 0 {
+		h = int(math.Max(1, math.Floor(float64(w)*float64(imgH)/float64(imgW)+0.5)))
+	}
+	return w, h
+}
+
+// padParams returns the size of the canvas to pad m to after resizing, or
+// zero if the image is not padded.  Unlike the resize dimensions, the canvas
+// is always the requested size, even if the image is not scaled up to fill it.
+func padParams(m image.Image, opt Options) (w, h int) {
+	if !opt.pad() {
+		return 0, 0
+	}
+	imgW, imgH := m.Bounds().Dx(), m.Bounds().Dy()
+	w = evaluateSize(opt.Width, opt.WidthPercent, imgW)
+	h = evaluateSize(opt.Height, opt.HeightPercent, imgH)
+	w, h = dprDimensions(w, h, imgW, imgH, opt)
+	if opt.Megapixels > 0 {
+		w, h = megapixelDimensions(w, h, opt.Megapixels)
+	}
+	return w, h
+}
+
+// dprDimensions returns w and h multiplied by the device pixel ratio in opt,
+// limited to MaxDPR.  Unless opt allows scaling up, ratios greater than 1 are
+// reduced so that neither dimension exceeds the original size of imgW by
+// imgH, which preserves the aspect ratio of w by h.  Zero dimensions remain
+// zero.
+func dprDimensions(w, h, imgW, imgH int, opt Options) (int, int) {
+	dpr := opt.dpr()
+	if dpr == 1 {
+		return w, h
+	}
+	if !opt.ScaleUp && dpr > 1 {
+		if w > 0 {
+			dpr = math.Min(dpr, float64(imgW)/float64(w))
+		}
+		if h > 0 {
+			dpr = math.Min(dpr, float64(imgH)/float64(h))
+		}
+		dpr = math.Max(dpr, 1)
+	}
+	scale := func(n int) int {
+		if n == 0 {
+			return 0
+		}
+		return int(math.Max(1, math.Round(float64(n)*dpr)))
+	}
+	return scale(w), scale(h)
+}
+
+// resizedDimensions returns the dimensions of an image of size imgW by imgH
+// after being resized to w by h, where either may be zero to preserve the
+// aspect ratio.  If fit is true, the image is resized to fit within w by h.
+func resizedDimensions(w, h, imgW, imgH int, fit bool) (int, int) {
+	if imgW <= 0 || imgH <= 0 {
+		return w, h
+	}
+	switch {
+	case w == 0 && h == 0:
+		return imgW, imgH
+	case h == 0:
+		return w, int(math.Round(float64(imgH) * float64(w) / float64(imgW)))
+	case w == 0:
+		return int(math.Round(float64(imgW) * float64(h) / float64(imgH))), h
+	case fit:
+		scale := math.Min(float64(w)/float64(imgW), float64(h)/float64(imgH))
+		return int(math.Round(float64(imgW) * scale)), int(math.Round(float64(imgH) * scale))
+	}
+	return w, h
+}
+
+// megapixelDimensions returns the largest dimensions with the aspect ratio of
+// w by h which are no larger than the specified number of megapixels.  If w
+// by h is already within the limit, it is returned unchanged.
+func megapixelDimensions(w, h int, megapixels float64) (int, int) {
+	budget := megapixels * 1e6
+	if w <= 0 || h <= 0 || budget <= 0 || float64(w)*float64(h) <= budget {
+		return w, h
+	}
+	scale := math.Sqrt(budget / (float64(w) * float64(h)))
+	w, h = int(float64(w)*scale), int(float64(h)*scale)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
 // transformImage modifies the image m based on the transformations specified
-// in opt.
-func transformImage(m image.Image, opt Options) image.Image {
-	// resize if needed
-	if w, h, resize := resizeParams(m, opt); resize {
-		if opt.Fit {
-			m = imaging.Fit(m, w, h, resampleFilter)
-		} else {
-			if w == 0 || h == 0 {
-				m = imaging.Resize(m, w, h, resampleFilter)
-			} else {
-				m = imaging.Thumbnail(m, w, h, resampleFilter)
+// in opt, performed in the order of transformSteps or of opt.Pipeline.  An
+// error is returned if a step can not be performed, such as padding the
+// image to a canvas exceeding MaxPixels.
+func transformImage(m image.Image, opt Options) (image.Image, error) {
+	// reduce 16-bit images to 8 bits, before any other transformation
+	// truncates them
+	if opt.Dither {
+		m = dither16(m)
+	}
+
+	s := &transformState{scale: 1}
+	for _, step := range opt.steps() {
+		if step.requested(opt) {
+			if m = step.apply(m, opt, s); s.err != nil {
+				return nil, s.err
 			}
 		}
 	}
+	return m, nil
+}
 
-	// flip
-	if opt.FlipVertical {
-		m = imaging.FlipV(m)
-	}
-	if opt.FlipHorizontal {
-		m = imaging.FlipH(m)
+// transformGIFPalettes replaces the palettes of all frames in the gif image
+// g with the result of calling fn on them.  transformGIF maps each
+// transformed frame back onto the palette of the original frame, so colors
+// which transformations add, such as transparency, must be added to the
+// palettes.
+func transformGIFPalettes(g *gif.GIF, fn func(color.Palette) color.Palette) {
+	for _, frame := range g.Image {
+		frame.Palette = fn(frame.Palette)
 	}
+}
+
+// colorSteps are the names of the transformSteps which change the color of
+// each pixel independently of the others, so that applying them to the
+// palette of a paletted image has the same effect as applying them to its
+// pixels.
+var colorSteps = map[string]bool{
+	"brightness": true,
+	"contrast":   true,
+	"gamma":      true,
+	"saturation": true,
+	"hue":        true,
+	"gray":       true,
+	"sepia":      true,
+	"invert":     true,
+	"lut":        true,
+}
 
-	// rotate
-	switch opt.Rotate {
-	case 90:
-		m = imaging.Rotate90(m)
-	case 180:
-		m = imaging.Rotate180(m)
-	case 270:
-		m = imaging.Rotate270(m)
+// adjustsColors returns whether o requests any of the colorSteps.
+func (o Options) adjustsColors() bool {
+	for _, step := range transformSteps {
+		if colorSteps[step.name] && step.requested(o) {
+			return true
+		}
 	}
+	return false
+}
 
-	return m
+// adjustPalette returns the colors of p adjusted by the colorSteps requested
+// in opt, exactly as they adjust the pixels of an image.
+func adjustPalette(p color.Palette, opt Options) color.Palette {
+	pm := image.NewPaletted(image.Rect(0, 0, len(p), 1), p)
+	for i := range p {
+		pm.Pix[i] = uint8(i)
+	}
+	var m image.Image = pm
+	s := &transformState{scale: 1}
+	for _, step := range opt.steps() {
+		if colorSteps[step.name] && step.requested(opt) {
+			m = step.apply(m, opt, s)
+		}
+	}
+	out := make(color.Palette, len(p))
+	for i := range p {
+		out[i] = color.NRGBAModel.Convert(m.At(i, 0))
+	}
+	return out
 }
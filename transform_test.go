@@ -16,6 +16,11 @@ package imageproxy
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"image"
 	"image/color"
 	"image/draw"
@@ -23,10 +28,15 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"reflect"
 	"testing"
+	"testing/iotest"
 
 	"github.com/disintegration/imaging"
+	"willnorris.com/go/imageproxy/internal/metadata"
+	"willnorris.com/go/imageproxy/internal/webp"
 )
 
 var (
@@ -51,72 +61,2079 @@ func newImage(w, h int, pixels ...color.NRGBA) image.Image {
 	return m
 }
 
+// mustTransformImage returns transformImage(m, opt), failing the test if it
+// returns an error.
+func mustTransformImage(t *testing.T, m image.Image, opt Options) image.Image {
+	t.Helper()
+	m, err := transformImage(m, opt)
+	if err != nil {
+		t.Fatalf("transformImage(%v) returned unexpected error: %v", opt, err)
+	}
+	return m
+}
+
 func TestResizeParams(t *testing.T) {
 	src := image.NewNRGBA(image.Rect(0, 0, 64, 128))
 	tests := []struct {
-		opt    Options
-		w, h   int
-		resize bool
+		opt    Options
+		w, h   int
+		resize bool
+	}{
+		{Options{Width: 0.5}, 32, 0, true},
+		{Options{Height: 0.5}, 0, 64, true},
+		{Options{Width: 0.5, Height: 0.5}, 32, 64, true},
+		{Options{Width: 100, Height: 200}, 0, 0, false},
+		{Options{Width: 100, Height: 200, ScaleUp: true}, 100, 200, true},
+		{Options{Width: 64}, 0, 0, false},
+		{Options{Height: 128}, 0, 0, false},
+
+		// pixel budget
+		{Options{Megapixels: 1}, 0, 0, false},
+		{Options{Megapixels: 0.002}, 31, 0, true},
+		{Options{Width: 16, Megapixels: 0.002}, 16, 0, true},
+		{Options{Width: 32, Megapixels: 0.002}, 31, 0, true},
+		{Options{Height: 64, Megapixels: 0.002}, 0, 63, true},
+		{Options{Width: 64, Height: 64, Megapixels: 0.002}, 44, 44, true},
+		{Options{Width: 64, Height: 64, Fit: true, Megapixels: 0.002}, 31, 63, true},
+		{Options{Width: 100, Height: 200, ScaleUp: true, Megapixels: 0.002}, 31, 63, true},
+
+		// device pixel ratio
+		{Options{Width: 16, DPR: 2}, 32, 0, true},
+		{Options{Width: 0.25, DPR: 2}, 32, 0, true},
+		{Options{Width: 32, DPR: 0.5}, 16, 0, true},
+		{Options{Width: 8, DPR: 10}, 32, 0, true},
+		{Options{Width: 48, Height: 64, DPR: 2}, 64, 85, true},
+		{Options{Width: 48, Height: 64, DPR: 2, ScaleUp: true}, 96, 128, true},
+		{Options{Width: 100, DPR: 2}, 0, 0, false},
+		{Options{Width: 40, DPR: 2, Megapixels: 0.002}, 31, 0, true},
+	}
+	for _, tt := range tests {
+		w, h, resize := resizeParams(src, tt.opt)
+		if w != tt.w || h != tt.h || resize != tt.resize {
+			t.Errorf("resizeParams(%v) returned (%d,%d,%t), want (%d,%d,%t)", tt.opt, w, h, resize, tt.w, tt.h, tt.resize)
+		}
+	}
+}
+
+// test that percentages of odd dimensions are rounded to the nearest pixel.
+func TestResizeParams_Percentage(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 101, 33))
+	tests := []struct {
+		opt    Options
+		w, h   int
+		resize bool
+	}{
+		{Options{Width: 0.5}, 51, 0, true},
+		{Options{Height: 0.5}, 0, 17, true},
+		{Options{Width: 0.5, Height: 0.5}, 51, 17, true},
+		{Options{Width: 0.333, Height: 0.333}, 34, 11, true},
+		{Options{Width: 0.25}, 25, 0, true},
+		{Options{Width: 0.999}, 0, 0, false},
+		{Options{Height: 0.99}, 0, 0, false},
+		{Options{Width: 0.001}, 1, 0, true},
+		{Options{Width: 0.5, DPR: 2}, 0, 0, false},
+
+		// a value of 1 is a single pixel, not 100%
+		{Options{Width: 1}, 1, 0, true},
+		{Options{Width: 1, Height: 1}, 1, 1, true},
+
+		// explicit percentages
+		{Options{Width: 50, WidthPercent: true}, 51, 0, true},
+		{Options{Width: 100, WidthPercent: true}, 0, 0, false},
+		{Options{Width: 1, WidthPercent: true}, 1, 0, true},
+		{Options{Width: 0.5, WidthPercent: true}, 1, 0, true},
+		{Options{Height: 50, HeightPercent: true, Width: 20}, 20, 17, true},
+		{Options{Width: 200, WidthPercent: true}, 0, 0, false},
+		{Options{Width: 200, WidthPercent: true, ScaleUp: true}, 202, 0, true},
+	}
+	for _, tt := range tests {
+		w, h, resize := resizeParams(src, tt.opt)
+		if w != tt.w || h != tt.h || resize != tt.resize {
+			t.Errorf("resizeParams(%v) returned (%d,%d,%t), want (%d,%d,%t)", tt.opt, w, h, resize, tt.w, tt.h, tt.resize)
+		}
+	}
+}
+
+func TestResizeDimensions(t *testing.T) {
+	sizes := []image.Point{{64, 128}, {100, 75}, {7, 3}}
+	opts := []Options{
+		{},
+		{Width: 32},
+		{Height: 0.3},
+		{Width: 50, Height: 50},
+		{Width: 50, Height: 50, SmartCrop: true},
+		{Width: 30, Height: 70, Fit: true},
+		{Width: 0.33, Height: 0.5, Fit: true},
+		{Width: 200, Height: 200, Fit: true},
+		{Width: 200, Height: 200, Fit: true, ScaleUp: true},
+		{Width: 200, Height: 50, Fit: true, ScaleUp: true},
+		{Width: 20, Fit: true},
+		{Height: 300, Fit: true, ScaleUp: true},
+		{Width: 200, Height: 200, Pad: true, ScaleUp: true},
+		{Width: 200, ScaleUp: true},
+		{Width: 40, Height: 40, Pad: true},
+		{Width: 200, Height: 40, Pad: true},
+		{Width: 10, DPR: 3},
+		{Width: 80, Height: 80, Megapixels: 0.002},
+		{CropX: 2, CropY: 0.25, CropWidth: 0.5},
+		{CropWidth: 50, CropHeight: 20, Width: 25},
+	}
+	for _, size := range sizes {
+		src := newImage(size.X, size.Y, color.NRGBA{255, 0, 0, 255})
+		config := image.Config{Width: size.X, Height: size.Y}
+		for _, opt := range opts {
+			b := mustTransformImage(t, src, opt).Bounds()
+			w, h, _ := ResizeDimensions(config, opt)
+			if w != b.Dx() || h != b.Dy() {
+				t.Errorf("ResizeDimensions(%v, %v) returned %dx%d, want %dx%d", size, opt, w, h, b.Dx(), b.Dy())
+			}
+		}
+	}
+
+	if _, _, resize := ResizeDimensions(image.Config{Width: 64, Height: 128}, Options{Width: 64}); resize {
+		t.Errorf("ResizeDimensions for the original size returned resize true")
+	}
+}
+
+// test that fit images are enlarged to fill the box if they may be scaled up,
+// and fit to a single dimension if only one is specified.
+func TestTransformImage_Fit(t *testing.T) {
+	src := newImage(40, 20, color.NRGBA{255, 0, 0, 255})
+	tests := []struct {
+		opt  Options
+		w, h int
+	}{
+		{Options{Width: 80, Height: 80, Fit: true}, 40, 20},
+		{Options{Width: 30, Height: 30, Fit: true}, 30, 15},
+		{Options{Width: 80, Height: 80, Fit: true, ScaleUp: true}, 80, 40},
+		{Options{Width: 100, Height: 30, Fit: true, ScaleUp: true}, 60, 30},
+		{Options{Width: 20, Fit: true}, 20, 10},
+		{Options{Height: 40, Fit: true, ScaleUp: true}, 80, 40},
+		{Options{Width: 80, Height: 80, Pad: true, ScaleUp: true}, 80, 80},
+	}
+	for _, tt := range tests {
+		if b := mustTransformImage(t, src, tt.opt).Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("transformImage(%v) returned %dx%d image, want %dx%d", tt.opt, b.Dx(), b.Dy(), tt.w, tt.h)
+		}
+	}
+
+	// padded images scaled up fill the canvas, rather than being centered at
+	// their original size
+	m := mustTransformImage(t, src, Options{Width: 80, Height: 80, Pad: true, ScaleUp: true})
+	if got := color.NRGBAModel.Convert(m.At(1, 30)); got != (color.NRGBA{255, 0, 0, 255}) {
+		t.Errorf("padded image scaled up has color %v at its left edge, want red", got)
+	}
+}
+
+func TestMegapixelDimensions(t *testing.T) {
+	tests := []struct {
+		w, h       int
+		megapixels float64
+		wantW      int
+		wantH      int
+	}{
+		{1000, 1000, 2, 1000, 1000},
+		{2000, 1000, 2, 2000, 1000},
+		{4000, 2000, 2, 2000, 1000},
+		{3000, 4000, 2, 1224, 1632},
+		{6000, 4000, 0.5, 866, 577},
+		{100, 100, 0, 100, 100},
+	}
+	for _, tt := range tests {
+		w, h := megapixelDimensions(tt.w, tt.h, tt.megapixels)
+		if w != tt.wantW || h != tt.wantH {
+			t.Errorf("megapixelDimensions(%d, %d, %v) returned (%d,%d), want (%d,%d)", tt.w, tt.h, tt.megapixels, w, h, tt.wantW, tt.wantH)
+		}
+		if tt.megapixels > 0 && float64(w*h) > tt.megapixels*1e6 {
+			t.Errorf("megapixelDimensions(%d, %d, %v) returned %d pixels, exceeding the budget", tt.w, tt.h, tt.megapixels, w*h)
+		}
+	}
+}
+
+func TestCropParams(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 128))
+	tests := []struct {
+		opt  Options
+		want image.Rectangle
+	}{
+		{Options{CropWidth: 10, CropHeight: 20}, image.Rect(0, 0, 10, 20)},
+		{Options{CropX: 10, CropY: 20}, image.Rect(10, 20, 64, 128)},
+		{Options{CropX: 10, CropY: 20, CropWidth: 30, CropHeight: 40}, image.Rect(10, 20, 40, 60)},
+		{Options{CropX: 0.5, CropY: 0.25, CropWidth: 0.25, CropHeight: 0.5}, image.Rect(32, 32, 48, 96)},
+
+		// clamped to image bounds
+		{Options{CropX: 50, CropY: 100, CropWidth: 100, CropHeight: 100}, image.Rect(50, 100, 64, 128)},
+		{Options{CropX: 100, CropY: 200}, image.Rect(63, 127, 64, 128)},
+		{Options{CropX: -200, CropY: -200, CropWidth: 10, CropHeight: 10}, image.Rect(0, 0, 10, 10)},
+
+		// negative offsets from the right and bottom edges
+		{Options{CropX: -10, CropY: -10, CropWidth: 5, CropHeight: 5}, image.Rect(54, 118, 59, 123)},
+		{Options{CropX: -10, CropY: -20}, image.Rect(54, 108, 64, 128)},
+		{Options{CropX: -10, CropWidth: 20}, image.Rect(54, 0, 64, 128)},
+		{Options{CropX: -0.25, CropY: -0.5}, image.Rect(48, 64, 64, 128)},
+		{Options{CropX: -1, CropY: -1}, image.Rect(63, 127, 64, 128)},
+	}
+
+	for _, tt := range tests {
+		if got := cropParams(src, tt.opt); got != tt.want {
+			t.Errorf("cropParams(%v) returned %v, want %v", tt.opt, got, tt.want)
+		}
+	}
+
+	// non-zero image origin
+	offset := image.NewNRGBA(image.Rect(10, 10, 20, 20))
+	if got, want := cropParams(offset, Options{CropX: 2, CropWidth: 2}), image.Rect(12, 10, 14, 20); got != want {
+		t.Errorf("cropParams with image offset returned %v, want %v", got, want)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	src := newImage(2, 2, red, green, blue, yellow)
+
+	buf := new(bytes.Buffer)
+	png.Encode(buf, src)
+
+	tests := []struct {
+		name        string
+		encode      func(io.Writer, image.Image)
+		exactOutput bool // whether input and output should match exactly
+	}{
+		{"gif", func(w io.Writer, m image.Image) { gif.Encode(w, m, nil) }, true},
+		{"jpeg", func(w io.Writer, m image.Image) { jpeg.Encode(w, m, nil) }, false},
+		{"png", func(w io.Writer, m image.Image) { png.Encode(w, m) }, true},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		tt.encode(buf, src)
+		in := buf.Bytes()
+
+		out, err := Transform(in, emptyOptions)
+		if err != nil {
+			t.Errorf("Transform with encoder %s returned unexpected error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("Transform with with encoder %s with empty options returned modified result", tt.name)
+		}
+
+		out, err = Transform(in, Options{Width: -1, Height: -1})
+		if err != nil {
+			t.Errorf("Transform with encoder %s returned unexpected error: %v", tt.name, err)
+		}
+		if len(out) == 0 {
+			t.Errorf("Transform with encoder %s returned empty bytes", tt.name)
+		}
+		if tt.exactOutput && !reflect.DeepEqual(in, out) {
+			t.Errorf("Transform with encoder %s with noop Options returned modified result", tt.name)
+		}
+
+		out, err = Transform(in, Options{Blur: 1})
+		if err != nil {
+			t.Errorf("Transform with encoder %s and blur returned unexpected error: %v", tt.name, err)
+		}
+		if _, format, err := image.DecodeConfig(bytes.NewReader(out)); err != nil || format != tt.name {
+			t.Errorf("Transform with encoder %s and blur returned format %q, err %v", tt.name, format, err)
+		}
+	}
+
+	// webp images are decoded, but re-encoded as png
+	in, _ := base64.StdEncoding.DecodeString("UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==")
+	out, err := Transform(in, Options{Width: -1, Height: -1})
+	if err != nil {
+		t.Errorf("Transform with webp input returned unexpected error: %v", err)
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(out)); err != nil || format != "png" {
+		t.Errorf("Transform with webp input returned format %q, err %v; want png", format, err)
+	}
+
+	// output format overrides
+	for _, format := range []string{"jpeg", "png", "webp"} {
+		out, err := Transform(buf.Bytes(), Options{Format: format})
+		if err != nil {
+			t.Errorf("Transform with format %s returned unexpected error: %v", format, err)
+		}
+		if _, got, err := image.DecodeConfig(bytes.NewReader(out)); err != nil || got != format {
+			t.Errorf("Transform with format %s returned format %q, err %v", format, got, err)
+		}
+	}
+	if _, err := Transform(buf.Bytes(), Options{Format: "pdf"}); err == nil {
+		t.Errorf("Transform with unsupported output format did not return expected err")
+	}
+	if _, err := Transform(buf.Bytes(), Options{Blur: -1}); err == nil {
+		t.Errorf("Transform with negative blur did not return expected err")
+	}
+	if _, err := Transform(buf.Bytes(), Options{Sharpen: -1}); err == nil {
+		t.Errorf("Transform with negative sharpen did not return expected err")
+	}
+
+	if _, err := Transform([]byte{}, Options{Width: 1}); err == nil {
+		t.Errorf("Transform with invalid image input did not return expected err")
+	}
+}
+
+// countdownContext is a context which is canceled after its Err method has
+// been called n times.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n <= 0 {
+		return context.Canceled
+	}
+	c.n--
+	return nil
+}
+
+func TestTransformContext(t *testing.T) {
+	src := newImage(4, 4, red)
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{red, green}),
+			image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{red, green}),
+		},
+		Delay: []int{10, 10},
+	}
+
+	tests := []struct {
+		name   string
+		encode func(io.Writer)
+	}{
+		{"gif", func(w io.Writer) { gif.EncodeAll(w, g) }},
+		{"jpeg", func(w io.Writer) { jpeg.Encode(w, src, nil) }},
+		{"png", func(w io.Writer) { png.Encode(w, src) }},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		tt.encode(buf)
+		opt := Options{Width: 2}
+
+		if _, err := TransformContext(context.Background(), buf.Bytes(), opt); err != nil {
+			t.Errorf("TransformContext of %s returned unexpected error: %v", tt.name, err)
+		}
+
+		// canceled before and during the transformation
+		for n := 0; n < 3; n++ {
+			ctx := &countdownContext{context.Background(), n}
+			if _, err := TransformContext(ctx, buf.Bytes(), opt); err != context.Canceled {
+				t.Errorf("TransformContext of %s canceled after %d checks returned error %v, want %v", tt.name, n, err, context.Canceled)
+			}
+		}
+	}
+}
+
+func TestQualities(t *testing.T) {
+	q := Qualities{JPEG: 80, WebP: 70, AVIF: 50}
+	tests := []struct {
+		q      Qualities
+		format string
+		want   int
+	}{
+		{Qualities{}, "jpeg", 95},
+		{Qualities{}, "webp", 95},
+		{Qualities{}, "avif", 0},
+		{Qualities{}, "png", 95},
+		{q, "jpeg", 80},
+		{q, "webp", 70},
+		{q, "avif", 50},
+		{q, "png", 95},
+	}
+
+	for _, tt := range tests {
+		if got := tt.q.quality(tt.format); got != tt.want {
+			t.Errorf("%+v.quality(%q) returned %d, want %d", tt.q, tt.format, got, tt.want)
+		}
+	}
+}
+
+// test that default qualities apply only to requests without a quality.
+func TestTransformContext_DefaultQuality(t *testing.T) {
+	src := new(bytes.Buffer)
+	png.Encode(src, newImage(4, 4, red, green, blue, yellow))
+	q := Qualities{JPEG: 50, WebP: 60}
+
+	tests := []struct {
+		opt  Options
+		want Options // equivalent options without default qualities
+	}{
+		{Options{Width: 2, Format: "jpeg"}, Options{Width: 2, Format: "jpeg", Quality: 50}},
+		{Options{Width: 2, Format: "webp"}, Options{Width: 2, Format: "webp", Quality: 60}},
+		{Options{Width: 2, Format: "jpeg", Quality: 90}, Options{Width: 2, Format: "jpeg", Quality: 90}},
+	}
+
+	for _, tt := range tests {
+		got, err := TransformConfig{Quality: q}.TransformContext(context.Background(), src.Bytes(), tt.opt)
+		if err != nil {
+			t.Errorf("TransformContext(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		want, err := Transform(src.Bytes(), tt.want)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.want, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("TransformContext(%v) with qualities %+v did not match Transform(%v)", tt.opt, q, tt.want)
+		}
+	}
+}
+
+// test that images which are already the requested size are not re-encoded.
+func TestTransform_Passthrough(t *testing.T) {
+	src := newImage(8, 4, red, green, blue, yellow)
+	// encoded differently than png images are re-encoded
+	buf := new(bytes.Buffer)
+	(&png.Encoder{CompressionLevel: png.NoCompression}).Encode(buf, src)
+	in := buf.Bytes()
+
+	tests := []struct {
+		opt       Options
+		unchanged bool
+	}{
+		{Options{Width: 8}, true},
+		{Options{Width: 8, Height: 4}, true},
+		{Options{Width: 16, Height: 8}, true}, // not scaled up
+		{Options{Width: 0.5, Height: 1}, false},
+		{Options{Width: 8, Height: 4, Fit: true, Filter: "box", Quality: 80}, true},
+		{Options{Megapixels: 1}, true},
+		{Options{Width: 4}, false},
+		{Options{Width: 16, Height: 8, ScaleUp: true}, false},
+		{Options{Width: 8, Height: 8, Pad: true}, false},
+		{Options{Width: 8, Format: "png"}, false},
+		{Options{Width: 8, Grayscale: true}, false},
+	}
+	for _, tt := range tests {
+		out, err := Transform(in, tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		if got := bytes.Equal(out, in); got != tt.unchanged {
+			t.Errorf("Transform(%v) returned unchanged image: %t, want %t", tt.opt, got, tt.unchanged)
+		}
+	}
+
+	// still webp images are re-encoded as png
+	buf.Reset()
+	webp.Encode(buf, src, &webp.Options{Lossless: true})
+	out, err := Transform(buf.Bytes(), Options{Width: 8})
+	if _, format, _ := image.DecodeConfig(bytes.NewReader(out)); err != nil || format != "png" {
+		t.Errorf("Transform of webp returned format %q, err %v; want png", format, err)
+	}
+}
+
+func TestTransformMany(t *testing.T) {
+	src := new(bytes.Buffer)
+	png.Encode(src, newImage(8, 8, red, green, blue, yellow))
+	opts := []Options{
+		{Width: 2, Format: "jpeg", Quality: 80},
+		{Width: 4, Height: 2, Grayscale: true},
+		emptyOptions,
+		{Width: 4, Rotate: 90, Format: "webp"},
+	}
+
+	got, err := TransformMany(src.Bytes(), opts)
+	if err != nil {
+		t.Fatalf("TransformMany returned unexpected error: %v", err)
+	}
+	if len(got) != len(opts) {
+		t.Fatalf("TransformMany returned %d images, want %d", len(got), len(opts))
+	}
+	for i, opt := range opts {
+		want, err := Transform(src.Bytes(), opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", opt, err)
+			continue
+		}
+		if !bytes.Equal(got[i], want) {
+			t.Errorf("TransformMany image %d did not match Transform(%v)", i, opt)
+		}
+	}
+
+	if _, err := TransformMany(src.Bytes(), []Options{{Width: 2}, {Format: "pdf"}}); err == nil {
+		t.Errorf("TransformMany with invalid options did not return expected error")
+	}
+}
+
+func TestDecodeCache(t *testing.T) {
+	src := new(bytes.Buffer)
+	png.Encode(src, newImage(2, 2, red))
+
+	d := new(decodeCache)
+	m, err := d.decode(bytes.NewReader(src.Bytes()), false)
+	if err != nil {
+		t.Fatalf("decode returned unexpected error: %v", err)
+	}
+	// the cached image is returned without reading the image again
+	if got, err := d.decode(bytes.NewReader(nil), false); got != m || err != nil {
+		t.Errorf("second decode returned %v, %v; want cached image", got, err)
+	}
+
+	var nilCache *decodeCache
+	if _, err := nilCache.decode(bytes.NewReader(nil), false); err == nil {
+		t.Errorf("decode of empty image with nil cache did not return expected error")
+	}
+}
+
+// test that truncated jpeg images are transformed if partial images are
+// allowed, and are otherwise reported as ErrDecode.
+func TestTransformConfig_AllowPartial(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			m.Set(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), 100, 255})
+		}
+	}
+	full := new(bytes.Buffer)
+	jpeg.Encode(full, m, &jpeg.Options{Quality: 90})
+	truncated := full.Bytes()[:full.Len()*6/10]
+
+	opt := Options{Width: 32}
+	if _, err := Transform(truncated, opt); !errors.Is(err, ErrDecode) {
+		t.Errorf("Transform of truncated jpeg returned error %v, want ErrDecode", err)
+	}
+
+	c := TransformConfig{AllowPartial: true}
+	out, err := c.Transform(truncated, opt)
+	if err != nil {
+		t.Fatalf("Transform of truncated jpeg with AllowPartial returned error: %v", err)
+	}
+	got, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed image: %v", err)
+	}
+	if b := got.Bounds(); b.Dx() != 32 || b.Dy() != 32 {
+		t.Errorf("Transform with AllowPartial returned %dx%d image, want 32x32", b.Dx(), b.Dy())
+	}
+	// the decoded part of the image is intact
+	if r, _, _, _ := got.At(4, 2).RGBA(); r>>8 > 48 {
+		t.Errorf("Transform with AllowPartial returned red %d at top left, want close to 32", r>>8)
+	}
+
+	// other formats are not partially decoded
+	src := new(bytes.Buffer)
+	png.Encode(src, m)
+	if _, err := c.Transform(src.Bytes()[:src.Len()/2], opt); !errors.Is(err, ErrDecode) {
+		t.Errorf("Transform of truncated png with AllowPartial returned error %v, want ErrDecode", err)
+	}
+}
+
+// test that the default filter applies only to requests without a filter.
+func TestTransformConfig_Filter(t *testing.T) {
+	src := new(bytes.Buffer)
+	png.Encode(src, newImage(4, 1, red, blue, red, blue))
+	c := TransformConfig{Filter: "nearest"}
+
+	tests := []struct {
+		opt  Options
+		want Options // equivalent options without a default filter
+	}{
+		{Options{Width: 2}, Options{Width: 2, Filter: "nearest"}},
+		{Options{Width: 2, Filter: "box"}, Options{Width: 2, Filter: "box"}},
+	}
+
+	for _, tt := range tests {
+		got, err := c.Transform(src.Bytes(), tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		want, err := Transform(src.Bytes(), tt.want)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.want, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Transform(%v) with filter %q did not match Transform(%v)", tt.opt, c.Filter, tt.want)
+		}
+	}
+
+	c.Filter = "bicubic"
+	if _, err := c.Transform(src.Bytes(), Options{Width: 2}); err == nil {
+		t.Errorf("Transform with filter %q did not return expected error", c.Filter)
+	}
+}
+
+func TestTransformConfig_TransformFunc(t *testing.T) {
+	var calls []Options
+	c := TransformConfig{
+		TransformFunc: func(m image.Image, opt Options) image.Image {
+			calls = append(calls, opt)
+			return imaging.Invert(m)
+		},
+	}
+
+	src := new(bytes.Buffer)
+	png.Encode(src, newImage(2, 2, red, red, red, red))
+	opt := Options{Width: 2, Format: "png"}
+	out, err := c.Transform(src.Bytes(), opt)
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	got, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed image: %v", err)
+	}
+	if want := (color.NRGBA{0, 255, 255, 255}); !reflect.DeepEqual(color.NRGBAModel.Convert(got.At(0, 0)), want) {
+		t.Errorf("Transform with TransformFunc returned color %v, want %v", got.At(0, 0), want)
+	}
+	if len(calls) != 1 || calls[0] != opt {
+		t.Errorf("TransformFunc called with %v, want [%v]", calls, opt)
+	}
+
+	// the function is called for each frame of animated images
+	calls = nil
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{red, blue}),
+			image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{red, blue}),
+			image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{red, blue}),
+		},
+		Delay: []int{10, 10, 10},
+	}
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, g)
+	if _, err := c.Transform(buf.Bytes(), Options{Width: 2}); err != nil {
+		t.Fatalf("Transform of gif returned unexpected error: %v", err)
+	}
+	if len(calls) != 3 {
+		t.Errorf("TransformFunc called %d times for gif, want 3", len(calls))
+	}
+}
+
+func TestTransformStream(t *testing.T) {
+	src := newImage(4, 4, red, green, blue, yellow)
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{red, green}),
+			image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{red, green}),
+		},
+		Delay: []int{10, 10},
+	}
+
+	tests := []struct {
+		name   string
+		encode func(io.Writer)
+		opt    Options
+	}{
+		{"gif", func(w io.Writer) { gif.EncodeAll(w, g) }, Options{Width: 2}},
+		{"gif", func(w io.Writer) { gif.EncodeAll(w, g) }, Options{Width: 2, Grayscale: true}},
+		{"jpeg", func(w io.Writer) { jpeg.Encode(w, src, nil) }, Options{Width: 2}},
+		{"jpeg", func(w io.Writer) { jpeg.Encode(w, src, nil) }, Options{Width: 2, StripMetadata: true}},
+		{"png", func(w io.Writer) { png.Encode(w, src) }, emptyOptions},
+		{"png", func(w io.Writer) { png.Encode(w, src) }, Options{Width: 2, Format: "jpeg"}},
+		{"png", func(w io.Writer) { png.Encode(w, src) }, Options{Width: 2, Rotate: 90}},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		tt.encode(buf)
+		in := buf.Bytes()
+
+		want, err := Transform(in, tt.opt)
+		if err != nil {
+			t.Errorf("Transform of %s with options %v returned unexpected error: %v", tt.name, tt.opt, err)
+			continue
+		}
+
+		// read the image a byte at a time, to make sure that nothing is
+		// lost when the header is read again to decode the image
+		out := new(bytes.Buffer)
+		if err := TransformStream(out, iotest.OneByteReader(bytes.NewReader(in)), tt.opt); err != nil {
+			t.Errorf("TransformStream of %s with options %v returned unexpected error: %v", tt.name, tt.opt, err)
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("TransformStream of %s with options %v returned different result than Transform", tt.name, tt.opt)
+		}
+	}
+
+	if err := TransformStream(ioutil.Discard, bytes.NewReader(nil), Options{Width: 1}); err == nil {
+		t.Errorf("TransformStream with invalid image input did not return expected err")
+	}
+}
+
+// Rotate:360 is a full rotation and not an EXIF auto-orient request, so it
+// must succeed for images without any EXIF metadata.
+func TestTransform_FullRotation(t *testing.T) {
+	src := newImage(4, 2, red)
+	tests := []struct {
+		name   string
+		encode func(io.Writer)
+	}{
+		{"jpeg", func(w io.Writer) { jpeg.Encode(w, src, nil) }},
+		{"png", func(w io.Writer) { png.Encode(w, src) }},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		tt.encode(buf)
+
+		out, err := Transform(buf.Bytes(), Options{Rotate: 360})
+		if err != nil {
+			t.Errorf("Transform of %s with Rotate 360 returned unexpected error: %v", tt.name, err)
+			continue
+		}
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(out))
+		if err != nil || format != tt.name || cfg.Width != 4 || cfg.Height != 2 {
+			t.Errorf("Transform of %s with Rotate 360 returned %s %dx%d, err %v; want %s 4x2", tt.name, format, cfg.Width, cfg.Height, err, tt.name)
+		}
+	}
+}
+
+func TestTransform_CMYK(t *testing.T) {
+	// 8x8 cyan jpeg with an Adobe APP14 marker, which stores inverted CMYK
+	// values.  Without applying the marker, the image would be black.
+	in, _ := base64.StdEncoding.DecodeString("/9j/7gAOQWRvYmUAZAAAAAAA/9sAQwABAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEB/8AAFAgACAAIBAERAAIRAAMRAAQRAP/EAB8AAAEFAQEBAQEBAAAAAAAAAAABAgMEBQYHCAkKC//EABQQAQAAAAAAAAAAAAAAAAAAAAD/2gAOBAEAAgADAAQAAD8A/wA/9/fw/v4f38P/2Q==")
+	cyan := color.NRGBA{0, 255, 255, 255}
+
+	if _, ok := convertCMYK(image.NewCMYK(image.Rect(0, 0, 1, 1))).(*image.NRGBA); !ok {
+		t.Errorf("convertCMYK did not convert CMYK image to NRGBA")
+	}
+
+	for _, opt := range []Options{{Width: 4}, {Format: "jpeg"}, {Width: 4, Format: "png"}} {
+		out, err := Transform(in, opt)
+		if err != nil {
+			t.Errorf("Transform of CMYK jpeg with options %v returned unexpected error: %v", opt, err)
+			continue
+		}
+		m, _, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("Transform of CMYK jpeg with options %v returned invalid image: %v", opt, err)
+			continue
+		}
+		if _, ok := m.(*image.CMYK); ok {
+			t.Errorf("Transform of CMYK jpeg with options %v returned CMYK image", opt)
+		}
+		got := color.NRGBAModel.Convert(m.At(1, 1)).(color.NRGBA)
+		if !within(got.R, cyan.R, 8) || !within(got.G, cyan.G, 8) || !within(got.B, cyan.B, 8) {
+			t.Errorf("Transform of CMYK jpeg with options %v returned color %v, want %v", opt, got, cyan)
+		}
+	}
+}
+
+func TestTransform_16Bit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, newGradient(256, 8, 100, 104))
+	in := buf.Bytes()
+
+	tests := []struct {
+		opt     Options
+		depth16 bool // whether the output should have 16 bits per channel
+		maxRun  int  // the longest allowed band of identical pixels
+	}{
+		{Options{Format: "png"}, true, 0},
+		{Options{Dither: true}, false, 32},
+		{Options{Width: 128, Dither: true}, false, 24},
+		{Options{Width: 128}, false, 0},
+	}
+
+	for _, tt := range tests {
+		out, err := Transform(in, tt.opt)
+		if err != nil {
+			t.Errorf("Transform with options %v returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		m, err := png.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("Transform with options %v returned invalid png: %v", tt.opt, err)
+			continue
+		}
+		if got := is16Bit(m); got != tt.depth16 {
+			t.Errorf("Transform with options %v returned 16-bit image %t, want %t", tt.opt, got, tt.depth16)
+		}
+		if got := longestRun(m, 2); tt.maxRun > 0 && got > tt.maxRun {
+			t.Errorf("Transform with options %v returned band of %d identical pixels, want at most %d", tt.opt, got, tt.maxRun)
+		}
+	}
+}
+
+func TestTransform_SingleFrameGIF(t *testing.T) {
+	p := color.Palette{red, green, blue, yellow}
+	frame := image.NewPaletted(image.Rect(0, 0, 4, 4), p)
+	for i := range frame.Pix {
+		frame.Pix[i] = uint8(i % len(p))
+	}
+	opt := Options{Width: 2}
+
+	buf := new(bytes.Buffer)
+	gif.Encode(buf, frame, nil)
+	out, err := Transform(buf.Bytes(), opt)
+	if err != nil {
+		t.Fatalf("Transform of single frame gif returned unexpected error: %v", err)
+	}
+
+	// single frames are transformed like static images
+	want := new(bytes.Buffer)
+	gif.Encode(want, palettedImage(mustTransformImage(t, frame, opt), p), nil)
+	if !bytes.Equal(out, want.Bytes()) {
+		t.Errorf("Transform of single frame gif returned different result than static transform")
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Transform of single frame gif returned invalid gif: %v", err)
+	}
+	if len(g.Image) != 1 || !samePalette(g.Image[0].Palette, p) {
+		t.Errorf("Transform of single frame gif returned %d frames with palette %v, want 1 frame with palette %v", len(g.Image), g.Image[0].Palette, p)
+	}
+
+	// animated gifs keep all of their frames
+	buf.Reset()
+	gif.EncodeAll(buf, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}})
+	out, err = Transform(buf.Bytes(), opt)
+	if err != nil {
+		t.Fatalf("Transform of animated gif returned unexpected error: %v", err)
+	}
+	if g, err := gif.DecodeAll(bytes.NewReader(out)); err != nil || len(g.Image) != 2 {
+		t.Errorf("Transform of animated gif did not return 2 frames, err %v", err)
+	}
+}
+
+func TestTransform_StripMetadata(t *testing.T) {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, newImage(4, 4, red), nil)
+	orig := buf.Bytes()
+
+	// insert an EXIF segment after the SOI marker
+	exif := []byte("\xff\xe1\x00\x0aExif\x00\x00II")
+	in := append(append(append([]byte{}, orig[:2]...), exif...), orig[2:]...)
+
+	out, err := Transform(in, emptyOptions)
+	if err != nil || !bytes.Equal(out, in) {
+		t.Errorf("Transform with empty options returned modified result, err %v", err)
+	}
+
+	out, err = Transform(in, Options{StripMetadata: true})
+	if err != nil {
+		t.Errorf("Transform returned unexpected error: %v", err)
+	}
+	if !bytes.Equal(out, orig) {
+		t.Errorf("Transform with StripMetadata did not losslessly remove metadata")
+	}
+
+	out, err = Transform(in, Options{Width: 2, StripMetadata: true})
+	if err != nil {
+		t.Errorf("Transform returned unexpected error: %v", err)
+	}
+	if bytes.Contains(out, []byte("Exif")) {
+		t.Errorf("Transform with StripMetadata returned image containing metadata")
+	}
+}
+
+func TestTransform_PreserveColorProfile(t *testing.T) {
+	profile := make([]byte, 200)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	copy(profile[36:], "acsp")
+
+	for _, format := range []string{"jpeg", "png"} {
+		buf := new(bytes.Buffer)
+		if format == "jpeg" {
+			jpeg.Encode(buf, newImage(4, 4, red), nil)
+		} else {
+			png.Encode(buf, newImage(4, 4, red))
+		}
+		in, err := metadata.SetICCProfile(buf.Bytes(), profile)
+		if err != nil {
+			t.Fatalf("error embedding color profile: %v", err)
+		}
+
+		tests := []struct {
+			opt  Options
+			want bool // whether the output should include the profile
+		}{
+			{Options{Width: 2}, false},
+			{Options{Width: 2, PreserveColorProfile: true}, true},
+			{Options{Width: 2, Format: "png", PreserveColorProfile: true}, true},
+			{Options{StripMetadata: true}, false},
+			{Options{StripMetadata: true, PreserveColorProfile: true}, true},
+		}
+		for _, tt := range tests {
+			out, err := Transform(in, tt.opt)
+			if err != nil {
+				t.Errorf("Transform(%s, %v) returned unexpected error: %v", format, tt.opt, err)
+				continue
+			}
+			got, err := metadata.ICCProfile(out)
+			if err != nil {
+				t.Errorf("Transform(%s, %v) returned image with invalid profile: %v", format, tt.opt, err)
+			}
+			if has := bytes.Equal(got, profile); has != tt.want {
+				t.Errorf("Transform(%s, %v) returned image with profile: %t, want %t", format, tt.opt, has, tt.want)
+			}
+		}
+	}
+
+	// invalid profiles are dropped
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, newImage(4, 4, red), nil)
+	b := buf.Bytes()
+	seg := append([]byte("\xff\xe2\x00\x14ICC_PROFILE\x00\x01\x01"), "bad!"...)
+	in := append(append(append([]byte{}, b[:2]...), seg...), b[2:]...)
+	out, err := Transform(in, Options{Width: 2, PreserveColorProfile: true})
+	if err != nil {
+		t.Errorf("Transform with invalid color profile returned unexpected error: %v", err)
+	}
+	if p, _ := metadata.ICCProfile(out); p != nil {
+		t.Errorf("Transform with invalid color profile returned image with profile")
+	}
+}
+
+func TestTransform_PreserveEXIF(t *testing.T) {
+	// little endian EXIF data with a Make of "Test" and Orientation 6
+	exif := []byte("II*\x00\x08\x00\x00\x00\x02\x00" +
+		"\x0f\x01\x02\x00\x05\x00\x00\x00\x26\x00\x00\x00" +
+		"\x12\x01\x03\x00\x01\x00\x00\x00\x06\x00\x00\x00" +
+		"\x00\x00\x00\x00Test\x00")
+	reset := append([]byte{}, exif...)
+	reset[30] = 1
+
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, newImage(4, 4, red), nil)
+	in, err := metadata.SetEXIF(buf.Bytes(), exif)
+	if err != nil {
+		t.Fatalf("error embedding EXIF data: %v", err)
+	}
+
+	tests := []struct {
+		opt  Options
+		want []byte
+	}{
+		{Options{Width: 2}, nil},
+		{Options{Width: 2, PreserveEXIF: true}, reset},
+		{Options{StripMetadata: true, PreserveEXIF: true}, reset},
+		{Options{Width: 2, Format: "png", PreserveEXIF: true}, nil},
+	}
+	for _, tt := range tests {
+		out, err := Transform(in, tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		got, err := metadata.EXIF(out)
+		if err != nil {
+			t.Errorf("Transform(%v) returned image with invalid EXIF data: %v", tt.opt, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("Transform(%v) returned EXIF data %q, want %q", tt.opt, got, tt.want)
+		}
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	// little endian EXIF data with an Orientation of 8
+	exif := []byte("II*\x00\x08\x00\x00\x00\x01\x00" +
+		"\x12\x01\x03\x00\x01\x00\x00\x00\x08\x00\x00\x00" +
+		"\x00\x00\x00\x00")
+
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, newImage(4, 4, red), nil)
+	jpegEXIF, err := metadata.SetEXIF(buf.Bytes(), exif)
+	if err != nil {
+		t.Fatalf("error embedding EXIF data: %v", err)
+	}
+	buf.Reset()
+	png.Encode(buf, newImage(4, 4, red))
+	pngEXIF := insertPNGChunk(buf.Bytes(), "eXIf", exif)
+
+	tests := []struct {
+		img    []byte
+		format string
+		want   int
+		ok     bool
+	}{
+		{jpegEXIF, "jpeg", 8, true},
+		{pngEXIF, "png", 8, true},
+		{buf.Bytes(), "png", 0, false},
+		{exif, "tiff", 8, true}, // tiff images are themselves TIFF structures
+		{exif, "heic", 0, false},
+		{[]byte("not an image"), "jpeg", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := orientation(tt.img, tt.format); got != tt.want || ok != tt.ok {
+			t.Errorf("orientation of %s image returned %d, %t, want %d, %t", tt.format, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// the EXIF data of png images is embedded in jpeg output, with its
+	// orientation reset since it is not applied
+	out, err := Transform(pngEXIF, Options{Width: 2, Format: "jpeg", PreserveEXIF: true})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	if got, ok := orientation(out, "jpeg"); got != 1 || !ok {
+		t.Errorf("Transform of png with EXIF returned orientation %d, %t, want 1", got, ok)
+	}
+}
+
+// insertPNGChunk returns the png image img with a chunk inserted after its
+// IHDR chunk.
+func insertPNGChunk(img []byte, typ string, data []byte) []byte {
+	i := 8 + 12 + 13 // end of IHDR chunk
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, data...)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc[:]...)
+
+	out := append([]byte{}, img[:i]...)
+	out = append(out, chunk...)
+	return append(out, img[i:]...)
+}
+
+func TestTransform_StripGPS(t *testing.T) {
+	// little endian EXIF data with a Make of "Test" and a GPS IFD with a
+	// GPSLatitude of 37 46' 30"
+	latitude := "\x25\x00\x00\x00\x01\x00\x00\x00\x2e\x00\x00\x00\x01\x00\x00\x00\xb8\x0b\x00\x00\x64\x00\x00\x00"
+	exif := []byte("II*\x00\x08\x00\x00\x00\x02\x00" +
+		"\x0f\x01\x02\x00\x05\x00\x00\x00\x26\x00\x00\x00" +
+		"\x25\x88\x04\x00\x01\x00\x00\x00\x2c\x00\x00\x00" +
+		"\x00\x00\x00\x00Test\x00\x00" +
+		"\x01\x00\x02\x00\x05\x00\x03\x00\x00\x00\x3e\x00\x00\x00" +
+		"\x00\x00\x00\x00" + latitude)
+
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, newImage(4, 4, red), nil)
+	orig := buf.Bytes()
+	in, err := metadata.SetEXIF(orig, exif)
+	if err != nil {
+		t.Fatalf("error embedding EXIF data: %v", err)
+	}
+
+	for _, opt := range []Options{
+		{StripGPS: true},
+		{Width: 2, PreserveEXIF: true, StripGPS: true},
+	} {
+		out, err := Transform(in, opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", opt, err)
+			continue
+		}
+		got, err := metadata.EXIF(out)
+		if err != nil {
+			t.Errorf("Transform(%v) returned image with invalid EXIF data: %v", opt, err)
+		}
+		if !bytes.Contains(got, []byte("Test\x00")) {
+			t.Errorf("Transform(%v) returned EXIF data without Make: %q", opt, got)
+		}
+		if bytes.Contains(got, []byte(latitude)) || bytes.Contains(got, []byte("\x25\x88")) {
+			t.Errorf("Transform(%v) returned EXIF data with GPS data: %q", opt, got)
+		}
+	}
+
+	// images without GPS data are unchanged
+	if out, err := Transform(orig, Options{StripGPS: true}); err != nil || !bytes.Equal(out, orig) {
+		t.Errorf("Transform of image without EXIF data returned modified result, err %v", err)
+	}
+}
+
+func TestTransform_DPI(t *testing.T) {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, newImage(4, 4, red), nil)
+	orig := buf.Bytes()
+
+	for _, opt := range []Options{
+		{},
+		{Width: 2},
+		{Format: "png"},
+		{Width: 2, StripMetadata: true},
+	} {
+		plain, err := Transform(orig, opt)
+		if err != nil {
+			t.Fatalf("Transform(%v) returned unexpected error: %v", opt, err)
+		}
+		want, err := metadata.SetDPI(plain, 300)
+		if err != nil {
+			t.Fatalf("SetDPI returned unexpected error: %v", err)
+		}
+
+		opt.DPI = 300
+		if got, err := Transform(orig, opt); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("Transform(%v) returned image without DPI set, err %v", opt, err)
+		}
+	}
+}
+
+func TestTransform_Lossless(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i * 7)
+	}
+	buf := new(bytes.Buffer)
+	png.Encode(buf, src)
+
+	for _, opt := range []Options{
+		{Format: "webp", Lossless: true},
+		{Format: "webp", Lossless: true, Quality: 10},
+		{Format: "png", Lossless: true, Quality: 50},
+	} {
+		out, err := Transform(buf.Bytes(), opt)
+		if err != nil {
+			t.Fatalf("Transform(%v) returned unexpected error: %v", opt, err)
+		}
+		m, _, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("Transform(%v) returned undecodable image: %v", opt, err)
+		}
+		if got := imaging.Clone(m); !reflect.DeepEqual(got.Pix, src.Pix) {
+			t.Errorf("Transform(%v) did not preserve pixels exactly", opt)
+		}
+	}
+}
+
+func TestTransform_Optimize(t *testing.T) {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, newImage(4, 4, red))
+	icon := buf.Bytes()
+
+	photo := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	r := rand.New(rand.NewSource(1))
+	r.Read(photo.Pix)
+	for i := 3; i < len(photo.Pix); i += 4 {
+		photo.Pix[i] = 255
+	}
+	buf = new(bytes.Buffer)
+	png.Encode(buf, photo)
+	noise := buf.Bytes()
+
+	tests := []struct {
+		img  []byte
+		opt  Options
+		want string // expected content type
+	}{
+		// tiny images are smaller as png
+		{icon, Options{Format: "jpeg", Optimize: true}, "image/png"},
+		// noisy opaque images are smaller as lossy jpeg
+		{noise, Options{Format: "webp", Quality: 50, Optimize: true}, "image/jpeg"},
+		// but not if lossless output was requested
+		{noise, Options{Format: "webp", Lossless: true, Optimize: true}, "image/webp"},
+		// other formats are kept
+		{icon, Options{Format: "bmp", Optimize: true}, "image/bmp"},
+	}
+	for _, tt := range tests {
+		out, err := Transform(tt.img, tt.opt)
+		if err != nil {
+			t.Fatalf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+		}
+		if got := imageContentType(out); got != tt.want {
+			t.Errorf("Transform(%v) returned %s image, want %s", tt.opt, got, tt.want)
+		}
+		plain := tt.opt
+		plain.Optimize = false
+		if want, _ := Transform(tt.img, plain); len(out) > len(want) {
+			t.Errorf("Transform(%v) returned %d bytes, more than %d bytes without optimizing", tt.opt, len(out), len(want))
+		}
+	}
+}
+
+func TestTransform_OptimizeOriginal(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	r := rand.New(rand.NewSource(1))
+	r.Read(m.Pix)
+	for i := 3; i < len(m.Pix); i += 4 {
+		m.Pix[i] = 255
+	}
+	// a pre-optimized jpeg, which grows when encoded at a higher quality
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, m, &jpeg.Options{Quality: 40})
+	orig := buf.Bytes()
+
+	opt := Options{Format: "jpeg", Quality: 95}
+	if out, err := Transform(orig, opt); err != nil || len(out) <= len(orig) {
+		t.Fatalf("Transform(%v) returned %d bytes, err %v, want more than %d", opt, len(out), err, len(orig))
+	}
+	opt.Optimize = true
+	if out, err := Transform(orig, opt); err != nil || !bytes.Equal(out, orig) {
+		t.Errorf("Transform(%v) did not return the original image, err %v", opt, err)
+	}
+	out := new(bytes.Buffer)
+	if err := TransformStream(out, bytes.NewReader(orig), opt); err != nil || !bytes.Equal(out.Bytes(), orig) {
+		t.Errorf("TransformStream(%v) did not return the original image, err %v", opt, err)
+	}
+
+	// images whose pixels are changed are never replaced by the original
+	opt.Grayscale = true
+	if out, err := Transform(orig, opt); err != nil || bytes.Equal(out, orig) {
+		t.Errorf("Transform(%v) returned the original image, err %v", opt, err)
+	}
+}
+
+func TestTransform_MaxPixels(t *testing.T) {
+	defer func(max int) { MaxPixels = max }(MaxPixels)
+
+	src := newImage(10, 10, red)
+	encoders := map[string]func(io.Writer, image.Image){
+		"gif":  func(w io.Writer, m image.Image) { gif.Encode(w, m, nil) },
+		"jpeg": func(w io.Writer, m image.Image) { jpeg.Encode(w, m, nil) },
+		"png":  func(w io.Writer, m image.Image) { png.Encode(w, m) },
+	}
+
+	for name, encode := range encoders {
+		buf := new(bytes.Buffer)
+		encode(buf, src)
+
+		MaxPixels = 99
+		if _, err := Transform(buf.Bytes(), Options{Width: 5}); err == nil {
+			t.Errorf("Transform of %s image exceeding MaxPixels did not return expected error", name)
+		}
+
+		MaxPixels = 100
+		if _, err := Transform(buf.Bytes(), Options{Width: 5}); err != nil {
+			t.Errorf("Transform of %s image within MaxPixels returned unexpected error: %v", name, err)
+		}
+
+		MaxPixels = 0
+		if _, err := Transform(buf.Bytes(), Options{Width: 5}); err != nil {
+			t.Errorf("Transform of %s image with no MaxPixels returned unexpected error: %v", name, err)
+		}
+	}
+}
+
+func TestTransform_ExtractFrame(t *testing.T) {
+	p := color.Palette{color.NRGBA{}, red, green, blue}
+	frame := func(r image.Rectangle, c uint8) *image.Paletted {
+		m := image.NewPaletted(r, p)
+		for i := range m.Pix {
+			m.Pix[i] = c
+		}
+		return m
+	}
+	// a red frame, followed by frames which only cover part of it
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 4, 4), 1),
+			frame(image.Rect(0, 0, 2, 4), 2),
+			frame(image.Rect(2, 0, 4, 4), 3),
+		},
+		Delay:    []int{10, 10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+	}
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, g)
+
+	transparent := color.NRGBA{}
+	tests := []struct {
+		opt         Options
+		format      string
+		left, right color.NRGBA
+	}{
+		{Options{ExtractFrame: true}, "png", red, red},
+		{Options{ExtractFrame: true, Frame: 1}, "png", green, red},
+		{Options{ExtractFrame: true, Frame: 2}, "png", transparent, blue},
+		{Options{ExtractFrame: true, Frame: 10}, "png", transparent, blue},
+		{Options{ExtractFrame: true, Format: "jpeg"}, "jpeg", red, red},
+	}
+
+	for _, tt := range tests {
+		out, err := Transform(buf.Bytes(), tt.opt)
+		if err != nil {
+			t.Errorf("Transform with options %v returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		m, format, err := image.Decode(bytes.NewReader(out))
+		if err != nil || format != tt.format {
+			t.Errorf("Transform with options %v returned format %q, err %v; want %s", tt.opt, format, err, tt.format)
+			continue
+		}
+		left := color.NRGBAModel.Convert(m.At(0, 0)).(color.NRGBA)
+		right := color.NRGBAModel.Convert(m.At(3, 0)).(color.NRGBA)
+		if tt.format == "jpeg" {
+			// compare only approximately
+			if !within(left.R, tt.left.R, 8) || !within(right.G, tt.right.G, 8) {
+				t.Errorf("Transform with options %v returned pixels %v and %v, want %v and %v", tt.opt, left, right, tt.left, tt.right)
+			}
+			continue
+		}
+		if left != tt.left || right != tt.right {
+			t.Errorf("Transform with options %v returned pixels %v and %v, want %v and %v", tt.opt, left, right, tt.left, tt.right)
+		}
+	}
+
+	// other images are not affected
+	buf.Reset()
+	png.Encode(buf, newImage(2, 2, red))
+	out, err := Transform(buf.Bytes(), Options{ExtractFrame: true, Frame: 1})
+	if _, format, _ := image.DecodeConfig(bytes.NewReader(out)); err != nil || format != "png" {
+		t.Errorf("Transform of png with ExtractFrame returned format %q, err %v", format, err)
+	}
+}
+
+func TestTransform_GIFDisposal(t *testing.T) {
+	transparent := color.NRGBA{}
+	p := color.Palette{transparent, red, green, blue}
+	frame := func(r image.Rectangle, c uint8) *image.Paletted {
+		m := image.NewPaletted(r, p)
+		for i := range m.Pix {
+			m.Pix[i] = c
+		}
+		return m
+	}
+	// a red frame, followed by a frame which covers part of it and is
+	// disposed of to the background, and frames which change one pixel
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 4, 4), 1),
+			frame(image.Rect(2, 0, 4, 4), 2),
+			frame(image.Rect(0, 3, 1, 4), 3),
+			frame(image.Rect(0, 3, 1, 4), 3),
+		},
+		Delay:    []int{10, 20, 30, 40},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone, gif.DisposalNone},
+	}
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, g)
+
+	out, err := Transform(buf.Bytes(), Options{FlipHorizontal: true})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	got, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed gif: %v", err)
+	}
+	if len(got.Image) != 4 {
+		t.Fatalf("transformed gif has %d frames, want 4", len(got.Image))
+	}
+	if !reflect.DeepEqual(got.Delay, g.Delay) {
+		t.Errorf("transformed gif has delays %v, want %v", got.Delay, g.Delay)
+	}
+	// frames which do not change the canvas are cropped
+	if b := got.Image[3].Bounds(); b.Dx()*b.Dy() != 1 {
+		t.Errorf("unchanged frame has bounds %v, want a single pixel", b)
+	}
+
+	// each frame is displayed flipped, with only the part of the canvas
+	// covered by the second frame cleared after it
+	want := [][2]color.NRGBA{
+		{red, red},
+		{green, red},
+		{transparent, red},
+		{transparent, red},
+	}
+	err = composeGIF(got, len(got.Image), func(i int, m *image.NRGBA) error {
+		left, right := m.NRGBAAt(0, 0), m.NRGBAAt(3, 0)
+		if left != want[i][0] || right != want[i][1] {
+			t.Errorf("frame %d displays pixels %v and %v, want %v and %v", i, left, right, want[i][0], want[i][1])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("error composing transformed gif: %v", err)
+	}
+}
+
+func TestTransform_AnimatedWebP(t *testing.T) {
+	p := color.Palette{red, green, blue}
+	var frames []*image.Paletted
+	for i := range p {
+		m := image.NewPaletted(image.Rect(0, 0, 8, 4), p)
+		for j := range m.Pix {
+			m.Pix[j] = uint8(i)
+		}
+		frames = append(frames, m)
+	}
+	g := &gif.GIF{Image: frames, Delay: []int{10, 25, 7}, LoopCount: 2}
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, g)
+
+	out, err := Transform(buf.Bytes(), Options{Width: 4, Format: "webp"})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	if len(out) < 12 || string(out[:4]) != "RIFF" || string(out[8:12]) != "WEBP" {
+		t.Fatalf("Transform did not return a webp image")
+	}
+
+	// read the chunks of the animation, which the webp decoder does not
+	// support
+	var loopCount int
+	var delays []int
+	for b := out[12:]; len(b) >= 8; {
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		data := b[8 : 8+n]
+		switch string(b[:4]) {
+		case "VP8X":
+			w := int(data[4]) | int(data[5])<<8 | int(data[6])<<16 + 1
+			h := int(data[7]) | int(data[8])<<8 | int(data[9])<<16 + 1
+			if w != 4 || h != 2 {
+				t.Errorf("Transform returned animation of size %dx%d, want 4x2", w, h)
+			}
+		case "ANIM":
+			loopCount = int(binary.LittleEndian.Uint16(data[4:]))
+		case "ANMF":
+			delays = append(delays, int(data[12])|int(data[13])<<8|int(data[14])<<16)
+		}
+		b = b[8+n+n%2:]
+	}
+	if loopCount != 3 {
+		t.Errorf("Transform returned loop count %d, want 3", loopCount)
+	}
+	if want := []int{100, 250, 70}; !reflect.DeepEqual(delays, want) {
+		t.Errorf("Transform returned frame delays %v, want %v", delays, want)
+	}
+
+	// single frames are encoded as still images
+	buf.Reset()
+	gif.Encode(buf, frames[0], nil)
+	out, err = Transform(buf.Bytes(), Options{Width: 4, Format: "webp"})
+	if err != nil {
+		t.Fatalf("Transform of single frame returned unexpected error: %v", err)
+	}
+	if cfg, format, err := image.DecodeConfig(bytes.NewReader(out)); err != nil || format != "webp" || cfg.Width != 4 {
+		t.Errorf("Transform of single frame returned %s image of width %d, err %v; want webp of width 4", format, cfg.Width, err)
+	}
+}
+
+// animatedWebP returns an animated WebP image with n frames of size w by h,
+// each filled with a different color.
+func animatedWebP(t *testing.T, w, h, n int) []byte {
+	a := &webp.Animation{LoopCount: 2}
+	for i := 0; i < n; i++ {
+		a.Image = append(a.Image, newImage(w, h, []color.NRGBA{red, green, blue, yellow}[i%4]))
+		a.Delay = append(a.Delay, 10*(i+1))
+	}
+	buf := new(bytes.Buffer)
+	if err := webp.EncodeAll(buf, a, nil); err != nil {
+		t.Fatalf("EncodeAll returned error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// webpFrames returns the number of frames of the WebP image img.
+func webpFrames(t *testing.T, img []byte) int {
+	if !webp.IsAnimated(img) {
+		if _, format, err := image.DecodeConfig(bytes.NewReader(img)); err != nil || format != "webp" {
+			t.Fatalf("image is not a webp image: %v", err)
+		}
+		return 1
+	}
+	_, n, err := webp.DecodeAnimationConfig(img)
+	if err != nil {
+		t.Fatalf("DecodeAnimationConfig returned error: %v", err)
+	}
+	return n
+}
+
+func TestTransform_AnimatedWebPInput(t *testing.T) {
+	in := animatedWebP(t, 8, 4, 3)
+
+	// animations remain animated, even without an explicit format
+	for _, opt := range []Options{{Width: 4}, {Width: 4, Format: "webp"}} {
+		out, err := Transform(in, opt)
+		if err != nil {
+			t.Fatalf("Transform(%v) returned unexpected error: %v", opt, err)
+		}
+		a, err := webp.DecodeAll(out, 0)
+		if err != nil {
+			t.Fatalf("Transform(%v) did not return an animated webp: %v", opt, err)
+		}
+		if got := a.Image[0].Bounds(); got != image.Rect(0, 0, 4, 2) {
+			t.Errorf("Transform(%v) returned frames with bounds %v, want 4x2", opt, got)
+		}
+		if want := []int{10, 20, 30}; !reflect.DeepEqual(a.Delay, want) {
+			t.Errorf("Transform(%v) returned frame delays %v, want %v", opt, a.Delay, want)
+		}
+		if a.LoopCount != 2 {
+			t.Errorf("Transform(%v) returned loop count %d, want 2", opt, a.LoopCount)
+		}
+	}
+
+	// other formats keep only the first frame
+	out, err := Transform(in, Options{Width: 4, Format: "png"})
+	if err != nil {
+		t.Fatalf("Transform to png returned unexpected error: %v", err)
+	}
+	m, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Transform to png returned invalid png: %v", err)
+	}
+	if c := color.NRGBAModel.Convert(m.At(1, 1)).(color.NRGBA); c.R < 200 || c.G > 50 || c.B > 50 {
+		t.Errorf("Transform to png returned color %v, want the red first frame", c)
+	}
+}
+
+func TestTransform_AnimatedWebPMaxFrames(t *testing.T) {
+	defer func(max, pixels int, truncate bool) {
+		MaxFrames, MaxPixels, TruncateFrames = max, pixels, truncate
+	}(MaxFrames, MaxPixels, TruncateFrames)
+
+	in := animatedWebP(t, 10, 10, 4)
+	opt := Options{Width: 5}
+
+	tests := []struct {
+		maxFrames, maxPixels int
+		truncate             bool
+		frames               int // number of frames returned, or 0 for an error
+	}{
+		{0, 0, false, 4},
+		{4, 400, false, 4},
+		{3, 0, false, 0},
+		{0, 300, false, 0},
+		{3, 0, true, 3},
+		{0, 250, true, 2},
+		{3, 150, true, 1},
+	}
+
+	for _, tt := range tests {
+		MaxFrames, MaxPixels, TruncateFrames = tt.maxFrames, tt.maxPixels, tt.truncate
+		out, err := Transform(in, opt)
+		if tt.frames == 0 {
+			if err == nil {
+				t.Errorf("Transform with MaxFrames %d, MaxPixels %d did not return expected error", tt.maxFrames, tt.maxPixels)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Transform with MaxFrames %d, MaxPixels %d returned unexpected error: %v", tt.maxFrames, tt.maxPixels, err)
+			continue
+		}
+		if got := webpFrames(t, out); got != tt.frames {
+			t.Errorf("Transform with MaxFrames %d, MaxPixels %d returned %d frames, want %d", tt.maxFrames, tt.maxPixels, got, tt.frames)
+		}
+	}
+}
+
+func TestWebPLoopCount(t *testing.T) {
+	tests := []struct {
+		gif, want int
+	}{
+		{0, 0},
+		{-1, 1},
+		{1, 2},
+		{0xffff, 0xffff},
+	}
+	for _, tt := range tests {
+		if got := webpLoopCount(tt.gif); got != tt.want {
+			t.Errorf("webpLoopCount(%d) returned %d, want %d", tt.gif, got, tt.want)
+		}
+	}
+}
+
+func TestTransform_MaxFrames(t *testing.T) {
+	defer func(max, pixels int, truncate bool) {
+		MaxFrames, MaxPixels, TruncateFrames = max, pixels, truncate
+	}(MaxFrames, MaxPixels, TruncateFrames)
+
+	frame := image.NewPaletted(image.Rect(0, 0, 10, 10), color.Palette{red, green})
+	g := &gif.GIF{
+		Image:    []*image.Paletted{frame, frame, frame, frame},
+		Delay:    []int{10, 20, 30, 40},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalNone, gif.DisposalNone},
+	}
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, g)
+	in := buf.Bytes()
+	opt := Options{Width: 5}
+
+	tests := []struct {
+		maxFrames, maxPixels int
+		truncate             bool
+		frames               int // number of frames returned, or 0 for an error
+	}{
+		{0, 0, false, 4},
+		{4, 400, false, 4},
+		{3, 0, false, 0},
+		{0, 300, false, 0},
+		{3, 0, true, 3},
+		{0, 250, true, 2},
+		{3, 150, true, 1},
+	}
+
+	for _, tt := range tests {
+		MaxFrames, MaxPixels, TruncateFrames = tt.maxFrames, tt.maxPixels, tt.truncate
+		out, err := Transform(in, opt)
+		if tt.frames == 0 {
+			if err == nil {
+				t.Errorf("Transform with MaxFrames %d, MaxPixels %d did not return expected error", tt.maxFrames, tt.maxPixels)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Transform with MaxFrames %d, MaxPixels %d returned unexpected error: %v", tt.maxFrames, tt.maxPixels, err)
+			continue
+		}
+		g, err := gif.DecodeAll(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("Transform with MaxFrames %d, MaxPixels %d returned invalid gif: %v", tt.maxFrames, tt.maxPixels, err)
+			continue
+		}
+		if got := len(g.Image); got != tt.frames {
+			t.Errorf("Transform with MaxFrames %d, MaxPixels %d returned %d frames, want %d", tt.maxFrames, tt.maxPixels, got, tt.frames)
+		}
+	}
+}
+
+func TestTransform_GrayscaleGIF(t *testing.T) {
+	palette := color.Palette{red, green, blue, yellow}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 2, 2), palette),
+			image.NewPaletted(image.Rect(0, 0, 2, 2), palette),
+		},
+		Delay: []int{10, 10},
+	}
+	copy(g.Image[0].Pix, []uint8{0, 1, 2, 3})
+	copy(g.Image[1].Pix, []uint8{3, 2, 1, 0})
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, g)
+
+	out, err := Transform(buf.Bytes(), Options{Grayscale: true})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	got, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed gif: %v", err)
+	}
+	if len(got.Image) != 2 {
+		t.Fatalf("transformed gif has %d frames, want 2", len(got.Image))
+	}
+	for i, frame := range got.Image {
+		b := frame.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if r, g, b, _ := frame.At(x, y).RGBA(); r != g || g != b {
+					t.Errorf("frame %d pixel (%d,%d) is not gray: %v", i, x, y, frame.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+// test that color adjustments of animated GIFs apply to every frame, rather
+// than being undone by mapping the frames back onto their original palettes.
+func TestTransform_ColorGIF(t *testing.T) {
+	palette := color.Palette{red, blue, color.NRGBA{100, 150, 200, 255}, color.NRGBA{60, 60, 60, 255}}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 2, 2), palette),
+			image.NewPaletted(image.Rect(0, 0, 2, 2), palette),
+			image.NewPaletted(image.Rect(0, 0, 2, 2), palette),
+		},
+		Delay: []int{10, 10, 10},
+	}
+	copy(g.Image[0].Pix, []uint8{0, 1, 2, 3})
+	copy(g.Image[1].Pix, []uint8{3, 2, 1, 0})
+	copy(g.Image[2].Pix, []uint8{1, 0, 3, 2})
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, g)
+
+	tests := []Options{
+		{Brightness: 10},
+		{Brightness: -40},
+		{Contrast: 20},
+		{Contrast: -50, Brightness: 5},
+		{Saturation: -100},
+		{Saturation: 50},
+		{Hue: 120},
+		{Hue: 270, Saturation: 30},
+		{Sepia: 100},
+		{Sepia: 40, Brightness: -10},
+		{Invert: true},
+		{Invert: true, Grayscale: true},
+	}
+	for _, opt := range tests {
+		out, err := Transform(buf.Bytes(), opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", opt, err)
+			continue
+		}
+		got, err := gif.DecodeAll(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("Transform(%v) returned invalid gif: %v", opt, err)
+			continue
+		}
+		if len(got.Image) != len(g.Image) {
+			t.Errorf("Transform(%v) returned %d frames, want %d", opt, len(got.Image), len(g.Image))
+			continue
+		}
+		for i, frame := range got.Image {
+			for j, idx := range g.Image[i].Pix {
+				x, y := j%2, j/2
+				want := color.NRGBAModel.Convert(mustTransformImage(t, newImage(1, 1, palette[idx].(color.NRGBA)), opt).At(0, 0))
+				if c := color.NRGBAModel.Convert(frame.At(x, y)); c != want {
+					t.Errorf("Transform(%v) frame %d pixel (%d,%d) is %v, want %v", opt, i, x, y, c, want)
+				}
+			}
+		}
+	}
+}
+
+// sofMarker returns the Start Of Frame marker of the JPEG image b, or 0 if
+// none is found before the image data.
+func sofMarker(b []byte) byte {
+	for i := 2; i+4 <= len(b) && b[i] == 0xff; {
+		marker := b[i+1]
+		if marker >= 0xc0 && marker <= 0xc2 {
+			return marker
+		}
+		if marker == 0xda { // start of scan
+			break
+		}
+		i += 2 + (int(b[i+2])<<8 | int(b[i+3]))
+	}
+	return 0
+}
+
+func TestTransform_Progressive(t *testing.T) {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, newImage(40, 30, red, yellow, green, blue), nil)
+	in := buf.Bytes()
+
+	tests := []struct {
+		opt  Options
+		want byte
 	}{
-		{Options{Width: 0.5}, 32, 0, true},
-		{Options{Height: 0.5}, 0, 64, true},
-		{Options{Width: 0.5, Height: 0.5}, 32, 64, true},
-		{Options{Width: 100, Height: 200}, 0, 0, false},
-		{Options{Width: 100, Height: 200, ScaleUp: true}, 100, 200, true},
-		{Options{Width: 64}, 0, 0, false},
-		{Options{Height: 128}, 0, 0, false},
+		{Options{Width: 20}, 0xc0},
+		{Options{Width: 20, Progressive: true}, 0xc2},
+		{Options{Progressive: true}, 0xc2},
+		{Options{Progressive: true, Quality: 50}, 0xc2},
 	}
 	for _, tt := range tests {
-		w, h, resize := resizeParams(src, tt.opt)
-		if w != tt.w || h != tt.h || resize != tt.resize {
-			t.Errorf("resizeParams(%v) returned (%d,%d,%t), want (%d,%d,%t)", tt.opt, w, h, resize, tt.w, tt.h, tt.resize)
+		out, err := Transform(in, tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
 		}
+		if got := sofMarker(out); got != tt.want {
+			t.Errorf("Transform(%v) returned image with SOF marker %#x, want %#x", tt.opt, got, tt.want)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+			t.Errorf("Transform(%v) returned invalid jpeg: %v", tt.opt, err)
+		}
+	}
+
+	// progressive only affects jpeg output
+	out, err := Transform(in, Options{Format: "png", Progressive: true})
+	if err != nil {
+		t.Errorf("Transform returned unexpected error: %v", err)
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(out)); err != nil || format != "png" {
+		t.Errorf("Transform with png format returned format %q, err %v", format, err)
 	}
 }
 
-func TestTransform(t *testing.T) {
-	src := newImage(2, 2, red, green, blue, yellow)
+// lumaSampling returns the sampling factors of the first component in the
+// Start Of Frame segment of the JPEG data b, or 0 if there is none.
+func lumaSampling(b []byte) byte {
+	for i := 2; i+4 <= len(b) && b[i] == 0xff; {
+		marker := b[i+1]
+		if marker >= 0xc0 && marker <= 0xc2 && i+11 < len(b) {
+			// length, precision, height, width, number of
+			// components, then component id and sampling factors
+			return b[i+11]
+		}
+		if marker == 0xda { // start of scan
+			break
+		}
+		i += 2 + (int(b[i+2])<<8 | int(b[i+3]))
+	}
+	return 0
+}
 
+func TestTransform_Subsampling(t *testing.T) {
 	buf := new(bytes.Buffer)
-	png.Encode(buf, src)
+	jpeg.Encode(buf, newImage(32, 32, red, blue), nil)
+	in := buf.Bytes()
 
 	tests := []struct {
-		name        string
-		encode      func(io.Writer, image.Image)
-		exactOutput bool // whether input and output should match exactly
+		opt  Options
+		want byte
 	}{
-		{"gif", func(w io.Writer, m image.Image) { gif.Encode(w, m, nil) }, true},
-		{"jpeg", func(w io.Writer, m image.Image) { jpeg.Encode(w, m, nil) }, false},
-		{"png", func(w io.Writer, m image.Image) { png.Encode(w, m) }, true},
+		{Options{Width: 16}, 0x22},
+		{Options{Width: 16, Subsampling: 420}, 0x22},
+		{Options{Width: 16, Subsampling: 422}, 0x21},
+		{Options{Width: 16, Subsampling: 444}, 0x11},
+		{Options{Subsampling: 444}, 0x11},
+		{Options{Progressive: true, Subsampling: 444}, 0x11},
 	}
-
 	for _, tt := range tests {
-		buf := new(bytes.Buffer)
-		tt.encode(buf, src)
-		in := buf.Bytes()
+		out, err := Transform(in, tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		if got := lumaSampling(out); got != tt.want {
+			t.Errorf("Transform(%v) returned image with luma sampling factors %#x, want %#x", tt.opt, got, tt.want)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+			t.Errorf("Transform(%v) returned invalid jpeg: %v", tt.opt, err)
+		}
+	}
+}
 
-		out, err := Transform(in, emptyOptions)
+func TestTransform_PNGCompression(t *testing.T) {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, newImage(64, 64, red, yellow, green, blue))
+	in := buf.Bytes()
+
+	sizes := make(map[png.CompressionLevel]int)
+	for _, level := range []png.CompressionLevel{png.DefaultCompression, png.NoCompression, png.BestSpeed, png.BestCompression} {
+		out, err := Transform(in, Options{Width: 32, PNGCompression: level})
 		if err != nil {
-			t.Errorf("Transform with encoder %s returned unexpected error: %v", tt.name, err)
+			t.Errorf("Transform with compression %d returned unexpected error: %v", level, err)
+			continue
 		}
-		if !reflect.DeepEqual(in, out) {
-			t.Errorf("Transform with with encoder %s with empty options returned modified result", tt.name)
+		if _, format, err := image.DecodeConfig(bytes.NewReader(out)); err != nil || format != "png" {
+			t.Errorf("Transform with compression %d returned format %q, err %v", level, format, err)
 		}
+		sizes[level] = len(out)
+	}
+	if sizes[png.BestCompression] >= sizes[png.NoCompression] {
+		t.Errorf("BestCompression output (%d bytes) not smaller than NoCompression output (%d bytes)", sizes[png.BestCompression], sizes[png.NoCompression])
+	}
 
-		out, err = Transform(in, Options{Width: -1, Height: -1})
+	if _, err := Transform(in, Options{Width: 32, PNGCompression: 7}); err == nil {
+		t.Errorf("Transform with invalid compression level did not return expected err")
+	}
+}
+
+func TestTransform_Background(t *testing.T) {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, newImage(8, 8, color.NRGBA{}))
+	in := buf.Bytes()
+
+	tests := []struct {
+		opt  Options
+		want color.Color
+	}{
+		{Options{Format: "jpeg"}, color.Black},
+		{Options{Format: "jpeg", Background: color.NRGBA{255, 255, 255, 255}}, color.White},
+		{Options{Format: "png", Background: color.NRGBA{255, 255, 255, 255}}, color.White},
+	}
+	for _, tt := range tests {
+		out, err := Transform(in, tt.opt)
 		if err != nil {
-			t.Errorf("Transform with encoder %s returned unexpected error: %v", tt.name, err)
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
 		}
-		if len(out) == 0 {
-			t.Errorf("Transform with encoder %s returned empty bytes", tt.name)
+		m, _, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("Transform(%v) returned invalid image: %v", tt.opt, err)
+			continue
 		}
-		if tt.exactOutput && !reflect.DeepEqual(in, out) {
-			t.Errorf("Transform with encoder %s with noop Options returned modified result", tt.name)
+		if got := color.GrayModel.Convert(m.At(4, 4)); got != color.GrayModel.Convert(tt.want) {
+			t.Errorf("Transform(%v) returned pixel %v, want %v", tt.opt, got, tt.want)
 		}
 	}
+}
 
-	if _, err := Transform([]byte{}, Options{Width: 1}); err == nil {
-		t.Errorf("Transform with invalid image input did not return expected err")
+func TestTransform_RoundedCorners(t *testing.T) {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, newImage(20, 20, red), nil)
+
+	out, err := Transform(buf.Bytes(), Options{RoundedCorners: 0.5})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	m, format, err := image.Decode(bytes.NewReader(out))
+	if err != nil || format != "png" {
+		t.Fatalf("Transform with rounded corners returned format %q, err %v; want png", format, err)
+	}
+	if _, _, _, a := m.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("Transform with rounded corners returned opaque corner")
+	}
+	if _, _, _, a := m.At(10, 10).RGBA(); a != 0xffff {
+		t.Errorf("Transform with rounded corners returned transparent center")
+	}
+
+	// each frame of animated gifs is masked
+	palette := color.Palette{red, green, blue, yellow}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 10, 10), palette),
+			image.NewPaletted(image.Rect(0, 0, 10, 10), palette),
+		},
+		Delay: []int{10, 10},
+	}
+	for i := range g.Image[1].Pix {
+		g.Image[1].Pix[i] = 2
+	}
+	buf.Reset()
+	gif.EncodeAll(buf, g)
+
+	out, err = Transform(buf.Bytes(), Options{RoundedCorners: 3})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	got, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed gif: %v", err)
+	}
+	if len(got.Image) != 2 {
+		t.Fatalf("transformed gif has %d frames, want 2", len(got.Image))
+	}
+	for i, frame := range got.Image {
+		if _, _, _, a := frame.At(0, 0).RGBA(); a != 0 {
+			t.Errorf("frame %d has opaque corner %v", i, frame.At(0, 0))
+		}
+		if _, _, _, a := frame.At(5, 5).RGBA(); a == 0 {
+			t.Errorf("frame %d has transparent center", i)
+		}
+	}
+}
+
+func TestTransform_Pad(t *testing.T) {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, newImage(20, 10, red), nil)
+
+	tests := []struct {
+		opt    Options
+		format string
+		pad    color.Color
+	}{
+		{Options{Width: 20, Height: 20, Pad: true}, "png", color.NRGBA{}},
+		{Options{Width: 20, Height: 20, Pad: true, Background: color.NRGBA{255, 255, 255, 255}}, "jpeg", color.White},
+		{Options{Width: 20, Height: 20, Pad: true, Format: "png", Background: color.NRGBA{0, 0, 0, 255}}, "png", color.Black},
+	}
+	for _, tt := range tests {
+		out, err := Transform(buf.Bytes(), tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		m, format, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("Transform(%v) returned invalid image: %v", tt.opt, err)
+			continue
+		}
+		if format != tt.format {
+			t.Errorf("Transform(%v) returned format %q, want %q", tt.opt, format, tt.format)
+		}
+		if got, want := m.Bounds(), image.Rect(0, 0, 20, 20); got != want {
+			t.Errorf("Transform(%v) returned bounds %v, want %v", tt.opt, got, want)
+		}
+		if got, want := color.NRGBAModel.Convert(m.At(10, 0)), color.NRGBAModel.Convert(tt.pad); got != want {
+			t.Errorf("Transform(%v) returned padding %v, want %v", tt.opt, got, want)
+		}
+	}
+}
+
+// test that borders may not expand the canvas beyond MaxPixels, or be wider
+// than maxBorderWidth.
+func TestTransform_BorderMaxPixels(t *testing.T) {
+	defer func(max int) { MaxPixels = max }(MaxPixels)
+	MaxPixels = 400
+
+	buf := new(bytes.Buffer)
+	png.Encode(buf, newImage(4, 4, red))
+
+	tests := []struct {
+		opt     Options
+		wantErr bool
+	}{
+		{Options{BorderWidth: 8}, false},
+		{Options{BorderWidth: 9}, true},
+		// inset borders do not expand the canvas
+		{Options{BorderWidth: 9, BorderInset: true}, false},
+		{Options{BorderWidth: maxBorderWidth + 1, BorderInset: true}, true},
+	}
+	for _, tt := range tests {
+		_, err := Transform(buf.Bytes(), tt.opt)
+		if tt.wantErr && err == nil {
+			t.Errorf("Transform(%v) did not return expected error", tt.opt)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+		}
+	}
+
+	opt := Options{BorderWidth: 1500}
+	if _, err := transformImage(newImage(4, 4, red), opt); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("transformImage(%v) returned error %v, want ErrTooLarge", opt, err)
+	}
+}
+
+// test that small images can not be padded to canvases exceeding MaxPixels.
+func TestTransform_PadMaxPixels(t *testing.T) {
+	defer func(max int) { MaxPixels = max }(MaxPixels)
+	MaxPixels = 400
+
+	buf := new(bytes.Buffer)
+	png.Encode(buf, newImage(4, 4, red))
+
+	opt := Options{Width: 21, Height: 20, Pad: true}
+	if _, err := Transform(buf.Bytes(), opt); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Transform(%v) returned error %v, want ErrTooLarge", opt, err)
+	}
+	opt = Options{Width: 20, Height: 20, Pad: true}
+	if _, err := Transform(buf.Bytes(), opt); err != nil {
+		t.Errorf("Transform(%v) returned unexpected error: %v", opt, err)
+	}
+	opt = Options{Width: 3000, Height: 3000, Pad: true}
+	if _, err := transformImage(newImage(4, 4, red), opt); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("transformImage(%v) returned error %v, want ErrTooLarge", opt, err)
+	}
+}
+
+func TestTransform_Watermark(t *testing.T) {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, newImage(40, 40, red))
+	in := buf.Bytes()
+
+	defer func(wm image.Image) { Watermark = wm }(Watermark)
+	Watermark = nil
+	out, err := Transform(in, Options{WatermarkPosition: "center"})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	m, _ := png.Decode(bytes.NewReader(out))
+	if got := color.NRGBAModel.Convert(m.At(20, 20)); got != red {
+		t.Errorf("Transform without watermark image returned pixel %v, want %v", got, red)
+	}
+
+	Watermark = newImage(4, 4, blue)
+	out, err = Transform(in, Options{Width: 20, WatermarkPosition: "southeast"})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	m, _ = png.Decode(bytes.NewReader(out))
+	if got := color.NRGBAModel.Convert(m.At(19, 19)); got != blue {
+		t.Errorf("Transform with watermark returned pixel %v, want %v", got, blue)
+	}
+	if got := color.NRGBAModel.Convert(m.At(0, 0)); got != red {
+		t.Errorf("Transform with watermark returned pixel %v, want %v", got, red)
+	}
+
+	if _, err := Transform(in, Options{WatermarkPosition: "left"}); err == nil {
+		t.Errorf("Transform with invalid watermark position did not return expected err")
+	}
+}
+
+func TestTransform_Border(t *testing.T) {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, newImage(10, 10, red), nil)
+	in := buf.Bytes()
+
+	tests := []struct {
+		opt    Options
+		size   image.Point
+		format string
+	}{
+		{Options{BorderWidth: 5, BorderColor: color.NRGBA{255, 255, 255, 255}}, image.Pt(20, 20), "jpeg"},
+		{Options{BorderWidth: 5, BorderInset: true}, image.Pt(10, 10), "jpeg"},
+		{Options{Width: 4, BorderWidth: 1}, image.Pt(6, 6), "jpeg"},
+		// borders which are not opaque need transparency
+		{Options{BorderWidth: 1, BorderColor: color.NRGBA{255, 255, 255, 128}}, image.Pt(12, 12), "png"},
+		{Options{BorderWidth: 1, RoundedCorners: 3}, image.Pt(12, 12), "png"},
+		{Options{BorderWidth: 1, RoundedCorners: 3, Background: color.NRGBA{255, 255, 255, 255}}, image.Pt(12, 12), "jpeg"},
+	}
+	for _, tt := range tests {
+		out, err := Transform(in, tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("Transform(%v) returned invalid image: %v", tt.opt, err)
+			continue
+		}
+		if got := image.Pt(cfg.Width, cfg.Height); got != tt.size || format != tt.format {
+			t.Errorf("Transform(%v) returned %v %s image, want %v %s", tt.opt, got, format, tt.size, tt.format)
+		}
 	}
 }
 
@@ -124,9 +2141,6 @@ func TestTransformImage(t *testing.T) {
 	// ref is a 2x2 reference image containing four colors
 	ref := newImage(2, 2, red, green, blue, yellow)
 
-	// use simpler filter while testing that won't skew colors
-	resampleFilter = imaging.Box
-
 	tests := []struct {
 		src  image.Image // source image to transform
 		opt  Options     // options to apply during transform
@@ -136,11 +2150,28 @@ func TestTransformImage(t *testing.T) {
 		{ref, emptyOptions, ref},
 
 		// rotations
-		{ref, Options{Rotate: 45}, ref}, // invalid rotation is a noop
+		{ref, Options{Rotate: 360}, ref}, // full rotation is a noop
 		{ref, Options{Rotate: 90}, newImage(2, 2, green, yellow, red, blue)},
 		{ref, Options{Rotate: 180}, newImage(2, 2, yellow, blue, green, red)},
 		{ref, Options{Rotate: 270}, newImage(2, 2, blue, red, yellow, green)},
 
+		// trim
+		{
+			newImage(3, 2, yellow, red, yellow, yellow, yellow, yellow),
+			Options{Trim: true},
+			newImage(1, 1, red),
+		},
+		{ref, Options{Trim: true}, ref},
+
+		// background
+		{
+			newImage(2, 2, red, color.NRGBA{}, color.NRGBA{0, 0, 255, 0}, yellow),
+			Options{Background: color.NRGBA{255, 255, 255, 255}},
+			newImage(2, 2, red, color.NRGBA{255, 255, 255, 255}, color.NRGBA{255, 255, 255, 255}, yellow),
+		},
+		{ref, Options{Background: color.NRGBA{255, 255, 255, 255}}, ref},
+		{ref, Options{Background: color.NRGBA{255, 255, 255, 0}}, ref},
+
 		// flips
 		{
 			ref,
@@ -158,6 +2189,23 @@ func TestTransformImage(t *testing.T) {
 			newImage(2, 2, yellow, blue, green, red),
 		},
 
+		// crops
+		{
+			ref,
+			Options{CropX: 1, CropWidth: 1},
+			newImage(1, 2, green, yellow),
+		},
+		{
+			ref,
+			Options{CropY: 1, CropHeight: 5},
+			newImage(2, 1, blue, yellow),
+		},
+		{ // crop is applied before resizing
+			newImage(4, 4, red, red, green, green, red, red, green, green, blue, blue, yellow, yellow, blue, blue, yellow, yellow),
+			Options{CropX: 0.5, CropY: 0.5, Width: 1, Height: 1},
+			newImage(1, 1, yellow),
+		},
+
 		// resizing
 		{ // can't resize larger than original image
 			ref,
@@ -174,6 +2222,11 @@ func TestTransformImage(t *testing.T) {
 			Options{Width: -1, Height: -1},
 			ref,
 		},
+		{ // nearest neighbor filter, which does not blend colors
+			newImage(4, 1, red, blue, red, blue),
+			Options{Width: 2, Filter: "nearest"},
+			newImage(2, 1, blue, blue),
+		},
 		{ // absolute values
 			newImage(100, 100, red),
 			Options{Width: 1, Height: 1},
@@ -215,6 +2268,88 @@ func TestTransformImage(t *testing.T) {
 			newImage(2, 1, red, blue),
 		},
 
+		// padding
+		{ // pad option fits the image and pads it to the exact size
+			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
+			Options{Width: 2, Height: 2, Pad: true},
+			newImage(2, 2, color.NRGBA{}, color.NRGBA{}, red, blue),
+		},
+		{ // images too small to fill the canvas are still padded
+			ref,
+			Options{Width: 4, Height: 2, Pad: true},
+			newImage(4, 2, color.NRGBA{}, red, green, color.NRGBA{}, color.NRGBA{}, blue, yellow, color.NRGBA{}),
+		},
+		{ // padding is flattened onto the background color
+			ref,
+			Options{Width: 2, Height: 3, Pad: true, Background: color.NRGBA{255, 255, 255, 255}},
+			newImage(2, 3, red, green, blue, yellow, color.NRGBA{255, 255, 255, 255}, color.NRGBA{255, 255, 255, 255}),
+		},
+		{ref, Options{Width: 2, Height: 2, Pad: true}, ref},
+		{ref, Options{Width: 4, Pad: true}, ref}, // pad requires width and height
+
+		// colors
+		{
+			ref,
+			Options{Grayscale: true},
+			newImage(2, 2,
+				color.NRGBA{76, 76, 76, 255}, color.NRGBA{150, 150, 150, 255},
+				color.NRGBA{29, 29, 29, 255}, color.NRGBA{226, 226, 226, 255}),
+		},
+
+		{ref, Options{Brightness: 10}, imaging.AdjustBrightness(ref, 10)},
+		{ref, Options{Contrast: -20}, imaging.AdjustContrast(ref, -20)},
+		{ref, Options{Gamma: 1.2}, imaging.AdjustGamma(ref, 1.2)},
+		{ref, Options{Gamma: 1}, ref},
+		{
+			ref,
+			Options{Saturation: -100},
+			newImage(2, 2,
+				color.NRGBA{128, 128, 128, 255}, color.NRGBA{128, 128, 128, 255},
+				color.NRGBA{128, 128, 128, 255}, color.NRGBA{128, 128, 128, 255}),
+		},
+		{ref, Options{Saturation: 50}, ref}, // already fully saturated
+		{
+			ref,
+			Options{Hue: 120},
+			newImage(2, 2, green, blue, red, color.NRGBA{0, 255, 255, 255}),
+		},
+		{ref, Options{Hue: 360}, ref},
+		{ref, Options{Sepia: 60}, sepia(ref, 60)},
+		{
+			newImage(2, 1, color.NRGBA{255, 255, 255, 255}, color.NRGBA{255, 255, 255, 0}),
+			Options{Invert: true},
+			newImage(2, 1, color.NRGBA{0, 0, 0, 255}, color.NRGBA{0, 0, 0, 0}),
+		},
+		{ // colors are inverted after conversion to grayscale
+			ref,
+			Options{Grayscale: true, Invert: true},
+			newImage(2, 2,
+				color.NRGBA{179, 179, 179, 255}, color.NRGBA{105, 105, 105, 255},
+				color.NRGBA{226, 226, 226, 255}, color.NRGBA{29, 29, 29, 255}),
+		},
+		{ // sepia toning is applied after resizing
+			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
+			Options{Width: 2, Height: 1, Sepia: 100},
+			sepia(newImage(2, 1, red, blue), 100),
+		},
+		{ // colors are adjusted in a fixed order
+			ref,
+			Options{Brightness: -50, Contrast: 50, Gamma: 0.8, Grayscale: true},
+			imaging.Grayscale(imaging.AdjustGamma(imaging.AdjustContrast(imaging.AdjustBrightness(ref, -50), 50), 0.8)),
+		},
+
+		// filters
+		{ref, Options{Blur: 1}, imaging.Blur(ref, 1)},
+		{ref, Options{Blur: -1}, ref}, // invalid blur is a noop
+		{ref, Options{Sharpen: 0.8}, imaging.Sharpen(ref, 0.8)},
+		{ref, Options{Sharpen: -1}, ref}, // invalid sharpen is a noop
+		{ref, Options{Pixelate: 1}, ref},
+		{ // pixelation is applied after resizing
+			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
+			Options{Width: 2, Height: 1, Pixelate: 2},
+			newImage(2, 1, color.NRGBA{128, 0, 128, 255}, color.NRGBA{128, 0, 128, 255}),
+		},
+
 		// combinations of options
 		{
 			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
@@ -224,8 +2359,56 @@ func TestTransformImage(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		if got := transformImage(tt.src, tt.opt); !reflect.DeepEqual(got, tt.want) {
+		// use simpler filter while testing that won't skew colors
+		if tt.opt.Filter == "" {
+			tt.opt.Filter = "box"
+		}
+		if got := mustTransformImage(t, tt.src, tt.opt); !reflect.DeepEqual(got, tt.want) {
 			t.Errorf("trasformImage(%v, %v) returned image %#v, want %#v", tt.src, tt.opt, got, tt.want)
 		}
 	}
 }
+
+func TestResizeScale(t *testing.T) {
+	tests := []struct {
+		src, dst image.Rectangle
+		want     float64
+	}{
+		{image.Rect(0, 0, 100, 50), image.Rect(0, 0, 100, 50), 1},
+		{image.Rect(0, 0, 100, 50), image.Rect(0, 0, 25, 12), 0.25},
+		{image.Rect(0, 0, 100, 50), image.Rect(0, 0, 20, 20), 0.4}, // cropped
+		{image.Rect(0, 0, 100, 50), image.Rect(0, 0, 200, 100), 2},
+		{image.Rect(0, 0, 0, 0), image.Rect(0, 0, 10, 10), 1},
+	}
+
+	for _, tt := range tests {
+		if got := resizeScale(tt.src, tt.dst); got != tt.want {
+			t.Errorf("resizeScale(%v, %v) returned %v, want %v", tt.src, tt.dst, got, tt.want)
+		}
+	}
+}
+
+func TestTransformImage_AutoSharpen(t *testing.T) {
+	m := imaging.Resize(newImage(2, 2, red, green, blue, yellow), 40, 40, imaging.Linear)
+	resized := mustTransformImage(t, m, Options{Width: 10})
+	if sharpened := imaging.Sharpen(resized, autoSharpenSigma); reflect.DeepEqual(sharpened, resized) {
+		t.Fatalf("sharpening test image has no effect")
+	}
+
+	tests := []struct {
+		opt  Options
+		want image.Image
+	}{
+		{Options{Width: 10, AutoSharpen: true}, imaging.Sharpen(resized, autoSharpenSigma)},
+		{Options{Width: 10, AutoSharpen: true, Sharpen: 2}, imaging.Sharpen(resized, 2)},
+		{Options{Width: 30, AutoSharpen: true}, mustTransformImage(t, m, Options{Width: 30})},
+		{Options{Width: 80, ScaleUp: true, AutoSharpen: true}, mustTransformImage(t, m, Options{Width: 80, ScaleUp: true})},
+		{Options{AutoSharpen: true}, m},
+	}
+
+	for _, tt := range tests {
+		if got := mustTransformImage(t, m, tt.opt); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("transformImage(%v) did not return the expected image", tt.opt)
+		}
+	}
+}
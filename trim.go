@@ -0,0 +1,82 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+)
+
+// trimBounds returns the rectangle of m remaining after trimming the uniform
+// borders of the color of its top-left pixel.  Pixels whose channels all
+// differ from the border color by at most tolerance (from 0 to 255) are
+// considered part of the border.  If all of m is the border color, its full
+// bounds are returned.
+func trimBounds(m image.Image, tolerance float64) image.Rectangle {
+	b := m.Bounds()
+	if b.Empty() {
+		return b
+	}
+	border := color.NRGBAModel.Convert(m.At(b.Min.X, b.Min.Y)).(color.NRGBA)
+	matches := func(x, y int) bool {
+		c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+		return within(c.R, border.R, tolerance) && within(c.G, border.G, tolerance) &&
+			within(c.B, border.B, tolerance) && within(c.A, border.A, tolerance)
+	}
+	row := func(y, x0, x1 int) bool {
+		for x := x0; x < x1; x++ {
+			if !matches(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	col := func(x, y0, y1 int) bool {
+		for y := y0; y < y1; y++ {
+			if !matches(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	r := b
+	for r.Min.Y < r.Max.Y && row(r.Min.Y, r.Min.X, r.Max.X) {
+		r.Min.Y++
+	}
+	if r.Min.Y == r.Max.Y {
+		// the whole image is the border color
+		return b
+	}
+	for row(r.Max.Y-1, r.Min.X, r.Max.X) {
+		r.Max.Y--
+	}
+	for col(r.Min.X, r.Min.Y, r.Max.Y) {
+		r.Min.X++
+	}
+	for col(r.Max.X-1, r.Min.Y, r.Max.Y) {
+		r.Max.X--
+	}
+	return r
+}
+
+// within returns whether a and b differ by at most tolerance.
+func within(a, b uint8, tolerance float64) bool {
+	d := int(a) - int(b)
+	if d < 0 {
+		d = -d
+	}
+	return float64(d) <= tolerance
+}
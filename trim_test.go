@@ -0,0 +1,70 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestTrimBounds(t *testing.T) {
+	white := color.NRGBA{255, 255, 255, 255}
+	offWhite := color.NRGBA{250, 252, 255, 255}
+
+	// newLogo returns a 20x10 image of border color c with a red
+	// rectangle at r.
+	newLogo := func(c color.NRGBA, r image.Rectangle) image.Image {
+		m := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+		draw.Draw(m, m.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		draw.Draw(m, r, image.NewUniform(red), image.Point{}, draw.Src)
+		return m
+	}
+
+	tests := []struct {
+		m         image.Image
+		tolerance float64
+		want      image.Rectangle
+	}{
+		{newLogo(white, image.Rect(5, 2, 15, 8)), 0, image.Rect(5, 2, 15, 8)},
+		{newLogo(white, image.Rect(0, 2, 15, 8)), 0, image.Rect(0, 2, 15, 8)},
+		{newLogo(white, image.Rect(19, 9, 20, 10)), 0, image.Rect(19, 9, 20, 10)},
+		{newLogo(white, image.Rect(0, 0, 20, 10)), 0, image.Rect(0, 0, 20, 10)},
+
+		// uniform images are not trimmed
+		{newImage(20, 10, white), 0, image.Rect(0, 0, 20, 10)},
+
+		// near-white pixels only trimmed within tolerance
+		{newLogo(white, image.Rect(3, 3, 4, 4)), 0, image.Rect(3, 3, 4, 4)},
+		{newOffWhite(newLogo(white, image.Rect(5, 2, 15, 8)), offWhite), 0, image.Rect(5, 2, 20, 10)},
+		{newOffWhite(newLogo(white, image.Rect(5, 2, 15, 8)), offWhite), 5, image.Rect(5, 2, 15, 8)},
+		{newOffWhite(newLogo(white, image.Rect(5, 2, 15, 8)), offWhite), 4, image.Rect(5, 2, 20, 10)},
+	}
+
+	for i, tt := range tests {
+		if got := trimBounds(tt.m, tt.tolerance); got != tt.want {
+			t.Errorf("%d. trimBounds(%v) returned %v, want %v", i, tt.tolerance, got, tt.want)
+		}
+	}
+}
+
+// newOffWhite returns m with its bottom right pixel set to c.
+func newOffWhite(m image.Image, c color.NRGBA) image.Image {
+	n := m.(*image.NRGBA)
+	b := n.Bounds()
+	n.SetNRGBA(b.Max.X-1, b.Max.Y-1, c)
+	return n
+}
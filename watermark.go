@@ -0,0 +1,78 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+// Watermark is the image overlaid on transformed images whose options
+// specify a WatermarkPosition.  If nil, no watermark is applied.
+var Watermark image.Image
+
+// watermarkMaxFraction is the largest fraction of the width or height of an
+// image that its watermark may cover.  Larger watermarks are scaled down.
+const watermarkMaxFraction = 4
+
+// watermarkPositions are the valid values of Options.WatermarkPosition.
+var watermarkPositions = []string{"northwest", "northeast", "southwest", "southeast", "center"}
+
+// isWatermarkPosition returns whether position is a valid watermark position.
+func isWatermarkPosition(position string) bool {
+	for _, p := range watermarkPositions {
+		if p == position {
+			return true
+		}
+	}
+	return false
+}
+
+// watermark overlays wm onto m at the position, margin, and opacity
+// specified in opt.  The watermark is scaled down, preserving its aspect
+// ratio, if it would cover more than a quarter of the width or height of m.
+func watermark(m, wm image.Image, opt Options) image.Image {
+	b := m.Bounds()
+	maxW, maxH := b.Dx()/watermarkMaxFraction, b.Dy()/watermarkMaxFraction
+	if maxW < 1 || maxH < 1 {
+		return m
+	}
+	if wb := wm.Bounds(); wb.Dx() > maxW || wb.Dy() > maxH {
+		wm = imaging.Fit(wm, maxW, maxH, resampleFilter(opt.Filter))
+	}
+
+	w, h := wm.Bounds().Dx(), wm.Bounds().Dy()
+	margin := opt.WatermarkMargin
+	var pos image.Point
+	switch opt.WatermarkPosition {
+	case "northwest":
+		pos = image.Pt(margin, margin)
+	case "northeast":
+		pos = image.Pt(b.Dx()-w-margin, margin)
+	case "southwest":
+		pos = image.Pt(margin, b.Dy()-h-margin)
+	case "southeast":
+		pos = image.Pt(b.Dx()-w-margin, b.Dy()-h-margin)
+	default:
+		pos = image.Pt((b.Dx()-w)/2, (b.Dy()-h)/2)
+	}
+
+	opacity := opt.WatermarkOpacity
+	if opacity == 0 {
+		opacity = 1
+	}
+	return imaging.Overlay(m, wm, b.Min.Add(pos), opacity)
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// bounds returns the bounds of the pixels in m which match c.
+func bounds(m image.Image, c color.Color) image.Rectangle {
+	var r image.Rectangle
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if m.At(x, y) == c {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
+
+func TestWatermark(t *testing.T) {
+	src := newImage(40, 40, red)
+	wm := newImage(4, 4, blue)
+
+	tests := []struct {
+		opt  Options
+		want image.Rectangle
+	}{
+		{Options{WatermarkPosition: "northwest"}, image.Rect(0, 0, 4, 4)},
+		{Options{WatermarkPosition: "northeast", WatermarkMargin: 2}, image.Rect(34, 2, 38, 6)},
+		{Options{WatermarkPosition: "southwest", WatermarkMargin: 1}, image.Rect(1, 35, 5, 39)},
+		{Options{WatermarkPosition: "southeast"}, image.Rect(36, 36, 40, 40)},
+		{Options{WatermarkPosition: "center", WatermarkMargin: 5}, image.Rect(18, 18, 22, 22)},
+	}
+
+	for _, tt := range tests {
+		got := bounds(watermark(src, wm, tt.opt), blue)
+		if got != tt.want {
+			t.Errorf("watermark(%v) placed watermark at %v, want %v", tt.opt, got, tt.want)
+		}
+	}
+}
+
+func TestWatermark_Scale(t *testing.T) {
+	// watermarks are scaled to at most a quarter of the image size
+	m := watermark(newImage(40, 20, red), newImage(20, 10, blue), Options{WatermarkPosition: "northwest"})
+	if got, want := bounds(m, blue), image.Rect(0, 0, 10, 5); got != want {
+		t.Errorf("watermark scaled to %v, want %v", got, want)
+	}
+
+	// images too small for a watermark are unchanged
+	src := newImage(3, 3, red)
+	if m := watermark(src, newImage(1, 1, blue), Options{WatermarkPosition: "center"}); m != src {
+		t.Errorf("watermark modified image too small to watermark")
+	}
+}
+
+func TestWatermark_Opacity(t *testing.T) {
+	m := watermark(newImage(8, 8, color.NRGBA{0, 0, 0, 255}), newImage(2, 2, color.NRGBA{255, 255, 255, 255}),
+		Options{WatermarkPosition: "northwest", WatermarkOpacity: 0.5})
+	c := color.NRGBAModel.Convert(m.At(0, 0)).(color.NRGBA)
+	if c.R < 120 || c.R > 135 || c.A != 255 {
+		t.Errorf("watermark with opacity 0.5 returned pixel %v, want half gray", c)
+	}
+}